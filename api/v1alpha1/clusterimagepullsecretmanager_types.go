@@ -33,14 +33,77 @@ type ClusterImagePullSecretManagerSpec struct {
 
 	// +kubebuilder:default=ServiceAccount
 
-	// Mode defines whether the controller reconciles pods or service accounts for imagePullSecrets
+	// Mode defines whether the controller reconciles pods, service accounts or workloads for imagePullSecrets
 	Mode ReconciliationMode `json:"mode"`
+
+	// +kubebuilder:default=0
+	// +optional
+
+	// Priority ranks the manager against other managers defining secrets for the same registry, higher wins
+	Priority int32 `json:"priority,omitempty"`
+
+	// +kubebuilder:default=NamespacedOverridesCluster
+	// +optional
+
+	// ConflictPolicy defines how secrets for the same registry defined by several managers are resolved. The policy
+	// of the highest ranked manager of a conflict applies
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+
+	// +kubebuilder:default=None
+	// +optional
+
+	// Remediation defines whether pods failing to pull images from the manager's registries are recreated
+	Remediation RemediationPolicy `json:"remediation,omitempty"`
+
+	// Rotation defines how changed credentials are written to secrets, by default secrets are overwritten in place
+	// +optional
+	Rotation *RotationPolicy `json:"rotation,omitempty"`
+
+	// Cleanup removes secrets from namespaces that have not used them for some time, by default secrets are kept
+	// +optional
+	Cleanup *CleanupPolicy `json:"cleanup,omitempty"`
+
+	// +kubebuilder:default=IfUnowned
+	// +optional
+
+	// AdoptionPolicy defines whether secrets that exist before the manager writes a secret of the same name are taken
+	// over. Secrets that are not of type kubernetes.io/dockerconfigjson are never taken over
+	AdoptionPolicy AdoptionPolicy `json:"adoptionPolicy,omitempty"`
 }
 
 // ClusterImagePullSecretManagerStatus defines the observed state of ClusterImagePullSecretManager
 type ClusterImagePullSecretManagerStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// Conditions represent the latest available observations of the manager's state
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// PullFailures lists containers failing to pull images from registries the manager attaches secrets for
+	// +optional
+	PullFailures []PullFailure `json:"pullFailures,omitempty"`
+
+	// RateLimits reports the Docker Hub pull rate limit of each of the manager's Docker Hub credentials and the
+	// validity of the members of its credential pools
+	// +optional
+	RateLimits []RateLimit `json:"rateLimits,omitempty"`
+
+	// Failover reports the credential in use for each secret with fallback credentials
+	// +optional
+	Failover []Failover `json:"failover,omitempty"`
+
+	// Usage reports how many pods and service accounts reference each secret of the manager and when it was last used
+	// +optional
+	Usage []SecretUsage `json:"usage,omitempty"`
+
+	// Expired lists the secrets removed from namespaces by the cleanup policy
+	// +optional
+	Expired []ExpiredSecret `json:"expired,omitempty"`
+
+	// Adoptions lists the secrets that existed before the manager wrote them, and whether they were taken over
+	// +optional
+	Adoptions []SecretAdoption `json:"adoptions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -0,0 +1,83 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+// PolicyAction defines what happens to pods violating a ClusterImagePullSecretPolicy
+// +kubebuilder:validation:Enum=Deny;Warn
+type PolicyAction string
+
+const (
+	// DenyAction rejects the creation of violating pods
+	DenyAction PolicyAction = "Deny"
+	// WarnAction admits violating pods and returns a warning to the client
+	WarnAction PolicyAction = "Warn"
+)
+
+// ClusterImagePullSecretPolicySpec defines the desired state of ClusterImagePullSecretPolicy
+type ClusterImagePullSecretPolicySpec struct {
+	// +kubebuilder:default=Deny
+	// +optional
+
+	// Action defines whether violating pods are rejected or only warned about
+	Action PolicyAction `json:"action,omitempty"`
+
+	// AllowedRegistries are the registries images may be pulled from, as host names or with globs per domain segment,
+	// e.g. *.dkr.ecr.*.amazonaws.com. All registries are allowed if empty
+	// +optional
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+
+	// CredentialsRequired are the registries images may only be pulled from with credentials, as host names or with
+	// globs per domain segment. The imagePullSecrets of the pod and of its service account must hold an entry for them
+	// +optional
+	CredentialsRequired []string `json:"credentialsRequired,omitempty"`
+
+	// NamespaceSelector restricts the namespaces whose pods are validated, all namespaces if unset
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Action",type=string,JSONPath=`.spec.action`
+
+// ClusterImagePullSecretPolicy validates that pods only pull images from allowed registries, and with credentials
+// from registries requiring them, s.t. pods do not silently fall back to anonymous pulls
+type ClusterImagePullSecretPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ClusterImagePullSecretPolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterImagePullSecretPolicyList contains a list of ClusterImagePullSecretPolicy
+type ClusterImagePullSecretPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterImagePullSecretPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterImagePullSecretPolicy{}, &ClusterImagePullSecretPolicyList{})
+}
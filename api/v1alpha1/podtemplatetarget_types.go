@@ -0,0 +1,76 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+// PodTemplateTargetSpec defines the desired state of PodTemplateTarget
+type PodTemplateTargetSpec struct {
+	// Group is the API group of the target kind, empty for the core group
+	// +optional
+	Group string `json:"group,omitempty"`
+
+	// Version is the API version of the target kind
+	Version string `json:"version"`
+
+	// Kind of the target ressources
+	Kind string `json:"kind"`
+
+	// +kubebuilder:validation:MinItems=1
+
+	// Paths are JSONPaths to the imagePullSecrets lists of the embedded PodSpecs, e.g. .spec.podTemplate.imagePullSecrets.
+	// Only paths through nested objects are supported, i.e. paths must neither contain list indices nor wildcards
+	Paths []string `json:"paths"`
+}
+
+// PodTemplateTargetStatus defines the observed state of PodTemplateTarget
+type PodTemplateTargetStatus struct {
+	// Conditions represent the latest available observations of the target's state
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+
+// PodTemplateTarget registers a kind embedding PodSpecs, e.g. of a third-party CRD, whose imagePullSecrets are
+// reconciled in Workload mode
+type PodTemplateTarget struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PodTemplateTargetSpec   `json:"spec,omitempty"`
+	Status PodTemplateTargetStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// PodTemplateTargetList contains a list of PodTemplateTarget
+type PodTemplateTargetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PodTemplateTarget `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PodTemplateTarget{}, &PodTemplateTargetList{})
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+// SecretSource is where a workload's pods get an imagePullSecret from
+// +kubebuilder:validation:Enum=PodSpec;ServiceAccount
+type SecretSource string
+
+const (
+	// PodSpecSource are imagePullSecrets of the pod template of the workload
+	PodSpecSource SecretSource = "PodSpec"
+	// ServiceAccountSource are imagePullSecrets of the service account of the workload
+	ServiceAccountSource SecretSource = "ServiceAccount"
+)
+
+// GapReason is the kind of a gap found in the pull secrets of a workload
+// +kubebuilder:validation:Enum=MissingCredentials;MissingSecret
+type GapReason string
+
+const (
+	// MissingCredentialsGap means images are pulled from a registry requiring credentials without any, e.g. from
+	// Docker Hub or from a registry managers provide secrets for
+	MissingCredentialsGap GapReason = "MissingCredentials"
+	// MissingSecretGap means an imagePullSecret references a secret that does not exist
+	MissingSecretGap GapReason = "MissingSecret"
+)
+
+// PullSecretReportSummary counts the workloads of a report
+type PullSecretReportSummary struct {
+	// Workloads is the number of workloads in the namespace
+	Workloads int32 `json:"workloads"`
+
+	// Compliant is the number of workloads without gaps
+	Compliant int32 `json:"compliant"`
+
+	// Gaps is the number of gaps of all workloads
+	Gaps int32 `json:"gaps"`
+
+	// Omitted is the number of workloads left out of the report to bound its size, workloads with gaps are left out
+	// last
+	// +optional
+	Omitted int32 `json:"omitted,omitempty"`
+}
+
+// RegistryReport lists the images a workload pulls from a registry and the secrets it holds credentials for it in
+type RegistryReport struct {
+	// Registry is the normalized host of the registry, the canonical host if it belongs to a Registry
+	Registry string `json:"registry"`
+
+	// Images are the images of the workload pulled from the registry
+	Images []string `json:"images"`
+
+	// Secrets are the names of the imagePullSecrets holding credentials for the registry
+	// +optional
+	Secrets []string `json:"secrets,omitempty"`
+}
+
+// SecretReport describes an imagePullSecret of a workload and where it came from
+type SecretReport struct {
+	// Name of the secret
+	Name string `json:"name"`
+
+	// Source is whether the secret is referenced by the pod template or the service account
+	Source SecretSource `json:"source"`
+
+	// Manager is the manager that attached the secret, e.g. ClusterImagePullSecretManager/dockerhub. Empty for
+	// foreign secrets attached by others than cheiron
+	// +optional
+	Manager string `json:"manager,omitempty"`
+
+	// Registries are the hosts the secret holds credentials for
+	// +optional
+	Registries []string `json:"registries,omitempty"`
+
+	// Missing is true if the secret does not exist
+	// +optional
+	Missing bool `json:"missing,omitempty"`
+}
+
+// ReportGap is a problem with the pull secrets of a workload
+type ReportGap struct {
+	// Reason is the kind of the gap
+	Reason GapReason `json:"reason"`
+
+	// Registry is the registry lacking credentials
+	// +optional
+	Registry string `json:"registry,omitempty"`
+
+	// Secret is the missing secret
+	// +optional
+	Secret string `json:"secret,omitempty"`
+
+	// Message describes the gap in human readable form
+	Message string `json:"message"`
+}
+
+// WorkloadReport reports the registries and pull secrets of a single workload
+type WorkloadReport struct {
+	// Kind of the workload, e.g. Deployment or Pod for pods not controlled by a workload
+	Kind string `json:"kind"`
+
+	// Name of the workload
+	Name string `json:"name"`
+
+	// ServiceAccount is the service account the pods of the workload run as
+	ServiceAccount string `json:"serviceAccount"`
+
+	// Registries are the registries the workload pulls images from
+	// +optional
+	Registries []RegistryReport `json:"registries,omitempty"`
+
+	// Secrets are the imagePullSecrets of the workload's pod template and service account
+	// +optional
+	Secrets []SecretReport `json:"secrets,omitempty"`
+
+	// Gaps are the problems found with the pull secrets of the workload
+	// +optional
+	Gaps []ReportGap `json:"gaps,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Namespaced
+//+kubebuilder:printcolumn:name="Workloads",type=integer,JSONPath=`.summary.workloads`
+//+kubebuilder:printcolumn:name="Compliant",type=integer,JSONPath=`.summary.compliant`
+//+kubebuilder:printcolumn:name="Gaps",type=integer,JSONPath=`.summary.gaps`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// PullSecretReport lists every workload of a namespace with the registries it pulls from, the credentials it has and
+// where they came from, and flags gaps. The report of a namespace is named cheiron and maintained by cheiron
+type PullSecretReport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Summary counts the workloads of the report
+	Summary PullSecretReportSummary `json:"summary"`
+
+	// Workloads are the reports of the workloads in the namespace, at most 250 of them
+	// +optional
+	Workloads []WorkloadReport `json:"workloads,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// PullSecretReportList contains a list of PullSecretReport
+type PullSecretReportList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PullSecretReport `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PullSecretReport{}, &PullSecretReportList{})
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+// RegistryAuthType defines how credentials are written to the entries of a registry in dockerconfigjson secrets
+// +kubebuilder:validation:Enum=Basic;IdentityToken;RegistryToken
+type RegistryAuthType string
+
+const (
+	// BasicAuthType writes the username and password, and their base64 encoding as auth
+	BasicAuthType RegistryAuthType = "Basic"
+	// IdentityTokenAuthType writes the password as identitytoken, an OAuth2 refresh token exchanged by the client
+	IdentityTokenAuthType RegistryAuthType = "IdentityToken"
+	// RegistryTokenAuthType writes the password as registrytoken, a bearer token sent to the registry as is
+	RegistryTokenAuthType RegistryAuthType = "RegistryToken"
+)
+
+// RegistrySpec defines the desired state of Registry
+type RegistrySpec struct {
+	// Host is the canonical host name of the registry, e.g. docker.io. Secrets referencing the registry are resolved
+	// against other managers' secrets for this host
+	Host string `json:"host"`
+
+	// Aliases are further host names of the registry, e.g. index.docker.io. Secrets contain an entry for each of them
+	// +optional
+	Aliases []string `json:"aliases,omitempty"`
+
+	// Patterns are host names with globs per domain segment, e.g. *.dkr.ecr.*.amazonaws.com, matching further hosts
+	// of the registry. Secrets contain an entry for each of them, which the kubelet matches like the pattern
+	// +optional
+	Patterns []string `json:"patterns,omitempty"`
+
+	// +kubebuilder:default=Basic
+	// +optional
+
+	// AuthType defines how credentials are written to the entries of the registry. Token types are not understood
+	// by the kubelet and meant for auth files of image tools
+	AuthType RegistryAuthType `json:"authType,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Host",type=string,JSONPath=`.spec.host`
+//+kubebuilder:printcolumn:name="Auth Type",type=string,JSONPath=`.spec.authType`
+
+// Registry describes the host names of a container registry, s.t. managers reference it by name instead of a
+// free-form host and one credential covers all its host names
+type Registry struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec RegistrySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// RegistryList contains a list of Registry
+type RegistryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Registry `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Registry{}, &RegistryList{})
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+// RegistryMirrorSpec defines the desired state of RegistryMirror
+type RegistryMirrorSpec struct {
+	// Source is the registry whose images are pulled from the mirror instead, e.g. docker.io
+	Source string `json:"source"`
+
+	// +kubebuilder:validation:Pattern=`^[a-zA-Z0-9.-]+(:[0-9]+)?(/[a-z0-9._/-]+)?$`
+
+	// Mirror is the host of the mirror, optionally followed by the path the repositories of the source are found
+	// under, e.g. mirror.example.com/dockerhub
+	Mirror string `json:"mirror"`
+
+	// NamespaceSelector restricts the namespaces whose pods are rewritten to the mirror, all namespaces if unset
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.spec.source`
+//+kubebuilder:printcolumn:name="Mirror",type=string,JSONPath=`.spec.mirror`
+
+// RegistryMirror rewrites the images of pods from a source registry to a mirror, e.g. a pull-through cache of
+// Docker Hub. Secrets of managers for the mirror's host are attached to rewritten pods
+type RegistryMirror struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec RegistryMirrorSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// RegistryMirrorList contains a list of RegistryMirror
+type RegistryMirrorList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []RegistryMirror `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&RegistryMirror{}, &RegistryMirrorList{})
+}
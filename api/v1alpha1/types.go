@@ -18,6 +18,7 @@ package v1alpha1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
@@ -30,6 +31,9 @@ const (
 	PodMode ReconciliationMode = "Pod"
 	// in service account mode, the operator adds the attached image pull secrets to the ServiceAccount
 	ServiceAccountMode ReconciliationMode = "ServiceAccount"
+	// in workload mode, the operator adds the attached image pull secrets to the pod templates of Deployments,
+	// StatefulSets, DaemonSets, ReplicaSets, Jobs and CronJobs
+	WorkloadMode ReconciliationMode = "Workload"
 )
 
 // ImagePullSecretSpec encodes a singular ImagePullSecret, either using existing secrets, or by providing the credentials explicitly
@@ -38,6 +42,10 @@ type ImagePullSecretSpec struct {
 	ExistingSecretRef corev1.LocalObjectReference `json:"existingSecretRef,omitempty"`
 	// Registy hostname is the container registry to target
 	Registry string `json:"registry,omitempty"`
+	// RegistryRef references a Registry by name instead of the registry hostname. The secret then holds an entry for
+	// the host, each alias and each pattern of the Registry, and the Registry field is ignored
+	// +optional
+	RegistryRef *corev1.LocalObjectReference `json:"registryRef,omitempty"`
 	// Username is the plaintext username field for the credentials of the registry
 	Username string `json:"username,omitempty"`
 	// Password is the plaintext field for the password of the credentials for the registry
@@ -46,4 +54,605 @@ type ImagePullSecretSpec struct {
 	Email string `json:"email,omitempty"`
 	// Name of the container registry and secret name
 	Name string `json:"name"`
+	// Pool holds several accounts for the registry instead of a single username and password, each namespace or
+	// service account is assigned one of them
+	// +optional
+	Pool *CredentialPool `json:"pool,omitempty"`
+	// Fallbacks are credentials for the registry used in order when the username and password are rejected by the
+	// registry or pulls with them fail. Not supported for pools
+	// +optional
+	Fallbacks []Credential `json:"fallbacks,omitempty"`
+	// Provider issues short-lived credentials for the registry instead of a static username and password
+	// +optional
+	Provider *CredentialProvider `json:"provider,omitempty"`
+}
+
+// PoolStrategy defines how the members of a credential pool are assigned
+// +kubebuilder:validation:Enum=RoundRobin;ConsistentHash;MostRemaining
+type PoolStrategy string
+
+const (
+	// RoundRobinStrategy assigns the member with the fewest assignments
+	RoundRobinStrategy PoolStrategy = "RoundRobin"
+	// ConsistentHashStrategy assigns members by hashing the name of the namespace or service account
+	ConsistentHashStrategy PoolStrategy = "ConsistentHash"
+	// MostRemainingStrategy assigns the member with the most remaining pulls as reported by the rate limit probe
+	MostRemainingStrategy PoolStrategy = "MostRemaining"
+)
+
+// PoolScope defines what a member of a credential pool is assigned to
+// +kubebuilder:validation:Enum=Namespace;ServiceAccount
+type PoolScope string
+
+const (
+	// NamespacePoolScope assigns one member per namespace, which is stored in the secret named after the pool
+	NamespacePoolScope PoolScope = "Namespace"
+	// ServiceAccountPoolScope assigns one member per service account. Each member is stored in its own secret, named
+	// after the pool and suffixed with the index of the member. Only applies to managers in ServiceAccount mode,
+	// managers in other modes assign members per namespace
+	ServiceAccountPoolScope PoolScope = "ServiceAccount"
+)
+
+// Credential is a single account of a registry, used in credential pools and as fallback credential
+type Credential struct {
+	// Username is the plaintext username of the account
+	Username string `json:"username"`
+	// Password is the plaintext password of the account
+	Password string `json:"password"`
+	// Email is the email address of the account
+	// +optional
+	Email string `json:"email,omitempty"`
+}
+
+// CredentialPool spreads the pulls from a registry across several accounts. Members that are exhausted or rejected
+// by the registry, as reported by the rate limit probe, are replaced by healthy members automatically
+type CredentialPool struct {
+	// Credentials are the accounts of the pool
+	// +kubebuilder:validation:MinItems=1
+	Credentials []Credential `json:"credentials"`
+
+	// +kubebuilder:default=ConsistentHash
+	// +optional
+
+	// Strategy defines how members are assigned
+	Strategy PoolStrategy `json:"strategy,omitempty"`
+
+	// +kubebuilder:default=Namespace
+	// +optional
+
+	// Scope defines whether members are assigned per namespace or per service account
+	Scope PoolScope `json:"scope,omitempty"`
+}
+
+// ConflictPolicy defines how secrets of different managers targeting the same registry in a namespace are resolved
+// +kubebuilder:validation:Enum=NamespacedOverridesCluster;HighestPriority;Union
+type ConflictPolicy string
+
+const (
+	// NamespacedOverridesCluster lets secrets of namespaced managers win over those of cluster managers, managers of
+	// the same scope are ranked by their priority
+	NamespacedOverridesCluster ConflictPolicy = "NamespacedOverridesCluster"
+	// HighestPriority lets the secret of the manager with the highest priority win, regardless of its scope
+	HighestPriority ConflictPolicy = "HighestPriority"
+	// Union attaches the secrets of all conflicting managers
+	Union ConflictPolicy = "Union"
+)
+
+const (
+	// ConditionConflicted is true when at least one secret of the manager lost against another manager's secret for
+	// the same registry and is therefore not attached
+	ConditionConflicted = "Conflicted"
+
+	// ReasonOverridden is used when a secret of the manager was overridden by another manager
+	ReasonOverridden = "Overridden"
+	// ReasonNoConflicts is used when none of the manager's secrets conflict with other managers
+	ReasonNoConflicts = "NoConflicts"
+)
+
+const (
+	// ConditionReady is true when cheiron acts on the resource
+	ConditionReady = "Ready"
+
+	// ReasonWatching is used when the kind registered by a PodTemplateTarget is watched
+	ReasonWatching = "Watching"
+	// ReasonInvalidPaths is used when the paths of a PodTemplateTarget cannot be used
+	ReasonInvalidPaths = "InvalidPaths"
+	// ReasonKindNotFound is used when the API server does not serve the kind registered by a PodTemplateTarget
+	ReasonKindNotFound = "KindNotFound"
+	// ReasonForbidden is used when cheiron lacks the permissions for the kind registered by a PodTemplateTarget
+	ReasonForbidden = "Forbidden"
+)
+
+// RemediationPolicy defines how the operator treats pods failing to pull images from registries it manages secrets for
+// +kubebuilder:validation:Enum=None;Recreate
+type RemediationPolicy string
+
+const (
+	// RemediationNone only reports pods failing to pull images in the manager's status
+	RemediationNone RemediationPolicy = "None"
+	// RemediationRecreate deletes failing pods owned by a controller that lack the manager's secret, s.t. they are
+	// recreated with the credentials of their service account. Only managers in ServiceAccount mode recreate pods
+	RemediationRecreate RemediationPolicy = "Recreate"
+)
+
+// PullFailure reports a container that fails to pull its image from a registry the manager attaches secrets for
+type PullFailure struct {
+	// Namespace of the pod
+	Namespace string `json:"namespace"`
+	// Pod is the name of the failing pod
+	Pod string `json:"pod"`
+	// Container is the name of the failing container
+	Container string `json:"container"`
+	// Image is the image the container fails to pull
+	Image string `json:"image"`
+	// Registry is the host name of the registry the image is pulled from
+	Registry string `json:"registry"`
+	// Reason is the reason the container is waiting for, e.g. ImagePullBackOff
+	Reason string `json:"reason"`
+	// Message is the latest message of the kubelet about the failing pull
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Secrets are the names of the manager's secrets for the registry the pod references, by the name of the
+	// ImagePullSecretSpec they are written for
+	// +optional
+	Secrets []string `json:"secrets,omitempty"`
+}
+
+// RateLimit reports the Docker Hub pull rate limit of a credential as observed by the latest probe. Credentials of
+// pools for other registries are only validated
+type RateLimit struct {
+	// Secret is the name of the secret the credential is stored in
+	Secret string `json:"secret"`
+	// Member is the index of the credential in the pool of the secret, or in the list of the secret's credentials
+	// starting with the primary credential followed by its fallbacks
+	// +optional
+	Member *int32 `json:"member,omitempty"`
+	// Limit is the number of pulls allowed per window, unset if Docker Hub does not limit the account
+	// +optional
+	Limit *int32 `json:"limit,omitempty"`
+	// Remaining is the number of pulls left in the current window, unset if Docker Hub does not limit the account
+	// +optional
+	Remaining *int32 `json:"remaining,omitempty"`
+	// WindowSeconds is the length of the rate limit window in seconds
+	// +optional
+	WindowSeconds int32 `json:"windowSeconds,omitempty"`
+	// Source is what Docker Hub counts the pulls against, either the account's user ID or the client's IP address
+	// +optional
+	Source string `json:"source,omitempty"`
+	// LastProbeTime is the time of the latest probe
+	LastProbeTime metav1.Time `json:"lastProbeTime"`
+	// Error describes why the latest probe failed
+	// +optional
+	Error string `json:"error,omitempty"`
+	// Invalid is true when the registry rejected the credential
+	// +optional
+	Invalid bool `json:"invalid,omitempty"`
+}
+
+const (
+	// ReasonValidationFailed is used when the registry rejected the credential in use
+	ReasonValidationFailed = "ValidationFailed"
+	// ReasonPullFailures is used when pulls with the credential in use fail to authenticate
+	ReasonPullFailures = "PullFailures"
+	// ReasonRecovered is used when a preferred credential is healthy again
+	ReasonRecovered = "Recovered"
+)
+
+// Failover reports which of the credentials of a secret with fallbacks is in use
+type Failover struct {
+	// Secret is the name of the secret
+	Secret string `json:"secret"`
+	// Active is the index of the credential in use, 0 is the primary credential and i the i-th fallback
+	Active int32 `json:"active"`
+	// LastSwitchTime is the time the operator switched to the active credential
+	// +optional
+	LastSwitchTime *metav1.Time `json:"lastSwitchTime,omitempty"`
+	// Reason is the reason of the latest switch
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Message describes the latest switch
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// RotationStrategy defines how the operator writes changed credentials to secrets
+// +kubebuilder:validation:Enum=InPlace;Versioned
+type RotationStrategy string
+
+const (
+	// InPlaceRotation overwrites the secret named in the ImagePullSecretSpec
+	InPlaceRotation RotationStrategy = "InPlace"
+	// VersionedRotation writes every version of the credentials to a new secret, named after the ImagePullSecretSpec
+	// and suffixed with a hash of its content
+	VersionedRotation RotationStrategy = "Versioned"
+)
+
+// RotationPolicy defines how changed credentials are rolled out to the targets
+type RotationPolicy struct {
+	// +kubebuilder:default=InPlace
+	// +optional
+
+	// Strategy defines whether secrets are overwritten or versioned
+	Strategy RotationStrategy `json:"strategy,omitempty"`
+
+	// Immutable creates versioned secrets as immutable secrets
+	// +optional
+	Immutable bool `json:"immutable,omitempty"`
+
+	// +kubebuilder:default="10m"
+	// +optional
+
+	// Overlap is the time a superseded version stays attached to targets together with the new version, before it is
+	// garbage-collected
+	Overlap *metav1.Duration `json:"overlap,omitempty"`
+}
+
+// CleanupPolicy defines when secrets of a manager are removed from namespaces that do not use them
+type CleanupPolicy struct {
+	// UnusedFor is the time no pod referencing a secret may have been created in a namespace, before the secret and
+	// its references are removed from the namespace. Pods created later with images of the secret's registry bring
+	// the secret back
+	UnusedFor metav1.Duration `json:"unusedFor"`
+}
+
+// SecretUsage reports how a secret of a manager is used across the namespaces it is attached in
+type SecretUsage struct {
+	// Name of the secret as in the ImagePullSecretSpec
+	Name string `json:"name"`
+
+	// Namespaces is the number of namespaces the secret exists in
+	Namespaces int32 `json:"namespaces"`
+
+	// Pods is the number of pods referencing the secret
+	Pods int32 `json:"pods"`
+
+	// ServiceAccounts is the number of service accounts referencing the secret
+	ServiceAccounts int32 `json:"serviceAccounts"`
+
+	// LastUsed is the creation time of the latest pod referencing the secret
+	// +optional
+	LastUsed *metav1.Time `json:"lastUsed,omitempty"`
+}
+
+// AdoptionPolicy defines whether a manager takes over secrets that exist before it writes a secret of the same name
+// +kubebuilder:validation:Enum=Never;IfUnowned;Always
+type AdoptionPolicy string
+
+const (
+	// AdoptNever refuses to write any secret the manager did not create
+	AdoptNever AdoptionPolicy = "Never"
+	// AdoptIfUnowned takes over secrets not controlled by another controller
+	AdoptIfUnowned AdoptionPolicy = "IfUnowned"
+	// AdoptAlways takes over secrets, even from other controllers
+	AdoptAlways AdoptionPolicy = "Always"
+)
+
+// AdoptionOutcome is the outcome of writing a secret that existed before the manager wrote it
+// +kubebuilder:validation:Enum=Adopted;Refused
+type AdoptionOutcome string
+
+const (
+	// SecretAdopted means the manager took over the existing secret
+	SecretAdopted AdoptionOutcome = "Adopted"
+	// SecretRefused means the manager left the existing secret untouched
+	SecretRefused AdoptionOutcome = "Refused"
+)
+
+// SecretAdoption reports a secret that existed before the manager wrote it
+type SecretAdoption struct {
+	// Name of the secret
+	Name string `json:"name"`
+
+	// Namespace of the secret
+	Namespace string `json:"namespace"`
+
+	// Outcome is whether the secret was adopted or refused
+	Outcome AdoptionOutcome `json:"outcome"`
+
+	// Message explains the outcome
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ExpiredSecret is a secret removed from a namespace by the cleanup policy
+type ExpiredSecret struct {
+	// Name of the secret as in the ImagePullSecretSpec
+	Name string `json:"name"`
+
+	// Namespace the secret was removed from
+	Namespace string `json:"namespace"`
+
+	// ExpiredAt is the time the secret was removed
+	ExpiredAt metav1.Time `json:"expiredAt"`
+}
+
+// CredentialProvider issues short-lived credentials for a registry, which the operator refreshes well before they
+// expire. Exactly one provider has to be set
+type CredentialProvider struct {
+	// ECR requests authorization tokens from Amazon Elastic Container Registry
+	// +optional
+	ECR *ECRProvider `json:"ecr,omitempty"`
+	// ACR exchanges Azure AD access tokens for refresh tokens of Azure Container Registry
+	// +optional
+	ACR *ACRProvider `json:"acr,omitempty"`
+	// GAR requests OAuth2 access tokens for Google Artifact Registry
+	// +optional
+	GAR *GARProvider `json:"gar,omitempty"`
+	// TokenExchange exchanges projected service account tokens for registry tokens at a security token service
+	// +optional
+	TokenExchange *TokenExchangeProvider `json:"tokenExchange,omitempty"`
+	// Harbor creates a pull-only robot account per namespace through the Harbor API
+	// +optional
+	Harbor *HarborProvider `json:"harbor,omitempty"`
+	// GitHubApp requests installation access tokens of a GitHub App, e.g. for ghcr.io
+	// +optional
+	GitHubApp *GitHubAppProvider `json:"githubApp,omitempty"`
+	// Vault reads the credentials from a KV v2 secret of HashiCorp Vault
+	// +optional
+	Vault *VaultProvider `json:"vault,omitempty"`
+	// Exec runs a plugin binary speaking the kubelet credential provider or the docker credential helper protocol
+	// +optional
+	Exec *ExecProvider `json:"exec,omitempty"`
+}
+
+// ECRProvider requests authorization tokens for Amazon Elastic Container Registry with GetAuthorizationToken
+type ECRProvider struct {
+	// Region is the AWS region of the registry
+	Region string `json:"region"`
+	// CredentialsSecretRef references a secret with the keys aws_access_key_id, aws_secret_access_key and optionally
+	// aws_session_token. The namespace defaults to the namespace of the manager and is required for cluster managers,
+	// namespaced managers may only reference secrets of their own namespace. Without reference, the web identity of
+	// the operator's pod is used, which only cluster managers may do
+	// +optional
+	CredentialsSecretRef *corev1.SecretReference `json:"credentialsSecretRef,omitempty"`
+	// RoleARN is the role assumed with the web identity, defaults to the AWS_ROLE_ARN environment variable of the
+	// operator
+	// +optional
+	RoleARN string `json:"roleARN,omitempty"`
+	// Endpoint overrides the ECR API endpoint, which defaults to https://api.ecr.<region>.amazonaws.com. Only cluster
+	// managers may override it
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+	// STSEndpoint overrides the STS endpoint used to assume the role of the web identity, which defaults to
+	// https://sts.<region>.amazonaws.com. Only cluster managers may override it
+	// +optional
+	STSEndpoint string `json:"stsEndpoint,omitempty"`
+}
+
+// ACRProvider exchanges Azure AD access tokens for refresh tokens of Azure Container Registry at its /oauth2/exchange
+// endpoint
+type ACRProvider struct {
+	// TenantID is the Azure AD tenant, defaults to the tenant_id key of the credentials secret or the AZURE_TENANT_ID
+	// environment variable of the operator
+	// +optional
+	TenantID string `json:"tenantID,omitempty"`
+	// CredentialsSecretRef references a secret of a service principal with the keys client_id, client_secret and
+	// optionally tenant_id. The namespace defaults to the namespace of the manager and is required for cluster
+	// managers, namespaced managers may only reference secrets of their own namespace. Without reference, the Azure
+	// workload identity of the operator's pod is used, which only cluster managers may do
+	// +optional
+	CredentialsSecretRef *corev1.SecretReference `json:"credentialsSecretRef,omitempty"`
+	// Endpoint overrides the registry endpoint the token is exchanged at, which defaults to https://<registry>
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+	// AuthorityEndpoint overrides the Azure AD endpoint, which defaults to https://login.microsoftonline.com. Only
+	// cluster managers may override it
+	// +optional
+	AuthorityEndpoint string `json:"authorityEndpoint,omitempty"`
+}
+
+// GARProvider requests OAuth2 access tokens for Google Artifact Registry, which are used with the username
+// oauth2accesstoken
+type GARProvider struct {
+	// CredentialsSecretRef references a secret with a service account key in the key key.json. The namespace defaults
+	// to the namespace of the manager and is required for cluster managers, namespaced managers may only reference
+	// secrets of their own namespace. Without reference, the token of the operator is requested from the metadata
+	// server, which only cluster managers may do
+	// +optional
+	CredentialsSecretRef *corev1.SecretReference `json:"credentialsSecretRef,omitempty"`
+	// MetadataEndpoint overrides the metadata server, which defaults to http://metadata.google.internal. Only cluster
+	// managers may override it
+	// +optional
+	MetadataEndpoint string `json:"metadataEndpoint,omitempty"`
+	// TokenEndpoint overrides the token endpoint of the service account key. Only cluster managers may override it
+	// +optional
+	TokenEndpoint string `json:"tokenEndpoint,omitempty"`
+}
+
+// TokenExchangeProvider requests a projected token of a service account with the TokenRequest API and exchanges it for
+// a registry token at a security token service following RFC 8693
+type TokenExchangeProvider struct {
+	// ServiceAccountName is the name of the service account the projected token is requested for. The service account
+	// has to list the audience in its cheiron.anny.co/token-audiences annotation
+	ServiceAccountName string `json:"serviceAccountName"`
+	// ServiceAccountNamespace is the namespace of the service account, which defaults to the namespace of the manager
+	// and is required for cluster managers. Namespaced managers may only use service accounts of their own namespace
+	// +optional
+	ServiceAccountNamespace string `json:"serviceAccountNamespace,omitempty"`
+	// Audience is the audience of the projected token, as expected by the security token service. Audiences of the
+	// API server are rejected
+	Audience string `json:"audience"`
+
+	// +kubebuilder:validation:Minimum=600
+	// +kubebuilder:default=3600
+	// +optional
+
+	// ExpirationSeconds is the requested lifetime of the projected token
+	ExpirationSeconds *int64 `json:"expirationSeconds,omitempty"`
+	// Endpoint is the token endpoint of the security token service. Namespaced managers may only use endpoints
+	// allowed by the operator
+	Endpoint string `json:"endpoint"`
+	// Scope is passed as scope parameter of the exchange
+	// +optional
+	Scope string `json:"scope,omitempty"`
+	// Resource is passed as resource parameter of the exchange
+	// +optional
+	Resource string `json:"resource,omitempty"`
+
+	// +kubebuilder:default=oauth2accesstoken
+	// +optional
+
+	// Username is the username the issued token is used with
+	Username string `json:"username,omitempty"`
+}
+
+// HarborProvider creates a robot account per namespace through the API of Harbor, which may only pull from the given
+// projects. The robot is replaced by a new one on a schedule, and robots are deleted once no secret holds them anymore.
+type HarborProvider struct {
+	// URL is the base URL of Harbor, which defaults to https://<registry>. Only cluster managers may override it
+	// +optional
+	URL string `json:"url,omitempty"`
+	// CredentialsSecretRef references a secret with the keys username and password of a Harbor user allowed to
+	// manage robot accounts. The namespace defaults to the namespace of the manager and is required for cluster
+	// managers, namespaced managers may only reference secrets of their own namespace
+	CredentialsSecretRef corev1.SecretReference `json:"credentialsSecretRef"`
+
+	// +kubebuilder:validation:MinItems=1
+
+	// Projects are the Harbor projects the robot accounts may pull from
+	Projects []string `json:"projects"`
+
+	// +kubebuilder:default="168h"
+	// +optional
+
+	// RotationInterval is the time after which the secret of a robot account is renewed
+	RotationInterval *metav1.Duration `json:"rotationInterval,omitempty"`
+}
+
+// GitHubAppProvider requests installation access tokens of a GitHub App with read access to packages, which expire
+// after an hour
+type GitHubAppProvider struct {
+	// AppID is the ID of the GitHub App
+	AppID int64 `json:"appID"`
+	// InstallationID is the ID of the installation of the app. Without it, the installation on the account Owner is
+	// used, or the only installation of the app
+	// +optional
+	InstallationID int64 `json:"installationID,omitempty"`
+	// Owner is the login of the user or organization the app is installed on
+	// +optional
+	Owner string `json:"owner,omitempty"`
+	// PrivateKeySecretRef references a secret with the private key of the app in the key private_key. The namespace
+	// defaults to the namespace of the manager and is required for cluster managers, namespaced managers may only
+	// reference secrets of their own namespace
+	PrivateKeySecretRef corev1.SecretReference `json:"privateKeySecretRef"`
+	// APIURL is the base URL of the GitHub API, which defaults to https://api.github.com. GitHub Enterprise Server
+	// uses https://<host>/api/v3. Only cluster managers may override it
+	// +optional
+	APIURL string `json:"apiURL,omitempty"`
+}
+
+// VaultProvider reads the credentials from a KV v2 secret of HashiCorp Vault, authenticating with the Kubernetes auth
+// method. The secret is read again after the refresh interval or half of its lease, whichever is shorter.
+type VaultProvider struct {
+	// Address is the address of Vault, e.g. https://vault.example.com:8200. Namespaced managers may only use addresses
+	// allowed by the operator
+	Address string `json:"address"`
+	// Namespace is the Vault Enterprise namespace
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// +kubebuilder:default=secret
+	// +optional
+
+	// Mount is the mount path of the KV v2 secrets engine
+	Mount string `json:"mount,omitempty"`
+	// Path is the path of the secret within the secrets engine
+	Path string `json:"path"`
+
+	// +kubebuilder:default=username
+	// +optional
+
+	// UsernameKey is the key of the secret holding the username
+	UsernameKey string `json:"usernameKey,omitempty"`
+
+	// +kubebuilder:default=password
+	// +optional
+
+	// PasswordKey is the key of the secret holding the password
+	PasswordKey string `json:"passwordKey,omitempty"`
+	// EmailKey is the key of the secret holding the email, which defaults to the email of the ImagePullSecretSpec
+	// +optional
+	EmailKey string `json:"emailKey,omitempty"`
+	// Role is the role of the Kubernetes auth method cheiron logs in with
+	Role string `json:"role"`
+
+	// +kubebuilder:default=kubernetes
+	// +optional
+
+	// AuthMount is the mount path of the Kubernetes auth method
+	AuthMount string `json:"authMount,omitempty"`
+	// ServiceAccountName is the service account whose projected token cheiron logs in with. Without it, the token of
+	// cheiron's own service account is used, which only cluster managers may do
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// ServiceAccountNamespace is the namespace of the service account, which defaults to the namespace of the manager
+	// and is required for cluster managers. Namespaced managers may only use service accounts of their own namespace
+	// +optional
+	ServiceAccountNamespace string `json:"serviceAccountNamespace,omitempty"`
+	// Audience is the audience of the projected token of ServiceAccountName, as configured for the role. It is required
+	// with ServiceAccountName, audiences of the API server are rejected
+	// +optional
+	Audience string `json:"audience,omitempty"`
+
+	// +kubebuilder:default="5m"
+	// +optional
+
+	// RefreshInterval is the time after which the secret is read again
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=CredentialProvider;DockerCredentialHelper
+
+// ExecProtocol is the protocol an exec plugin speaks
+type ExecProtocol string
+
+const (
+	// CredentialProviderProtocol is the protocol of kubelet credential provider plugins, which read a
+	// CredentialProviderRequest from stdin and write a CredentialProviderResponse to stdout
+	CredentialProviderProtocol ExecProtocol = "CredentialProvider"
+	// DockerCredentialHelperProtocol is the get command of docker-credential-* helpers
+	DockerCredentialHelperProtocol ExecProtocol = "DockerCredentialHelper"
+)
+
+// ExecEnvVar is an environment variable passed to an exec plugin
+type ExecEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ExecProvider runs a plugin binary from the plugin directory of cheiron, see --credential-plugin-dir, and renders its
+// output as dockerconfigjson. Namespaced managers may only run the plugins of --namespaced-credential-plugins
+type ExecProvider struct {
+	// +kubebuilder:validation:Pattern=`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`
+
+	// Plugin is the name of the binary in the plugin directory. Docker credential helpers are named without their
+	// docker-credential- prefix, e.g. pass for docker-credential-pass
+	Plugin string `json:"plugin"`
+
+	// +kubebuilder:default=CredentialProvider
+	// +optional
+
+	// Protocol is the protocol the plugin speaks
+	Protocol ExecProtocol `json:"protocol,omitempty"`
+	// APIVersion is the apiVersion of CredentialProviderRequests, which defaults to
+	// credentialprovider.kubelet.k8s.io/v1
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Image is the image of CredentialProviderRequests, which defaults to the registry
+	// +optional
+	Image string `json:"image,omitempty"`
+	// Args are passed to the plugin, docker credential helpers always receive the get command. Only cluster managers
+	// may set them
+	// +optional
+	Args []string `json:"args,omitempty"`
+	// Env are passed to the plugin in addition to the environment variables of cheiron allowed by
+	// --credential-plugin-env. Namespaced managers may only set the variables allowed by the operator
+	// +optional
+	Env []ExecEnvVar `json:"env,omitempty"`
+
+	// +kubebuilder:default="5m"
+	// +optional
+
+	// RefreshInterval is the time after which the plugin is run again, if it does not return a cache duration
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
 }
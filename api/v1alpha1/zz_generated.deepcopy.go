@@ -21,16 +21,54 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ACRProvider) DeepCopyInto(out *ACRProvider) {
+	*out = *in
+	if in.CredentialsSecretRef != nil {
+		in, out := &in.CredentialsSecretRef, &out.CredentialsSecretRef
+		*out = new(corev1.SecretReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ACRProvider.
+func (in *ACRProvider) DeepCopy() *ACRProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(ACRProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CleanupPolicy) DeepCopyInto(out *CleanupPolicy) {
+	*out = *in
+	out.UnusedFor = in.UnusedFor
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CleanupPolicy.
+func (in *CleanupPolicy) DeepCopy() *CleanupPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(CleanupPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClusterImagePullSecretManager) DeepCopyInto(out *ClusterImagePullSecretManager) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterImagePullSecretManager.
@@ -89,7 +127,19 @@ func (in *ClusterImagePullSecretManagerSpec) DeepCopyInto(out *ClusterImagePullS
 	if in.Secrets != nil {
 		in, out := &in.Secrets, &out.Secrets
 		*out = make([]ImagePullSecretSpec, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Rotation != nil {
+		in, out := &in.Rotation, &out.Rotation
+		*out = new(RotationPolicy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Cleanup != nil {
+		in, out := &in.Cleanup, &out.Cleanup
+		*out = new(CleanupPolicy)
+		**out = **in
 	}
 }
 
@@ -106,6 +156,53 @@ func (in *ClusterImagePullSecretManagerSpec) DeepCopy() *ClusterImagePullSecretM
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClusterImagePullSecretManagerStatus) DeepCopyInto(out *ClusterImagePullSecretManagerStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PullFailures != nil {
+		in, out := &in.PullFailures, &out.PullFailures
+		*out = make([]PullFailure, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RateLimits != nil {
+		in, out := &in.RateLimits, &out.RateLimits
+		*out = make([]RateLimit, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Failover != nil {
+		in, out := &in.Failover, &out.Failover
+		*out = make([]Failover, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Usage != nil {
+		in, out := &in.Usage, &out.Usage
+		*out = make([]SecretUsage, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Expired != nil {
+		in, out := &in.Expired, &out.Expired
+		*out = make([]ExpiredSecret, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Adoptions != nil {
+		in, out := &in.Adoptions, &out.Adoptions
+		*out = make([]SecretAdoption, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterImagePullSecretManagerStatus.
@@ -119,26 +216,25 @@ func (in *ClusterImagePullSecretManagerStatus) DeepCopy() *ClusterImagePullSecre
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ImagePullSecretManager) DeepCopyInto(out *ImagePullSecretManager) {
+func (in *ClusterImagePullSecretPolicy) DeepCopyInto(out *ClusterImagePullSecretPolicy) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretManager.
-func (in *ImagePullSecretManager) DeepCopy() *ImagePullSecretManager {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterImagePullSecretPolicy.
+func (in *ClusterImagePullSecretPolicy) DeepCopy() *ClusterImagePullSecretPolicy {
 	if in == nil {
 		return nil
 	}
-	out := new(ImagePullSecretManager)
+	out := new(ClusterImagePullSecretPolicy)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *ImagePullSecretManager) DeepCopyObject() runtime.Object {
+func (in *ClusterImagePullSecretPolicy) DeepCopyObject() runtime.Object {
 	if c := in.DeepCopy(); c != nil {
 		return c
 	}
@@ -146,31 +242,31 @@ func (in *ImagePullSecretManager) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ImagePullSecretManagerList) DeepCopyInto(out *ImagePullSecretManagerList) {
+func (in *ClusterImagePullSecretPolicyList) DeepCopyInto(out *ClusterImagePullSecretPolicyList) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ListMeta.DeepCopyInto(&out.ListMeta)
 	if in.Items != nil {
 		in, out := &in.Items, &out.Items
-		*out = make([]ImagePullSecretManager, len(*in))
+		*out = make([]ClusterImagePullSecretPolicy, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretManagerList.
-func (in *ImagePullSecretManagerList) DeepCopy() *ImagePullSecretManagerList {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterImagePullSecretPolicyList.
+func (in *ClusterImagePullSecretPolicyList) DeepCopy() *ClusterImagePullSecretPolicyList {
 	if in == nil {
 		return nil
 	}
-	out := new(ImagePullSecretManagerList)
+	out := new(ClusterImagePullSecretPolicyList)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *ImagePullSecretManagerList) DeepCopyObject() runtime.Object {
+func (in *ClusterImagePullSecretPolicyList) DeepCopyObject() runtime.Object {
 	if c := in.DeepCopy(); c != nil {
 		return c
 	}
@@ -178,52 +274,1053 @@ func (in *ImagePullSecretManagerList) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ImagePullSecretManagerSpec) DeepCopyInto(out *ImagePullSecretManagerSpec) {
+func (in *ClusterImagePullSecretPolicySpec) DeepCopyInto(out *ClusterImagePullSecretPolicySpec) {
 	*out = *in
-	if in.Secrets != nil {
-		in, out := &in.Secrets, &out.Secrets
-		*out = make([]ImagePullSecretSpec, len(*in))
+	if in.AllowedRegistries != nil {
+		in, out := &in.AllowedRegistries, &out.AllowedRegistries
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.CredentialsRequired != nil {
+		in, out := &in.CredentialsRequired, &out.CredentialsRequired
+		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretManagerSpec.
-func (in *ImagePullSecretManagerSpec) DeepCopy() *ImagePullSecretManagerSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterImagePullSecretPolicySpec.
+func (in *ClusterImagePullSecretPolicySpec) DeepCopy() *ClusterImagePullSecretPolicySpec {
 	if in == nil {
 		return nil
 	}
-	out := new(ImagePullSecretManagerSpec)
+	out := new(ClusterImagePullSecretPolicySpec)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ImagePullSecretManagerStatus) DeepCopyInto(out *ImagePullSecretManagerStatus) {
+func (in *Credential) DeepCopyInto(out *Credential) {
 	*out = *in
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretManagerStatus.
-func (in *ImagePullSecretManagerStatus) DeepCopy() *ImagePullSecretManagerStatus {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Credential.
+func (in *Credential) DeepCopy() *Credential {
 	if in == nil {
 		return nil
 	}
-	out := new(ImagePullSecretManagerStatus)
+	out := new(Credential)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ImagePullSecretSpec) DeepCopyInto(out *ImagePullSecretSpec) {
+func (in *CredentialPool) DeepCopyInto(out *CredentialPool) {
 	*out = *in
-	out.ExistingSecretRef = in.ExistingSecretRef
+	if in.Credentials != nil {
+		in, out := &in.Credentials, &out.Credentials
+		*out = make([]Credential, len(*in))
+		copy(*out, *in)
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretSpec.
-func (in *ImagePullSecretSpec) DeepCopy() *ImagePullSecretSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CredentialPool.
+func (in *CredentialPool) DeepCopy() *CredentialPool {
 	if in == nil {
 		return nil
 	}
-	out := new(ImagePullSecretSpec)
+	out := new(CredentialPool)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CredentialProvider) DeepCopyInto(out *CredentialProvider) {
+	*out = *in
+	if in.ECR != nil {
+		in, out := &in.ECR, &out.ECR
+		*out = new(ECRProvider)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ACR != nil {
+		in, out := &in.ACR, &out.ACR
+		*out = new(ACRProvider)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.GAR != nil {
+		in, out := &in.GAR, &out.GAR
+		*out = new(GARProvider)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TokenExchange != nil {
+		in, out := &in.TokenExchange, &out.TokenExchange
+		*out = new(TokenExchangeProvider)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Harbor != nil {
+		in, out := &in.Harbor, &out.Harbor
+		*out = new(HarborProvider)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.GitHubApp != nil {
+		in, out := &in.GitHubApp, &out.GitHubApp
+		*out = new(GitHubAppProvider)
+		**out = **in
+	}
+	if in.Vault != nil {
+		in, out := &in.Vault, &out.Vault
+		*out = new(VaultProvider)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Exec != nil {
+		in, out := &in.Exec, &out.Exec
+		*out = new(ExecProvider)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CredentialProvider.
+func (in *CredentialProvider) DeepCopy() *CredentialProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(CredentialProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ECRProvider) DeepCopyInto(out *ECRProvider) {
+	*out = *in
+	if in.CredentialsSecretRef != nil {
+		in, out := &in.CredentialsSecretRef, &out.CredentialsSecretRef
+		*out = new(corev1.SecretReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ECRProvider.
+func (in *ECRProvider) DeepCopy() *ECRProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(ECRProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExecEnvVar) DeepCopyInto(out *ExecEnvVar) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExecEnvVar.
+func (in *ExecEnvVar) DeepCopy() *ExecEnvVar {
+	if in == nil {
+		return nil
+	}
+	out := new(ExecEnvVar)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExecProvider) DeepCopyInto(out *ExecProvider) {
+	*out = *in
+	if in.Args != nil {
+		in, out := &in.Args, &out.Args
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make([]ExecEnvVar, len(*in))
+		copy(*out, *in)
+	}
+	if in.RefreshInterval != nil {
+		in, out := &in.RefreshInterval, &out.RefreshInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExecProvider.
+func (in *ExecProvider) DeepCopy() *ExecProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(ExecProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExpiredSecret) DeepCopyInto(out *ExpiredSecret) {
+	*out = *in
+	in.ExpiredAt.DeepCopyInto(&out.ExpiredAt)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExpiredSecret.
+func (in *ExpiredSecret) DeepCopy() *ExpiredSecret {
+	if in == nil {
+		return nil
+	}
+	out := new(ExpiredSecret)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Failover) DeepCopyInto(out *Failover) {
+	*out = *in
+	if in.LastSwitchTime != nil {
+		in, out := &in.LastSwitchTime, &out.LastSwitchTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Failover.
+func (in *Failover) DeepCopy() *Failover {
+	if in == nil {
+		return nil
+	}
+	out := new(Failover)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GARProvider) DeepCopyInto(out *GARProvider) {
+	*out = *in
+	if in.CredentialsSecretRef != nil {
+		in, out := &in.CredentialsSecretRef, &out.CredentialsSecretRef
+		*out = new(corev1.SecretReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GARProvider.
+func (in *GARProvider) DeepCopy() *GARProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(GARProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitHubAppProvider) DeepCopyInto(out *GitHubAppProvider) {
+	*out = *in
+	out.PrivateKeySecretRef = in.PrivateKeySecretRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitHubAppProvider.
+func (in *GitHubAppProvider) DeepCopy() *GitHubAppProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(GitHubAppProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HarborProvider) DeepCopyInto(out *HarborProvider) {
+	*out = *in
+	out.CredentialsSecretRef = in.CredentialsSecretRef
+	if in.Projects != nil {
+		in, out := &in.Projects, &out.Projects
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RotationInterval != nil {
+		in, out := &in.RotationInterval, &out.RotationInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HarborProvider.
+func (in *HarborProvider) DeepCopy() *HarborProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(HarborProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImagePullSecretManager) DeepCopyInto(out *ImagePullSecretManager) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretManager.
+func (in *ImagePullSecretManager) DeepCopy() *ImagePullSecretManager {
+	if in == nil {
+		return nil
+	}
+	out := new(ImagePullSecretManager)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImagePullSecretManager) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImagePullSecretManagerList) DeepCopyInto(out *ImagePullSecretManagerList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ImagePullSecretManager, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretManagerList.
+func (in *ImagePullSecretManagerList) DeepCopy() *ImagePullSecretManagerList {
+	if in == nil {
+		return nil
+	}
+	out := new(ImagePullSecretManagerList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImagePullSecretManagerList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImagePullSecretManagerSpec) DeepCopyInto(out *ImagePullSecretManagerSpec) {
+	*out = *in
+	if in.Secrets != nil {
+		in, out := &in.Secrets, &out.Secrets
+		*out = make([]ImagePullSecretSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Rotation != nil {
+		in, out := &in.Rotation, &out.Rotation
+		*out = new(RotationPolicy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Cleanup != nil {
+		in, out := &in.Cleanup, &out.Cleanup
+		*out = new(CleanupPolicy)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretManagerSpec.
+func (in *ImagePullSecretManagerSpec) DeepCopy() *ImagePullSecretManagerSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImagePullSecretManagerSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImagePullSecretManagerStatus) DeepCopyInto(out *ImagePullSecretManagerStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PullFailures != nil {
+		in, out := &in.PullFailures, &out.PullFailures
+		*out = make([]PullFailure, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RateLimits != nil {
+		in, out := &in.RateLimits, &out.RateLimits
+		*out = make([]RateLimit, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Failover != nil {
+		in, out := &in.Failover, &out.Failover
+		*out = make([]Failover, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Usage != nil {
+		in, out := &in.Usage, &out.Usage
+		*out = make([]SecretUsage, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Expired != nil {
+		in, out := &in.Expired, &out.Expired
+		*out = make([]ExpiredSecret, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Adoptions != nil {
+		in, out := &in.Adoptions, &out.Adoptions
+		*out = make([]SecretAdoption, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretManagerStatus.
+func (in *ImagePullSecretManagerStatus) DeepCopy() *ImagePullSecretManagerStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ImagePullSecretManagerStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImagePullSecretSpec) DeepCopyInto(out *ImagePullSecretSpec) {
+	*out = *in
+	out.ExistingSecretRef = in.ExistingSecretRef
+	if in.RegistryRef != nil {
+		in, out := &in.RegistryRef, &out.RegistryRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
+	if in.Pool != nil {
+		in, out := &in.Pool, &out.Pool
+		*out = new(CredentialPool)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Fallbacks != nil {
+		in, out := &in.Fallbacks, &out.Fallbacks
+		*out = make([]Credential, len(*in))
+		copy(*out, *in)
+	}
+	if in.Provider != nil {
+		in, out := &in.Provider, &out.Provider
+		*out = new(CredentialProvider)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePullSecretSpec.
+func (in *ImagePullSecretSpec) DeepCopy() *ImagePullSecretSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImagePullSecretSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodTemplateTarget) DeepCopyInto(out *PodTemplateTarget) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodTemplateTarget.
+func (in *PodTemplateTarget) DeepCopy() *PodTemplateTarget {
+	if in == nil {
+		return nil
+	}
+	out := new(PodTemplateTarget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PodTemplateTarget) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodTemplateTargetList) DeepCopyInto(out *PodTemplateTargetList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]PodTemplateTarget, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodTemplateTargetList.
+func (in *PodTemplateTargetList) DeepCopy() *PodTemplateTargetList {
+	if in == nil {
+		return nil
+	}
+	out := new(PodTemplateTargetList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PodTemplateTargetList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodTemplateTargetSpec) DeepCopyInto(out *PodTemplateTargetSpec) {
+	*out = *in
+	if in.Paths != nil {
+		in, out := &in.Paths, &out.Paths
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodTemplateTargetSpec.
+func (in *PodTemplateTargetSpec) DeepCopy() *PodTemplateTargetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PodTemplateTargetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodTemplateTargetStatus) DeepCopyInto(out *PodTemplateTargetStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodTemplateTargetStatus.
+func (in *PodTemplateTargetStatus) DeepCopy() *PodTemplateTargetStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PodTemplateTargetStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PullFailure) DeepCopyInto(out *PullFailure) {
+	*out = *in
+	if in.Secrets != nil {
+		in, out := &in.Secrets, &out.Secrets
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PullFailure.
+func (in *PullFailure) DeepCopy() *PullFailure {
+	if in == nil {
+		return nil
+	}
+	out := new(PullFailure)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PullSecretReport) DeepCopyInto(out *PullSecretReport) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Summary = in.Summary
+	if in.Workloads != nil {
+		in, out := &in.Workloads, &out.Workloads
+		*out = make([]WorkloadReport, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PullSecretReport.
+func (in *PullSecretReport) DeepCopy() *PullSecretReport {
+	if in == nil {
+		return nil
+	}
+	out := new(PullSecretReport)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PullSecretReport) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PullSecretReportList) DeepCopyInto(out *PullSecretReportList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]PullSecretReport, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PullSecretReportList.
+func (in *PullSecretReportList) DeepCopy() *PullSecretReportList {
+	if in == nil {
+		return nil
+	}
+	out := new(PullSecretReportList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PullSecretReportList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PullSecretReportSummary) DeepCopyInto(out *PullSecretReportSummary) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PullSecretReportSummary.
+func (in *PullSecretReportSummary) DeepCopy() *PullSecretReportSummary {
+	if in == nil {
+		return nil
+	}
+	out := new(PullSecretReportSummary)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RateLimit) DeepCopyInto(out *RateLimit) {
+	*out = *in
+	if in.Member != nil {
+		in, out := &in.Member, &out.Member
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Limit != nil {
+		in, out := &in.Limit, &out.Limit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Remaining != nil {
+		in, out := &in.Remaining, &out.Remaining
+		*out = new(int32)
+		**out = **in
+	}
+	in.LastProbeTime.DeepCopyInto(&out.LastProbeTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RateLimit.
+func (in *RateLimit) DeepCopy() *RateLimit {
+	if in == nil {
+		return nil
+	}
+	out := new(RateLimit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Registry) DeepCopyInto(out *Registry) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Registry.
+func (in *Registry) DeepCopy() *Registry {
+	if in == nil {
+		return nil
+	}
+	out := new(Registry)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *Registry) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryList) DeepCopyInto(out *RegistryList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]Registry, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryList.
+func (in *RegistryList) DeepCopy() *RegistryList {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *RegistryList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryMirror) DeepCopyInto(out *RegistryMirror) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryMirror.
+func (in *RegistryMirror) DeepCopy() *RegistryMirror {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryMirror)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *RegistryMirror) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryMirrorList) DeepCopyInto(out *RegistryMirrorList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]RegistryMirror, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryMirrorList.
+func (in *RegistryMirrorList) DeepCopy() *RegistryMirrorList {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryMirrorList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *RegistryMirrorList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryMirrorSpec) DeepCopyInto(out *RegistryMirrorSpec) {
+	*out = *in
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryMirrorSpec.
+func (in *RegistryMirrorSpec) DeepCopy() *RegistryMirrorSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryMirrorSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryReport) DeepCopyInto(out *RegistryReport) {
+	*out = *in
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Secrets != nil {
+		in, out := &in.Secrets, &out.Secrets
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryReport.
+func (in *RegistryReport) DeepCopy() *RegistryReport {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryReport)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistrySpec) DeepCopyInto(out *RegistrySpec) {
+	*out = *in
+	if in.Aliases != nil {
+		in, out := &in.Aliases, &out.Aliases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Patterns != nil {
+		in, out := &in.Patterns, &out.Patterns
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistrySpec.
+func (in *RegistrySpec) DeepCopy() *RegistrySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistrySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReportGap) DeepCopyInto(out *ReportGap) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReportGap.
+func (in *ReportGap) DeepCopy() *ReportGap {
+	if in == nil {
+		return nil
+	}
+	out := new(ReportGap)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RotationPolicy) DeepCopyInto(out *RotationPolicy) {
+	*out = *in
+	if in.Overlap != nil {
+		in, out := &in.Overlap, &out.Overlap
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RotationPolicy.
+func (in *RotationPolicy) DeepCopy() *RotationPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(RotationPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretAdoption) DeepCopyInto(out *SecretAdoption) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretAdoption.
+func (in *SecretAdoption) DeepCopy() *SecretAdoption {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretAdoption)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretReport) DeepCopyInto(out *SecretReport) {
+	*out = *in
+	if in.Registries != nil {
+		in, out := &in.Registries, &out.Registries
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretReport.
+func (in *SecretReport) DeepCopy() *SecretReport {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretReport)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretUsage) DeepCopyInto(out *SecretUsage) {
+	*out = *in
+	if in.LastUsed != nil {
+		in, out := &in.LastUsed, &out.LastUsed
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretUsage.
+func (in *SecretUsage) DeepCopy() *SecretUsage {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretUsage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TokenExchangeProvider) DeepCopyInto(out *TokenExchangeProvider) {
+	*out = *in
+	if in.ExpirationSeconds != nil {
+		in, out := &in.ExpirationSeconds, &out.ExpirationSeconds
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TokenExchangeProvider.
+func (in *TokenExchangeProvider) DeepCopy() *TokenExchangeProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(TokenExchangeProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VaultProvider) DeepCopyInto(out *VaultProvider) {
+	*out = *in
+	if in.RefreshInterval != nil {
+		in, out := &in.RefreshInterval, &out.RefreshInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultProvider.
+func (in *VaultProvider) DeepCopy() *VaultProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadReport) DeepCopyInto(out *WorkloadReport) {
+	*out = *in
+	if in.Registries != nil {
+		in, out := &in.Registries, &out.Registries
+		*out = make([]RegistryReport, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Secrets != nil {
+		in, out := &in.Secrets, &out.Secrets
+		*out = make([]SecretReport, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Gaps != nil {
+		in, out := &in.Gaps, &out.Gaps
+		*out = make([]ReportGap, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadReport.
+func (in *WorkloadReport) DeepCopy() *WorkloadReport {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadReport)
 	in.DeepCopyInto(out)
 	return out
 }
@@ -0,0 +1,150 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// cheiron-credential-provider is a kubelet credential provider plugin answering image pull credential requests with
+// the credentials of ClusterImagePullSecretManagers, for workloads whose service accounts can not be managed. The
+// kubelet runs it with a CredentialProviderRequest on stdin and reads the CredentialProviderResponse from stdout.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+	"github.com/anny-co/cheiron/controllers"
+)
+
+// apiVersion is the version of the kubelet credential provider API the plugin speaks
+const apiVersion = "credentialprovider.kubelet.k8s.io/v1"
+
+// credentialProviderRequest is the request of the kubelet for the credentials of an image
+type credentialProviderRequest struct {
+	Kind       string `json:"kind"`
+	APIVersion string `json:"apiVersion"`
+	Image      string `json:"image"`
+}
+
+// authConfig is a credential of a credentialProviderResponse
+type authConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// credentialProviderResponse are the credentials for an image and the time the kubelet caches them
+type credentialProviderResponse struct {
+	Kind          string                `json:"kind"`
+	APIVersion    string                `json:"apiVersion"`
+	CacheKeyType  string                `json:"cacheKeyType"`
+	CacheDuration string                `json:"cacheDuration,omitempty"`
+	Auth          map[string]authConfig `json:"auth,omitempty"`
+}
+
+func main() {
+	var secretNamespace string
+	var cacheDuration time.Duration
+	var timeout time.Duration
+	flag.StringVar(&secretNamespace, "secret-namespace", "",
+		"The namespace the managed secrets of existingSecretRefs and providers are read from. Only inline credentials are answered if empty.")
+	flag.DurationVar(&cacheDuration, "cache-duration", 5*time.Minute,
+		"The time the kubelet caches the credentials of a registry, at most until they expire.")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second,
+		"The time the plugin may take to answer a request.")
+	// the kubeconfig flag is registered by controller-runtime
+	flag.Parse()
+
+	if err := run(os.Stdin, os.Stdout, secretNamespace, cacheDuration, timeout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run answers a single request
+func run(in io.Reader, out io.Writer, secretNamespace string, cacheDuration, timeout time.Duration) error {
+	request, err := decodeRequest(in)
+	if err != nil {
+		return err
+	}
+
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(cheironv1alpha1.AddToScheme(scheme))
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+
+	// nodes are spread over the members of pools by their host name
+	assignee, _ := os.Hostname()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	credential, err := controllers.NodeCredentials(ctx, c, request.Image, secretNamespace, assignee)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(out).Encode(newResponse(credential, cacheDuration, time.Now()))
+}
+
+// decodeRequest reads the request of the kubelet, only requests of the supported version are accepted
+func decodeRequest(in io.Reader) (credentialProviderRequest, error) {
+	var request credentialProviderRequest
+	if err := json.NewDecoder(in).Decode(&request); err != nil {
+		return request, fmt.Errorf("failed to decode request: %w", err)
+	}
+	if request.Kind != "CredentialProviderRequest" || request.APIVersion != apiVersion {
+		return request, fmt.Errorf("unsupported request %s %s, only CredentialProviderRequest %s is supported", request.APIVersion, request.Kind, apiVersion)
+	}
+	return request, nil
+}
+
+// newResponse returns the response answering a credential at the given time, nil answers no credentials
+func newResponse(credential *controllers.NodeCredential, cacheDuration time.Duration, now time.Time) credentialProviderResponse {
+	response := credentialProviderResponse{
+		Kind:          "CredentialProviderResponse",
+		APIVersion:    apiVersion,
+		CacheKeyType:  "Registry",
+		CacheDuration: cacheDuration.String(),
+	}
+	if credential != nil {
+		response.Auth = map[string]authConfig{
+			credential.Registry: {Username: credential.Username, Password: credential.Password},
+		}
+		// issued credentials must not be used by the kubelet after they expired
+		if !credential.ExpiresAt.IsZero() {
+			if remaining := credential.ExpiresAt.Sub(now).Truncate(time.Second); remaining < cacheDuration {
+				if remaining < 0 {
+					remaining = 0
+				}
+				response.CacheDuration = remaining.String()
+			}
+		}
+	}
+	return response
+}
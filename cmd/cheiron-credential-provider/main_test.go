@@ -0,0 +1,82 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anny-co/cheiron/controllers"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    string
+		fails   bool
+	}{
+		{name: "v1 request", request: `{"kind":"CredentialProviderRequest","apiVersion":"credentialprovider.kubelet.k8s.io/v1","image":"quay.io/anny/app"}`, want: "quay.io/anny/app"},
+		{name: "v1alpha1 request", request: `{"kind":"CredentialProviderRequest","apiVersion":"credentialprovider.kubelet.k8s.io/v1alpha1","image":"quay.io/anny/app"}`, fails: true},
+		{name: "other kind", request: `{"kind":"CredentialProviderResponse","apiVersion":"credentialprovider.kubelet.k8s.io/v1"}`, fails: true},
+		{name: "invalid request", request: `{"kind":`, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := decodeRequest(strings.NewReader(tt.request))
+			if (err != nil) != tt.fails {
+				t.Fatalf("decodeRequest() error = %v, want error %v", err, tt.fails)
+			}
+			if !tt.fails && request.Image != tt.want {
+				t.Errorf("decodeRequest() image = %s, want %s", request.Image, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewResponse(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	credential := func(expiresAt time.Time) *controllers.NodeCredential {
+		return &controllers.NodeCredential{Registry: "harbor.internal", Username: "robot", Password: "secret", ExpiresAt: expiresAt}
+	}
+	auth := map[string]authConfig{"harbor.internal": {Username: "robot", Password: "secret"}}
+	tests := []struct {
+		name          string
+		credential    *controllers.NodeCredential
+		wantAuth      map[string]authConfig
+		wantCacheTime string
+	}{
+		{name: "no credential", wantCacheTime: "5m0s"},
+		{name: "credential without expiry", credential: credential(time.Time{}), wantAuth: auth, wantCacheTime: "5m0s"},
+		{name: "credential expiring after cache duration", credential: credential(now.Add(time.Hour)), wantAuth: auth, wantCacheTime: "5m0s"},
+		{name: "credential expiring within cache duration", credential: credential(now.Add(90*time.Second + 500*time.Millisecond)), wantAuth: auth, wantCacheTime: "1m30s"},
+		{name: "expired credential", credential: credential(now.Add(-time.Minute)), wantAuth: auth, wantCacheTime: "0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := newResponse(tt.credential, 5*time.Minute, now)
+			if response.Kind != "CredentialProviderResponse" || response.APIVersion != apiVersion || response.CacheKeyType != "Registry" {
+				t.Errorf("newResponse() = %+v", response)
+			}
+			if !reflect.DeepEqual(response.Auth, tt.wantAuth) || response.CacheDuration != tt.wantCacheTime {
+				t.Errorf("newResponse() auth = %v cached for %s, want %v cached for %s", response.Auth, response.CacheDuration, tt.wantAuth, tt.wantCacheTime)
+			}
+		})
+	}
+}
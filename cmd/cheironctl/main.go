@@ -0,0 +1,159 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// cheironctl summarizes the PullSecretReports of the cluster. `cheironctl report` prints the number of workloads,
+// compliant workloads and gaps per namespace, `cheironctl gaps` lists every gap.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+	"github.com/anny-co/cheiron/controllers"
+)
+
+const usage = `Usage: cheironctl [flags] <command>
+
+Commands:
+  report  print the workloads, compliant workloads and gaps of each namespace
+  gaps    list the gaps of all workloads
+
+Flags:
+`
+
+func main() {
+	var namespace string
+	var timeout time.Duration
+	flag.StringVar(&namespace, "namespace", "", "Only summarize the report of this namespace.")
+	flag.StringVar(&namespace, "n", "", "Shorthand for --namespace.")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "The time the reports may take to fetch.")
+	// the kubeconfig flag is registered by controller-runtime
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// flags may follow the command as well
+	command := flag.Arg(0)
+	if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	reports, err := fetchReports(ctx, namespace)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "report":
+		err = printReport(os.Stdout, reports)
+	case "gaps":
+		err = printGaps(os.Stdout, reports)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// fetchReports returns the PullSecretReports of all namespaces, or of the given one, sorted by namespace
+func fetchReports(ctx context.Context, namespace string) ([]cheironv1alpha1.PullSecretReport, error) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(cheironv1alpha1.AddToScheme(scheme))
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	var reports cheironv1alpha1.PullSecretReportList
+	opts := []client.ListOption{}
+	if namespace != "" {
+		opts = append(opts, client.InNamespace(namespace))
+	}
+	if err := c.List(ctx, &reports, opts...); err != nil {
+		return nil, err
+	}
+	items := []cheironv1alpha1.PullSecretReport{}
+	for _, r := range reports.Items {
+		if r.Name == controllers.PullSecretReportName {
+			items = append(items, r)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Namespace < items[j].Namespace })
+	return items, nil
+}
+
+// printReport prints the summary of each report and the total of the cluster
+func printReport(out io.Writer, reports []cheironv1alpha1.PullSecretReport) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tWORKLOADS\tCOMPLIANT\tGAPS")
+	var total cheironv1alpha1.PullSecretReportSummary
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", r.Namespace, r.Summary.Workloads, r.Summary.Compliant, r.Summary.Gaps)
+		total.Workloads += r.Summary.Workloads
+		total.Compliant += r.Summary.Compliant
+		total.Gaps += r.Summary.Gaps
+	}
+	if len(reports) > 1 {
+		fmt.Fprintf(w, "TOTAL\t%d\t%d\t%d\n", total.Workloads, total.Compliant, total.Gaps)
+	}
+	return w.Flush()
+}
+
+// printGaps lists the gaps of all workloads
+func printGaps(out io.Writer, reports []cheironv1alpha1.PullSecretReport) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tKIND\tNAME\tREASON\tMESSAGE")
+	for _, r := range reports {
+		for _, workload := range r.Workloads {
+			for _, gap := range workload.Gaps {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Namespace, workload.Kind, workload.Name, gap.Reason,
+					strings.ReplaceAll(gap.Message, "\t", " "))
+			}
+		}
+	}
+	return w.Flush()
+}
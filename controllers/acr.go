@@ -0,0 +1,149 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+const (
+	// acrUsername is the username refresh tokens of Azure Container Registry are used with
+	acrUsername = "00000000-0000-0000-0000-000000000000"
+	// acrRefreshTokenLifetime is assumed for refresh tokens whose expiry can not be read from the token
+	acrRefreshTokenLifetime = 3 * time.Hour
+	// azureManagementScope is the scope of the Azure AD access token exchanged for a refresh token
+	azureManagementScope = "https://management.azure.com/.default"
+)
+
+// acrProvider exchanges Azure AD access tokens for refresh tokens of Azure Container Registry
+type acrProvider struct {
+	Client    client.Client
+	Spec      *cheironv1alpha1.ACRProvider
+	Namespace string
+	// Registry is the normalized host of the registry
+	Registry string
+}
+
+// endpoint returns the URL of the registry's exchange endpoint
+func (p *acrProvider) endpoint() string {
+	endpoint := p.Spec.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + p.Registry
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/oauth2/exchange"
+}
+
+// authorityEndpoint returns the Azure AD endpoint
+func (p *acrProvider) authorityEndpoint() string {
+	if p.Spec.AuthorityEndpoint != "" {
+		return strings.TrimSuffix(p.Spec.AuthorityEndpoint, "/")
+	}
+	return "https://login.microsoftonline.com"
+}
+
+// accessToken requests an Azure AD access token either with the service principal of the referenced secret or with
+// the federated token of the operator's workload identity. The tenant is returned as well, as the exchange needs it.
+func (p *acrProvider) accessToken(ctx context.Context) (string, string, error) {
+	tenant := p.Spec.TenantID
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", azureManagementScope)
+
+	if ref := p.Spec.CredentialsSecretRef; ref != nil {
+		secret, err := providerSecret(ctx, p.Client, ref, p.Namespace)
+		if err != nil {
+			return "", "", err
+		}
+		if tenant == "" {
+			tenant = string(secret.Data["tenant_id"])
+		}
+		clientID, clientSecret := string(secret.Data["client_id"]), string(secret.Data["client_secret"])
+		if clientID == "" || clientSecret == "" {
+			return "", "", fmt.Errorf("secret %s/%s lacks client_id or client_secret", secret.Namespace, secret.Name)
+		}
+		form.Set("client_id", clientID)
+		form.Set("client_secret", clientSecret)
+	} else {
+		tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+		clientID := os.Getenv("AZURE_CLIENT_ID")
+		if tokenFile == "" || clientID == "" {
+			return "", "", fmt.Errorf("no credentials secret referenced and no workload identity available")
+		}
+		assertion, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return "", "", err
+		}
+		form.Set("client_id", clientID)
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	}
+	if tenant == "" {
+		tenant = os.Getenv("AZURE_TENANT_ID")
+	}
+	if tenant == "" {
+		return "", "", fmt.Errorf("no Azure AD tenant specified")
+	}
+
+	token, err := requestToken(ctx, p.authorityEndpoint()+"/"+url.PathEscape(tenant)+"/oauth2/v2.0/token", form)
+	if err != nil {
+		return "", "", err
+	}
+	return token.AccessToken, tenant, nil
+}
+
+// issue exchanges an Azure AD access token for a refresh token of the registry, which is used as password
+func (p *acrProvider) issue(ctx context.Context) (providedCredential, error) {
+	accessToken, tenant, err := p.accessToken(ctx)
+	if err != nil {
+		return providedCredential{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", p.Registry)
+	form.Set("tenant", tenant)
+	form.Set("access_token", accessToken)
+	issuedAt := time.Now()
+	token, err := requestToken(ctx, p.endpoint(), form)
+	if err != nil {
+		return providedCredential{}, err
+	}
+	if token.RefreshToken == "" {
+		return providedCredential{}, fmt.Errorf("exchange at %s returned no refresh token", p.Registry)
+	}
+
+	expiresAt, err := jwtExpiry(token.RefreshToken)
+	if err != nil {
+		expiresAt = issuedAt.Add(acrRefreshTokenLifetime)
+	}
+	return providedCredential{
+		Username:  acrUsername,
+		Password:  token.RefreshToken,
+		IssuedAt:  issuedAt,
+		ExpiresAt: expiresAt,
+	}, nil
+}
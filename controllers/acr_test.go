@@ -0,0 +1,117 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// unsignedJWT returns a JWT with the given expiry and no valid signature
+func unsignedJWT(exp time.Time) string {
+	claims, _ := json.Marshal(map[string]int64{"exp": exp.Unix()})
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+func TestACRProvider(t *testing.T) {
+	expiresAt := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tenant/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("client_id") != "client" || r.Form.Get("client_secret") != "secret" ||
+			r.Form.Get("scope") != azureManagementScope {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"access_token": "aad-token", "expires_in": 3600})
+	})
+	mux.HandleFunc("/oauth2/exchange", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("access_token") != "aad-token" || r.Form.Get("tenant") != "tenant" ||
+			r.Form.Get("service") != "example.azurecr.io" {
+			http.Error(w, "invalid exchange", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"refresh_token": unsignedJWT(expiresAt)})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := fakeClient(
+		credentialsSecret("azure", map[string]string{"tenant_id": "tenant", "client_id": "client", "client_secret": "secret"}),
+		credentialsSecret("azure-client", map[string]string{"client_id": "client", "client_secret": "secret"}),
+		credentialsSecret("azure-incomplete", map[string]string{"tenant_id": "tenant", "client_id": "client"}),
+	)
+	tests := []struct {
+		name   string
+		secret string
+		tenant string
+		fails  bool
+	}{
+		{name: "service principal", secret: "azure"},
+		{name: "tenant of the spec", secret: "azure-client", tenant: "tenant"},
+		{name: "tenant of the spec overrides the secret", secret: "azure", tenant: "other", fails: true},
+		{name: "no tenant", secret: "azure-client", fails: true},
+		{name: "no client secret", secret: "azure-incomplete", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &acrProvider{
+				Client: c,
+				Spec: &cheironv1alpha1.ACRProvider{
+					TenantID:             tt.tenant,
+					CredentialsSecretRef: secretRef(tt.secret),
+					Endpoint:             server.URL,
+					AuthorityEndpoint:    server.URL,
+				},
+				Registry: "example.azurecr.io",
+			}
+			cred, err := p.issue(context.Background())
+			if tt.fails {
+				if err == nil {
+					t.Errorf("issue() = %+v, want error", cred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cred.Username != acrUsername || cred.Password != unsignedJWT(expiresAt) || !cred.ExpiresAt.Equal(expiresAt) {
+				t.Errorf("issue() = %+v", cred)
+			}
+		})
+	}
+}
+
+func TestACREndpoints(t *testing.T) {
+	p := &acrProvider{Spec: &cheironv1alpha1.ACRProvider{}, Registry: "example.azurecr.io"}
+	if got := p.endpoint(); got != "https://example.azurecr.io/oauth2/exchange" {
+		t.Errorf("endpoint() = %s", got)
+	}
+	if got := p.authorityEndpoint(); got != "https://login.microsoftonline.com" {
+		t.Errorf("authorityEndpoint() = %s", got)
+	}
+	p.Spec.Endpoint, p.Spec.AuthorityEndpoint = "http://acr/", "http://aad/"
+	if p.endpoint() != "http://acr/oauth2/exchange" || p.authorityEndpoint() != "http://aad" {
+		t.Errorf("endpoints = %s, %s, want the overrides", p.endpoint(), p.authorityEndpoint())
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+var (
+	// adoptedAnnotation records when a manager took over a secret that existed before
+	adoptedAnnotation = "cheiron.anny.co/adopted-at"
+	// adoptedFromAnnotation records the controller a secret was taken over from, if it had one
+	adoptedFromAnnotation = "cheiron.anny.co/adopted-from"
+)
+
+// adoptionError is returned when a manager refuses to take over an existing secret
+type adoptionError struct {
+	Namespace string
+	Name      string
+	Reason    string
+}
+
+func (e *adoptionError) Error() string {
+	return fmt.Sprintf("refusing to take over secret %s/%s: %s", e.Namespace, e.Name, e.Reason)
+}
+
+// asAdoptionError returns the adoptionError wrapped by err, if any
+func asAdoptionError(err error) (*adoptionError, bool) {
+	var refused *adoptionError
+	if errors.As(err, &refused) {
+		return refused, true
+	}
+	return nil, false
+}
+
+// adoptionPolicyOf returns the adoption policy of a manager, IfUnowned if it specifies none
+func adoptionPolicyOf(owner client.Object) cheironv1alpha1.AdoptionPolicy {
+	policy := cheironv1alpha1.AdoptionPolicy("")
+	switch m := owner.(type) {
+	case *cheironv1alpha1.ImagePullSecretManager:
+		policy = m.Spec.AdoptionPolicy
+	case *cheironv1alpha1.ClusterImagePullSecretManager:
+		policy = m.Spec.AdoptionPolicy
+	}
+	if policy == "" {
+		return cheironv1alpha1.AdoptIfUnowned
+	}
+	return policy
+}
+
+// adoptSecret checks whether the owner may write an existing secret according to its adoption policy. Secrets of
+// other types are never written, as the type of a secret can't be changed. A secret taken over from another
+// controller loses that controller s.t. the owner can be set as controller. Secrets the owner controls already are
+// written as is.
+func adoptSecret(secret *corev1.Secret, owner client.Object) error {
+	if metav1.IsControlledBy(secret, owner) {
+		return nil
+	}
+	if secret.Type != corev1.SecretTypeDockerConfigJson {
+		return &adoptionError{Namespace: secret.Namespace, Name: secret.Name, Reason: fmt.Sprintf("secret is of type %s", secret.Type)}
+	}
+	policy := adoptionPolicyOf(owner)
+	controller := metav1.GetControllerOf(secret)
+	switch {
+	case policy == cheironv1alpha1.AdoptNever:
+		return &adoptionError{Namespace: secret.Namespace, Name: secret.Name, Reason: "adoptionPolicy is Never"}
+	case controller != nil && policy != cheironv1alpha1.AdoptAlways:
+		return &adoptionError{Namespace: secret.Namespace, Name: secret.Name, Reason: fmt.Sprintf("secret is controlled by %s %s", controller.Kind, controller.Name)}
+	}
+
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[adoptedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if controller != nil {
+		secret.Annotations[adoptedFromAnnotation] = controller.Kind + "/" + controller.Name
+		for i := range secret.OwnerReferences {
+			if secret.OwnerReferences[i].Controller != nil && *secret.OwnerReferences[i].Controller {
+				secret.OwnerReferences[i].Controller = nil
+			}
+		}
+	}
+	return nil
+}
+
+// secretAdoptions reports the secrets of a namespace the owner took over, together with the refused ones
+func secretAdoptions(ctx context.Context, c client.Client, owner client.Object, namespace string, refused []adoptionError) ([]cheironv1alpha1.SecretAdoption, error) {
+	var secrets corev1.SecretList
+	if err := c.List(ctx, &secrets, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	adoptions := []cheironv1alpha1.SecretAdoption{}
+	for _, s := range secrets.Items {
+		adopted, ok := s.Annotations[adoptedAnnotation]
+		if !ok || !metav1.IsControlledBy(&s, owner) {
+			continue
+		}
+		message := "taken over at " + adopted
+		if from, ok := s.Annotations[adoptedFromAnnotation]; ok {
+			message = "taken over from " + from + " at " + adopted
+		}
+		adoptions = append(adoptions, cheironv1alpha1.SecretAdoption{
+			Name:      s.Name,
+			Namespace: s.Namespace,
+			Outcome:   cheironv1alpha1.SecretAdopted,
+			Message:   message,
+		})
+	}
+	for _, r := range refused {
+		if r.Namespace != namespace {
+			continue
+		}
+		adoptions = append(adoptions, cheironv1alpha1.SecretAdoption{
+			Name:      r.Name,
+			Namespace: r.Namespace,
+			Outcome:   cheironv1alpha1.SecretRefused,
+			Message:   r.Reason,
+		})
+	}
+	sort.SliceStable(adoptions, func(i, j int) bool { return adoptions[i].Name < adoptions[j].Name })
+	return adoptions, nil
+}
+
+// dropRefused removes the winners from the resolution whose secrets exist in the namespace without being controlled by
+// their manager, i.e. secrets the manager refused to take over. These secrets hold foreign credentials, so they are
+// neither attached to targets nor merged into the auth file. Versions are only ever created by their manager and
+// secrets given as existingSecretRef are attached as is, hence both are kept.
+func (r *resolution) dropRefused(ctx context.Context, c client.Client) error {
+	winners := []candidate{}
+	for _, w := range r.Winners {
+		names := []string{}
+		switch {
+		case w.Secret.ExistingSecretRef.Name != "" || w.versioned():
+		case w.perServiceAccount():
+			for member := range w.Secret.Pool.Credentials {
+				names = append(names, poolSecretName(w.Secret.Name, member))
+			}
+		default:
+			names = append(names, w.Secret.Name)
+		}
+		refused := false
+		for _, name := range names {
+			secret := &corev1.Secret{}
+			err := c.Get(ctx, client.ObjectKey{Namespace: r.Namespace, Name: name}, secret)
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !isControlledByManager(secret, w.Manager) {
+				refused = true
+				break
+			}
+		}
+		if !refused {
+			winners = append(winners, w)
+		}
+	}
+	r.Winners = winners
+	return nil
+}
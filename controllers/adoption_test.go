@@ -0,0 +1,151 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+func TestAdoptSecret(t *testing.T) {
+	managerOf := func(policy cheironv1alpha1.AdoptionPolicy) *cheironv1alpha1.ImagePullSecretManager {
+		return &cheironv1alpha1.ImagePullSecretManager{
+			ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "shop", UID: "manager"},
+			Spec:       cheironv1alpha1.ImagePullSecretManagerSpec{AdoptionPolicy: policy},
+		}
+	}
+	secretOf := func(secretType corev1.SecretType, owners ...metav1.OwnerReference) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "quay", Namespace: "shop", OwnerReferences: owners},
+			Type:       secretType,
+		}
+	}
+	own := controllerRef("ImagePullSecretManager", "team", "manager")
+	other := controllerRef("SealedSecret", "quay", "other")
+
+	tests := []struct {
+		name    string
+		secret  *corev1.Secret
+		policy  cheironv1alpha1.AdoptionPolicy
+		refused bool
+		adopted bool
+		from    string
+	}{
+		{name: "secrets of the manager are written as is", secret: secretOf(corev1.SecretTypeOpaque, own), policy: cheironv1alpha1.AdoptNever},
+		{name: "secrets of other types are refused", secret: secretOf(corev1.SecretTypeOpaque), policy: cheironv1alpha1.AdoptAlways, refused: true},
+		{name: "Never refuses unowned secrets", secret: secretOf(corev1.SecretTypeDockerConfigJson), policy: cheironv1alpha1.AdoptNever, refused: true},
+		{name: "IfUnowned takes over unowned secrets", secret: secretOf(corev1.SecretTypeDockerConfigJson), adopted: true},
+		{name: "IfUnowned refuses secrets of other controllers", secret: secretOf(corev1.SecretTypeDockerConfigJson, other), policy: cheironv1alpha1.AdoptIfUnowned, refused: true},
+		{name: "Always takes over secrets of other controllers", secret: secretOf(corev1.SecretTypeDockerConfigJson, other), policy: cheironv1alpha1.AdoptAlways, adopted: true, from: "SealedSecret/quay"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := adoptSecret(tt.secret, managerOf(tt.policy))
+			if _, ok := asAdoptionError(err); ok != tt.refused || (!tt.refused && err != nil) {
+				t.Fatalf("adoptSecret() error = %v, refused %v", err, tt.refused)
+			}
+			if _, ok := tt.secret.Annotations[adoptedAnnotation]; ok != tt.adopted {
+				t.Errorf("adopted-at annotation set = %v, want %v", ok, tt.adopted)
+			}
+			if got := tt.secret.Annotations[adoptedFromAnnotation]; got != tt.from {
+				t.Errorf("adopted-from annotation = %q, want %q", got, tt.from)
+			}
+			if tt.adopted && metav1.GetControllerOf(tt.secret) != nil {
+				t.Errorf("adopted secret keeps controller %v", metav1.GetControllerOf(tt.secret))
+			}
+		})
+	}
+}
+
+func TestSecretAdoptions(t *testing.T) {
+	owner := &cheironv1alpha1.ImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "shop", UID: "team-uid"}}
+	ownerRef := *metav1.NewControllerRef(owner, cheironv1alpha1.GroupVersion.WithKind("ImagePullSecretManager"))
+	adopted := func(name string, annotations map[string]string, owners ...metav1.OwnerReference) *corev1.Secret {
+		secret := newDockerSecretObj(name, "shop")
+		secret.Annotations = annotations
+		secret.OwnerReferences = owners
+		return secret
+	}
+	c := fakeClient(
+		adopted("quay", map[string]string{adoptedAnnotation: "2021-06-01T12:00:00Z"}, ownerRef),
+		adopted("ghcr", map[string]string{adoptedAnnotation: "2021-06-01T12:00:00Z", adoptedFromAnnotation: "SealedSecret/ghcr"}, ownerRef),
+		adopted("written", nil, ownerRef),
+		adopted("foreign", map[string]string{adoptedAnnotation: "2021-06-01T12:00:00Z"}, controllerRef("ImagePullSecretManager", "other", "other-uid")),
+	)
+	refused := []adoptionError{
+		{Namespace: "shop", Name: "hub", Reason: "adoptionPolicy is Never"},
+		{Namespace: "batch", Name: "hub", Reason: "adoptionPolicy is Never"},
+	}
+
+	adoptions, err := secretAdoptions(context.Background(), c, owner, "shop", refused)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cheironv1alpha1.SecretAdoption{
+		{Name: "ghcr", Namespace: "shop", Outcome: cheironv1alpha1.SecretAdopted, Message: "taken over from SealedSecret/ghcr at 2021-06-01T12:00:00Z"},
+		{Name: "hub", Namespace: "shop", Outcome: cheironv1alpha1.SecretRefused, Message: "adoptionPolicy is Never"},
+		{Name: "quay", Namespace: "shop", Outcome: cheironv1alpha1.SecretAdopted, Message: "taken over at 2021-06-01T12:00:00Z"},
+	}
+	if !reflect.DeepEqual(adoptions, want) {
+		t.Errorf("secretAdoptions() = %+v, want %+v", adoptions, want)
+	}
+}
+
+func TestDropRefused(t *testing.T) {
+	own := controllerRef("ImagePullSecretManager", "team", "team-uid")
+	secretOf := func(name string, owners ...metav1.OwnerReference) *corev1.Secret {
+		secret := newDockerSecretObj(name, "shop")
+		secret.OwnerReferences = owners
+		return secret
+	}
+	winner := func(secret cheironv1alpha1.ImagePullSecretSpec) candidate {
+		return candidate{Manager: managerRef{Name: "team", Namespace: "shop", UID: "team-uid"}, Secret: secret}
+	}
+	existing := winner(cheironv1alpha1.ImagePullSecretSpec{Name: "legacy", Registry: "legacy.example.com", ExistingSecretRef: corev1.LocalObjectReference{Name: "foreign"}})
+	versioned := winner(basicSecret("hub", "docker.io"))
+	versioned.Rotation = &cheironv1alpha1.RotationPolicy{Strategy: cheironv1alpha1.VersionedRotation}
+	c := fakeClient(
+		secretOf("quay", own),
+		secretOf("ghcr", controllerRef("SealedSecret", "ghcr", "sealed-uid")),
+		secretOf("hub"),
+		secretOf("foreign"),
+	)
+
+	res := &resolution{Namespace: "shop", Winners: []candidate{
+		winner(basicSecret("quay", "quay.io")),
+		winner(basicSecret("ghcr", "ghcr.io")),
+		winner(basicSecret("gitlab", "registry.gitlab.com")),
+		existing,
+		versioned,
+	}}
+	if err := res.dropRefused(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, w := range res.Winners {
+		names = append(names, w.Secret.Name)
+	}
+	if want := []string{"quay", "gitlab", "legacy", "hub"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("dropRefused() winners = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// fieldManager is the field manager all mutations of target ressources are server-side applied with. Cheiron only
+// owns its annotations and the imagePullSecrets entries it attached, s.t. tools such as Helm, Flux or Argo CD keep
+// ownership of everything else.
+const fieldManager = "cheiron"
+
+// pullSecretsList describes where a target kind keeps its imagePullSecrets
+type pullSecretsList struct {
+	// Path is the field path of the imagePullSecrets list in the object
+	Path []string
+	// Atomic is true for lists without a merge key. Server-side apply cannot own single entries of such lists, so the
+	// complete list including foreign entries has to be applied
+	Atomic bool
+}
+
+var (
+	// podPullSecrets is the location of imagePullSecrets in a Pod, entries are merged by name
+	podPullSecrets = pullSecretsList{Path: []string{"spec", "imagePullSecrets"}}
+	// serviceAccountPullSecrets is the location of imagePullSecrets in a ServiceAccount, which is an atomic list
+	serviceAccountPullSecrets = pullSecretsList{Path: []string{"imagePullSecrets"}, Atomic: true}
+)
+
+// splitSecretNames parses the comma-separated value of the reconcile-with annotation
+func splitSecretNames(secrets string) []string {
+	names := []string{}
+	for _, s := range strings.Split(secrets, ",") {
+		if name := strings.TrimSpace(s); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// targetNeedsUpdate reports whether a target has to be (re-)applied with the given secrets, either because its
+// annotations are outdated or because the secrets attached to it are missing in one of its imagePullSecrets lists, e.g.
+// as another tool replaced an atomic list. Ressources explicitly ignored or marked as non-reconcilable are left
+// untouched.
+func targetNeedsUpdate(obj client.Object, lists []pullSecretsList, secrets string) bool {
+	annotations := obj.GetAnnotations()
+
+	reconcilable, reconcilablePresent := annotations[reconcilableAnnotation]
+	if annotations[ignoreAnnotation] == "true" {
+		return false
+	}
+	if reconcilablePresent && reconcilable != "true" {
+		return false
+	}
+	if !reconcilablePresent && secrets == "" {
+		// nothing to attach to a ressource cheiron never touched
+		return false
+	}
+	if !reconcilablePresent || annotations[reconcileWithAnnotation] != secrets || annotations[reconciledAnnotation] != "true" {
+		return true
+	}
+	// workloads deferring their rollout carry the secrets attached so far, which may differ from the desired ones
+	attached, ok := annotations[attachedAnnotation]
+	if !ok {
+		attached = secrets
+	}
+	return !listsContain(obj, lists, splitSecretNames(attached))
+}
+
+// listsContain reports whether all imagePullSecrets lists of a target contain entries for all given secrets
+func listsContain(obj client.Object, lists []pullSecretsList, secrets []string) bool {
+	content := toUnstructured(obj)
+	for _, list := range lists {
+		current, _, err := unstructured.NestedSlice(content, list.Path...)
+		if err != nil {
+			return false
+		}
+		present := map[string]bool{}
+		for _, item := range current {
+			if ref, ok := item.(map[string]interface{}); ok {
+				name, _, _ := unstructured.NestedString(ref, "name")
+				present[name] = true
+			}
+		}
+		for _, name := range secrets {
+			if !present[name] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// applyPullSecrets server-side applies the cheiron annotations and the given secrets as imagePullSecrets to a target.
+// Every apply contains all fields cheiron owns on the target, as fields owned by the field manager but missing in an
+// apply are removed by the API server.
+func applyPullSecrets(ctx context.Context, c client.Client, obj client.Object, list pullSecretsList, secrets []string) error {
+	return applyTarget(ctx, c, obj, []pullSecretsList{list}, secrets, secrets, nil)
+}
+
+// applyTarget server-side applies the cheiron annotations for the desired secrets together with additional
+// annotations, and attaches the given secrets as imagePullSecrets entries to all lists. Desired and attached secrets
+// only differ for workloads that defer attaching changed secrets to their next rollout.
+func applyTarget(ctx context.Context, c client.Client, obj client.Object, lists []pullSecretsList, secrets []string, attached []string, annotations map[string]string) error {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return err
+	}
+
+	apply := &unstructured.Unstructured{}
+	apply.SetGroupVersionKind(gvk)
+	apply.SetName(obj.GetName())
+	apply.SetNamespace(obj.GetNamespace())
+	applyAnnotations := map[string]string{
+		reconcilableAnnotation:  "true",
+		reconcileWithAnnotation: strings.Join(secrets, ","),
+		// mark the ressource as reconciled s.t. later reconciles don't pick it up again (see filters())
+		reconciledAnnotation: "true",
+	}
+	for k, v := range annotations {
+		applyAnnotations[k] = v
+	}
+	apply.SetAnnotations(applyAnnotations)
+
+	for _, list := range lists {
+		entries, err := listEntries(obj, list, attached)
+		if err != nil {
+			return err
+		}
+		refs := []interface{}{}
+		for _, name := range entries {
+			refs = append(refs, map[string]interface{}{"name": name})
+		}
+		if err := unstructured.SetNestedSlice(apply.Object, refs, list.Path...); err != nil {
+			return err
+		}
+	}
+
+	return c.Patch(ctx, apply, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+}
+
+// listEntries returns the entries cheiron applies to an imagePullSecrets list of a target. For atomic lists foreign
+// entries of the live object are retained and the entries cheiron attached before are replaced.
+func listEntries(obj client.Object, list pullSecretsList, attached []string) ([]string, error) {
+	if !list.Atomic {
+		return attached, nil
+	}
+
+	annotations := obj.GetAnnotations()
+	previouslyAttached, ok := annotations[attachedAnnotation]
+	if !ok {
+		previouslyAttached = annotations[reconcileWithAnnotation]
+	}
+	previous := map[string]bool{}
+	for _, name := range splitSecretNames(previouslyAttached) {
+		previous[name] = true
+	}
+	wanted := map[string]bool{}
+	for _, name := range attached {
+		wanted[name] = true
+	}
+
+	entries := []string{}
+	current, _, err := unstructured.NestedSlice(toUnstructured(obj), list.Path...)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range current {
+		ref, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(ref, "name")
+		if name == "" || previous[name] || wanted[name] {
+			continue
+		}
+		entries = append(entries, name)
+	}
+	return append(entries, attached...), nil
+}
+
+// toUnstructured returns the content of an object as unstructured map
+func toUnstructured(obj client.Object) map[string]interface{} {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return u.Object
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return map[string]interface{}{}
+	}
+	return content
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// fakeClient returns a client serving the given objects of the built-in and cheiron's kinds
+func fakeClient(objs ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = cheironv1alpha1.AddToScheme(scheme)
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+// applyRecorder records the patches sent through it instead of sending them, as the fake client can't apply
+type applyRecorder struct {
+	client.Client
+	patches []*unstructured.Unstructured
+	options []client.PatchOption
+}
+
+func (r *applyRecorder) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() == client.Apply.Type() {
+		r.patches = append(r.patches, obj.(*unstructured.Unstructured))
+		r.options = opts
+		return nil
+	}
+	return r.Client.Patch(ctx, obj, patch, opts...)
+}
+
+// pullSecretRefs returns references to the named secrets
+func pullSecretRefs(names ...string) []corev1.LocalObjectReference {
+	refs := []corev1.LocalObjectReference{}
+	for _, name := range names {
+		refs = append(refs, corev1.LocalObjectReference{Name: name})
+	}
+	return refs
+}
+
+func TestSplitSecretNames(t *testing.T) {
+	tests := map[string][]string{
+		"":                 {},
+		"quay":             {"quay"},
+		" quay , ,hub ,":   {"quay", "hub"},
+		"quay,hub,private": {"quay", "hub", "private"},
+	}
+	for value, want := range tests {
+		if got := splitSecretNames(value); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitSecretNames(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestTargetNeedsUpdate(t *testing.T) {
+	reconciled := map[string]string{reconcilableAnnotation: "true", reconcileWithAnnotation: "quay", reconciledAnnotation: "true"}
+	with := func(annotations map[string]string, changes ...string) map[string]string {
+		result := map[string]string{}
+		for k, v := range annotations {
+			result[k] = v
+		}
+		for i := 0; i+1 < len(changes); i += 2 {
+			result[changes[i]] = changes[i+1]
+		}
+		return result
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		refs        []corev1.LocalObjectReference
+		secrets     string
+		want        bool
+	}{
+		{name: "untouched ressources without secrets are left alone", secrets: ""},
+		{name: "untouched ressources get the secrets", secrets: "quay", want: true},
+		{name: "ignored ressources are left alone", annotations: map[string]string{ignoreAnnotation: "true"}, secrets: "quay"},
+		{name: "non-reconcilable ressources are left alone", annotations: map[string]string{reconcilableAnnotation: "false"}, secrets: "quay"},
+		{name: "reconciled ressources with the secrets are up to date", annotations: reconciled, refs: pullSecretRefs("foreign", "quay"), secrets: "quay"},
+		{name: "changed secrets are applied", annotations: reconciled, refs: pullSecretRefs("quay"), secrets: "quay,hub", want: true},
+		{name: "unreconciled ressources are applied", annotations: with(reconciled, reconciledAnnotation, "false"), refs: pullSecretRefs("quay"), secrets: "quay", want: true},
+		{name: "secrets removed by others are applied again", annotations: reconciled, refs: pullSecretRefs("foreign"), secrets: "quay", want: true},
+		{name: "deferred secrets are compared with the attached ones", annotations: with(reconciled, reconcileWithAnnotation, "quay,hub", attachedAnnotation, "quay"), refs: pullSecretRefs("quay"), secrets: "quay,hub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "shop", Annotations: tt.annotations}, ImagePullSecrets: tt.refs}
+			if got := targetNeedsUpdate(sa, []pullSecretsList{serviceAccountPullSecrets}, tt.secrets); got != tt.want {
+				t.Errorf("targetNeedsUpdate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	tests := []struct {
+		name        string
+		list        pullSecretsList
+		annotations map[string]string
+		refs        []corev1.LocalObjectReference
+		attached    []string
+		want        []string
+	}{
+		{name: "merged lists only hold the attached secrets", list: podPullSecrets, refs: pullSecretRefs("foreign"), attached: []string{"quay"}, want: []string{"quay"}},
+		{name: "atomic lists keep foreign entries", list: serviceAccountPullSecrets, refs: pullSecretRefs("foreign"), attached: []string{"quay"}, want: []string{"foreign", "quay"}},
+		{
+			name:        "atomic lists drop entries attached before",
+			list:        serviceAccountPullSecrets,
+			annotations: map[string]string{reconcileWithAnnotation: "old,quay"},
+			refs:        pullSecretRefs("old", "foreign", "quay"),
+			attached:    []string{"quay", "hub"},
+			want:        []string{"foreign", "quay", "hub"},
+		},
+		{
+			name:        "the attached annotation takes precedence over the desired secrets",
+			list:        serviceAccountPullSecrets,
+			annotations: map[string]string{reconcileWithAnnotation: "quay,hub", attachedAnnotation: "old"},
+			refs:        pullSecretRefs("old", "hub"),
+			attached:    []string{"quay"},
+			want:        []string{"hub", "quay"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := client.Object(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}, ImagePullSecrets: tt.refs})
+			if !tt.list.Atomic {
+				obj = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}, Spec: corev1.PodSpec{ImagePullSecrets: tt.refs}}
+			}
+			got, err := listEntries(obj, tt.list, tt.attached)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listEntries() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyTarget(t *testing.T) {
+	recorder := &applyRecorder{Client: fakeClient()}
+	sa := &corev1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Name: "default", Namespace: "shop", Annotations: map[string]string{"helm.sh/chart": "shop"}},
+		ImagePullSecrets: pullSecretRefs("foreign"),
+	}
+	if err := applyTarget(context.Background(), recorder, sa, []pullSecretsList{serviceAccountPullSecrets}, []string{"quay", "hub"}, []string{"quay"}, map[string]string{attachedAnnotation: "quay"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.patches) != 1 {
+		t.Fatalf("applyTarget() sent %d patches", len(recorder.patches))
+	}
+	apply := recorder.patches[0]
+	if apply.GetKind() != "ServiceAccount" || apply.GetName() != "default" || apply.GetNamespace() != "shop" {
+		t.Errorf("apply targets %s %s/%s", apply.GetKind(), apply.GetNamespace(), apply.GetName())
+	}
+	wantAnnotations := map[string]string{
+		reconcilableAnnotation:  "true",
+		reconcileWithAnnotation: "quay,hub",
+		reconciledAnnotation:    "true",
+		attachedAnnotation:      "quay",
+	}
+	if got := apply.GetAnnotations(); !reflect.DeepEqual(got, wantAnnotations) {
+		t.Errorf("apply annotations = %v, want only cheiron's %v", got, wantAnnotations)
+	}
+	refs, _, _ := unstructured.NestedSlice(apply.Object, "imagePullSecrets")
+	wantRefs := []interface{}{map[string]interface{}{"name": "foreign"}, map[string]interface{}{"name": "quay"}}
+	if !reflect.DeepEqual(refs, wantRefs) {
+		t.Errorf("apply imagePullSecrets = %v, want %v", refs, wantRefs)
+	}
+	options := &client.PatchOptions{}
+	options.ApplyOptions(recorder.options)
+	if options.FieldManager != fieldManager || options.Force == nil || !*options.Force {
+		t.Errorf("apply options = %+v, want forced apply as %s", options, fieldManager)
+	}
+}
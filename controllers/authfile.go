@@ -0,0 +1,167 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+var (
+	// authFileSecretName is the name of the secret merging the credentials of all winning secrets of a namespace into a
+	// single auth file, which is mounted into pods asking for it, see AuthFileInjector
+	authFileSecretName = "cheiron-auth-file"
+	// authFileLabel marks auth file secrets
+	authFileLabel = "cheiron.anny.co/auth-file"
+)
+
+// authFileContent merges the credentials of all winners of the resolution into a single dockerconfigjson, which
+// doubles as config.json of docker and auth.json of containers-auth. Only the first winner of a registry is used, as
+// an auth file holds a single credential per registry. Secrets that do not exist (yet) are skipped.
+func authFileContent(ctx context.Context, c client.Client, res *resolution) ([]byte, error) {
+	merged := DockerConfigJSON{Auths: DockerConfig{}}
+	registries := map[string]bool{}
+	for _, w := range res.Winners {
+		names := w.attachedNames()
+		if w.perServiceAccount() {
+			// the members of pools assigned per service account are all candidates, the first healthy one is used
+			names = []string{}
+			for _, m := range w.healthyMembers() {
+				names = append(names, poolSecretName(w.Secret.Name, m))
+			}
+		}
+		for _, name := range names {
+			secret := &corev1.Secret{}
+			if err := c.Get(ctx, client.ObjectKey{Namespace: res.Namespace, Name: name}, secret); err != nil {
+				if errors.IsNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			var config DockerConfigJSON
+			if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+				// secrets referenced as existingSecretRef may be of another type
+				break
+			}
+			for host, entry := range config.Auths {
+				if registry := normalizeRegistry(host); !registries[registry] {
+					registries[registry] = true
+					merged.Auths[host] = entry
+				}
+			}
+			break
+		}
+	}
+	if len(merged.Auths) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(merged)
+}
+
+// authFileRequested reports whether any pod of the namespace asks for the auth file to be mounted
+func authFileRequested(ctx context.Context, c client.Client, namespace string) (bool, error) {
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(namespace)); err != nil {
+		return false, err
+	}
+	for _, p := range pods.Items {
+		if _, ok := p.Annotations[mountAuthAnnotation]; ok && p.DeletionTimestamp == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authFileOwners returns owner references to all managers with winners in the resolution, s.t. the auth file is
+// garbage-collected once all of them are gone
+func authFileOwners(res *resolution) []metav1.OwnerReference {
+	owners := []metav1.OwnerReference{}
+	seen := map[types.UID]bool{}
+	for _, w := range res.Winners {
+		ref := w.Manager
+		if seen[ref.UID] || ref.UID == "" {
+			continue
+		}
+		seen[ref.UID] = true
+		kind := "ImagePullSecretManager"
+		if ref.Cluster {
+			kind = "ClusterImagePullSecretManager"
+		}
+		owners = append(owners, metav1.OwnerReference{
+			APIVersion: cheironv1alpha1.GroupVersion.String(),
+			Kind:       kind,
+			Name:       ref.Name,
+			UID:        ref.UID,
+		})
+	}
+	return owners
+}
+
+// writeAuthFile creates or updates the auth file secret of the resolved namespace. The secret only exists while pods
+// of the namespace ask for it and managers attach credentials there, otherwise it is deleted.
+func writeAuthFile(ctx context.Context, c client.Client, res *resolution) error {
+	requested, err := authFileRequested(ctx, c, res.Namespace)
+	if err != nil {
+		return err
+	}
+	var content []byte
+	if requested {
+		if content, err = authFileContent(ctx, c, res); err != nil {
+			return err
+		}
+	}
+	owners := authFileOwners(res)
+
+	existing := &corev1.Secret{}
+	err = c.Get(ctx, client.ObjectKey{Namespace: res.Namespace, Name: authFileSecretName}, existing)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	if exists && existing.Labels[authFileLabel] != "true" {
+		// the name is taken by a secret not written by cheiron
+		return nil
+	}
+
+	switch {
+	case content == nil && exists:
+		return client.IgnoreNotFound(c.Delete(ctx, existing))
+	case content == nil:
+		return nil
+	case exists && bytes.Equal(existing.Data[corev1.DockerConfigJsonKey], content) && equality.Semantic.DeepEqual(existing.OwnerReferences, owners):
+		return nil
+	case exists:
+		existing.Data = map[string][]byte{corev1.DockerConfigJsonKey: content}
+		existing.OwnerReferences = owners
+		return c.Update(ctx, existing)
+	}
+	secret := newDockerSecretObj(authFileSecretName, res.Namespace)
+	secret.Labels = map[string]string{authFileLabel: "true"}
+	secret.OwnerReferences = owners
+	secret.Data[corev1.DockerConfigJsonKey] = content
+	return c.Create(ctx, secret)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// AuthFileReconciler writes the auth file of a namespace once a pod asks for it and deletes it once no pod does
+// anymore. Changes of the attached secrets are written by the managers, see annotateTargets().
+type AuthFileReconciler struct {
+	client.Client
+}
+
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;delete
+
+// Reconcile resolves the managers of the namespace in the request and writes its auth file
+func (r *AuthFileReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	res, err := resolveNamespace(ctx, r.Client, req.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := res.dropRefused(ctx, r.Client); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := res.resolveVersions(ctx, r.Client); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, writeAuthFile(ctx, r.Client, &res)
+}
+
+// requestsAuthFile reports whether the object is a pod asking for the auth file
+func requestsAuthFile(obj client.Object) bool {
+	_, ok := obj.GetAnnotations()[mountAuthAnnotation]
+	return ok
+}
+
+// authFileFilters only passes pods asking for the auth file when they are created or deleted
+func authFileFilters() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return requestsAuthFile(e.Object) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return requestsAuthFile(e.Object) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return false },
+		GenericFunc: func(e event.GenericEvent) bool { return false },
+	}
+}
+
+// podNamespace maps a pod to a reconcile request for its namespace
+func podNamespace(obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *AuthFileReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("authfile").
+		// requests are namespaces, which are only reconciled for the pods asking for their auth file
+		For(&corev1.Namespace{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(client.Object) bool { return false }))).
+		Watches(&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(podNamespace),
+			builder.WithPredicates(authFileFilters())).
+		Complete(r)
+}
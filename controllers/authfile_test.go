@@ -0,0 +1,167 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// authSecret returns a dockerconfigjson secret of the namespace shop holding a credential per registry
+func authSecret(name string, users map[string]string) *corev1.Secret {
+	config := DockerConfigJSON{Auths: DockerConfig{}}
+	for registry, user := range users {
+		config.Auths[registry] = DockerConfigEntry{Username: user, Password: "password"}
+	}
+	content, _ := json.Marshal(config)
+	secret := newDockerSecretObj(name, "shop")
+	secret.Data[corev1.DockerConfigJsonKey] = content
+	return secret
+}
+
+// authWinner returns a winner of the manager with the given UID for a secret
+func authWinner(uid string, cluster bool, secret cheironv1alpha1.ImagePullSecretSpec) candidate {
+	return candidate{Manager: managerRef{Cluster: cluster, Name: "team", Namespace: "shop", UID: types.UID(uid)}, Secret: secret}
+}
+
+// authFileUsers returns the users of the auth file by registry
+func authFileUsers(t *testing.T, content []byte) map[string]string {
+	if content == nil {
+		return nil
+	}
+	var config DockerConfigJSON
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]string{}
+	for registry, entry := range config.Auths {
+		users[registry] = entry.Username
+	}
+	return users
+}
+
+func TestAuthFileContent(t *testing.T) {
+	versioned := authWinner("team", false, basicSecret("gitlab", "registry.gitlab.com"))
+	versioned.Rotation = &cheironv1alpha1.RotationPolicy{Strategy: cheironv1alpha1.VersionedRotation}
+	versioned.Versions = []string{"gitlab-bbbbbbbbbb", "gitlab-aaaaaaaaaa"}
+	existing := authWinner("team", false, cheironv1alpha1.ImagePullSecretSpec{Name: "ghcr", Registry: "ghcr.io", ExistingSecretRef: corev1.LocalObjectReference{Name: "ghcr-pull"}})
+	opaque := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "ghcr-pull", Namespace: "shop"}, Data: map[string][]byte{"token": []byte("token")}}
+	c := fakeClient(
+		authSecret("quay", map[string]string{"quay.io": "team"}),
+		authSecret("quay-cluster", map[string]string{"https://quay.io": "cluster"}),
+		authSecret("gitlab-aaaaaaaaaa", map[string]string{"registry.gitlab.com": "old"}),
+		opaque,
+	)
+
+	tests := []struct {
+		name    string
+		winners []candidate
+		want    map[string]string
+	}{
+		{name: "no winners"},
+		{
+			name:    "first winner of a registry",
+			winners: []candidate{authWinner("team", false, basicSecret("quay", "quay.io")), authWinner("cluster", true, basicSecret("quay-cluster", "quay.io"))},
+			want:    map[string]string{"quay.io": "team"},
+		},
+		{name: "missing secret", winners: []candidate{authWinner("team", false, basicSecret("harbor", "harbor.example.com"))}},
+		{name: "existing secret of other type", winners: []candidate{existing}},
+		{name: "first existing version", winners: []candidate{versioned}, want: map[string]string{"registry.gitlab.com": "old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := authFileContent(context.Background(), c, &resolution{Namespace: "shop", Winners: tt.winners})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := authFileUsers(t, content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("authFileContent() users = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthFileOwners(t *testing.T) {
+	res := &resolution{Winners: []candidate{
+		authWinner("team", false, basicSecret("quay", "quay.io")),
+		authWinner("team", false, basicSecret("ghcr", "ghcr.io")),
+		authWinner("cluster", true, basicSecret("gitlab", "registry.gitlab.com")),
+		authWinner("", false, basicSecret("harbor", "harbor.example.com")),
+	}}
+	owners := authFileOwners(res)
+	if len(owners) != 2 || owners[0].Kind != "ImagePullSecretManager" || owners[0].UID != "team" ||
+		owners[1].Kind != "ClusterImagePullSecretManager" || owners[1].UID != "cluster" ||
+		owners[0].APIVersion != cheironv1alpha1.GroupVersion.String() {
+		t.Errorf("authFileOwners() = %+v", owners)
+	}
+}
+
+func TestWriteAuthFile(t *testing.T) {
+	requesting := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "kaniko", Namespace: "shop", Annotations: map[string]string{mountAuthAnnotation: "/kaniko/.docker"}}}
+	other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"}}
+	quay := authSecret("quay", map[string]string{"quay.io": "team"})
+	winners := []candidate{authWinner("team", false, basicSecret("quay", "quay.io"))}
+	stale := authSecret(authFileSecretName, map[string]string{"ghcr.io": "stale"})
+	stale.Labels = map[string]string{authFileLabel: "true"}
+	foreign := authSecret(authFileSecretName, map[string]string{"ghcr.io": "foreign"})
+
+	tests := []struct {
+		name    string
+		objs    []client.Object
+		winners []candidate
+		want    map[string]string
+	}{
+		{name: "requested by pod", objs: []client.Object{requesting, quay}, winners: winners, want: map[string]string{"quay.io": "team"}},
+		{name: "update of stale auth file", objs: []client.Object{requesting, quay, stale}, winners: winners, want: map[string]string{"quay.io": "team"}},
+		{name: "not requested by any pod", objs: []client.Object{other, quay}, winners: winners},
+		{name: "deleted once no longer requested", objs: []client.Object{other, quay, stale}, winners: winners},
+		{name: "deleted once no credentials are attached", objs: []client.Object{requesting, stale}},
+		{name: "secret of the same name not written by cheiron", objs: []client.Object{requesting, quay, foreign}, winners: winners, want: map[string]string{"ghcr.io": "foreign"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fakeClient(tt.objs...)
+			if err := writeAuthFile(context.Background(), c, &resolution{Namespace: "shop", Winners: tt.winners}); err != nil {
+				t.Fatal(err)
+			}
+			secret := &corev1.Secret{}
+			err := c.Get(context.Background(), client.ObjectKey{Namespace: "shop", Name: authFileSecretName}, secret)
+			if tt.want == nil {
+				if !apierrors.IsNotFound(err) {
+					t.Errorf("auth file = %+v, %v, want none", secret, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := authFileUsers(t, secret.Data[corev1.DockerConfigJsonKey]); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("auth file users = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var (
+	// mountAuthAnnotation requests the auth file of the namespace to be mounted into all containers of a pod at the
+	// given directory, e.g. /kaniko/.docker
+	mountAuthAnnotation = "cheiron.anny.co/mount-auth"
+	// mountAuthFormatAnnotation selects whether the auth file is mounted as config.json of docker (default) or as
+	// auth.json of containers-auth, as read by buildah, podman and skopeo
+	mountAuthFormatAnnotation = "cheiron.anny.co/mount-auth-format"
+	// authFileVolumeName is the name of the volume the auth file is mounted with
+	authFileVolumeName = "cheiron-auth-file"
+)
+
+const (
+	authFileFormatDocker     = "docker"
+	authFileFormatContainers = "containers"
+)
+
+//+kubebuilder:webhook:path=/mutate-v1-pod-auth-file,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=authfile.cheiron.anny.co,admissionReviewVersions=v1
+
+// AuthFileInjector mounts the auth file of the namespace into pods annotated with cheiron.anny.co/mount-auth, s.t.
+// image tools running in-cluster (kaniko, buildah, skopeo, crane) authenticate with the same credentials the
+// managers attach as imagePullSecrets
+type AuthFileInjector struct {
+	decoder *admission.Decoder
+}
+
+// Handle adds the auth file volume, its mounts and the environment variable pointing the tools to it
+func (a *AuthFileInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := a.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	dir, ok := pod.Annotations[mountAuthAnnotation]
+	if !ok {
+		return admission.Allowed("no auth file requested")
+	}
+	if !path.IsAbs(dir) {
+		return admission.Denied(fmt.Sprintf("%s must be an absolute directory, got %q", mountAuthAnnotation, dir))
+	}
+	format := pod.Annotations[mountAuthFormatAnnotation]
+	if format == "" {
+		format = authFileFormatDocker
+	}
+	if format != authFileFormatDocker && format != authFileFormatContainers {
+		return admission.Denied(fmt.Sprintf("%s must be %s or %s, got %q", mountAuthFormatAnnotation,
+			authFileFormatDocker, authFileFormatContainers, format))
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == authFileVolumeName {
+			return admission.Allowed("auth file already mounted")
+		}
+	}
+
+	injectAuthFile(pod, path.Clean(dir), format)
+
+	marshaled, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// InjectDecoder injects the decoder of admission requests
+func (a *AuthFileInjector) InjectDecoder(d *admission.Decoder) error {
+	a.decoder = d
+	return nil
+}
+
+// injectAuthFile mounts the auth file secret of the namespace read-only at dir into all containers of the pod. The
+// secret is optional, s.t. pods start before any manager attached credentials to the namespace.
+func injectAuthFile(pod *corev1.Pod, dir, format string) {
+	file, env := "config.json", corev1.EnvVar{Name: "DOCKER_CONFIG", Value: dir}
+	if format == authFileFormatContainers {
+		file = "auth.json"
+		env = corev1.EnvVar{Name: "REGISTRY_AUTH_FILE", Value: path.Join(dir, file)}
+	}
+
+	optional := true
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: authFileVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{
+					Secret: &corev1.SecretProjection{
+						LocalObjectReference: corev1.LocalObjectReference{Name: authFileSecretName},
+						Items:                []corev1.KeyToPath{{Key: corev1.DockerConfigJsonKey, Path: file}},
+						Optional:             &optional,
+					},
+				}},
+			},
+		},
+	})
+
+	mount := func(c *corev1.Container) {
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      authFileVolumeName,
+			MountPath: dir,
+			ReadOnly:  true,
+		})
+		for _, e := range c.Env {
+			if e.Name == env.Name {
+				return
+			}
+		}
+		c.Env = append(c.Env, env)
+	}
+	for i := range pod.Spec.InitContainers {
+		mount(&pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		mount(&pod.Spec.Containers[i])
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// admissionRequest returns the admission request creating a pod
+func admissionRequest(t *testing.T, pod *corev1.Pod) admission.Request {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+func TestInjectAuthFile(t *testing.T) {
+	tests := []struct {
+		format  string
+		file    string
+		wantEnv corev1.EnvVar
+	}{
+		{format: authFileFormatDocker, file: "config.json", wantEnv: corev1.EnvVar{Name: "DOCKER_CONFIG", Value: "/kaniko/.docker"}},
+		{format: authFileFormatContainers, file: "auth.json", wantEnv: corev1.EnvVar{Name: "REGISTRY_AUTH_FILE", Value: "/kaniko/.docker/auth.json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init"}},
+				Containers: []corev1.Container{
+					{Name: "build"},
+					{Name: "custom", Env: []corev1.EnvVar{{Name: tt.wantEnv.Name, Value: "/custom"}}},
+				},
+			}}
+			injectAuthFile(pod, "/kaniko/.docker", tt.format)
+
+			if len(pod.Spec.Volumes) != 1 {
+				t.Fatalf("volumes = %+v", pod.Spec.Volumes)
+			}
+			projection := pod.Spec.Volumes[0].Projected.Sources[0].Secret
+			if projection.Name != authFileSecretName || projection.Items[0].Path != tt.file || !*projection.Optional {
+				t.Errorf("projection = %+v", projection)
+			}
+			containers := append(pod.Spec.InitContainers, pod.Spec.Containers...)
+			for _, c := range containers {
+				if len(c.VolumeMounts) != 1 || c.VolumeMounts[0].MountPath != "/kaniko/.docker" || !c.VolumeMounts[0].ReadOnly {
+					t.Errorf("mounts of %s = %+v", c.Name, c.VolumeMounts)
+				}
+				if len(c.Env) != 1 {
+					t.Errorf("env of %s = %+v", c.Name, c.Env)
+				}
+			}
+			if containers[0].Env[0] != tt.wantEnv || containers[1].Env[0] != tt.wantEnv {
+				t.Errorf("env = %+v, want %+v", containers[0].Env, tt.wantEnv)
+			}
+			// variables set by the pod are kept
+			if containers[2].Env[0].Value != "/custom" {
+				t.Errorf("env of custom = %+v", containers[2].Env)
+			}
+		})
+	}
+}
+
+func TestAuthFileInjector(t *testing.T) {
+	decoder, err := admission.NewDecoder(clientgoscheme.Scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	injector := &AuthFileInjector{}
+	if err := injector.InjectDecoder(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	mounted := corev1.PodSpec{Containers: []corev1.Container{{Name: "build"}}, Volumes: []corev1.Volume{{Name: authFileVolumeName}}}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		spec        corev1.PodSpec
+		allowed     bool
+		patched     bool
+	}{
+		{name: "no annotation", allowed: true},
+		{name: "docker format", annotations: map[string]string{mountAuthAnnotation: "/kaniko/.docker/"}, allowed: true, patched: true},
+		{name: "containers format", annotations: map[string]string{mountAuthAnnotation: "/auth", mountAuthFormatAnnotation: authFileFormatContainers}, allowed: true, patched: true},
+		{name: "relative directory", annotations: map[string]string{mountAuthAnnotation: ".docker"}},
+		{name: "unknown format", annotations: map[string]string{mountAuthAnnotation: "/auth", mountAuthFormatAnnotation: "podman"}},
+		{name: "already mounted", annotations: map[string]string{mountAuthAnnotation: "/auth"}, spec: mounted, allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.spec.Containers == nil {
+				tt.spec.Containers = []corev1.Container{{Name: "build"}}
+			}
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "kaniko", Namespace: "shop", Annotations: tt.annotations}, Spec: tt.spec}
+			resp := injector.Handle(context.Background(), admissionRequest(t, pod))
+			if resp.Allowed != tt.allowed || (len(resp.Patches) > 0) != tt.patched {
+				t.Errorf("Handle() = allowed %v with patches %+v, want allowed %v, patched %v", resp.Allowed, resp.Patches, tt.allowed, tt.patched)
+			}
+		})
+	}
+}
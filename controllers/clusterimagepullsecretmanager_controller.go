@@ -18,47 +18,212 @@ package controllers
 
 import (
 	"context"
+	"time"
 
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	types "k8s.io/apimachinery/pkg/types"
 )
 
 // ClusterImagePullSecretManagerReconciler reconciles a ClusterImagePullSecretManager object
 type ClusterImagePullSecretManagerReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// ServiceAccounts requests projected service account tokens for token exchange providers
+	ServiceAccounts corev1client.ServiceAccountsGetter
+	// CredentialPluginDir is the directory of exec plugins, exec plugins are disabled without it
+	CredentialPluginDir string
+	// CredentialPluginEnv are the names of the environment variables passed to exec plugins
+	CredentialPluginEnv []string
+	// APIAudiences are audiences of the API server besides the defaults, which tokens are never requested for
+	APIAudiences []string
 }
 
 //+kubebuilder:rbac:groups=cheiron.anny.co,resources=clusterimagepullsecretmanagers,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=cheiron.anny.co,resources=clusterimagepullsecretmanagers/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=cheiron.anny.co,resources=clusterimagepullsecretmanagers/finalizers,verbs=update
 
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the ClusterImagePullSecretManager object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+//
+// A ClusterImagePullSecretManager attaches its secrets to every namespace of the cluster. In each namespace the
+// secrets are resolved against the namespaced managers and other cluster managers first (see resolveSecrets()), only
+// the winning secrets are created and the lost conflicts are reported in the manager's status.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.9.2/pkg/reconcile
 func (r *ClusterImagePullSecretManagerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	log := log.FromContext(ctx)
+
+	cmgr := &cheironv1alpha1.ClusterImagePullSecretManager{}
+	if err := r.Get(ctx, req.NamespacedName, cmgr); err != nil {
+		if !errors.IsNotFound(err) {
+			log.Error(err, "Unable to fetch ClusterImagePullSecretManager")
+			return ctrl.Result{}, err
+		}
+		// the manager is gone, its secrets still need to be removed from all targets
+		log.Info("Manager CR not found. Re-annotating all namespaces since object must be deleted")
+		cmgr = nil
+	}
+
+	var failover []cheironv1alpha1.Failover
+	var switches []failoverSwitch
+	var requeueAfter time.Duration
+	if cmgr != nil && cmgr.DeletionTimestamp != nil {
+		// the robot accounts of the manager are deleted before the manager is gone
+		return ctrl.Result{}, finalizeHarborRobots(ctx, r.Client, cmgr, cmgr.Spec.Secrets)
+	}
+	if cmgr != nil {
+		if err := ensureHarborFinalizer(ctx, r.Client, cmgr, cmgr.Spec.Secrets); err != nil {
+			return ctrl.Result{}, err
+		}
+		// secrets referencing a Registry are handled like secrets naming its canonical host
+		catalog, err := loadRegistryCatalog(ctx, r.Client)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		catalog.expand(cmgr.Spec.Secrets)
+		// the credential in use is decided once for all namespaces
+		failover, switches, requeueAfter = resolveFailover(cmgr.Spec.Secrets, cmgr.Status.Failover, cmgr.Status.RateLimits, cmgr.Status.PullFailures, time.Now())
+
+		mode := cmgr.Spec.Mode
+		if mode != cheironv1alpha1.PodMode && mode != cheironv1alpha1.ServiceAccountMode && mode != cheironv1alpha1.WorkloadMode {
+			err := errors.NewBadRequest("Value of mode spec is not supported")
+			log.Error(err, "Unsupported mode")
+			return ctrl.Result{}, err
+		}
+	}
+
+	var namespaces corev1.NamespaceList
+	if err := r.List(ctx, &namespaces); err != nil {
+		log.Error(err, "Failed to fetch all namespaces")
+		return ctrl.Result{}, err
+	}
+
+	conflicts := []conflict{}
+	robots := map[string]bool{}
+	adoptions := []cheironv1alpha1.SecretAdoption{}
+	for _, ns := range namespaces.Items {
+		if ns.DeletionTimestamp != nil {
+			// terminating namespaces do not accept new secrets
+			continue
+		}
 
-	// your logic here
+		res, err := resolveNamespace(ctx, r.Client, ns.Name)
+		if err != nil {
+			log.Error(err, "Failed to resolve managers in namespace", "namespace", ns.Name)
+			return ctrl.Result{}, err
+		}
 
-	return ctrl.Result{}, nil
+		if cmgr != nil {
+			ref := refForClusterManager(cmgr)
+			res.withFailover(ref, failover)
+			refused := []adoptionError{}
+			for _, winner := range res.winnersOf(ref) {
+				versionsExpireAfter, err := createOrUpdateCandidateSecrets(ctx, r.Client, providerDeps{Tokens: r.ServiceAccounts, PluginDir: r.CredentialPluginDir, PluginEnv: r.CredentialPluginEnv, APIAudiences: r.APIAudiences}, r.Scheme, cmgr, ns.Name, winner, robots)
+				if refusal, ok := asAdoptionError(err); ok {
+					log.Info("Existing secret is not taken over", "secret", refusal.Name, "namespace", refusal.Namespace, "reason", refusal.Reason)
+					refused = append(refused, *refusal)
+					continue
+				}
+				if err != nil {
+					return ctrl.Result{}, err
+				}
+				requeueAfter = minRequeue(requeueAfter, versionsExpireAfter)
+				if err := harborRobotsInUse(ctx, r.Client, cmgr, ns.Name, winner, robots); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			conflicts = append(conflicts, res.conflictsOf(ref)...)
+			nsAdoptions, err := secretAdoptions(ctx, r.Client, cmgr, ns.Name, refused)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			adoptions = append(adoptions, nsAdoptions...)
+		}
+
+		if err := annotateTargets(ctx, r.Client, &res); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if cmgr == nil {
+		return ctrl.Result{}, nil
+	}
+
+	// robot accounts of deleted namespaces, lost conflicts and removed secrets left the scope of the manager
+	if err := pruneHarborRobots(ctx, r.Client, cmgr, cmgr.Spec.Secrets, robots); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := cmgr.Status.DeepCopy()
+	meta.SetStatusCondition(&status.Conditions, conflictCondition(cmgr.Generation, conflicts))
+	status.Failover = failover
+	status.Adoptions = adoptions
+	if !equality.Semantic.DeepEqual(status, &cmgr.Status) {
+		cmgr.Status = *status
+		if err := r.Status().Update(ctx, cmgr); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	recordFailover(r.Recorder, cmgr, switches)
+
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
+// Cluster managers are reconciled again whenever a namespace or a namespaced manager changes, as both can change the
+// secrets a cluster manager contributes to a namespace, whenever a PodTemplateTarget registers new targets and
+// whenever a Registry changes the entries of secrets.
 func (r *ClusterImagePullSecretManagerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&cheironv1alpha1.ClusterImagePullSecretManager{}).
-		Owns(&corev1.Secret{}).
+		Owns(&corev1.Secret{}, builder.WithPredicates(ownedSecretFilters())).
+		Watches(&source.Kind{Type: &cheironv1alpha1.ImagePullSecretManager{}},
+			handler.EnqueueRequestsFromMapFunc(r.allManagers)).
+		Watches(&source.Kind{Type: &cheironv1alpha1.PodTemplateTarget{}},
+			handler.EnqueueRequestsFromMapFunc(r.allManagers)).
+		Watches(&source.Kind{Type: &cheironv1alpha1.Registry{}},
+			handler.EnqueueRequestsFromMapFunc(r.allManagers)).
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(r.allManagers),
+			builder.WithPredicates(predicate.Funcs{
+				UpdateFunc: func(e event.UpdateEvent) bool { return false },
+			})).
 		Complete(r)
 }
+
+// allManagers maps any object to reconcile requests for all cluster managers
+func (r *ClusterImagePullSecretManagerReconciler) allManagers(_ client.Object) []reconcile.Request {
+	var managers cheironv1alpha1.ClusterImagePullSecretManagerList
+	if err := r.List(context.Background(), &managers); err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, m := range managers.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: m.Name},
+		})
+	}
+	return requests
+}
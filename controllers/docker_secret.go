@@ -1,13 +1,26 @@
 package controllers
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
 )
 
+// contentHashAnnotation records the hash of the dockerconfigjson cheiron wrote to a secret
+var contentHashAnnotation = "cheiron.anny.co/content-hash"
+
+// contentHash returns the hash of the dockerconfigjson of a secret
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
 // DockerConfigJSON represents a local docker auth config file
 // for pulling images.
 type DockerConfigJSON struct {
@@ -23,23 +36,35 @@ type DockerConfig map[string]DockerConfigEntry
 
 // DockerConfigEntry holds the user information that grant the access to docker registry
 type DockerConfigEntry struct {
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty" datapolicy:"password"`
-	Email    string `json:"email,omitempty"`
-	Auth     string `json:"auth,omitempty" datapolicy:"token"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty" datapolicy:"password"`
+	Email         string `json:"email,omitempty"`
+	Auth          string `json:"auth,omitempty" datapolicy:"token"`
+	IdentityToken string `json:"identitytoken,omitempty" datapolicy:"token"`
+	RegistryToken string `json:"registrytoken,omitempty" datapolicy:"token"`
 }
 
 // encodeDockerConfigFieldAuth returns base64 encoding of the username and password string
 // taken from https://github.com/kubernetes/kubernetes/blob/master/staging/src/k8s.io/kubectl/pkg/cmd/create/create_secret_docker.go
-func handleDockerCfgJSONContent(username, password, email, registry string) ([]byte, error) {
+// The same entry is written for each of the registries, token auth types write the password as token instead.
+func handleDockerCfgJSONContent(username, password, email string, registries []string, authType cheironv1alpha1.RegistryAuthType) ([]byte, error) {
 	dockerConfigAuth := DockerConfigEntry{
 		Username: username,
 		Password: password,
 		Email:    email,
 		Auth:     encodeDockerConfigFieldAuth(username, password),
 	}
+	switch authType {
+	case cheironv1alpha1.IdentityTokenAuthType:
+		dockerConfigAuth = DockerConfigEntry{Username: username, Email: email, IdentityToken: password}
+	case cheironv1alpha1.RegistryTokenAuthType:
+		dockerConfigAuth = DockerConfigEntry{Email: email, RegistryToken: password}
+	}
 	dockerConfigJSON := DockerConfigJSON{
-		Auths: map[string]DockerConfigEntry{registry: dockerConfigAuth},
+		Auths: map[string]DockerConfigEntry{},
+	}
+	for _, registry := range registries {
+		dockerConfigJSON.Auths[registry] = dockerConfigAuth
 	}
 	return json.Marshal(dockerConfigJSON)
 }
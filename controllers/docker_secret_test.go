@@ -0,0 +1,53 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+func TestHandleDockerCfgJSONContent(t *testing.T) {
+	tests := []struct {
+		authType cheironv1alpha1.RegistryAuthType
+		want     DockerConfigEntry
+	}{
+		{authType: "", want: DockerConfigEntry{Username: "robot", Password: "secret", Email: "robot@example.com", Auth: "cm9ib3Q6c2VjcmV0"}},
+		{authType: cheironv1alpha1.BasicAuthType, want: DockerConfigEntry{Username: "robot", Password: "secret", Email: "robot@example.com", Auth: "cm9ib3Q6c2VjcmV0"}},
+		{authType: cheironv1alpha1.IdentityTokenAuthType, want: DockerConfigEntry{Username: "robot", Email: "robot@example.com", IdentityToken: "secret"}},
+		{authType: cheironv1alpha1.RegistryTokenAuthType, want: DockerConfigEntry{Email: "robot@example.com", RegistryToken: "secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.authType), func(t *testing.T) {
+			content, err := handleDockerCfgJSONContent("robot", "secret", "robot@example.com", []string{"harbor.example.com", "harbor.internal"}, tt.authType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var config DockerConfigJSON
+			if err := json.Unmarshal(content, &config); err != nil {
+				t.Fatal(err)
+			}
+			want := DockerConfig{"harbor.example.com": tt.want, "harbor.internal": tt.want}
+			if !reflect.DeepEqual(config.Auths, want) {
+				t.Errorf("handleDockerCfgJSONContent() = %+v, want %+v", config.Auths, want)
+			}
+		})
+	}
+}
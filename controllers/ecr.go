@@ -0,0 +1,268 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// awsCredentials are the credentials requests to AWS are signed with
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// ecrProvider issues authorization tokens of Amazon ECR
+type ecrProvider struct {
+	Client    client.Client
+	Spec      *cheironv1alpha1.ECRProvider
+	Namespace string
+}
+
+// endpoint returns the ECR API endpoint of the region
+func (p *ecrProvider) endpoint() string {
+	if p.Spec.Endpoint != "" {
+		return p.Spec.Endpoint
+	}
+	return "https://api.ecr." + p.Spec.Region + ".amazonaws.com"
+}
+
+// credentials returns the AWS credentials either from the referenced secret or by assuming a role with the web
+// identity of the operator's pod
+func (p *ecrProvider) credentials(ctx context.Context) (awsCredentials, error) {
+	ref := p.Spec.CredentialsSecretRef
+	if ref == nil {
+		return assumeRoleWithWebIdentity(ctx, p.stsEndpoint(), p.Spec.RoleARN)
+	}
+
+	secret, err := providerSecret(ctx, p.Client, ref, p.Namespace)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	creds := awsCredentials{
+		AccessKeyID:     string(secret.Data["aws_access_key_id"]),
+		SecretAccessKey: string(secret.Data["aws_secret_access_key"]),
+		SessionToken:    string(secret.Data["aws_session_token"]),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("secret %s/%s lacks aws_access_key_id or aws_secret_access_key", secret.Namespace, secret.Name)
+	}
+	return creds, nil
+}
+
+// stsEndpoint returns the STS endpoint of the region
+func (p *ecrProvider) stsEndpoint() string {
+	if p.Spec.STSEndpoint != "" {
+		return p.Spec.STSEndpoint
+	}
+	return "https://sts." + p.Spec.Region + ".amazonaws.com"
+}
+
+// issue calls GetAuthorizationToken and decodes the token to the username and password of the registry
+func (p *ecrProvider) issue(ctx context.Context) (providedCredential, error) {
+	creds, err := p.credentials(ctx)
+	if err != nil {
+		return providedCredential{}, err
+	}
+
+	body := []byte("{}")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint(), bytes.NewReader(body))
+	if err != nil {
+		return providedCredential{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken")
+	issuedAt := time.Now()
+	signV4(req, body, creds, p.Spec.Region, "ecr", issuedAt)
+
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return providedCredential{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return providedCredential{}, fmt.Errorf("GetAuthorizationToken failed with status %s: %s", resp.Status, msg)
+	}
+	var out struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"`
+		} `json:"authorizationData"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return providedCredential{}, err
+	}
+	if len(out.AuthorizationData) == 0 {
+		return providedCredential{}, fmt.Errorf("GetAuthorizationToken returned no authorization data")
+	}
+
+	data := out.AuthorizationData[0]
+	token, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+	if err != nil {
+		return providedCredential{}, err
+	}
+	parts := strings.SplitN(string(token), ":", 2)
+	if len(parts) != 2 {
+		return providedCredential{}, fmt.Errorf("authorization token is not of the form user:password")
+	}
+	seconds, fraction := math.Modf(data.ExpiresAt)
+	return providedCredential{
+		Username:  parts[0],
+		Password:  parts[1],
+		IssuedAt:  issuedAt,
+		ExpiresAt: time.Unix(int64(seconds), int64(fraction*1e9)),
+	}, nil
+}
+
+// assumeRoleWithWebIdentity exchanges the web identity token of the operator's pod, as projected for IAM roles for
+// service accounts, for temporary AWS credentials
+func assumeRoleWithWebIdentity(ctx context.Context, endpoint, roleARN string) (awsCredentials, error) {
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN == "" || tokenFile == "" {
+		return awsCredentials{}, fmt.Errorf("no credentials secret referenced and no web identity available")
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	return assumeRole(ctx, endpoint, roleARN, strings.TrimSpace(string(token)))
+}
+
+// assumeRole calls AssumeRoleWithWebIdentity of STS with the given token, which does not need to be signed
+func assumeRole(ctx context.Context, endpoint, roleARN, token string) (awsCredentials, error) {
+	query := url.Values{}
+	query.Set("Action", "AssumeRoleWithWebIdentity")
+	query.Set("Version", "2011-06-15")
+	query.Set("RoleArn", roleARN)
+	query.Set("RoleSessionName", "cheiron")
+	query.Set("WebIdentityToken", token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(query.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return awsCredentials{}, fmt.Errorf("AssumeRoleWithWebIdentity failed with status %s: %s", resp.Status, msg)
+	}
+	var out struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string `xml:"SecretAccessKey"`
+			SessionToken    string `xml:"SessionToken"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return awsCredentials{}, err
+	}
+	return awsCredentials{
+		AccessKeyID:     out.Credentials.AccessKeyID,
+		SecretAccessKey: out.Credentials.SecretAccessKey,
+		SessionToken:    out.Credentials.SessionToken,
+	}, nil
+}
+
+// signV4 signs a request with AWS Signature Version 4, see
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signV4(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with the given key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+func TestECRProvider(t *testing.T) {
+	expiresAt := time.Now().Add(12 * time.Hour).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken" {
+			http.Error(w, "unknown target", http.StatusBadRequest)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/ecr/aws4_request") ||
+			r.Header.Get("X-Amz-Security-Token") != "session" {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"authorizationData": []map[string]interface{}{{
+			"authorizationToken": base64.StdEncoding.EncodeToString([]byte("AWS:ecr-password")),
+			"expiresAt":          float64(expiresAt.Unix()),
+		}}})
+	}))
+	defer server.Close()
+
+	c := fakeClient(
+		credentialsSecret("aws", map[string]string{
+			"aws_access_key_id":     "AKID",
+			"aws_secret_access_key": "secret",
+			"aws_session_token":     "session",
+		}),
+		credentialsSecret("incomplete", map[string]string{"aws_access_key_id": "AKID"}),
+	)
+	tests := []struct {
+		name  string
+		ref   string
+		fails bool
+	}{
+		{name: "credentials secret", ref: "aws"},
+		{name: "missing credentials secret", ref: "missing", fails: true},
+		{name: "credentials secret without secret key", ref: "incomplete", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ecrProvider{Client: c, Spec: &cheironv1alpha1.ECRProvider{Region: "eu-west-1", CredentialsSecretRef: secretRef(tt.ref), Endpoint: server.URL}}
+			cred, err := p.issue(context.Background())
+			if tt.fails {
+				if err == nil {
+					t.Errorf("issue() = %+v, want error", cred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cred.Username != "AWS" || cred.Password != "ecr-password" || !cred.ExpiresAt.Equal(expiresAt) {
+				t.Errorf("issue() = %+v", cred)
+			}
+		})
+	}
+}
+
+func TestECREndpoints(t *testing.T) {
+	p := &ecrProvider{Spec: &cheironv1alpha1.ECRProvider{Region: "eu-west-1"}}
+	if got := p.endpoint(); got != "https://api.ecr.eu-west-1.amazonaws.com" {
+		t.Errorf("endpoint() = %s", got)
+	}
+	if got := p.stsEndpoint(); got != "https://sts.eu-west-1.amazonaws.com" {
+		t.Errorf("stsEndpoint() = %s", got)
+	}
+	p.Spec.Endpoint, p.Spec.STSEndpoint = "http://ecr", "http://sts"
+	if p.endpoint() != "http://ecr" || p.stsEndpoint() != "http://sts" {
+		t.Errorf("endpoints = %s, %s, want the overrides", p.endpoint(), p.stsEndpoint())
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("Action") != "AssumeRoleWithWebIdentity" ||
+			r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/cheiron" || r.Form.Get("WebIdentityToken") != "web-identity" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>AKID</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session</SessionToken>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`)
+	}))
+	defer server.Close()
+
+	creds, err := assumeRole(context.Background(), server.URL, "arn:aws:iam::123456789012:role/cheiron", "web-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds != (awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "session"}) {
+		t.Errorf("assumeRole() = %+v", creds)
+	}
+	if _, err := assumeRole(context.Background(), server.URL, "arn:aws:iam::123456789012:role/other", "web-identity"); err == nil {
+		t.Errorf("assumeRole() succeeded for rejected request")
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla of the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %s, want %s", got, want)
+	}
+	if req.Header.Get("X-Amz-Date") != "20150830T123600Z" || req.Header.Get("X-Amz-Security-Token") != "" {
+		t.Errorf("headers = %v", req.Header)
+	}
+}
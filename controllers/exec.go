@@ -0,0 +1,227 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+const (
+	// execTimeout is the time a plugin may run
+	execTimeout = 30 * time.Second
+	// defaultExecRefreshInterval is the time after which plugins are run again if neither the plugin nor the provider
+	// specify it
+	defaultExecRefreshInterval = 5 * time.Minute
+	// defaultCredentialProviderAPIVersion is the apiVersion of requests to kubelet credential provider plugins
+	defaultCredentialProviderAPIVersion = "credentialprovider.kubelet.k8s.io/v1"
+	// dockerCredentialHelperPrefix is the prefix of the binaries of docker credential helpers
+	dockerCredentialHelperPrefix = "docker-credential-"
+	// dockerIdentityTokenUsername is returned by docker credential helpers for identity tokens instead of passwords
+	dockerIdentityTokenUsername = "<token>"
+)
+
+// execProvider runs a plugin binary to obtain credentials
+type execProvider struct {
+	Spec      *cheironv1alpha1.ExecProvider
+	PluginDir string
+	// PluginEnv are the names of the environment variables of cheiron passed to the plugin
+	PluginEnv []string
+	// Registry is the normalized host of the registry
+	Registry string
+}
+
+// command returns the command running the plugin. Only binaries in the plugin directory are run, s.t. managers can not
+// run arbitrary binaries in cheiron's pod. The plugin only receives the environment variables of cheiron allowed by
+// the operator, as the environment may hold cheiron's own credentials.
+func (p *execProvider) command(ctx context.Context) (*exec.Cmd, error) {
+	if p.PluginDir == "" {
+		return nil, fmt.Errorf("exec plugins are disabled, see --credential-plugin-dir")
+	}
+	name := p.Spec.Plugin
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid plugin name %q", name)
+	}
+	args := p.Spec.Args
+	if p.Spec.Protocol == cheironv1alpha1.DockerCredentialHelperProtocol {
+		name = dockerCredentialHelperPrefix + name
+		args = []string{"get"}
+	}
+
+	cmd := exec.CommandContext(ctx, filepath.Join(p.PluginDir, name), args...)
+	cmd.Env = []string{}
+	for _, name := range p.PluginEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+	}
+	for _, e := range p.Spec.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	return cmd, nil
+}
+
+// run runs the plugin with the given input and returns its output
+func (p *execProvider) run(ctx context.Context, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, execTimeout)
+	defer cancel()
+	cmd, err := p.command(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("plugin %s failed: %w: %s", p.Spec.Plugin, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// refreshInterval returns the time after which the plugin is run again if it does not return a cache duration
+func (p *execProvider) refreshInterval() time.Duration {
+	if p.Spec.RefreshInterval != nil && p.Spec.RefreshInterval.Duration > 0 {
+		return p.Spec.RefreshInterval.Duration
+	}
+	return defaultExecRefreshInterval
+}
+
+// issue runs the plugin with the protocol of the spec
+func (p *execProvider) issue(ctx context.Context) (providedCredential, error) {
+	if p.Spec.Protocol == cheironv1alpha1.DockerCredentialHelperProtocol {
+		return p.issueDockerCredential(ctx)
+	}
+	return p.issueCredentialProvider(ctx)
+}
+
+// issueCredentialProvider requests credentials for the image from a kubelet credential provider plugin, see
+// https://kubernetes.io/docs/tasks/kubelet-credential-provider/kubelet-credential-provider/. The credentials are
+// cached for half of the returned cache duration, like those of all providers.
+func (p *execProvider) issueCredentialProvider(ctx context.Context) (providedCredential, error) {
+	apiVersion := p.Spec.APIVersion
+	if apiVersion == "" {
+		apiVersion = defaultCredentialProviderAPIVersion
+	}
+	image := p.Spec.Image
+	if image == "" {
+		image = p.Registry
+	}
+	request, err := json.Marshal(map[string]string{
+		"kind":       "CredentialProviderRequest",
+		"apiVersion": apiVersion,
+		"image":      image,
+	})
+	if err != nil {
+		return providedCredential{}, err
+	}
+
+	issuedAt := time.Now()
+	output, err := p.run(ctx, request)
+	if err != nil {
+		return providedCredential{}, err
+	}
+	var response struct {
+		Kind          string           `json:"kind"`
+		APIVersion    string           `json:"apiVersion"`
+		CacheDuration *metav1.Duration `json:"cacheDuration"`
+		Auth          map[string]struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auth"`
+	}
+	if err := json.Unmarshal(output, &response); err != nil {
+		return providedCredential{}, fmt.Errorf("plugin %s returned an invalid response: %w", p.Spec.Plugin, err)
+	}
+	if response.Kind != "CredentialProviderResponse" || response.APIVersion != apiVersion {
+		return providedCredential{}, fmt.Errorf("plugin %s returned %s %s instead of CredentialProviderResponse %s", p.Spec.Plugin, response.APIVersion, response.Kind, apiVersion)
+	}
+
+	found := false
+	credential := providedCredential{IssuedAt: issuedAt}
+	for pattern, auth := range response.Auth {
+		if matchesRegistry(pattern, p.Registry) || len(response.Auth) == 1 {
+			credential.Username, credential.Password = auth.Username, auth.Password
+			found = true
+			break
+		}
+	}
+	if !found {
+		return providedCredential{}, fmt.Errorf("plugin %s returned no credentials for %s", p.Spec.Plugin, p.Registry)
+	}
+	lifetime := 2 * p.refreshInterval()
+	if response.CacheDuration != nil && response.CacheDuration.Duration > 0 {
+		lifetime = response.CacheDuration.Duration
+	}
+	credential.ExpiresAt = issuedAt.Add(lifetime)
+	return credential, nil
+}
+
+// issueDockerCredential requests credentials for the registry from a docker credential helper, see
+// https://github.com/docker/docker-credential-helpers. The helpers return no lifetime, hence they are run again after
+// the refresh interval.
+func (p *execProvider) issueDockerCredential(ctx context.Context) (providedCredential, error) {
+	issuedAt := time.Now()
+	output, err := p.run(ctx, []byte(p.Registry+"\n"))
+	if err != nil {
+		return providedCredential{}, err
+	}
+	var response struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(output, &response); err != nil {
+		return providedCredential{}, fmt.Errorf("plugin %s returned an invalid response: %w", p.Spec.Plugin, err)
+	}
+	if response.Username == dockerIdentityTokenUsername {
+		return providedCredential{}, fmt.Errorf("plugin %s returned an identity token, which is not supported", p.Spec.Plugin)
+	}
+	return providedCredential{
+		Username:  response.Username,
+		Password:  response.Secret,
+		IssuedAt:  issuedAt,
+		ExpiresAt: issuedAt.Add(2 * p.refreshInterval()),
+	}, nil
+}
+
+// matchesRegistry reports whether a registry host matches a pattern of a CredentialProviderResponse. Like the
+// kubelet, patterns may contain globs per domain segment, e.g. *.dkr.ecr.*.amazonaws.com, and paths are ignored.
+func matchesRegistry(pattern, registry string) bool {
+	host := normalizeRegistry(pattern)
+	patternSegments, registrySegments := strings.Split(host, "."), strings.Split(registry, ".")
+	if len(patternSegments) != len(registrySegments) {
+		return false
+	}
+	for i := range patternSegments {
+		if ok, err := path.Match(patternSegments[i], registrySegments[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
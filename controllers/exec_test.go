@@ -0,0 +1,198 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// pluginDir returns a directory holding the given shell scripts as plugins
+func pluginDir(t *testing.T, plugins map[string]string) string {
+	dir := t.TempDir()
+	for name, script := range plugins {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestMatchesRegistry(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		registry string
+		want     bool
+	}{
+		{pattern: "quay.io", registry: "quay.io", want: true},
+		{pattern: "https://quay.io/v2/", registry: "quay.io", want: true},
+		{pattern: "*.dkr.ecr.*.amazonaws.com", registry: "123456789012.dkr.ecr.eu-central-1.amazonaws.com", want: true},
+		{pattern: "*.example.com", registry: "example.com"},
+		{pattern: "*.example.com", registry: "registry.eu.example.com"},
+		{pattern: "registry.example.com", registry: "registry.example.org"},
+	}
+	for _, tt := range tests {
+		if got := matchesRegistry(tt.pattern, tt.registry); got != tt.want {
+			t.Errorf("matchesRegistry(%s, %s) = %v, want %v", tt.pattern, tt.registry, got, tt.want)
+		}
+	}
+}
+
+func TestProviderForRestrictsExecPlugins(t *testing.T) {
+	deps := providerDeps{NamespacedPlugins: []string{"kubelet"}, NamespacedPluginEnv: []string{"REGION"}}
+	tests := []struct {
+		name    string
+		spec    cheironv1alpha1.ExecProvider
+		allowed bool
+	}{
+		{name: "allowed plugin", spec: cheironv1alpha1.ExecProvider{Plugin: "kubelet"}, allowed: true},
+		{name: "allowed plugin with allowed variable", spec: cheironv1alpha1.ExecProvider{Plugin: "kubelet", Env: []cheironv1alpha1.ExecEnvVar{{Name: "REGION", Value: "eu"}}}, allowed: true},
+		{name: "allowed plugin with other variable", spec: cheironv1alpha1.ExecProvider{Plugin: "kubelet", Env: []cheironv1alpha1.ExecEnvVar{{Name: "REGION", Value: "eu"}, {Name: "LD_PRELOAD", Value: "/tmp/hook.so"}}}},
+		{name: "allowed plugin with args", spec: cheironv1alpha1.ExecProvider{Plugin: "kubelet", Args: []string{"--verbose"}}},
+		{name: "other plugin", spec: cheironv1alpha1.ExecProvider{Plugin: "pass"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &cheironv1alpha1.ImagePullSecretSpec{Name: "registry", Registry: "registry.example.com", Provider: &cheironv1alpha1.CredentialProvider{Exec: &tt.spec}}
+			if _, err := providerFor(fakeClient(), providerDeps{}, secret, ""); err != nil {
+				t.Fatalf("providerFor() of cluster manager failed: %v", err)
+			}
+			_, err := providerFor(fakeClient(), deps, secret, "shop")
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("providerFor() of namespaced manager error = %v, allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestExecCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		pluginDir string
+		spec      cheironv1alpha1.ExecProvider
+		want      string
+		wantArgs  []string
+		fails     bool
+	}{
+		{name: "kubelet plugin", pluginDir: "/plugins", spec: cheironv1alpha1.ExecProvider{Plugin: "ecr", Args: []string{"--region", "eu"}}, want: "/plugins/ecr", wantArgs: []string{"--region", "eu"}},
+		{name: "docker credential helper", pluginDir: "/plugins", spec: cheironv1alpha1.ExecProvider{Plugin: "pass", Protocol: cheironv1alpha1.DockerCredentialHelperProtocol, Args: []string{"erase"}}, want: "/plugins/docker-credential-pass", wantArgs: []string{"get"}},
+		{name: "plugins disabled", spec: cheironv1alpha1.ExecProvider{Plugin: "ecr"}, fails: true},
+		{name: "path in plugin name", pluginDir: "/plugins", spec: cheironv1alpha1.ExecProvider{Plugin: "../bin/sh"}, fails: true},
+		{name: "hidden plugin", pluginDir: "/plugins", spec: cheironv1alpha1.ExecProvider{Plugin: ".."}, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &execProvider{Spec: &tt.spec, PluginDir: tt.pluginDir}
+			cmd, err := p.command(context.Background())
+			if tt.fails {
+				if err == nil {
+					t.Errorf("command() = %v, want error", cmd)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd.Path != tt.want || len(cmd.Args) != len(tt.wantArgs)+1 {
+				t.Fatalf("command() = %s %v, want %s %v", cmd.Path, cmd.Args, tt.want, tt.wantArgs)
+			}
+			for i, arg := range tt.wantArgs {
+				if cmd.Args[i+1] != arg {
+					t.Errorf("command() args = %v, want %v", cmd.Args[1:], tt.wantArgs)
+				}
+			}
+		})
+	}
+}
+
+func TestExecProvider(t *testing.T) {
+	os.Setenv("CHEIRON_TEST_SECRET", "operator-secret")
+	defer os.Unsetenv("CHEIRON_TEST_SECRET")
+	dir := pluginDir(t, map[string]string{
+		"kubelet": `read request
+echo '{"kind":"CredentialProviderResponse","apiVersion":"credentialprovider.kubelet.k8s.io/v1","cacheDuration":"1h",` +
+			`"auth":{"*.example.com":{"username":"'"$REGION"'","password":"'"$1$CHEIRON_TEST_SECRET"'"},"quay.io":{"username":"quay","password":"quay"}}}'`,
+		"nocache":  `echo '{"kind":"CredentialProviderResponse","apiVersion":"credentialprovider.kubelet.k8s.io/v1","auth":{"other.com":{"username":"robot","password":"secret"}}}'`,
+		"v1alpha1": `echo '{"kind":"CredentialProviderResponse","apiVersion":"credentialprovider.kubelet.k8s.io/v1alpha1","auth":{}}'`,
+		"failing":  `echo "no credentials" >&2; exit 1`,
+		"docker-credential-pass": `read registry
+echo '{"ServerURL":"'"$registry"'","Username":"'"$registry"'","Secret":"secret"}'`,
+		"docker-credential-identity": `echo '{"Username":"<token>","Secret":"refresh-token"}'`,
+	})
+
+	tests := []struct {
+		name         string
+		spec         cheironv1alpha1.ExecProvider
+		wantUsername string
+		wantPassword string
+		wantLifetime time.Duration
+		fails        bool
+	}{
+		{
+			name:         "kubelet plugin",
+			spec:         cheironv1alpha1.ExecProvider{Plugin: "kubelet", Args: []string{"arg-"}, Env: []cheironv1alpha1.ExecEnvVar{{Name: "REGION", Value: "eu"}}},
+			wantUsername: "eu",
+			wantPassword: "arg-",
+			wantLifetime: time.Hour,
+		},
+		{
+			name:         "kubelet plugin with single credential and without cache duration",
+			spec:         cheironv1alpha1.ExecProvider{Plugin: "nocache", RefreshInterval: &metav1.Duration{Duration: time.Minute}},
+			wantUsername: "robot",
+			wantPassword: "secret",
+			wantLifetime: 2 * time.Minute,
+		},
+		{name: "kubelet plugin of other version", spec: cheironv1alpha1.ExecProvider{Plugin: "v1alpha1"}, fails: true},
+		{name: "failing plugin", spec: cheironv1alpha1.ExecProvider{Plugin: "failing"}, fails: true},
+		{name: "missing plugin", spec: cheironv1alpha1.ExecProvider{Plugin: "missing"}, fails: true},
+		{
+			name:         "docker credential helper",
+			spec:         cheironv1alpha1.ExecProvider{Plugin: "pass", Protocol: cheironv1alpha1.DockerCredentialHelperProtocol},
+			wantUsername: "registry.example.com",
+			wantPassword: "secret",
+			wantLifetime: 2 * defaultExecRefreshInterval,
+		},
+		{name: "docker credential helper returning identity token", spec: cheironv1alpha1.ExecProvider{Plugin: "identity", Protocol: cheironv1alpha1.DockerCredentialHelperProtocol}, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &execProvider{Spec: &tt.spec, PluginDir: dir, PluginEnv: []string{"PATH"}, Registry: "registry.example.com"}
+			cred, err := p.issue(context.Background())
+			if tt.fails {
+				if err == nil {
+					t.Errorf("issue() = %+v, want error", cred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the password of the kubelet plugin would include the variables of cheiron not passed to plugins
+			if cred.Username != tt.wantUsername || cred.Password != tt.wantPassword || cred.ExpiresAt.Sub(cred.IssuedAt) != tt.wantLifetime {
+				t.Errorf("issue() = %+v, want %s:%s valid for %v", cred, tt.wantUsername, tt.wantPassword, tt.wantLifetime)
+			}
+		})
+	}
+}
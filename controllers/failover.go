@@ -0,0 +1,245 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+const (
+	// failoverGracePeriod is the time pods get to retry their pulls with a new credential before failing pulls are
+	// held against it, which covers the maximum back-off of the kubelet
+	failoverGracePeriod = 5 * time.Minute
+	// failoverRetryPeriod is the time a credential left because of failing pulls is not switched back to, as its
+	// validation succeeds regardless
+	failoverRetryPeriod = 30 * time.Minute
+)
+
+// authFailureMessages are substrings of kubelet messages about pulls failing to authenticate
+var authFailureMessages = []string{
+	"unauthorized",
+	"authentication required",
+	"no basic auth credentials",
+	"401",
+}
+
+// failoverSwitch records a switch between the credentials of a secret
+type failoverSwitch struct {
+	Secret string
+	From   int32
+	To     int32
+	Reason string
+}
+
+// credentialAt returns the spec of a secret using the credential with the given index, 0 is the primary credential
+// and i the i-th fallback
+func credentialAt(secret *cheironv1alpha1.ImagePullSecretSpec, index int) *cheironv1alpha1.ImagePullSecretSpec {
+	spec := &cheironv1alpha1.ImagePullSecretSpec{
+		Name:        secret.Name,
+		Registry:    secret.Registry,
+		RegistryRef: secret.RegistryRef,
+		Username:    secret.Username,
+		Password:    secret.Password,
+		Email:       secret.Email,
+	}
+	if index > 0 && index <= len(secret.Fallbacks) {
+		fallback := secret.Fallbacks[index-1]
+		spec.Username, spec.Password = fallback.Username, fallback.Password
+		if fallback.Email != "" {
+			spec.Email = fallback.Email
+		}
+	}
+	return spec
+}
+
+// hasFallbacks reports whether cheiron fails over between credentials of the secret
+func hasFallbacks(secret *cheironv1alpha1.ImagePullSecretSpec) bool {
+	return secret.ExistingSecretRef.Name == "" && secret.Pool == nil && secret.Provider == nil && len(secret.Fallbacks) > 0
+}
+
+// activeCredential returns the index of the credential of a secret in use according to the failover status
+func activeCredential(secret *cheironv1alpha1.ImagePullSecretSpec, failover []cheironv1alpha1.Failover) int {
+	for _, f := range failover {
+		if f.Secret == secret.Name && int(f.Active) <= len(secret.Fallbacks) {
+			return int(f.Active)
+		}
+	}
+	return 0
+}
+
+// credentialProbedHealthy reports whether the latest probe of a credential neither found it rejected nor exhausted.
+// Credentials that were not probed yet are considered healthy.
+func credentialProbedHealthy(secret string, index int, rateLimits []cheironv1alpha1.RateLimit) bool {
+	for _, l := range rateLimits {
+		if l.Secret == secret && l.Member != nil && int(*l.Member) == index {
+			return !l.Invalid && (l.Remaining == nil || *l.Remaining > 0)
+		}
+	}
+	return true
+}
+
+// hasAuthPullFailures reports whether pulls from the registry currently fail to authenticate with the given secret.
+// Only failures of pods referencing the secret count, as other pods don't use its active credential.
+func hasAuthPullFailures(registry, secret string, failures []cheironv1alpha1.PullFailure) bool {
+	for _, f := range failures {
+		if f.Registry != registry || !containsString(f.Secrets, secret) {
+			continue
+		}
+		msg := strings.ToLower(f.Message)
+		for _, m := range authFailureMessages {
+			if strings.Contains(msg, m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveFailover decides which credential each secret with fallbacks uses. The credential in use is left when its
+// probe fails or pulls with it fail to authenticate, the next healthy credential in order is used instead. Once a
+// preferred credential is healthy again, cheiron switches back to it. Besides the new failover status, the switches
+// and the time after which the decision has to be revisited are returned.
+func resolveFailover(secrets []cheironv1alpha1.ImagePullSecretSpec, status []cheironv1alpha1.Failover, rateLimits []cheironv1alpha1.RateLimit, pullFailures []cheironv1alpha1.PullFailure, now time.Time) ([]cheironv1alpha1.Failover, []failoverSwitch, time.Duration) {
+	var next []cheironv1alpha1.Failover
+	var switches []failoverSwitch
+	var requeueAfter time.Duration
+	requeue := func(d time.Duration) {
+		if d > 0 && (requeueAfter == 0 || d < requeueAfter) {
+			requeueAfter = d
+		}
+	}
+
+	for i := range secrets {
+		secret := &secrets[i]
+		if !hasFallbacks(secret) {
+			continue
+		}
+		current := cheironv1alpha1.Failover{Secret: secret.Name}
+		for _, f := range status {
+			if f.Secret == secret.Name && int(f.Active) <= len(secret.Fallbacks) {
+				current = f
+			}
+		}
+		active := int(current.Active)
+		sinceSwitch := time.Duration(1<<63 - 1)
+		if current.LastSwitchTime != nil {
+			sinceSwitch = now.Sub(current.LastSwitchTime.Time)
+		}
+		count := len(secret.Fallbacks) + 1
+		healthy := func(index int) bool {
+			return credentialProbedHealthy(secret.Name, index, rateLimits)
+		}
+
+		target, reason := active, ""
+		pullsFailing := hasAuthPullFailures(normalizeRegistry(secret.Registry), secret.Name, pullFailures)
+		switch {
+		case !healthy(active):
+			reason = cheironv1alpha1.ReasonValidationFailed
+		case pullsFailing && sinceSwitch >= failoverGracePeriod:
+			reason = cheironv1alpha1.ReasonPullFailures
+		case pullsFailing:
+			requeue(failoverGracePeriod - sinceSwitch)
+		}
+
+		if reason != "" {
+			// fail over to the next healthy credential after the one in use
+			for offset := 1; offset < count; offset++ {
+				if candidate := (active + offset) % count; healthy(candidate) {
+					target = candidate
+					break
+				}
+			}
+		} else if active > 0 {
+			// switch back to the most preferred healthy credential, but not right after leaving it for failing pulls
+			for candidate := 0; candidate < active; candidate++ {
+				if !healthy(candidate) {
+					continue
+				}
+				if current.Reason == cheironv1alpha1.ReasonPullFailures && sinceSwitch < failoverRetryPeriod {
+					requeue(failoverRetryPeriod - sinceSwitch)
+					break
+				}
+				target, reason = candidate, cheironv1alpha1.ReasonRecovered
+				break
+			}
+		}
+
+		if target != active {
+			switches = append(switches, failoverSwitch{Secret: secret.Name, From: int32(active), To: int32(target), Reason: reason})
+			switchTime := metav1.NewTime(now)
+			current = cheironv1alpha1.Failover{
+				Secret:         secret.Name,
+				Active:         int32(target),
+				LastSwitchTime: &switchTime,
+				Reason:         reason,
+				Message:        fmt.Sprintf("Switched from %s to %s", credentialName(active), credentialName(target)),
+			}
+		}
+		next = append(next, current)
+	}
+	return next, switches, requeueAfter
+}
+
+// minRequeue returns the shorter of two requeue durations, where zero means no requeue
+func minRequeue(a, b time.Duration) time.Duration {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// credentialName returns a human readable name of the credential with the given index
+func credentialName(index int) string {
+	if index == 0 {
+		return "primary credential"
+	}
+	return fmt.Sprintf("fallback credential %d", index)
+}
+
+// recordFailover emits an event on the manager for each switch between credentials
+func recordFailover(recorder record.EventRecorder, manager runtime.Object, switches []failoverSwitch) {
+	if recorder == nil {
+		return
+	}
+	for _, s := range switches {
+		eventType := corev1.EventTypeWarning
+		if s.Reason == cheironv1alpha1.ReasonRecovered {
+			eventType = corev1.EventTypeNormal
+		}
+		recorder.Eventf(manager, eventType, s.Reason, "Secret %s switched from %s to %s",
+			s.Secret, credentialName(int(s.From)), credentialName(int(s.To)))
+	}
+}
+
+// withFailover replaces the failover status of the given manager's winners, s.t. the secrets are rendered with the
+// credentials just decided on instead of those in the cached status
+func (r *resolution) withFailover(m managerRef, failover []cheironv1alpha1.Failover) {
+	for i, w := range r.Winners {
+		if w.Manager.Cluster == m.Cluster && w.Manager.Namespace == m.Namespace && w.Manager.Name == m.Name {
+			r.Winners[i].Failover = failover
+		}
+	}
+}
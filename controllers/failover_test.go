@@ -0,0 +1,299 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// failoverSecret returns a Docker Hub secret with the given number of fallback credentials
+func failoverSecret(fallbacks int) cheironv1alpha1.ImagePullSecretSpec {
+	secret := basicSecret("hub", "docker.io")
+	for i := 1; i <= fallbacks; i++ {
+		secret.Fallbacks = append(secret.Fallbacks, cheironv1alpha1.Credential{Username: fmt.Sprintf("fallback%d", i), Password: "secret"})
+	}
+	return secret
+}
+
+// credentialLimit returns the probe result of a credential of the secret hub
+func credentialLimit(index int32, invalid bool) cheironv1alpha1.RateLimit {
+	return cheironv1alpha1.RateLimit{Secret: "hub", Member: &index, Invalid: invalid}
+}
+
+// authFailure returns a failing pull from Docker Hub with the secret hub
+func authFailure() cheironv1alpha1.PullFailure {
+	return cheironv1alpha1.PullFailure{
+		Namespace: "shop", Pod: "web", Registry: "docker.io", Reason: "ErrImagePull",
+		Message: "pull access denied: 401 Unauthorized", Secrets: []string{"hub"},
+	}
+}
+
+func TestCredentialAt(t *testing.T) {
+	secret := failoverSecret(2)
+	secret.Fallbacks[1].Email = "fallback@example.com"
+
+	tests := []struct {
+		index    int
+		username string
+		email    string
+	}{
+		{index: 0, username: "user", email: "user@example.com"},
+		{index: 1, username: "fallback1", email: "user@example.com"},
+		{index: 2, username: "fallback2", email: "fallback@example.com"},
+		{index: 3, username: "user", email: "user@example.com"},
+	}
+	for _, tt := range tests {
+		spec := credentialAt(&secret, tt.index)
+		if spec.Name != "hub" || spec.Registry != "docker.io" || spec.Username != tt.username || spec.Email != tt.email {
+			t.Errorf("credentialAt(%d) = %+v, want username %s and email %s", tt.index, spec, tt.username, tt.email)
+		}
+	}
+}
+
+func TestHasFallbacks(t *testing.T) {
+	pool := failoverSecret(1)
+	pool.Pool = &cheironv1alpha1.CredentialPool{}
+	existing := failoverSecret(1)
+	existing.ExistingSecretRef.Name = "hub-credentials"
+
+	tests := map[string]struct {
+		secret cheironv1alpha1.ImagePullSecretSpec
+		want   bool
+	}{
+		"fallbacks":       {secret: failoverSecret(1), want: true},
+		"no fallbacks":    {secret: failoverSecret(0)},
+		"pool":            {secret: pool},
+		"existing secret": {secret: existing},
+		"provider":        {secret: cheironv1alpha1.ImagePullSecretSpec{Fallbacks: failoverSecret(1).Fallbacks, Provider: &cheironv1alpha1.CredentialProvider{}}},
+	}
+	for name, tt := range tests {
+		if got := hasFallbacks(&tt.secret); got != tt.want {
+			t.Errorf("%s: hasFallbacks() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestActiveCredential(t *testing.T) {
+	secret := failoverSecret(2)
+	tests := map[string]struct {
+		failover []cheironv1alpha1.Failover
+		want     int
+	}{
+		"no status":      {want: 0},
+		"fallback":       {failover: []cheironv1alpha1.Failover{{Secret: "hub", Active: 2}}, want: 2},
+		"other secret":   {failover: []cheironv1alpha1.Failover{{Secret: "quay", Active: 1}}, want: 0},
+		"removed backup": {failover: []cheironv1alpha1.Failover{{Secret: "hub", Active: 3}}, want: 0},
+	}
+	for name, tt := range tests {
+		if got := activeCredential(&secret, tt.failover); got != tt.want {
+			t.Errorf("%s: activeCredential() = %d, want %d", name, got, tt.want)
+		}
+	}
+}
+
+func TestHasAuthPullFailures(t *testing.T) {
+	otherSecret := authFailure()
+	otherSecret.Secrets = []string{"quay"}
+	notFound := authFailure()
+	notFound.Message = "manifest unknown"
+
+	tests := map[string]struct {
+		failure cheironv1alpha1.PullFailure
+		want    bool
+	}{
+		"unauthorized":   {failure: authFailure(), want: true},
+		"other secret":   {failure: otherSecret},
+		"image missing":  {failure: notFound},
+		"other registry": {failure: cheironv1alpha1.PullFailure{Registry: "quay.io", Message: "unauthorized", Secrets: []string{"hub"}}},
+	}
+	for name, tt := range tests {
+		if got := hasAuthPullFailures("docker.io", "hub", []cheironv1alpha1.PullFailure{tt.failure}); got != tt.want {
+			t.Errorf("%s: hasAuthPullFailures() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveFailover(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ago time.Duration) *metav1.Time {
+		t := metav1.NewTime(now.Add(-ago))
+		return &t
+	}
+
+	tests := map[string]struct {
+		status       []cheironv1alpha1.Failover
+		rateLimits   []cheironv1alpha1.RateLimit
+		pullFailures []cheironv1alpha1.PullFailure
+		active       int32
+		reason       string
+		requeue      time.Duration
+	}{
+		"healthy primary is kept": {
+			active: 0,
+		},
+		"rejected primary fails over": {
+			rateLimits: []cheironv1alpha1.RateLimit{credentialLimit(0, true)},
+			active:     1,
+			reason:     cheironv1alpha1.ReasonValidationFailed,
+		},
+		"rejected fallbacks are skipped": {
+			rateLimits: []cheironv1alpha1.RateLimit{credentialLimit(0, true), credentialLimit(1, true)},
+			active:     2,
+			reason:     cheironv1alpha1.ReasonValidationFailed,
+		},
+		"all rejected keeps credential": {
+			rateLimits: []cheironv1alpha1.RateLimit{credentialLimit(0, true), credentialLimit(1, true), credentialLimit(2, true)},
+			active:     0,
+		},
+		"failing pulls fail over": {
+			pullFailures: []cheironv1alpha1.PullFailure{authFailure()},
+			active:       1,
+			reason:       cheironv1alpha1.ReasonPullFailures,
+		},
+		"failing pulls within grace period wait": {
+			status:       []cheironv1alpha1.Failover{{Secret: "hub", Active: 1, LastSwitchTime: at(time.Minute), Reason: cheironv1alpha1.ReasonValidationFailed}},
+			rateLimits:   []cheironv1alpha1.RateLimit{credentialLimit(0, true)},
+			pullFailures: []cheironv1alpha1.PullFailure{authFailure()},
+			active:       1,
+			reason:       cheironv1alpha1.ReasonValidationFailed,
+			requeue:      failoverGracePeriod - time.Minute,
+		},
+		"failing pulls on last credential wrap around": {
+			status:       []cheironv1alpha1.Failover{{Secret: "hub", Active: 2, LastSwitchTime: at(time.Hour), Reason: cheironv1alpha1.ReasonPullFailures}},
+			rateLimits:   []cheironv1alpha1.RateLimit{credentialLimit(0, true)},
+			pullFailures: []cheironv1alpha1.PullFailure{authFailure()},
+			active:       1,
+			reason:       cheironv1alpha1.ReasonPullFailures,
+		},
+		"recovered primary is switched back to": {
+			status: []cheironv1alpha1.Failover{{Secret: "hub", Active: 2, LastSwitchTime: at(time.Minute), Reason: cheironv1alpha1.ReasonValidationFailed}},
+			active: 0,
+			reason: cheironv1alpha1.ReasonRecovered,
+		},
+		"credential left for failing pulls is not retried early": {
+			status:  []cheironv1alpha1.Failover{{Secret: "hub", Active: 1, LastSwitchTime: at(10 * time.Minute), Reason: cheironv1alpha1.ReasonPullFailures}},
+			active:  1,
+			reason:  cheironv1alpha1.ReasonPullFailures,
+			requeue: failoverRetryPeriod - 10*time.Minute,
+		},
+		"credential left for failing pulls is retried later": {
+			status: []cheironv1alpha1.Failover{{Secret: "hub", Active: 1, LastSwitchTime: at(time.Hour), Reason: cheironv1alpha1.ReasonPullFailures}},
+			active: 0,
+			reason: cheironv1alpha1.ReasonRecovered,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			secrets := []cheironv1alpha1.ImagePullSecretSpec{failoverSecret(2), basicSecret("quay", "quay.io")}
+			next, switches, requeue := resolveFailover(secrets, tt.status, tt.rateLimits, tt.pullFailures, now)
+			if len(next) != 1 || next[0].Secret != "hub" {
+				t.Fatalf("failover status = %+v, want status of hub only", next)
+			}
+			if next[0].Active != tt.active || next[0].Reason != tt.reason {
+				t.Errorf("failover = %+v, want credential %d with reason %q", next[0], tt.active, tt.reason)
+			}
+			if requeue != tt.requeue {
+				t.Errorf("requeue = %v, want %v", requeue, tt.requeue)
+			}
+
+			from := int32(0)
+			if len(tt.status) > 0 {
+				from = tt.status[0].Active
+			}
+			switched := from != tt.active
+			if switched != (len(switches) == 1) {
+				t.Fatalf("switches = %+v, want switch %v", switches, switched)
+			}
+			if switched {
+				want := failoverSwitch{Secret: "hub", From: from, To: tt.active, Reason: tt.reason}
+				if switches[0] != want {
+					t.Errorf("switch = %+v, want %+v", switches[0], want)
+				}
+				if next[0].LastSwitchTime == nil || !next[0].LastSwitchTime.Time.Equal(now) {
+					t.Errorf("last switch time = %v, want %v", next[0].LastSwitchTime, now)
+				}
+			}
+		})
+	}
+}
+
+func TestMinRequeue(t *testing.T) {
+	tests := []struct {
+		a, b, want time.Duration
+	}{
+		{a: 0, b: 0, want: 0},
+		{a: time.Minute, b: 0, want: time.Minute},
+		{a: 0, b: time.Minute, want: time.Minute},
+		{a: time.Hour, b: time.Minute, want: time.Minute},
+		{a: time.Minute, b: time.Hour, want: time.Minute},
+	}
+	for _, tt := range tests {
+		if got := minRequeue(tt.a, tt.b); got != tt.want {
+			t.Errorf("minRequeue(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRecordFailover(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	manager := &cheironv1alpha1.ImagePullSecretManager{}
+	recordFailover(recorder, manager, []failoverSwitch{
+		{Secret: "hub", From: 0, To: 1, Reason: cheironv1alpha1.ReasonValidationFailed},
+		{Secret: "hub", From: 1, To: 0, Reason: cheironv1alpha1.ReasonRecovered},
+	})
+	close(recorder.Events)
+
+	events := []string{}
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+	want := []string{
+		"Warning ValidationFailed Secret hub switched from primary credential to fallback credential 1",
+		"Normal Recovered Secret hub switched from fallback credential 1 to primary credential",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+	// managers without recorder, e.g. in tests, must not fail
+	recordFailover(nil, manager, []failoverSwitch{{Secret: "hub"}})
+}
+
+func TestWithFailover(t *testing.T) {
+	manager := managerRef{Name: "hub", Namespace: "shop"}
+	cluster := managerRef{Cluster: true, Name: "hub"}
+	r := &resolution{Winners: []candidate{
+		{Manager: manager, Secret: failoverSecret(1)},
+		{Manager: cluster, Secret: basicSecret("quay", "quay.io")},
+	}}
+	failover := []cheironv1alpha1.Failover{{Secret: "hub", Active: 1}}
+	r.withFailover(manager, failover)
+
+	if !reflect.DeepEqual(r.Winners[0].Failover, failover) {
+		t.Errorf("failover of manager = %+v, want %+v", r.Winners[0].Failover, failover)
+	}
+	if r.Winners[1].Failover != nil {
+		t.Errorf("failover of cluster manager with same name = %+v, want none", r.Winners[1].Failover)
+	}
+}
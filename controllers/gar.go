@@ -0,0 +1,139 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+const (
+	// garUsername is the username access tokens of Google Artifact Registry are used with
+	garUsername = "oauth2accesstoken"
+	// googleCloudPlatformScope is the scope of the access tokens requested with a service account key
+	googleCloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	// googleTokenLifetime is requested for and assumed of access tokens if the response lacks their lifetime
+	googleTokenLifetime = time.Hour
+)
+
+// googleServiceAccountKey are the fields of a service account key file used to request tokens
+type googleServiceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// garProvider requests OAuth2 access tokens for Google Artifact Registry
+type garProvider struct {
+	Client    client.Client
+	Spec      *cheironv1alpha1.GARProvider
+	Namespace string
+}
+
+// metadataEndpoint returns the URL of the token of the default service account at the metadata server
+func (p *garProvider) metadataEndpoint() string {
+	endpoint := p.Spec.MetadataEndpoint
+	if endpoint == "" {
+		endpoint = "http://metadata.google.internal"
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/computeMetadata/v1/instance/service-accounts/default/token"
+}
+
+// accessToken requests an access token either with the referenced service account key or from the metadata server
+func (p *garProvider) accessToken(ctx context.Context) (oauthToken, error) {
+	ref := p.Spec.CredentialsSecretRef
+	if ref == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.metadataEndpoint(), nil)
+		if err != nil {
+			return oauthToken{}, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return doTokenRequest(req)
+	}
+
+	secret, err := providerSecret(ctx, p.Client, ref, p.Namespace)
+	if err != nil {
+		return oauthToken{}, err
+	}
+	var key googleServiceAccountKey
+	if err := json.Unmarshal(secret.Data["key.json"], &key); err != nil {
+		return oauthToken{}, fmt.Errorf("secret %s/%s lacks a valid service account key in key.json: %w", secret.Namespace, secret.Name, err)
+	}
+	endpoint := p.Spec.TokenEndpoint
+	if endpoint == "" {
+		endpoint = key.TokenURI
+	}
+	if endpoint == "" {
+		endpoint = "https://oauth2.googleapis.com/token"
+	}
+	assertion, err := signServiceAccountJWT(key, endpoint, time.Now())
+	if err != nil {
+		return oauthToken{}, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	return requestToken(ctx, endpoint, form)
+}
+
+// issue requests an access token, which is used as password with the username oauth2accesstoken
+func (p *garProvider) issue(ctx context.Context) (providedCredential, error) {
+	issuedAt := time.Now()
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return providedCredential{}, err
+	}
+	if token.AccessToken == "" {
+		return providedCredential{}, fmt.Errorf("token response contains no access token")
+	}
+	lifetime := token.ExpiresIn
+	if lifetime <= 0 {
+		lifetime = googleTokenLifetime
+	}
+	return providedCredential{
+		Username:  garUsername,
+		Password:  token.AccessToken,
+		IssuedAt:  issuedAt,
+		ExpiresAt: issuedAt.Add(lifetime),
+	}, nil
+}
+
+// signServiceAccountJWT returns the RS256 signed JWT a service account key requests an access token with, see
+// https://developers.google.com/identity/protocols/oauth2/service-account#authorizingrequests
+func signServiceAccountJWT(key googleServiceAccountKey, audience string, now time.Time) (string, error) {
+	privateKey, err := parseRSAPrivateKey([]byte(key.PrivateKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid service account key: %w", err)
+	}
+	return signRS256JWT(privateKey, key.PrivateKeyID, map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": googleCloudPlatformScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(googleTokenLifetime).Unix(),
+	})
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// testKey returns an RSA key together with its PKCS #1 PEM encoding
+func testKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return key, string(encoded)
+}
+
+// verifyRS256JWT verifies the signature of a JWT and returns its claims
+func verifyRS256JWT(token string, key *rsa.PublicKey) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token is not a JWT")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	return claims, json.Unmarshal(payload, &claims)
+}
+
+func TestGARProvider(t *testing.T) {
+	key, keyPEM := testKey(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "invalid grant", http.StatusBadRequest)
+			return
+		}
+		claims, err := verifyRS256JWT(r.Form.Get("assertion"), &key.PublicKey)
+		if err != nil || claims["iss"] != "cheiron@project.iam.gserviceaccount.com" || claims["scope"] != googleCloudPlatformScope ||
+			!strings.HasSuffix(fmt.Sprint(claims["aud"]), "/token") {
+			http.Error(w, "invalid assertion", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"access_token": "key-token", "expires_in": 1800})
+	})
+	mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/default/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing metadata flavor", http.StatusForbidden)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"access_token": "metadata-token"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	serviceAccountKey, _ := json.Marshal(googleServiceAccountKey{
+		ClientEmail:  "cheiron@project.iam.gserviceaccount.com",
+		PrivateKeyID: "key",
+		PrivateKey:   keyPEM,
+		TokenURI:     server.URL + "/token",
+	})
+	c := fakeClient(
+		credentialsSecret("google", map[string]string{"key.json": string(serviceAccountKey)}),
+		credentialsSecret("google-invalid", map[string]string{"key.json": "{"}),
+	)
+
+	tests := []struct {
+		name     string
+		spec     *cheironv1alpha1.GARProvider
+		password string
+		lifetime time.Duration
+		fails    bool
+	}{
+		{name: "service account key", spec: &cheironv1alpha1.GARProvider{CredentialsSecretRef: secretRef("google")}, password: "key-token", lifetime: 30 * time.Minute},
+		{name: "token endpoint override", spec: &cheironv1alpha1.GARProvider{CredentialsSecretRef: secretRef("google"), TokenEndpoint: server.URL + "/token"}, password: "key-token", lifetime: 30 * time.Minute},
+		{name: "metadata server", spec: &cheironv1alpha1.GARProvider{MetadataEndpoint: server.URL}, password: "metadata-token", lifetime: googleTokenLifetime},
+		{name: "invalid service account key", spec: &cheironv1alpha1.GARProvider{CredentialsSecretRef: secretRef("google-invalid")}, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := (&garProvider{Client: c, Spec: tt.spec}).issue(context.Background())
+			if tt.fails {
+				if err == nil {
+					t.Errorf("issue() = %+v, want error", cred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cred.Username != garUsername || cred.Password != tt.password || cred.ExpiresAt.Sub(cred.IssuedAt) != tt.lifetime {
+				t.Errorf("issue() = %+v", cred)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// githubAppUsername is the username installation access tokens are used with
+const githubAppUsername = "x-access-token"
+
+// githubAppProvider requests installation access tokens of a GitHub App
+type githubAppProvider struct {
+	Client    client.Client
+	Spec      *cheironv1alpha1.GitHubAppProvider
+	Namespace string
+}
+
+// apiURL returns the base URL of the GitHub API
+func (p *githubAppProvider) apiURL() string {
+	if p.Spec.APIURL != "" {
+		return strings.TrimSuffix(p.Spec.APIURL, "/")
+	}
+	return "https://api.github.com"
+}
+
+// appJWT returns the JWT the app authenticates with, which is valid for less than the allowed ten minutes and issued
+// a minute in the past to allow for clock drift, see
+// https://docs.github.com/en/developers/apps/building-github-apps/authenticating-with-github-apps
+func (p *githubAppProvider) appJWT(ctx context.Context, now time.Time) (string, error) {
+	secret, err := providerSecret(ctx, p.Client, &p.Spec.PrivateKeySecretRef, p.Namespace)
+	if err != nil {
+		return "", err
+	}
+	key, err := parseRSAPrivateKey(secret.Data["private_key"])
+	if err != nil {
+		return "", fmt.Errorf("secret %s/%s lacks a valid private key in private_key: %w", secret.Namespace, secret.Name, err)
+	}
+	return signRS256JWT(key, "", map[string]interface{}{
+		"iss": fmt.Sprint(p.Spec.AppID),
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+	})
+}
+
+// do sends a request authenticated as the app to the API and decodes the response into out
+func (p *githubAppProvider) do(ctx context.Context, jwt, method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, p.apiURL()+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GitHub API request %s %s failed with status %s: %s", method, path, resp.Status, msg)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// installationID returns the ID of the installation tokens are requested for
+func (p *githubAppProvider) installationID(ctx context.Context, jwt string) (int64, error) {
+	if p.Spec.InstallationID != 0 {
+		return p.Spec.InstallationID, nil
+	}
+	var installations []struct {
+		ID      int64 `json:"id"`
+		Account struct {
+			Login string `json:"login"`
+		} `json:"account"`
+	}
+	if err := p.do(ctx, jwt, http.MethodGet, "/app/installations?per_page=100", nil, &installations); err != nil {
+		return 0, err
+	}
+	for _, i := range installations {
+		if p.Spec.Owner != "" && strings.EqualFold(i.Account.Login, p.Spec.Owner) {
+			return i.ID, nil
+		}
+	}
+	if p.Spec.Owner == "" && len(installations) == 1 {
+		return installations[0].ID, nil
+	}
+	if p.Spec.Owner != "" {
+		return 0, fmt.Errorf("GitHub App %d is not installed on %s", p.Spec.AppID, p.Spec.Owner)
+	}
+	return 0, fmt.Errorf("GitHub App %d has %d installations, installationID or owner is required", p.Spec.AppID, len(installations))
+}
+
+// issue requests an installation access token which may only read packages
+func (p *githubAppProvider) issue(ctx context.Context) (providedCredential, error) {
+	issuedAt := time.Now()
+	jwt, err := p.appJWT(ctx, issuedAt)
+	if err != nil {
+		return providedCredential{}, err
+	}
+	id, err := p.installationID(ctx, jwt)
+	if err != nil {
+		return providedCredential{}, err
+	}
+
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	body := []byte(`{"permissions":{"packages":"read"}}`)
+	if err := p.do(ctx, jwt, http.MethodPost, fmt.Sprintf("/app/installations/%d/access_tokens", id), body, &token); err != nil {
+		return providedCredential{}, err
+	}
+	if token.Token == "" {
+		return providedCredential{}, fmt.Errorf("GitHub returned no installation access token")
+	}
+	if token.ExpiresAt.IsZero() {
+		token.ExpiresAt = issuedAt.Add(time.Hour)
+	}
+	return providedCredential{
+		Username:  githubAppUsername,
+		Password:  token.Token,
+		IssuedAt:  issuedAt,
+		ExpiresAt: token.ExpiresAt,
+	}, nil
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+func TestGitHubAppAPIURL(t *testing.T) {
+	tests := map[string]string{
+		"":                                   "https://api.github.com",
+		"https://github.example.com/api/v3/": "https://github.example.com/api/v3",
+	}
+	for apiURL, want := range tests {
+		p := &githubAppProvider{Spec: &cheironv1alpha1.GitHubAppProvider{APIURL: apiURL}}
+		if got := p.apiURL(); got != want {
+			t.Errorf("apiURL() of %q = %s, want %s", apiURL, got, want)
+		}
+	}
+}
+
+func TestGitHubAppJWT(t *testing.T) {
+	key, keyPEM := testKey(t)
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		data  map[string]string
+		fails bool
+	}{
+		"private key":         {data: map[string]string{"private_key": keyPEM}},
+		"missing private key": {data: map[string]string{"key": keyPEM}, fails: true},
+		"invalid private key": {data: map[string]string{"private_key": "key"}, fails: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := &githubAppProvider{
+				Client: fakeClient(credentialsSecret("github", tt.data)),
+				Spec:   &cheironv1alpha1.GitHubAppProvider{AppID: 42, PrivateKeySecretRef: *secretRef("github")},
+			}
+			jwt, err := p.appJWT(context.Background(), now)
+			if tt.fails {
+				if err == nil {
+					t.Errorf("appJWT() = %s, want error", jwt)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := verifyRS256JWT(jwt, &key.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// GitHub rejects app tokens valid for more than ten minutes
+			iat, exp := claims["iat"].(float64), claims["exp"].(float64)
+			if claims["iss"] != "42" || iat != float64(now.Add(-time.Minute).Unix()) || exp-iat > 600 {
+				t.Errorf("appJWT() claims = %v", claims)
+			}
+		})
+	}
+}
+
+func TestGitHubAppProvider(t *testing.T) {
+	key, keyPEM := testKey(t)
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	installations := []map[string]interface{}{
+		{"id": 1, "account": map[string]string{"login": "someone"}},
+		{"id": 2, "account": map[string]string{"login": "anny-co"}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := verifyRS256JWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), &key.PublicKey)
+		if err != nil || claims["iss"] != "42" {
+			http.Error(w, "invalid app token", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/app/installations":
+			writeJSON(w, installations)
+		case r.Method == http.MethodPost && (r.URL.Path == "/app/installations/2/access_tokens" || r.URL.Path == "/app/installations/7/access_tokens"):
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != `{"permissions":{"packages":"read"}}` {
+				http.Error(w, "unexpected permissions", http.StatusUnprocessableEntity)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			if strings.Contains(r.URL.Path, "/7/") {
+				writeJSON(w, map[string]interface{}{"token": "ghs_token"})
+				return
+			}
+			writeJSON(w, map[string]interface{}{"token": "ghs_token", "expires_at": expiresAt})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := fakeClient(credentialsSecret("github", map[string]string{"private_key": keyPEM}))
+	tests := []struct {
+		name           string
+		owner          string
+		installationID int64
+		// defaultExpiry expects the token to expire an hour after it was issued
+		defaultExpiry bool
+		fails         bool
+	}{
+		{name: "installation of the owner", owner: "Anny-Co"},
+		{name: "explicit installation without expiry", installationID: 7, defaultExpiry: true},
+		{name: "owner without installation", owner: "nobody", fails: true},
+		{name: "several installations without owner", fails: true},
+		{name: "unknown installation", installationID: 3, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &githubAppProvider{Client: c, Spec: &cheironv1alpha1.GitHubAppProvider{
+				AppID:               42,
+				Owner:               tt.owner,
+				InstallationID:      tt.installationID,
+				PrivateKeySecretRef: *secretRef("github"),
+				APIURL:              server.URL,
+			}}
+			cred, err := p.issue(context.Background())
+			if tt.fails {
+				if err == nil {
+					t.Errorf("issue() = %+v, want error", cred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := expiresAt
+			if tt.defaultExpiry {
+				want = cred.IssuedAt.Add(time.Hour)
+			}
+			if cred.Username != githubAppUsername || cred.Password != "ghs_token" || !cred.ExpiresAt.Equal(want) {
+				t.Errorf("issue() = %+v", cred)
+			}
+		})
+	}
+}
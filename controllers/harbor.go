@@ -0,0 +1,430 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// defaultHarborRotationInterval is the time after which robot secrets are renewed if the provider does not specify it
+const defaultHarborRotationInterval = 7 * 24 * time.Hour
+
+var (
+	// harborRotatedAnnotation records when the secret of the robot account was issued
+	harborRotatedAnnotation = "cheiron.anny.co/harbor-rotated-at"
+	// harborConfigAnnotation records a hash of the registry and projects the robot account was created for
+	harborConfigAnnotation = "cheiron.anny.co/harbor-config"
+	// harborRobotAnnotation records the name of the robot account whose secret a secret holds
+	harborRobotAnnotation = "cheiron.anny.co/harbor-robot"
+	// harborFinalizer keeps managers until the robot accounts they created are deleted
+	harborFinalizer = "cheiron.anny.co/harbor-robots"
+)
+
+// harborRobot is a robot account of the Harbor API
+type harborRobot struct {
+	ID          int64  `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Secret      string `json:"secret,omitempty"`
+}
+
+// shortName returns the name of the robot without the robot prefix Harbor adds, e.g. robot$
+func (r harborRobot) shortName() string {
+	return r.Name[strings.Index(r.Name, "$")+1:]
+}
+
+// harborStatusError is returned for requests Harbor answers with an unexpected status
+type harborStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *harborStatusError) Error() string {
+	return fmt.Sprintf("Harbor API returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// harborClient calls the v2.0 API of Harbor with basic authentication
+type harborClient struct {
+	URL      string
+	Username string
+	Password string
+}
+
+// newHarborClient returns a client for the Harbor of a secret spec, namespace is the namespace of the manager
+func newHarborClient(ctx context.Context, c client.Client, secret *cheironv1alpha1.ImagePullSecretSpec, namespace string) (*harborClient, error) {
+	spec := secret.Provider.Harbor
+	if settings := clusterProviderSettings(secret.Provider); namespace != "" && len(settings) > 0 {
+		return nil, fmt.Errorf("secret %s uses %s, which only cluster managers may use", secret.Name, strings.Join(settings, ", "))
+	}
+	credentials, err := providerSecret(ctx, c, &spec.CredentialsSecretRef, namespace)
+	if err != nil {
+		return nil, err
+	}
+	h := &harborClient{
+		URL:      strings.TrimSuffix(spec.URL, "/"),
+		Username: string(credentials.Data["username"]),
+		Password: string(credentials.Data["password"]),
+	}
+	if h.URL == "" {
+		h.URL = "https://" + normalizeRegistry(secret.Registry)
+	}
+	if h.Username == "" || h.Password == "" {
+		return nil, fmt.Errorf("secret %s/%s lacks username or password", credentials.Namespace, credentials.Name)
+	}
+	return h, nil
+}
+
+// do sends a request to the API and decodes the response into out, if given
+func (h *harborClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, h.URL+"/api/v2.0"+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(h.Username, h.Password)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &harborStatusError{StatusCode: resp.StatusCode, Message: string(msg)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// createRobot creates a system robot account which may pull from the given projects and never expires, as its secret
+// is rotated by cheiron
+func (h *harborClient) createRobot(ctx context.Context, name, description string, projects []string) (harborRobot, error) {
+	type access struct {
+		Resource string `json:"resource"`
+		Action   string `json:"action"`
+	}
+	type permission struct {
+		Kind      string   `json:"kind"`
+		Namespace string   `json:"namespace"`
+		Access    []access `json:"access"`
+	}
+	permissions := []permission{}
+	for _, project := range projects {
+		permissions = append(permissions, permission{
+			Kind:      "project",
+			Namespace: project,
+			Access:    []access{{Resource: "repository", Action: "pull"}},
+		})
+	}
+	robot := harborRobot{}
+	err := h.do(ctx, http.MethodPost, "/robots", map[string]interface{}{
+		"name":        name,
+		"description": description,
+		"duration":    -1,
+		"level":       "system",
+		"disable":     false,
+		"permissions": permissions,
+	}, &robot)
+	return robot, err
+}
+
+// deleteRobot deletes a robot account, robots that do not exist anymore are ignored
+func (h *harborClient) deleteRobot(ctx context.Context, id int64) error {
+	err := h.do(ctx, http.MethodDelete, fmt.Sprintf("/robots/%d", id), nil, nil)
+	if statusErr, ok := err.(*harborStatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// listRobots returns all robot accounts whose name without robot prefix starts with the given prefix
+func (h *harborClient) listRobots(ctx context.Context, prefix string) ([]harborRobot, error) {
+	const pageSize = 100
+	robots := []harborRobot{}
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("q", "name=~"+prefix)
+		query.Set("page", fmt.Sprint(page))
+		query.Set("page_size", fmt.Sprint(pageSize))
+		var items []harborRobot
+		if err := h.do(ctx, http.MethodGet, "/robots?"+query.Encode(), nil, &items); err != nil {
+			return nil, err
+		}
+		for _, r := range items {
+			// the query matches fuzzily, only robots with the prefix are returned
+			if strings.HasPrefix(r.shortName(), prefix) {
+				robots = append(robots, r)
+			}
+		}
+		if len(items) < pageSize {
+			return robots, nil
+		}
+	}
+}
+
+// usesHarbor reports whether any of the secrets creates robot accounts in Harbor
+func usesHarbor(secrets []cheironv1alpha1.ImagePullSecretSpec) bool {
+	for _, s := range secrets {
+		if s.ExistingSecretRef.Name == "" && s.Provider != nil && s.Provider.Harbor != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// harborRobotPrefix returns the prefix of the names of all robot accounts created for a manager
+func harborRobotPrefix(owner client.Object) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%T/%s/%s", owner, owner.GetNamespace(), owner.GetName())))
+	return "cheiron-" + hex.EncodeToString(sum[:])[:8] + "-"
+}
+
+// harborRobotName returns the name of the robot account of a manager's secret in a namespace. Namespaces contain no
+// dots, hence the name is unambiguous. Robots created before the name got a suffix per rotation have this name.
+func harborRobotName(owner client.Object, secret, namespace string) string {
+	return harborRobotPrefix(owner) + namespace + "." + secret
+}
+
+// harborRobotsInUse adds the robot accounts held by the secrets of a winner in a namespace to robots, i.e. the robot of
+// the current secret and those of superseded versions that are still attached
+func harborRobotsInUse(ctx context.Context, c client.Client, owner client.Object, namespace string, winner candidate, robots map[string]bool) error {
+	if winner.Secret.Provider == nil || winner.Secret.Provider.Harbor == nil {
+		return nil
+	}
+	secrets := []corev1.Secret{}
+	if winner.versioned() {
+		versions, err := secretVersions(ctx, c, namespace, winner)
+		if err != nil {
+			return err
+		}
+		secrets = versions
+	} else {
+		current, err := currentCandidateSecret(ctx, c, namespace, winner)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			secrets = append(secrets, *current)
+		}
+	}
+	for _, s := range secrets {
+		if name, ok := s.Annotations[harborRobotAnnotation]; ok {
+			robots[name] = true
+		} else {
+			robots[harborRobotName(owner, winner.Secret.Name, namespace)] = true
+		}
+	}
+	return nil
+}
+
+// harborConfig returns a hash of the settings a robot account is created with, s.t. robots are recreated when they
+// change
+func harborConfig(secret *cheironv1alpha1.ImagePullSecretSpec) string {
+	config, _ := json.Marshal([]interface{}{normalizeRegistry(secret.Registry), secret.Provider.Harbor.URL, secret.Provider.Harbor.Projects})
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:])[:10]
+}
+
+// currentCandidateSecret returns the secret currently holding the credentials of a candidate in a namespace, i.e. the
+// current version of versioned secrets, or nil if there is none
+func currentCandidateSecret(ctx context.Context, c client.Client, namespace string, cand candidate) (*corev1.Secret, error) {
+	if cand.versioned() {
+		versions, err := secretVersions(ctx, c, namespace, cand)
+		if err != nil || len(versions) == 0 {
+			return nil, err
+		}
+		if _, superseded := supersededAt(&versions[0]); superseded {
+			return nil, nil
+		}
+		return &versions[0], nil
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: cand.Secret.Name, Namespace: namespace}, secret); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return secret, nil
+}
+
+// createOrUpdateHarborSecret writes the credentials of the robot account of a winner in a namespace. A new robot is
+// created if there is none, its projects changed or the rotation interval has passed. Harbor reveals robot secrets
+// only once, hence the managed secret is kept as is until then. Superseded robots are not touched, s.t. the versions
+// holding them keep working until they are detached, see pruneHarborRobots(). Robots are only created once the secret
+// may be written and deleted again if writing it fails, s.t. no robot is left that no secret holds. The name of the
+// created robot is returned together with the time until the next rotation or until superseded versions have to be
+// garbage-collected.
+func createOrUpdateHarborSecret(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner client.Object, namespace string, winner candidate) (string, time.Duration, error) {
+	spec := winner.Secret.Provider.Harbor
+	interval := defaultHarborRotationInterval
+	if spec.RotationInterval != nil && spec.RotationInterval.Duration > 0 {
+		interval = spec.RotationInterval.Duration
+	}
+	config := harborConfig(&winner.Secret)
+
+	current, err := currentCandidateSecret(ctx, c, namespace, winner)
+	if err != nil {
+		return "", 0, err
+	}
+	if current != nil && current.Annotations[harborConfigAnnotation] == config {
+		if rotatedAt, err := time.Parse(time.RFC3339, current.Annotations[harborRotatedAnnotation]); err == nil {
+			if remaining := interval - time.Since(rotatedAt); remaining > 0 {
+				return "", remaining, nil
+			}
+		}
+	}
+	if current != nil && !winner.versioned() {
+		// a secret the manager may not take over would never hold the robot
+		if err := adoptSecret(current.DeepCopy(), owner); err != nil {
+			return "", 0, err
+		}
+	}
+
+	h, err := newHarborClient(ctx, c, &winner.Secret, owner.GetNamespace())
+	if err != nil {
+		return "", 0, err
+	}
+	// the description records the settings the robot was created with
+	name := harborRobotName(owner, winner.Secret.Name, namespace) + "-" + utilrand.String(5)
+	robot, err := h.createRobot(ctx, name, config, spec.Projects)
+	if err != nil {
+		return "", 0, err
+	}
+
+	annotations := map[string]string{
+		harborRotatedAnnotation: time.Now().UTC().Format(time.RFC3339),
+		harborConfigAnnotation:  config,
+		harborRobotAnnotation:   robot.shortName(),
+	}
+	pullSecret := &cheironv1alpha1.ImagePullSecretSpec{
+		Name:        winner.Secret.Name,
+		Registry:    winner.Secret.Registry,
+		RegistryRef: winner.Secret.RegistryRef,
+		Username:    robot.Name,
+		Password:    robot.Secret,
+		Email:       winner.Secret.Email,
+	}
+	versionsExpireAfter, err := writeCandidateSecret(ctx, c, scheme, owner, namespace, winner, pullSecret, nil, annotations)
+	if err != nil {
+		if errors.IsTimeout(err) || errors.IsServerTimeout(err) {
+			// the secret may have been written nonetheless, the robot is pruned later if it was not
+			return "", 0, err
+		}
+		if deleteErr := h.deleteRobot(ctx, robot.ID); deleteErr != nil {
+			return "", 0, fmt.Errorf("%w, failed to delete robot %s: %v", err, robot.Name, deleteErr)
+		}
+		return "", 0, err
+	}
+	return robot.shortName(), minRequeue(interval, versionsExpireAfter), nil
+}
+
+// pruneHarborRobots deletes the robot accounts of a manager that are not in keep from every Harbor the manager's
+// secrets use, i.e. robots of detached versions, of namespaces that left the scope of the manager or of secrets that
+// were removed
+func pruneHarborRobots(ctx context.Context, c client.Client, owner client.Object, secrets []cheironv1alpha1.ImagePullSecretSpec, keep map[string]bool) error {
+	prefix := harborRobotPrefix(owner)
+	pruned := map[string]bool{}
+	for i := range secrets {
+		secret := &secrets[i]
+		if !usesHarbor([]cheironv1alpha1.ImagePullSecretSpec{*secret}) {
+			continue
+		}
+		if owner.GetNamespace() != "" && len(clusterProviderSettings(secret.Provider)) > 0 {
+			// no robots were created for secrets the manager may not use
+			continue
+		}
+		h, err := newHarborClient(ctx, c, secret, owner.GetNamespace())
+		if err != nil {
+			return err
+		}
+		if pruned[h.URL] {
+			continue
+		}
+		pruned[h.URL] = true
+		robots, err := h.listRobots(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		for _, r := range robots {
+			if keep[r.shortName()] {
+				continue
+			}
+			if err := h.deleteRobot(ctx, r.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureHarborFinalizer adds the finalizer to managers creating robot accounts and removes it from all others
+func ensureHarborFinalizer(ctx context.Context, c client.Client, owner client.Object, secrets []cheironv1alpha1.ImagePullSecretSpec) error {
+	has := controllerutil.ContainsFinalizer(owner, harborFinalizer)
+	switch uses := usesHarbor(secrets); {
+	case uses && !has:
+		controllerutil.AddFinalizer(owner, harborFinalizer)
+	case !uses && has:
+		controllerutil.RemoveFinalizer(owner, harborFinalizer)
+	default:
+		return nil
+	}
+	return c.Update(ctx, owner)
+}
+
+// finalizeHarborRobots deletes all robot accounts of a manager being deleted and removes its finalizer
+func finalizeHarborRobots(ctx context.Context, c client.Client, owner client.Object, secrets []cheironv1alpha1.ImagePullSecretSpec) error {
+	if !controllerutil.ContainsFinalizer(owner, harborFinalizer) {
+		return nil
+	}
+	if err := pruneHarborRobots(ctx, c, owner, secrets, nil); err != nil {
+		return err
+	}
+	controllerutil.RemoveFinalizer(owner, harborFinalizer)
+	return c.Update(ctx, owner)
+}
@@ -0,0 +1,353 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// fakeHarbor serves the robot accounts API of Harbor for the user admin with password harbor
+type fakeHarbor struct {
+	*httptest.Server
+	mu     sync.Mutex
+	nextID int64
+	robots map[int64]harborRobot
+}
+
+func newFakeHarbor(t *testing.T, robots ...harborRobot) *fakeHarbor {
+	h := &fakeHarbor{robots: map[int64]harborRobot{}}
+	for _, r := range robots {
+		h.robots[r.ID] = r
+		if r.ID > h.nextID {
+			h.nextID = r.ID
+		}
+	}
+	h.Server = httptest.NewServer(http.HandlerFunc(h.serve))
+	t.Cleanup(h.Close)
+	return h
+}
+
+func (h *fakeHarbor) serve(w http.ResponseWriter, r *http.Request) {
+	if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "harbor" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v2.0/robots":
+		var body struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			Permissions []struct {
+				Namespace string `json:"namespace"`
+			} `json:"permissions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Permissions) == 0 {
+			http.Error(w, "invalid robot", http.StatusBadRequest)
+			return
+		}
+		h.nextID++
+		h.robots[h.nextID] = harborRobot{ID: h.nextID, Name: "robot$" + body.Name, Description: body.Description, Secret: fmt.Sprintf("robot-secret-%d", h.nextID)}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, h.robots[h.nextID])
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v2.0/robots":
+		items := []harborRobot{}
+		for _, robot := range h.robots {
+			items = append(items, harborRobot{ID: robot.ID, Name: robot.Name, Description: robot.Description})
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+		writeJSON(w, items)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/v2.0/robots/"):
+		var id int64
+		fmt.Sscan(strings.TrimPrefix(r.URL.Path, "/api/v2.0/robots/"), &id)
+		if _, ok := h.robots[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(h.robots, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// names returns the short names of all robots
+func (h *fakeHarbor) names() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := []string{}
+	for _, r := range h.robots {
+		names = append(names, r.shortName())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// harborSecret returns a secret spec creating robots in the fake Harbor
+func harborSecret(h *fakeHarbor) cheironv1alpha1.ImagePullSecretSpec {
+	return cheironv1alpha1.ImagePullSecretSpec{
+		Name:     "harbor",
+		Registry: "harbor.example.com",
+		Provider: &cheironv1alpha1.CredentialProvider{Harbor: &cheironv1alpha1.HarborProvider{
+			URL:                  h.URL,
+			CredentialsSecretRef: *secretRef("harbor"),
+			Projects:             []string{"library", "shop"},
+		}},
+	}
+}
+
+// failingSecretWriter fails all writes of secrets with err
+type failingSecretWriter struct {
+	client.Client
+	err error
+}
+
+func (f failingSecretWriter) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		return f.err
+	}
+	return f.Client.Create(ctx, obj, opts...)
+}
+
+func (f failingSecretWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		return f.err
+	}
+	return f.Client.Update(ctx, obj, opts...)
+}
+
+func TestHarborClient(t *testing.T) {
+	h := newFakeHarbor(t,
+		harborRobot{ID: 1, Name: "robot$cheiron-shop-quay-abcde"},
+		harborRobot{ID: 2, Name: "robot$other-quay"},
+	)
+	c := fakeClient(credentialsSecret("harbor", map[string]string{"username": "admin", "password": "harbor"}))
+	secret := harborSecret(h)
+	if _, err := newHarborClient(context.Background(), c, &secret, "shop"); err == nil {
+		t.Fatalf("namespaced manager may override the Harbor URL")
+	}
+	client, err := newHarborClient(context.Background(), c, &secret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	robot, err := client.createRobot(context.Background(), "cheiron-shop-quay-fghij", "test", secret.Provider.Harbor.Projects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if robot.ID != 3 || robot.Secret != "robot-secret-3" || robot.shortName() != "cheiron-shop-quay-fghij" {
+		t.Errorf("createRobot() = %+v", robot)
+	}
+
+	listed, err := client.listRobots(context.Background(), "cheiron-shop-quay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].ID != 1 || listed[1].ID != 3 {
+		t.Errorf("listRobots() = %+v", listed)
+	}
+
+	if err := client.deleteRobot(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	// robots deleted already are ignored
+	if err := client.deleteRobot(context.Background(), 1); err != nil {
+		t.Errorf("deleteRobot() of deleted robot: %v", err)
+	}
+}
+
+func TestHarborRobotNames(t *testing.T) {
+	manager := &cheironv1alpha1.ImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "harbor", Namespace: "shop"}}
+	clusterManager := &cheironv1alpha1.ClusterImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "harbor"}}
+
+	prefix := harborRobotPrefix(manager)
+	if !strings.HasPrefix(prefix, "cheiron-") || len(prefix) != len("cheiron-")+9 {
+		t.Errorf("harborRobotPrefix() = %s", prefix)
+	}
+	if harborRobotPrefix(clusterManager) == prefix {
+		t.Errorf("managers of both kinds with the same name share the prefix %s", prefix)
+	}
+	if name := harborRobotName(manager, "harbor", "shop"); name != prefix+"shop.harbor" {
+		t.Errorf("harborRobotName() = %s", name)
+	}
+}
+
+func TestHarborConfig(t *testing.T) {
+	h := newFakeHarbor(t)
+	secret := harborSecret(h)
+	config := harborConfig(&secret)
+
+	other := harborSecret(h)
+	other.Provider.Harbor.Projects = []string{"library"}
+	if harborConfig(&other) == config {
+		t.Errorf("harborConfig() ignores the projects")
+	}
+	rotated := harborSecret(h)
+	rotated.Provider.Harbor.RotationInterval = &metav1.Duration{Duration: time.Hour}
+	if harborConfig(&rotated) != config {
+		t.Errorf("harborConfig() changes with the rotation interval")
+	}
+}
+
+func TestCreateOrUpdateHarborSecret(t *testing.T) {
+	owner := &cheironv1alpha1.ClusterImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "harbor", UID: "harbor-uid"}}
+	foreignController := controllerRef("ReplicaSet", "web", "web-uid")
+
+	tests := map[string]struct {
+		// existing returns the secret in the namespace before the write, if any
+		existing func(config string) *corev1.Secret
+		writeErr error
+		created  bool
+		robots   int
+		refused  bool
+		err      bool
+	}{
+		"new secret": {
+			created: true,
+			robots:  1,
+		},
+		"secret rotated within interval": {
+			existing: func(config string) *corev1.Secret {
+				s := newDockerSecretObj("harbor", "shop")
+				s.Annotations = map[string]string{harborConfigAnnotation: config, harborRotatedAnnotation: time.Now().UTC().Format(time.RFC3339)}
+				s.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(owner, cheironv1alpha1.GroupVersion.WithKind("ClusterImagePullSecretManager"))}
+				return s
+			},
+		},
+		"secret due for rotation": {
+			existing: func(config string) *corev1.Secret {
+				s := newDockerSecretObj("harbor", "shop")
+				s.Annotations = map[string]string{harborConfigAnnotation: config, harborRotatedAnnotation: time.Now().Add(-8 * 24 * time.Hour).UTC().Format(time.RFC3339)}
+				s.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(owner, cheironv1alpha1.GroupVersion.WithKind("ClusterImagePullSecretManager"))}
+				return s
+			},
+			created: true,
+			robots:  1,
+		},
+		"secret of another controller": {
+			existing: func(string) *corev1.Secret {
+				s := newDockerSecretObj("harbor", "shop")
+				s.OwnerReferences = []metav1.OwnerReference{foreignController}
+				return s
+			},
+			refused: true,
+			err:     true,
+		},
+		"failing write": {
+			writeErr: apierrors.NewForbidden(corev1.Resource("secrets"), "harbor", fmt.Errorf("denied")),
+			err:      true,
+		},
+		"timed out write": {
+			writeErr: apierrors.NewTimeoutError("write timed out", 1),
+			robots:   1,
+			err:      true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := newFakeHarbor(t)
+			winner := candidate{Manager: managerRef{Cluster: true, Name: "harbor", UID: "harbor-uid"}, Secret: harborSecret(h)}
+			objs := []client.Object{credentialsSecret("harbor", map[string]string{"username": "admin", "password": "harbor"})}
+			if tt.existing != nil {
+				objs = append(objs, tt.existing(harborConfig(&winner.Secret)))
+			}
+			var c client.Client = fakeClient(objs...)
+			if tt.writeErr != nil {
+				c = failingSecretWriter{Client: c, err: tt.writeErr}
+			}
+
+			robots := map[string]bool{}
+			requeue, err := createOrUpdateCandidateSecrets(context.Background(), c, providerDeps{}, c.Scheme(), owner, "shop", winner, robots)
+			if (err != nil) != tt.err {
+				t.Fatalf("createOrUpdateCandidateSecrets() error = %v, want error %v", err, tt.err)
+			}
+			if _, refused := asAdoptionError(err); refused != tt.refused {
+				t.Errorf("createOrUpdateCandidateSecrets() error = %v, want refusal %v", err, tt.refused)
+			}
+			if created := h.names(); len(created) != tt.robots {
+				t.Errorf("robots in Harbor = %v, want %d", created, tt.robots)
+			}
+			if !tt.created {
+				if len(robots) != 0 {
+					t.Errorf("robots in use = %v, want none", robots)
+				}
+				return
+			}
+
+			if requeue <= 0 || requeue > defaultHarborRotationInterval {
+				t.Errorf("requeue = %v, want the rotation interval", requeue)
+			}
+			robot := h.names()[0]
+			if !robots[robot] || !strings.HasPrefix(robot, harborRobotName(owner, "harbor", "shop")+"-") {
+				t.Errorf("robots in use = %v, want the created robot %s", robots, robot)
+			}
+			var secret corev1.Secret
+			if err := c.Get(context.Background(), types.NamespacedName{Namespace: "shop", Name: "harbor"}, &secret); err != nil {
+				t.Fatal(err)
+			}
+			if secret.Annotations[harborRobotAnnotation] != robot || !strings.Contains(string(secret.Data[corev1.DockerConfigJsonKey]), "robot") {
+				t.Errorf("secret = %+v, want the credentials of robot %s", secret, robot)
+			}
+		})
+	}
+}
+
+func TestPruneHarborRobots(t *testing.T) {
+	owner := &cheironv1alpha1.ClusterImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "harbor"}}
+	prefix := harborRobotPrefix(owner)
+	h := newFakeHarbor(t,
+		harborRobot{ID: 1, Name: "robot$" + prefix + "shop.harbor-aaaaa"},
+		harborRobot{ID: 2, Name: "robot$" + prefix + "shop.harbor-bbbbb"},
+		harborRobot{ID: 3, Name: "robot$" + prefix + "batch.harbor-ccccc"},
+		harborRobot{ID: 4, Name: "robot$cheiron-other-shop.harbor-ddddd"},
+	)
+	c := fakeClient(credentialsSecret("harbor", map[string]string{"username": "admin", "password": "harbor"}))
+	secrets := []cheironv1alpha1.ImagePullSecretSpec{harborSecret(h), harborSecret(h), basicSecret("quay", "quay.io")}
+
+	keep := map[string]bool{prefix + "shop.harbor-bbbbb": true}
+	if err := pruneHarborRobots(context.Background(), c, owner, secrets, keep); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cheiron-other-shop.harbor-ddddd", prefix + "shop.harbor-bbbbb"}
+	sort.Strings(want)
+	if strings.Join(h.names(), ",") != strings.Join(want, ",") {
+		t.Errorf("robots = %v, want %v", h.names(), want)
+	}
+
+	// namespaced managers never created robots for settings only cluster managers may use
+	manager := &cheironv1alpha1.ImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "harbor", Namespace: "shop"}}
+	if err := pruneHarborRobots(context.Background(), c, manager, secrets, nil); err != nil {
+		t.Errorf("pruneHarborRobots() of namespaced manager: %v", err)
+	}
+}
@@ -18,15 +18,26 @@ package controllers
 
 import (
 	"context"
+	"sort"
 	"strings"
+	"time"
 
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
@@ -36,12 +47,29 @@ import (
 // ImagePullSecretManagerReconciler reconciles a ImagePullSecretManager object
 type ImagePullSecretManagerReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// ServiceAccounts requests projected service account tokens for token exchange providers
+	ServiceAccounts corev1client.ServiceAccountsGetter
+	// CredentialPluginDir is the directory of exec plugins, exec plugins are disabled without it
+	CredentialPluginDir string
+	// CredentialPluginEnv are the names of the environment variables passed to exec plugins
+	CredentialPluginEnv []string
+	// NamespacedCredentialPlugins are the exec plugins namespaced managers may run
+	NamespacedCredentialPlugins []string
+	// NamespacedCredentialPluginEnv are the environment variables namespaced managers may pass to exec plugins
+	NamespacedCredentialPluginEnv []string
+	// NamespacedTokenEndpoints are the endpoints namespaced managers may send service account tokens to
+	NamespacedTokenEndpoints []string
+	// APIAudiences are audiences of the API server besides the defaults, which tokens are never requested for
+	APIAudiences []string
 }
 
 //+kubebuilder:rbac:groups=cheiron.anny.co,resources=imagepullsecretmanagers,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=cheiron.anny.co,resources=pods,verbs=get;list;watch;update;patch
-//+kubebuilder:rbac:groups=cheiron.anny.co,resources=serviceaccounts,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=serviceaccounts/token,verbs=create
 //+kubebuilder:rbac:groups=cheiron.anny.co,resources=imagepullsecretmanagers/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=cheiron.anny.co,resources=imagepullsecretmanagers/finalizers,verbs=update
 
@@ -61,7 +89,7 @@ func filters() predicate.Predicate {
 			return true
 		},
 		UpdateFunc: func(e event.UpdateEvent) bool {
-			annotations := e.ObjectOld.GetAnnotations()
+			annotations := e.ObjectNew.GetAnnotations()
 			val, ok := annotations[reconciledAnnotation]
 			return !ok || val != "true"
 		},
@@ -71,129 +99,273 @@ func filters() predicate.Predicate {
 	}
 }
 
-// updatePodAnnotations adds the common labels for cheiron on pods to a given pod ressource
-func updatePodAnnotations(pod corev1.Pod, secrets string) corev1.Pod {
-	annotations := pod.GetAnnotations()
-
-	_, reconcilablePresent := annotations[reconcilableAnnotation]
-	ignore, ignorePresent := annotations[ignoreAnnotation]
-	if ignorePresent && ignore == "true" {
-		return pod
-	}
-	if !reconcilablePresent {
-		// pod currently is not marked as reconcilable, add the annotation!
-		pod.Annotations[reconcilableAnnotation] = "true"
-		pod.Annotations[ignoreAnnotation] = "false"
-		pod.Annotations[reconcileWithAnnotation] = secrets
-	}
-	return pod
-}
-
-// updatePodAnnotations adds the common labels for cheiron on pods to a given pod ressource
-func updateServiceAccountAnnotations(sa corev1.ServiceAccount, secrets string) corev1.ServiceAccount {
-	annotations := sa.GetAnnotations()
-
-	_, reconcilablePresent := annotations[reconcilableAnnotation]
-	ignore, ignorePresent := annotations[ignoreAnnotation]
-	if ignorePresent && ignore == "true" {
-		return sa
-	}
-	if !reconcilablePresent {
-		// pod currently is not marked as reconcilable, add the annotation!
-		sa.Annotations[reconcilableAnnotation] = "true"
-		sa.Annotations[ignoreAnnotation] = "false"
-		sa.Annotations[reconcileWithAnnotation] = secrets
+// ownedSecretFilters filters events of secrets owned by managers. Updates changing neither the content nor the labels
+// or owners of a secret, like cheiron's own bookkeeping annotations, don't reconcile the manager again.
+func ownedSecretFilters() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldSecret, ok := e.ObjectOld.(*corev1.Secret)
+			if !ok {
+				return true
+			}
+			newSecret, ok := e.ObjectNew.(*corev1.Secret)
+			if !ok {
+				return true
+			}
+			return oldSecret.Type != newSecret.Type ||
+				oldSecret.Annotations[contentHashAnnotation] != newSecret.Annotations[contentHashAnnotation] ||
+				!equality.Semantic.DeepEqual(oldSecret.Data, newSecret.Data) ||
+				!equality.Semantic.DeepEqual(oldSecret.Labels, newSecret.Labels) ||
+				!equality.Semantic.DeepEqual(oldSecret.OwnerReferences, newSecret.OwnerReferences) ||
+				!equality.Semantic.DeepEqual(oldSecret.DeletionTimestamp, newSecret.DeletionTimestamp)
+		},
 	}
-	return sa
 }
 
-// Reconciles all pods in the request's namespace s.t. they have the set of required annotations for the pod controller of
-// Cheiron already set
-func (r *ImagePullSecretManagerReconciler) GetAndUpdatePods(ctx context.Context, req ctrl.Request, secrets string) (ctrl.Result, error) {
+// getAndUpdatePods reconciles all pods in the namespace s.t. they have the set of required annotations and
+// imagePullSecrets of Cheiron applied
+func getAndUpdatePods(ctx context.Context, c client.Client, namespace string, secrets string) error {
 	log := log.FromContext(ctx)
 	var pods corev1.PodList
-	if err := r.List(ctx, &pods, client.InNamespace(req.Namespace)); err != nil {
+	if err := c.List(ctx, &pods, client.InNamespace(namespace)); err != nil {
 		log.Error(err, "Failed to fetch all pods in namespace")
-		return ctrl.Result{}, err
+		return err
 	}
 
-	for _, pod := range pods.Items {
-		pod = updatePodAnnotations(pod, secrets)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !targetNeedsUpdate(pod, []pullSecretsList{podPullSecrets}, secrets) {
+			continue
+		}
+		if err := applyPullSecrets(ctx, c, pod, podPullSecrets, splitSecretNames(secrets)); err != nil {
+			if errors.IsInvalid(err) {
+				// imagePullSecrets of running pods are immutable
+				log.Info("Cannot attach imagePullSecrets to existing pod", "pod", pod.Name)
+				continue
+			}
+			return client.IgnoreNotFound(err)
+		}
 	}
 
-	return ctrl.Result{}, nil
+	return nil
 }
 
-// Reconciles all service accounts in the request's namespace s.t. they have the set of required annotations for the pod controller of
-// Cheiron already set
-func (r *ImagePullSecretManagerReconciler) GetAndUpdateServiceAccounts(ctx context.Context, req ctrl.Request, secrets string) (ctrl.Result, error) {
+// getAndUpdateServiceAccounts reconciles all service accounts in the resolved namespace s.t. they have the set of
+// required annotations and imagePullSecrets of Cheiron applied
+func getAndUpdateServiceAccounts(ctx context.Context, c client.Client, res *resolution) error {
 	log := log.FromContext(ctx)
 	var serviceAccounts corev1.ServiceAccountList
-	if err := r.List(ctx, &serviceAccounts, client.InNamespace(req.Namespace)); err != nil {
+	if err := c.List(ctx, &serviceAccounts, client.InNamespace(res.Namespace)); err != nil {
 		log.Error(err, "Failed to fetch all service accounts in namespace")
-		return ctrl.Result{}, err
+		return err
 	}
-
-	for _, pod := range serviceAccounts.Items {
-		pod = updateServiceAccountAnnotations(pod, secrets)
+	// members of pools assigned per service account are balanced in the order of the service accounts' names
+	sort.Slice(serviceAccounts.Items, func(i, j int) bool {
+		return serviceAccounts.Items[i].Name < serviceAccounts.Items[j].Name
+	})
+
+	load := map[string]map[int]int{}
+	for i := range serviceAccounts.Items {
+		sa := &serviceAccounts.Items[i]
+		secrets := res.serviceAccountSecrets(sa, load)
+		if !targetNeedsUpdate(sa, []pullSecretsList{serviceAccountPullSecrets}, secrets) {
+			continue
+		}
+		if err := applyPullSecrets(ctx, c, sa, serviceAccountPullSecrets, splitSecretNames(secrets)); err != nil {
+			return client.IgnoreNotFound(err)
+		}
 	}
 
-	return ctrl.Result{}, nil
+	return nil
+}
+
+// annotateTargets marks the pods, workloads and service accounts of the resolved namespace as reconcilable with the winning
+// secrets of managers in the respective mode and attaches these secrets. The auth file of the namespace is updated
+// with them as well.
+func annotateTargets(ctx context.Context, c client.Client, res *resolution) error {
+	if err := res.dropRefused(ctx, c); err != nil {
+		return err
+	}
+	if err := res.resolveVersions(ctx, c); err != nil {
+		return err
+	}
+	if err := getAndUpdatePods(ctx, c, res.Namespace, strings.Join(res.secretNames(cheironv1alpha1.PodMode), ",")); err != nil {
+		return err
+	}
+	kinds, err := allWorkloadKinds(ctx, c)
+	if err != nil {
+		return err
+	}
+	if err := getAndUpdateWorkloads(ctx, c, res.Namespace, kinds, strings.Join(res.secretNames(cheironv1alpha1.WorkloadMode), ",")); err != nil {
+		return err
+	}
+	if err := getAndUpdateServiceAccounts(ctx, c, res); err != nil {
+		return err
+	}
+	return writeAuthFile(ctx, c, res)
 }
 
 // CreateOrUpdateSecret fetches an existing secret with the name specified in the CR or creates a new one,
 // adds the registry credentials as payload and (re-)submits it to the API server
 func (r *ImagePullSecretManagerReconciler) CreateOrUpdateSecret(ctx context.Context, req ctrl.Request, manager *cheironv1alpha1.ImagePullSecretManager, pullSecret *cheironv1alpha1.ImagePullSecretSpec) (*corev1.Secret, error) {
+	return createOrUpdateSecret(ctx, r.Client, r.Scheme, manager, req.Namespace, pullSecret, nil, nil)
+}
+
+// createOrUpdateCandidateSecrets creates or updates the secrets of a winning candidate in a namespace. Secrets given
+// as existingSecretRef are attached as is and never written. Robot accounts created in Harbor are added to robots,
+// which the cache may not know to be in use yet. The returned duration is the time until superseded versions of the
+// secrets have to be garbage-collected.
+func createOrUpdateCandidateSecrets(ctx context.Context, c client.Client, deps providerDeps, scheme *runtime.Scheme, owner client.Object, namespace string, winner candidate, robots map[string]bool) (time.Duration, error) {
+	if winner.Secret.ExistingSecretRef.Name != "" {
+		return 0, nil
+	}
+	if winner.Secret.Provider != nil && winner.Secret.Provider.Harbor != nil {
+		robot, requeueAfter, err := createOrUpdateHarborSecret(ctx, c, scheme, owner, namespace, winner)
+		if robot != "" {
+			robots[robot] = true
+		}
+		return requeueAfter, err
+	}
+	if winner.Secret.Provider != nil {
+		provided, annotations, refreshAfter, err := provideCredentials(ctx, c, deps, owner, &winner.Secret)
+		if err != nil {
+			return 0, err
+		}
+		versionsExpireAfter, err := writeCandidateSecret(ctx, c, scheme, owner, namespace, winner, provided, nil, annotations)
+		return minRequeue(refreshAfter, versionsExpireAfter), err
+	}
+	if winner.Secret.Pool != nil {
+		return createOrUpdatePoolSecrets(ctx, c, scheme, owner, namespace, winner)
+	}
+	if hasFallbacks(&winner.Secret) {
+		return writeCandidateSecret(ctx, c, scheme, owner, namespace, winner, credentialAt(&winner.Secret, activeCredential(&winner.Secret, winner.Failover)), nil, nil)
+	}
+	return writeCandidateSecret(ctx, c, scheme, owner, namespace, winner, &winner.Secret, nil, nil)
+}
+
+// writeCandidateSecret writes the credentials of a spec for a candidate, either in place to the secret named in the
+// spec or as new version, depending on the rotation policy of the candidate's manager
+func writeCandidateSecret(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner client.Object, namespace string, winner candidate, pullSecret *cheironv1alpha1.ImagePullSecretSpec, labels, annotations map[string]string) (time.Duration, error) {
+	if winner.versioned() {
+		return createSecretVersion(ctx, c, scheme, owner, namespace, winner, pullSecret, labels, annotations)
+	}
+	_, err := createOrUpdateSecret(ctx, c, scheme, owner, namespace, pullSecret, labels, annotations)
+	return 0, err
+}
+
+// createOrUpdateSecret fetches an existing secret with the name specified in the spec from the namespace or creates a
+// new one, adds the registry credentials as payload together with the given labels and annotations and (re-)submits
+// it to the API server with owner as controller. Existing secrets not controlled by owner are only written if the
+// adoption policy of owner allows it, an adoptionError is returned otherwise
+func createOrUpdateSecret(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner client.Object, namespace string, pullSecret *cheironv1alpha1.ImagePullSecretSpec, labels, annotations map[string]string) (*corev1.Secret, error) {
 	log := log.FromContext(ctx)
 	create := false
-	name := types.NamespacedName{Name: pullSecret.Name, Namespace: req.Namespace}
+	name := types.NamespacedName{Name: pullSecret.Name, Namespace: namespace}
 	existingSecret := &corev1.Secret{}
 
-	err := r.Get(ctx, name, existingSecret)
+	err := c.Get(ctx, name, existingSecret)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// no secret with that name exists, create a new one!
 			create = true
-			existingSecret = newDockerSecretObj(name.Name, req.Namespace)
+			existingSecret = newDockerSecretObj(name.Name, namespace)
 		} else {
 			log.Error(err, "Error while fetching secrets from API")
 			return nil, err
 		}
+	} else if err := adoptSecret(existingSecret, owner); err != nil {
+		return nil, err
 	}
 
 	username := pullSecret.Username
 	password := pullSecret.Password
 	email := pullSecret.Email
-	registry := pullSecret.Registry
-	dockerConfigJSONContent, err := handleDockerCfgJSONContent(username, password, email, registry)
+	registries, authType, err := registryEntries(ctx, c, pullSecret)
+	if err != nil {
+		log.Error(err, "Failed to fetch Registry of secret")
+		return nil, err
+	}
+	dockerConfigJSONContent, err := handleDockerCfgJSONContent(username, password, email, registries, authType)
 
 	if err != nil {
 		log.Error(err, "Failed to create secret from CRD")
 		return nil, err
 	}
 
+	hash := contentHash(dockerConfigJSONContent)
+	if !create && secretIsUpToDate(existingSecret, owner, hash, labels, annotations) {
+		// writing the unchanged secret would only reconcile its manager again
+		return existingSecret, nil
+	}
+
+	if existingSecret.Data == nil {
+		existingSecret.Data = map[string][]byte{}
+	}
 	existingSecret.Data[corev1.DockerConfigJsonKey] = dockerConfigJSONContent
+	if existingSecret.Annotations == nil {
+		existingSecret.Annotations = map[string]string{}
+	}
+	existingSecret.Annotations[contentHashAnnotation] = hash
+	for k, v := range labels {
+		if existingSecret.Labels == nil {
+			existingSecret.Labels = map[string]string{}
+		}
+		existingSecret.Labels[k] = v
+	}
+	for k, v := range annotations {
+		if existingSecret.Annotations == nil {
+			existingSecret.Annotations = map[string]string{}
+		}
+		existingSecret.Annotations[k] = v
+	}
 
-	if err := ctrl.SetControllerReference(manager, existingSecret, r.Scheme); err != nil {
+	if err := ctrl.SetControllerReference(owner, existingSecret, scheme); err != nil {
 		return nil, err
 	}
 
 	if create {
-		if err := r.Create(ctx, existingSecret); err != nil {
+		if err := c.Create(ctx, existingSecret); err != nil {
 			return nil, err
 		}
 	} else {
-		if err := r.Update(ctx, existingSecret); err != nil {
+		if err := c.Update(ctx, existingSecret); err != nil {
 			return nil, err
 		}
 	}
 	return existingSecret, nil
 }
 
+// secretIsUpToDate reports whether a secret is controlled by owner and holds the content with the given hash together
+// with the given labels and annotations. The hash recorded on the secret is compared with the hash of its actual
+// content, s.t. changes to the secret by others are overwritten.
+func secretIsUpToDate(secret *corev1.Secret, owner metav1.Object, hash string, labels, annotations map[string]string) bool {
+	if !metav1.IsControlledBy(secret, owner) || secret.Annotations[contentHashAnnotation] != hash ||
+		contentHash(secret.Data[corev1.DockerConfigJsonKey]) != hash {
+		return false
+	}
+	for k, v := range labels {
+		if secret.Labels[k] != v {
+			return false
+		}
+	}
+	for k, v := range annotations {
+		if secret.Annotations[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
 // secretIsFullySpecified is a validator function for a ImagePullSecretSpec that returns either true if the secret spec is sufficient or
 // false if not
 func secretIsFullySpecified(secret *cheironv1alpha1.ImagePullSecretSpec) bool {
 	if secret.ExistingSecretRef.Name == "" {
+		if secret.Provider != nil {
+			return providerIsFullySpecified(secret)
+		}
+		if secret.Pool != nil {
+			return poolIsFullySpecified(secret)
+		}
 		if secret.Name != "" && secret.Email != "" && secret.Password != "" && secret.Username != "" && secret.Registry != "" {
 			return true
 		}
@@ -219,56 +391,143 @@ func (r *ImagePullSecretManagerReconciler) Reconcile(ctx context.Context, req ct
 	err := r.Get(ctx, req.NamespacedName, imgr)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			log.Info("Manager CR not found. Ignoring since object must be deleted")
-			return ctrl.Result{}, nil
+			log.Info("Manager CR not found. Re-annotating namespace since object must be deleted")
+			res, err := resolveNamespace(ctx, r.Client, req.Namespace)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{}, annotateTargets(ctx, r.Client, &res)
 		}
 		log.Error(err, "Unable to fetch ImagePullSecretManager")
 		return ctrl.Result{}, err
 	}
 
+	if imgr.DeletionTimestamp != nil {
+		// the robot accounts of the manager are deleted before the manager is gone
+		return ctrl.Result{}, finalizeHarborRobots(ctx, r.Client, imgr, imgr.Spec.Secrets)
+	}
+	if err := ensureHarborFinalizer(ctx, r.Client, imgr, imgr.Spec.Secrets); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	mode := imgr.Spec.Mode
+	if mode != cheironv1alpha1.PodMode && mode != cheironv1alpha1.ServiceAccountMode && mode != cheironv1alpha1.WorkloadMode {
+		err := errors.NewBadRequest("Value of mode spec is not supported")
+		log.Error(err, "Unsupported mode")
+		return ctrl.Result{}, err
+	}
+
+	// secrets referencing a Registry are handled like secrets naming its canonical host
+	catalog, err := loadRegistryCatalog(ctx, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	catalog.expand(imgr.Spec.Secrets)
+
 	// TODO(fix): add fallthrough for neither, existingSecretRef, or full specification of creds being present
-	secretNames := []string{}
 	for _, secret := range imgr.Spec.Secrets {
 		if !secretIsFullySpecified(&secret) {
 			// skip this secret as it is not fully specified
 			log.Error(errors.NewBadRequest("Secret not fully specified"), "ImagePullSecret is not fully specified", "imagePullSecretManager", imgr.Name)
+		}
+	}
+
+	// resolve the secrets of this manager against all other managers in the namespace, only winning secrets are
+	// created and attached
+	res, err := resolveNamespace(ctx, r.Client, req.Namespace)
+	if err != nil {
+		log.Error(err, "Failed to resolve managers in namespace")
+		return ctrl.Result{}, err
+	}
+
+	// switch secrets with fallbacks to their next healthy credential, or back to a recovered one
+	failover, switches, requeueAfter := resolveFailover(imgr.Spec.Secrets, imgr.Status.Failover, imgr.Status.RateLimits, imgr.Status.PullFailures, time.Now())
+
+	ref := refForManager(imgr)
+	res.withFailover(ref, failover)
+	robots := map[string]bool{}
+	refused := []adoptionError{}
+	for _, winner := range res.winnersOf(ref) {
+		// create new dockerconfigjson secrets from the given name if they do not exist, and update their payload.
+		// Existing secret refs are present as localObjectReference, their name is attached as is
+		versionsExpireAfter, err := createOrUpdateCandidateSecrets(ctx, r.Client, providerDeps{
+			Tokens:                   r.ServiceAccounts,
+			PluginDir:                r.CredentialPluginDir,
+			PluginEnv:                r.CredentialPluginEnv,
+			NamespacedPlugins:        r.NamespacedCredentialPlugins,
+			NamespacedPluginEnv:      r.NamespacedCredentialPluginEnv,
+			NamespacedTokenEndpoints: r.NamespacedTokenEndpoints,
+			APIAudiences:             r.APIAudiences,
+		}, r.Scheme, imgr, req.Namespace, winner, robots)
+		if refusal, ok := asAdoptionError(err); ok {
+			log.Info("Existing secret is not taken over", "secret", refusal.Name, "reason", refusal.Reason)
+			refused = append(refused, *refusal)
 			continue
 		}
-		if secret.ExistingSecretRef.Name != "" {
-			// existing secret ref present as localObjectReference, just add the name to the string for annotation
-			secretNames = append(secretNames, secret.ExistingSecretRef.Name)
-		} else {
-			// create new dockerconfigjson secret from the given name if it does not exist, and update its payload
-			secretObj, err := r.CreateOrUpdateSecret(ctx, req, imgr, &secret)
-			if err != nil {
-				return ctrl.Result{}, err
-			}
-			secretNames = append(secretNames, secretObj.Name)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		requeueAfter = minRequeue(requeueAfter, versionsExpireAfter)
+		if err := harborRobotsInUse(ctx, r.Client, imgr, req.Namespace, winner, robots); err != nil {
+			return ctrl.Result{}, err
 		}
 	}
+	// robot accounts of secrets that lost their conflicts or were removed leave the scope of the manager
+	if err := pruneHarborRobots(ctx, r.Client, imgr, imgr.Spec.Secrets, robots); err != nil {
+		return ctrl.Result{}, err
+	}
 
-	s := strings.Join(secretNames, ",")
+	adoptions, err := secretAdoptions(ctx, r.Client, imgr, req.Namespace, refused)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := imgr.Status.DeepCopy()
+	meta.SetStatusCondition(&status.Conditions, conflictCondition(imgr.Generation, res.conflictsOf(ref)))
+	status.Failover = failover
+	status.Adoptions = adoptions
+	if !equality.Semantic.DeepEqual(status, &imgr.Status) {
+		imgr.Status = *status
+		if err := r.Status().Update(ctx, imgr); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	recordFailover(r.Recorder, imgr, switches)
 
 	// Depending on the mode, mark all "mode" resources in the namespace as reconcilable with
 	// the LocalObjectReference name set as annotation to consume from either PodController or
 	// ServiceAccountController
-
-	mode := imgr.Spec.Mode
-	if mode == cheironv1alpha1.PodMode {
-		return r.GetAndUpdatePods(ctx, req, s)
-	} else if mode == cheironv1alpha1.ServiceAccountMode {
-		return r.GetAndUpdateServiceAccounts(ctx, req, s)
-	} else {
-		err := errors.NewBadRequest("Value of mode spec is not supported")
-		log.Error(err, "Unsupported mode")
-		return ctrl.Result{}, err
-	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, annotateTargets(ctx, r.Client, &res)
 }
 
 // SetupWithManager sets up the controller with the Manager.
+// Changes to cluster managers can change the outcome of conflicts in every namespace, PodTemplateTargets register
+// new targets for Workload mode and Registries change the entries of secrets, hence all namespaced managers are
+// reconciled again on these changes.
 func (r *ImagePullSecretManagerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&cheironv1alpha1.ImagePullSecretManager{}).
-		Owns(&corev1.Secret{}).
+		Owns(&corev1.Secret{}, builder.WithPredicates(ownedSecretFilters())).
+		Watches(&source.Kind{Type: &cheironv1alpha1.ClusterImagePullSecretManager{}},
+			handler.EnqueueRequestsFromMapFunc(r.allManagers)).
+		Watches(&source.Kind{Type: &cheironv1alpha1.PodTemplateTarget{}},
+			handler.EnqueueRequestsFromMapFunc(r.allManagers)).
+		Watches(&source.Kind{Type: &cheironv1alpha1.Registry{}},
+			handler.EnqueueRequestsFromMapFunc(r.allManagers)).
 		Complete(r)
 }
+
+// allManagers maps any object to reconcile requests for all namespaced managers
+func (r *ImagePullSecretManagerReconciler) allManagers(_ client.Object) []reconcile.Request {
+	var managers cheironv1alpha1.ImagePullSecretManagerList
+	if err := r.List(context.Background(), &managers); err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, m := range managers.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: m.Name, Namespace: m.Namespace},
+		})
+	}
+	return requests
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+func TestSecretIsUpToDate(t *testing.T) {
+	owner := &cheironv1alpha1.ImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "shop", UID: "manager"}}
+	content := []byte(`{"auths":{"quay.io":{"auth":"dXNlcjpwYXNzd29yZA=="}}}`)
+	hash := contentHash(content)
+	secretOf := func(mutate func(*corev1.Secret)) *corev1.Secret {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "quay",
+				Namespace:       "shop",
+				Labels:          map[string]string{"team": "shop"},
+				Annotations:     map[string]string{contentHashAnnotation: hash, "note": "kept"},
+				OwnerReferences: []metav1.OwnerReference{controllerRef("ImagePullSecretManager", "team", "manager")},
+			},
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: content},
+		}
+		if mutate != nil {
+			mutate(secret)
+		}
+		return secret
+	}
+
+	tests := []struct {
+		name   string
+		secret *corev1.Secret
+		want   bool
+	}{
+		{name: "matching secrets are up to date", secret: secretOf(nil), want: true},
+		{name: "secrets of other controllers are outdated", secret: secretOf(func(s *corev1.Secret) {
+			s.OwnerReferences = []metav1.OwnerReference{controllerRef("SealedSecret", "quay", "other")}
+		})},
+		{name: "secrets with another recorded hash are outdated", secret: secretOf(func(s *corev1.Secret) {
+			s.Annotations[contentHashAnnotation] = "stale"
+		})},
+		{name: "secrets changed by others are outdated", secret: secretOf(func(s *corev1.Secret) {
+			s.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{}}`)
+		})},
+		{name: "secrets lacking a label are outdated", secret: secretOf(func(s *corev1.Secret) {
+			delete(s.Labels, "team")
+		})},
+		{name: "secrets with a changed annotation are outdated", secret: secretOf(func(s *corev1.Secret) {
+			s.Annotations["note"] = "changed"
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := secretIsUpToDate(tt.secret, owner, hash, map[string]string{"team": "shop"}, map[string]string{"note": "kept"})
+			if got != tt.want {
+				t.Errorf("secretIsUpToDate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeCounter counts the writes sent through it
+type writeCounter struct {
+	client.Client
+	writes int
+}
+
+func (w *writeCounter) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	w.writes++
+	return w.Client.Create(ctx, obj, opts...)
+}
+
+func (w *writeCounter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	w.writes++
+	return w.Client.Update(ctx, obj, opts...)
+}
+
+func TestCreateOrUpdateSecret(t *testing.T) {
+	owner := &cheironv1alpha1.ImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "shop", UID: "team-uid"}}
+	spec := basicSecret("quay", "quay.io")
+	c := &writeCounter{Client: fakeClient()}
+	labels, annotations := map[string]string{"team": "shop"}, map[string]string{"note": "kept"}
+
+	write := func() *corev1.Secret {
+		secret, err := createOrUpdateSecret(context.Background(), c, c.Scheme(), owner, "shop", &spec, labels, annotations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	write()
+	write()
+	if c.writes != 1 {
+		t.Errorf("unchanged secret written %d times, want once", c.writes)
+	}
+
+	// changes by others are overwritten
+	changed := write()
+	changed.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{}}`)
+	if err := c.Client.Update(context.Background(), changed); err != nil {
+		t.Fatal(err)
+	}
+	write()
+	spec.Password = "rotated"
+	secret := write()
+	if c.writes != 3 {
+		t.Errorf("secret written %d times, want 3", c.writes)
+	}
+	if hash := contentHash(secret.Data[corev1.DockerConfigJsonKey]); secret.Annotations[contentHashAnnotation] != hash || !metav1.IsControlledBy(secret, owner) {
+		t.Errorf("secret = %+v, want content hash %s controlled by the manager", secret, hash)
+	}
+}
+
+func TestOwnedSecretFilters(t *testing.T) {
+	base := newDockerSecretObj("quay", "shop")
+	base.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{}}`)
+	base.Annotations = map[string]string{contentHashAnnotation: "hash"}
+	base.Labels = map[string]string{"team": "shop"}
+	tests := []struct {
+		name   string
+		mutate func(*corev1.Secret)
+		want   bool
+	}{
+		{name: "usage annotations", mutate: func(s *corev1.Secret) { s.Annotations[usedByPodsAnnotation] = "3" }},
+		{name: "resource version", mutate: func(s *corev1.Secret) { s.ResourceVersion = "2" }},
+		{name: "content", mutate: func(s *corev1.Secret) { s.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{"quay.io":{}}}`) }, want: true},
+		{name: "content hash", mutate: func(s *corev1.Secret) { s.Annotations[contentHashAnnotation] = "other" }, want: true},
+		{name: "labels", mutate: func(s *corev1.Secret) { s.Labels["team"] = "batch" }, want: true},
+		{name: "owners", mutate: func(s *corev1.Secret) {
+			s.OwnerReferences = []metav1.OwnerReference{controllerRef("ImagePullSecretManager", "team", "team-uid")}
+		}, want: true},
+		{name: "deletion", mutate: func(s *corev1.Secret) { s.DeletionTimestamp = &metav1.Time{} }, want: true},
+		{name: "type", mutate: func(s *corev1.Secret) { s.Type = corev1.SecretTypeOpaque }, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := base.DeepCopy()
+			tt.mutate(updated)
+			if got := ownedSecretFilters().Update(event.UpdateEvent{ObjectOld: base, ObjectNew: updated}); got != tt.want {
+				t.Errorf("Update() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// originalImagesAnnotation records the images of rewritten containers before rewriting, keyed by container name
+var originalImagesAnnotation = "cheiron.anny.co/original-images"
+
+//+kubebuilder:rbac:groups=cheiron.anny.co,resources=registrymirrors,verbs=get;list;watch
+//+kubebuilder:webhook:path=/mutate-v1-pod-mirror,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=mirror.cheiron.anny.co,admissionReviewVersions=v1
+
+// RegistryMirrorInjector rewrites the images of pods to the RegistryMirrors of their registries and attaches the
+// secrets managers provide for the mirrors
+type RegistryMirrorInjector struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+// Handle rewrites the images of all containers and init containers of a pod
+func (m *RegistryMirrorInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := log.FromContext(ctx)
+
+	pod := &corev1.Pod{}
+	if err := m.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if _, ok := pod.Annotations[originalImagesAnnotation]; ok {
+		return admission.Allowed("images already rewritten")
+	}
+	// the namespace of pods created by controllers is only known from the request
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
+
+	mirrors, err := m.mirrorsFor(ctx, namespace)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(mirrors) == 0 {
+		return admission.Allowed("no mirrors apply to the namespace")
+	}
+
+	catalog, err := loadRegistryCatalog(ctx, m.Client)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	originals := map[string]string{}
+	used := map[string]bool{}
+	rewrite := func(c *corev1.Container) {
+		for _, mirror := range mirrors {
+			if image, ok := mirrorImage(c.Image, mirror.Spec); ok {
+				originals[c.Name] = c.Image
+				used[catalog.canonical(imageRegistry(image))] = true
+				c.Image = image
+				return
+			}
+		}
+	}
+	for i := range pod.Spec.InitContainers {
+		rewrite(&pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		rewrite(&pod.Spec.Containers[i])
+	}
+	if len(originals) == 0 {
+		return admission.Allowed("no images pulled from mirrored registries")
+	}
+
+	recorded, err := json.Marshal(originals)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[originalImagesAnnotation] = string(recorded)
+
+	if err := m.attachMirrorSecrets(ctx, pod, namespace, used); err != nil {
+		// the images are still rewritten, the pod may pull with the secrets of its service account
+		log.Error(err, "Unable to attach secrets of mirrors", "namespace", namespace)
+	}
+
+	marshaled, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// InjectDecoder injects the decoder of admission requests
+func (m *RegistryMirrorInjector) InjectDecoder(d *admission.Decoder) error {
+	m.decoder = d
+	return nil
+}
+
+// mirrorsFor returns the mirrors whose namespace selector matches the namespace, ordered by name s.t. the first of
+// several mirrors of the same source consistently wins
+func (m *RegistryMirrorInjector) mirrorsFor(ctx context.Context, namespace string) ([]cheironv1alpha1.RegistryMirror, error) {
+	var mirrors cheironv1alpha1.RegistryMirrorList
+	if err := m.Client.List(ctx, &mirrors); err != nil {
+		return nil, err
+	}
+	if len(mirrors.Items) == 0 {
+		return nil, nil
+	}
+	ns := &corev1.Namespace{}
+	if err := m.Client.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		return nil, err
+	}
+
+	matching := []cheironv1alpha1.RegistryMirror{}
+	for _, mirror := range mirrors.Items {
+		if selectsNamespace(mirror.Spec.NamespaceSelector, ns) {
+			matching = append(matching, mirror)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].Name < matching[j].Name })
+	return matching, nil
+}
+
+// attachMirrorSecrets adds the winning secrets of the namespace for the given registries to the imagePullSecrets of
+// the pod, regardless of the managers' modes, as pods rewritten to a mirror are unable to pull without them
+func (m *RegistryMirrorInjector) attachMirrorSecrets(ctx context.Context, pod *corev1.Pod, namespace string, registries map[string]bool) error {
+	res, err := resolveNamespace(ctx, m.Client, namespace)
+	if err != nil {
+		return err
+	}
+	if err := res.dropRefused(ctx, m.Client); err != nil {
+		return err
+	}
+	if err := res.resolveVersions(ctx, m.Client); err != nil {
+		return err
+	}
+	attached := map[string]bool{}
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		attached[ref.Name] = true
+	}
+	for _, w := range res.Winners {
+		if !registries[normalizeRegistry(w.Secret.Registry)] {
+			continue
+		}
+		for _, name := range w.attachedNames() {
+			if attached[name] {
+				continue
+			}
+			attached[name] = true
+			pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+		}
+	}
+	return nil
+}
+
+// mirrorImage returns the image rewritten to the mirror if it is pulled from the mirror's source registry. The
+// repository, tag and digest are kept, Docker Hub images are expanded to their full repository, e.g. nginx to
+// library/nginx, as pull-through caches expect them
+func mirrorImage(image string, mirror cheironv1alpha1.RegistryMirrorSpec) (string, bool) {
+	if image == "" || imageRegistry(image) != normalizeRegistry(mirror.Source) {
+		return "", false
+	}
+
+	repository := image
+	if i := strings.Index(image, "/"); i >= 0 {
+		host := image[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			repository = image[i+1:]
+		}
+	}
+	if normalizeRegistry(mirror.Source) == dockerHubRegistry && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+
+	return strings.TrimSuffix(mirror.Mirror, "/") + "/" + repository, true
+}
+
+// selectsNamespace reports whether an optional namespace selector matches the namespace, a nil selector matches all
+// namespaces and an invalid one none
+func selectsNamespace(namespaceSelector *metav1.LabelSelector, ns *corev1.Namespace) bool {
+	if namespaceSelector == nil {
+		return true
+	}
+	selector, err := metav1.LabelSelectorAsSelector(namespaceSelector)
+	return err == nil && selector.Matches(labels.Set(ns.Labels))
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// patchedPod returns the pod of the request with the add and replace operations of the response applied
+func patchedPod(t *testing.T, req admission.Request, resp admission.Response) *corev1.Pod {
+	var doc interface{}
+	if err := json.Unmarshal(req.Object.Raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range resp.Patches {
+		if op.Operation != "add" && op.Operation != "replace" {
+			t.Fatalf("unexpected patch %+v", op)
+		}
+		tokens := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+		parent := doc
+		for i, token := range tokens {
+			token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+			last := i == len(tokens)-1
+			switch node := parent.(type) {
+			case map[string]interface{}:
+				if last {
+					node[token] = op.Value
+				}
+				parent = node[token]
+			case []interface{}:
+				index, err := strconv.Atoi(token)
+				if err != nil || index >= len(node) {
+					t.Fatalf("unsupported patch %+v", op)
+				}
+				if last {
+					node[index] = op.Value
+				}
+				parent = node[index]
+			}
+		}
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(raw, pod); err != nil {
+		t.Fatal(err)
+	}
+	return pod
+}
+
+func TestMirrorImage(t *testing.T) {
+	hub := cheironv1alpha1.RegistryMirrorSpec{Source: "docker.io", Mirror: "mirror.example.com/hub/"}
+	quay := cheironv1alpha1.RegistryMirrorSpec{Source: "https://quay.io", Mirror: "mirror.example.com:5000/quay"}
+
+	tests := []struct {
+		name     string
+		image    string
+		mirror   cheironv1alpha1.RegistryMirrorSpec
+		want     string
+		mirrored bool
+	}{
+		{name: "official images are expanded to library", image: "nginx:1.21", mirror: hub, want: "mirror.example.com/hub/library/nginx:1.21", mirrored: true},
+		{name: "user images keep their repository", image: "bitnami/redis", mirror: hub, want: "mirror.example.com/hub/bitnami/redis", mirrored: true},
+		{name: "aliases of the source are mirrored", image: "index.docker.io/library/nginx", mirror: hub, want: "mirror.example.com/hub/library/nginx", mirrored: true},
+		{name: "digests are kept", image: "quay.io/prometheus/node-exporter@sha256:abc", mirror: quay, want: "mirror.example.com:5000/quay/prometheus/node-exporter@sha256:abc", mirrored: true},
+		{name: "images of other registries are left alone", image: "ghcr.io/anny-co/cheiron:latest", mirror: hub},
+		{name: "images of hosts with port are left alone", image: "localhost:5000/nginx", mirror: hub},
+		{name: "empty images are left alone", image: "", mirror: hub},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, mirrored := mirrorImage(tt.image, tt.mirror)
+			if got != tt.want || mirrored != tt.mirrored {
+				t.Errorf("mirrorImage(%q) = %q, %v, want %q, %v", tt.image, got, mirrored, tt.want, tt.mirrored)
+			}
+		})
+	}
+}
+
+func TestSelectsNamespace(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{"mirror": "true"}}}
+	tests := []struct {
+		name     string
+		selector *metav1.LabelSelector
+		want     bool
+	}{
+		{name: "no selector", want: true},
+		{name: "matching selector", selector: &metav1.LabelSelector{MatchLabels: map[string]string{"mirror": "true"}}, want: true},
+		{name: "other selector", selector: &metav1.LabelSelector{MatchLabels: map[string]string{"mirror": "false"}}},
+		{name: "invalid selector", selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "mirror", Operator: "Near"}}}},
+	}
+	for _, tt := range tests {
+		if got := selectsNamespace(tt.selector, ns); got != tt.want {
+			t.Errorf("selectsNamespace() of %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRegistryMirrorInjector(t *testing.T) {
+	decoder, err := admission.NewDecoder(clientgoscheme.Scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hubMirror := &cheironv1alpha1.RegistryMirror{
+		ObjectMeta: metav1.ObjectMeta{Name: "hub"},
+		Spec:       cheironv1alpha1.RegistryMirrorSpec{Source: "docker.io", Mirror: "mirror.example.com/hub"},
+	}
+	// the mirror of the quay namespace only applies to labeled namespaces
+	quayMirror := &cheironv1alpha1.RegistryMirror{
+		ObjectMeta: metav1.ObjectMeta{Name: "quay"},
+		Spec: cheironv1alpha1.RegistryMirrorSpec{Source: "quay.io", Mirror: "mirror.example.com/quay",
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"quay-mirror": "true"}}},
+	}
+	manager := namespacedManager("mirror", 0, "", basicSecret("mirror", "mirror.example.com"), basicSecret("ghcr", "ghcr.io"))
+	injector := &RegistryMirrorInjector{Client: fakeClient(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}},
+		hubMirror, quayMirror, &manager,
+	)}
+	if err := injector.InjectDecoder(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		pod         *corev1.Pod
+		wantImages  []string
+		wantSecrets []corev1.LocalObjectReference
+	}{
+		{
+			name: "rewritten images",
+			pod: &corev1.Pod{Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "migrate", Image: "quay.io/anny/migrate"}},
+				Containers:     []corev1.Container{{Name: "web", Image: "nginx"}, {Name: "app", Image: "ghcr.io/anny-co/app"}},
+			}},
+			wantImages:  []string{"quay.io/anny/migrate", "mirror.example.com/hub/library/nginx", "ghcr.io/anny-co/app"},
+			wantSecrets: pullSecretRefs("mirror"),
+		},
+		{
+			name:        "attached secret kept",
+			pod:         &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}}, ImagePullSecrets: pullSecretRefs("mirror")}},
+			wantImages:  []string{"mirror.example.com/hub/library/nginx"},
+			wantSecrets: pullSecretRefs("mirror"),
+		},
+		{
+			name:       "no mirrored images",
+			pod:        &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "ghcr.io/anny-co/app"}}}},
+			wantImages: []string{"ghcr.io/anny-co/app"},
+		},
+		{
+			name: "already rewritten",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{originalImagesAnnotation: `{"web":"nginx"}`}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}}},
+			},
+			wantImages: []string{"nginx"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := admissionRequest(t, tt.pod)
+			req.Namespace = "shop"
+			resp := injector.Handle(context.Background(), req)
+			if !resp.Allowed {
+				t.Fatalf("Handle() = %+v", resp)
+			}
+			pod := patchedPod(t, req, resp)
+			images := []string{}
+			for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+				images = append(images, c.Image)
+			}
+			if !reflect.DeepEqual(images, tt.wantImages) || !reflect.DeepEqual(pod.Spec.ImagePullSecrets, tt.wantSecrets) {
+				t.Errorf("Handle() images = %v with secrets %v, want %v with %v", images, pod.Spec.ImagePullSecrets, tt.wantImages, tt.wantSecrets)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// NodeCredential is the credential for the registry of an image answered to the kubelet
+type NodeCredential struct {
+	// Registry is the normalized host of the image's registry, which may be an alias of the Registry the credential
+	// is attached for
+	Registry string
+	Username string
+	Password string
+	// ExpiresAt is the time the credential expires, zero if it does not expire or its expiry is unknown
+	ExpiresAt time.Time
+}
+
+// NodeCredentials returns the credential cluster managers attach for the registry of an image, or nil if there is
+// none. Conflicts between cluster managers are resolved like in any namespace, the highest ranked winner is used.
+// Inline credentials are read from the spec of the manager, respecting pools and failover. Credentials of
+// existingSecretRefs and providers are only known to the managed secrets, which are read from secretNamespace if it
+// is given. Assignee spreads the nodes over the members of pools.
+func NodeCredentials(ctx context.Context, c client.Client, image, secretNamespace, assignee string) (*NodeCredential, error) {
+	catalog, err := loadRegistryCatalog(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	host := imageRegistry(image)
+	registry := catalog.canonical(host)
+	var clusterManagers cheironv1alpha1.ClusterImagePullSecretManagerList
+	if err := c.List(ctx, &clusterManagers); err != nil {
+		return nil, err
+	}
+	catalog.expandManagers(nil, clusterManagers.Items)
+	res := resolveSecrets(secretNamespace, nil, clusterManagers.Items)
+
+	for _, w := range res.Winners {
+		if normalizeRegistry(w.Secret.Registry) != registry {
+			continue
+		}
+		spec := &w.Secret
+		switch {
+		case spec.ExistingSecretRef.Name != "" || spec.Provider != nil:
+			if secretNamespace == "" {
+				continue
+			}
+			credential, err := managedCredential(ctx, c, secretNamespace, w, registry)
+			if err != nil {
+				return nil, err
+			}
+			if credential == nil {
+				continue
+			}
+			credential.Registry = host
+			return credential, nil
+		case spec.Pool != nil:
+			spec = memberSpec(spec, w.selectPoolMember(assignee, -1, nil), spec.Name)
+		case hasFallbacks(spec):
+			spec = credentialAt(spec, activeCredential(spec, w.Failover))
+		}
+		return &NodeCredential{Registry: host, Username: spec.Username, Password: spec.Password}, nil
+	}
+	return nil, nil
+}
+
+// managedCredential reads the credential for a registry from the secret attached for a candidate in a namespace, nil
+// is returned if the secret does not exist (yet)
+func managedCredential(ctx context.Context, c client.Client, namespace string, cand candidate, registry string) (*NodeCredential, error) {
+	var secret *corev1.Secret
+	var err error
+	if cand.Secret.ExistingSecretRef.Name != "" {
+		secret = &corev1.Secret{}
+		err = c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: cand.Secret.ExistingSecretRef.Name}, secret)
+		if client.IgnoreNotFound(err) == nil && err != nil {
+			return nil, nil
+		}
+	} else {
+		secret, err = currentCandidateSecret(ctx, c, namespace, cand)
+		if errors.IsForbidden(err) && cand.versioned() {
+			return nil, fmt.Errorf("versions of secret %s are only found with list access to the secrets of namespace %s: %w", cand.Secret.Name, namespace, err)
+		}
+	}
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	var config DockerConfigJSON
+	if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+		return nil, fmt.Errorf("secret %s/%s holds no valid %s: %w", secret.Namespace, secret.Name, corev1.DockerConfigJsonKey, err)
+	}
+	for host, entry := range config.Auths {
+		if normalizeRegistry(host) != registry {
+			continue
+		}
+		if entry.Username == "" && entry.Auth != "" {
+			// secrets not written by cheiron may only carry the encoded auth field
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("secret %s/%s holds an invalid auth for %s: %w", secret.Namespace, secret.Name, host, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) == 2 {
+				entry.Username, entry.Password = parts[0], parts[1]
+			}
+		}
+		credential := &NodeCredential{Registry: registry, Username: entry.Username, Password: entry.Password}
+		if expiresAt, err := time.Parse(time.RFC3339, secret.Annotations[expiresAtAnnotation]); err == nil {
+			credential.ExpiresAt = expiresAt
+		}
+		return credential, nil
+	}
+	return nil, nil
+}
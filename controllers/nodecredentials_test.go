@@ -0,0 +1,126 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// nodeSecret returns a dockerconfigjson secret of the namespace kube-system
+func nodeSecret(name, config string, annotations map[string]string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "kube-system", Annotations: annotations},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(config)},
+	}
+}
+
+func TestNodeCredentials(t *testing.T) {
+	expiresAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	quay := basicSecret("quay", "quay.io")
+	quay.Username = "low"
+	preferred := basicSecret("quay", "https://quay.io/v2/")
+	preferred.Username = "high"
+	dockerHub := basicSecret("dockerhub", "https://index.docker.io/v1/")
+	harbor := basicSecret("harbor", "harbor.example.com")
+	existing := cheironv1alpha1.ImagePullSecretSpec{Name: "gitlab", Registry: "registry.gitlab.com", ExistingSecretRef: corev1.LocalObjectReference{Name: "gitlab-pull"}}
+	missing := cheironv1alpha1.ImagePullSecretSpec{Name: "ghcr", Registry: "ghcr.io", ExistingSecretRef: corev1.LocalObjectReference{Name: "ghcr-pull"}}
+	ecr := cheironv1alpha1.ImagePullSecretSpec{
+		Name:     "ecr",
+		Registry: "123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		Provider: &cheironv1alpha1.CredentialProvider{ECR: &cheironv1alpha1.ECRProvider{Region: "eu-central-1", CredentialsSecretRef: secretRef("aws")}},
+	}
+	low, high := clusterManager("low", 0, "", quay, dockerHub, harbor, existing, missing, ecr), clusterManager("high", 10, "", preferred)
+	objs := []client.Object{
+		&low, &high,
+		&cheironv1alpha1.Registry{ObjectMeta: metav1.ObjectMeta{Name: "harbor"}, Spec: cheironv1alpha1.RegistrySpec{Host: "harbor.example.com", Aliases: []string{"harbor.internal"}}},
+		nodeSecret("gitlab-pull", `{"auths":{"registry.gitlab.com":{"auth":"`+base64.StdEncoding.EncodeToString([]byte("deploy:token"))+`"}}}`, nil),
+		nodeSecret("ecr", `{"auths":{"123456789012.dkr.ecr.eu-central-1.amazonaws.com":{"username":"AWS","password":"ecr-token"}}}`,
+			map[string]string{expiresAtAnnotation: expiresAt.Format(time.RFC3339)}),
+	}
+	c := fakeClient(objs...)
+
+	tests := []struct {
+		name            string
+		image           string
+		secretNamespace string
+		want            *NodeCredential
+	}{
+		{name: "highest ranked manager", image: "quay.io/anny/app:1.0", want: &NodeCredential{Registry: "quay.io", Username: "high", Password: "password"}},
+		{name: "Docker Hub image without host", image: "bitnami/redis", want: &NodeCredential{Registry: "docker.io", Username: "user", Password: "password"}},
+		{name: "alias of Registry", image: "harbor.internal/shop/app", want: &NodeCredential{Registry: "harbor.internal", Username: "user", Password: "password"}},
+		{name: "registry without secret", image: "registry.example.org/app", want: nil},
+		{name: "existing secret without secret namespace", image: "registry.gitlab.com/anny/app", want: nil},
+		{name: "existing secret", image: "registry.gitlab.com/anny/app", secretNamespace: "kube-system", want: &NodeCredential{Registry: "registry.gitlab.com", Username: "deploy", Password: "token"}},
+		{name: "missing existing secret", image: "ghcr.io/anny/app", secretNamespace: "kube-system", want: nil},
+		{
+			name:            "managed secret of provider",
+			image:           "123456789012.dkr.ecr.eu-central-1.amazonaws.com/app",
+			secretNamespace: "kube-system",
+			want:            &NodeCredential{Registry: "123456789012.dkr.ecr.eu-central-1.amazonaws.com", Username: "AWS", Password: "ecr-token", ExpiresAt: expiresAt},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NodeCredentials(context.Background(), c, tt.image, tt.secretNamespace, "node-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && (got.Registry != tt.want.Registry || got.Username != tt.want.Username ||
+				got.Password != tt.want.Password || !got.ExpiresAt.Equal(tt.want.ExpiresAt)) {
+				t.Errorf("NodeCredentials() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagedCredential(t *testing.T) {
+	cand := candidate{Secret: cheironv1alpha1.ImagePullSecretSpec{Name: "quay", Registry: "quay.io", ExistingSecretRef: corev1.LocalObjectReference{Name: "quay-pull"}}}
+	tests := []struct {
+		name   string
+		config string
+		want   *NodeCredential
+		fails  bool
+	}{
+		{name: "username and password", config: `{"auths":{"https://quay.io":{"username":"robot","password":"secret"}}}`, want: &NodeCredential{Registry: "quay.io", Username: "robot", Password: "secret"}},
+		{name: "auth only", config: `{"auths":{"quay.io":{"auth":"cm9ib3Q6c2VjcmV0"}}}`, want: &NodeCredential{Registry: "quay.io", Username: "robot", Password: "secret"}},
+		{name: "other registry", config: `{"auths":{"ghcr.io":{"username":"robot","password":"secret"}}}`},
+		{name: "invalid auth", config: `{"auths":{"quay.io":{"auth":"%%%"}}}`, fails: true},
+		{name: "invalid config", config: `{"auths":`, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fakeClient(nodeSecret("quay-pull", tt.config, nil))
+			got, err := managedCredential(context.Background(), c, "kube-system", cand, "quay.io")
+			if (err != nil) != tt.fails {
+				t.Fatalf("managedCredential() error = %v, want error %v", err, tt.fails)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("managedCredential() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
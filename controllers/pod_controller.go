@@ -18,9 +18,9 @@ package controllers
 
 import (
 	"context"
-	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -33,9 +33,9 @@ type ImagePullSecretManagerPodReconciler struct {
 	Scheme *runtime.Scheme
 }
 
-//+kubebuilder:rbac:groups=cheiron.anny.co,resources=pods,verbs=get;list;watch;update;patch
-//+kubebuilder:rbac:groups=cheiron.anny.co,resources=pods/status,verbs=get;update;patch
-//+kubebuilder:rbac:groups=cheiron.anny.co,resources=pods/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=pods/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=pods/finalizers,verbs=update
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -61,7 +61,7 @@ func (r *ImagePullSecretManagerPodReconciler) Reconcile(ctx context.Context, req
 	isReconcilable, isReconcilablePresent := annotations[reconcilableAnnotation]
 	reconcileWith, isReconcilableWithPresent := annotations[reconcileWithAnnotation]
 
-	if !isReconcilablePresent || isReconcilable != "true" {
+	if !isReconcilablePresent || isReconcilable != "true" || annotations[ignoreAnnotation] == "true" {
 		log.Info("Resource is marked as non-reconcilable", "pod", pod.Name)
 		return ctrl.Result{}, nil
 	}
@@ -70,29 +70,19 @@ func (r *ImagePullSecretManagerPodReconciler) Reconcile(ctx context.Context, req
 		log.Info("No secrets attached to the resource, not adding secrets", "pod", pod.Name)
 	}
 
-	secrets := strings.Split(reconcileWith, ",")
-
-	imagePullSecrets := []corev1.LocalObjectReference{}
-
-	for _, s := range secrets {
-		imagePullSecrets = append(imagePullSecrets, corev1.LocalObjectReference{
-			Name: strings.TrimSpace(s),
-		})
-	}
-
-	pod.Spec.ImagePullSecrets = imagePullSecrets
-
-	// mark pod as reconciled s.t. later reconciles don't pick up this pod again (see filters())
-	pod.Annotations[reconciledAnnotation] = "true"
-
-	if err := r.Update(ctx, pod); err != nil {
+	// apply the secrets under cheiron's field manager, only the cheiron annotations and imagePullSecrets entries are
+	// owned by cheiron s.t. other tools managing the pod are not overwritten
+	if err := applyPullSecrets(ctx, r.Client, pod, podPullSecrets, splitSecretNames(reconcileWith)); err != nil {
+		if errors.IsInvalid(err) {
+			// imagePullSecrets of running pods are immutable
+			log.Info("Cannot attach imagePullSecrets to existing pod", "pod", pod.Name)
+			return ctrl.Result{}, nil
+		}
 		return ctrl.Result{}, err
 	}
 
 	log.Info("Updated Pod with imagePullSecrets", "pod", pod.Name)
 
-	// TODO(fix): clarify if this operator's actions would clash with flux operator
-
 	return ctrl.Result{}, nil
 }
 
@@ -0,0 +1,224 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// PodTemplateTargetReconciler reconciles a PodTemplateTarget object by watching the registered kind dynamically
+type PodTemplateTargetReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	mgr     ctrl.Manager
+	mu      sync.Mutex
+	watched map[schema.GroupVersionKind]bool
+}
+
+//+kubebuilder:rbac:groups=cheiron.anny.co,resources=podtemplatetargets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=cheiron.anny.co,resources=podtemplatetargets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=cheiron.anny.co,resources=podtemplatetargets/finalizers,verbs=update
+
+// parsePullSecretsPath parses a JSONPath such as {.spec.podTemplate.imagePullSecrets} to a field path
+func parsePullSecretsPath(jsonPath string) ([]string, error) {
+	path := strings.TrimSpace(jsonPath)
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "{"), "}")
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if strings.ContainsAny(path, "[]*") {
+		return nil, fmt.Errorf("path %q must neither contain list indices nor wildcards", jsonPath)
+	}
+	fields := strings.Split(path, ".")
+	for _, field := range fields {
+		if field == "" {
+			return nil, fmt.Errorf("path %q contains an empty field", jsonPath)
+		}
+	}
+	if len(fields) < 2 {
+		// the parent object of the list is hashed to detect template changes, which cannot be the whole ressource
+		return nil, fmt.Errorf("path %q must point to a list nested in an object", jsonPath)
+	}
+	return fields, nil
+}
+
+// targetWorkloadKind returns the workload kind registered by a PodTemplateTarget. Lists of custom resources are atomic
+// for server-side apply unless their schema says otherwise, hence they are always treated as atomic.
+func targetWorkloadKind(target *cheironv1alpha1.PodTemplateTarget) (workloadKind, error) {
+	kind := workloadKind{GroupVersionKind: schema.GroupVersionKind{
+		Group:   target.Spec.Group,
+		Version: target.Spec.Version,
+		Kind:    target.Spec.Kind,
+	}}
+	for _, p := range target.Spec.Paths {
+		path, err := parsePullSecretsPath(p)
+		if err != nil {
+			return workloadKind{}, err
+		}
+		kind.PullSecrets = append(kind.PullSecrets, pullSecretsList{Path: path, Atomic: true})
+	}
+	return kind, nil
+}
+
+// allWorkloadKinds returns the built-in workload kinds together with all kinds registered through PodTemplateTargets
+func allWorkloadKinds(ctx context.Context, c client.Client) ([]workloadKind, error) {
+	var targets cheironv1alpha1.PodTemplateTargetList
+	if err := c.List(ctx, &targets); err != nil {
+		return nil, err
+	}
+	kinds := append([]workloadKind{}, workloadKinds...)
+	for i := range targets.Items {
+		target := &targets.Items[i]
+		if target.DeletionTimestamp != nil {
+			continue
+		}
+		kind, err := targetWorkloadKind(target)
+		if err != nil {
+			continue
+		}
+		if existing, ok := findWorkloadKind(kinds, kind.GroupVersionKind); ok {
+			// several targets for the same kind add up their paths
+			for j := range kinds {
+				if kinds[j].GroupVersionKind == existing.GroupVersionKind {
+					kinds[j].PullSecrets = append(append([]pullSecretsList{}, kinds[j].PullSecrets...), kind.PullSecrets...)
+				}
+			}
+			continue
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// Reconcile validates the target and starts watching its kind through the unstructured client. The managers attach
+// their secrets to the ressources of the kind in Workload mode, see annotateTargets().
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.9.2/pkg/reconcile
+func (r *PodTemplateTargetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	target := &cheironv1alpha1.PodTemplateTarget{}
+	if err := r.Get(ctx, req.NamespacedName, target); err != nil {
+		if errors.IsNotFound(err) {
+			// the watch of the kind keeps running, but the workload reconciler ignores kinds without target
+			log.Info("PodTemplateTarget CR not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Unable to fetch PodTemplateTarget")
+		return ctrl.Result{}, err
+	}
+
+	var result ctrl.Result
+	condition := metav1.Condition{
+		Type:               cheironv1alpha1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: target.Generation,
+		Reason:             cheironv1alpha1.ReasonWatching,
+		Message:            "Watching " + target.Spec.Kind,
+	}
+
+	kind, err := targetWorkloadKind(target)
+	if err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = cheironv1alpha1.ReasonInvalidPaths
+		condition.Message = err.Error()
+	} else if _, err := r.RESTMapper().RESTMapping(kind.GroupKind(), kind.Version); err != nil {
+		// starting a watch on a kind the API server does not know fails the whole manager, wait for the CRD instead
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = cheironv1alpha1.ReasonKindNotFound
+		condition.Message = err.Error()
+		result.RequeueAfter = time.Minute
+	} else if err := r.checkAccess(ctx, kind.GroupVersionKind); errors.IsForbidden(err) {
+		// the aggregated ClusterRole of cheiron has no rules for the kind (yet), managers skip the kind meanwhile
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = cheironv1alpha1.ReasonForbidden
+		condition.Message = err.Error()
+		result.RequeueAfter = time.Minute
+	} else if err != nil {
+		return ctrl.Result{}, err
+	} else if err := r.watch(kind.GroupVersionKind); err != nil {
+		log.Error(err, "Failed to watch kind", "kind", kind.GroupVersionKind)
+		return ctrl.Result{}, err
+	}
+
+	status := target.Status.DeepCopy()
+	meta.SetStatusCondition(&status.Conditions, condition)
+	if !equality.Semantic.DeepEqual(status, &target.Status) {
+		target.Status = *status
+		if err := r.Status().Update(ctx, target); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return result, nil
+}
+
+// checkAccess lists a single ressource of the given kind to find out whether cheiron may access the kind at all
+func (r *PodTemplateTargetReconciler) checkAccess(ctx context.Context, gvk schema.GroupVersionKind) error {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	return r.List(ctx, list, client.Limit(1))
+}
+
+// watch starts a controller for the given kind unless there already is one. Controllers cannot be removed from a
+// running manager, so the controller of a kind keeps running once started.
+func (r *PodTemplateTargetReconciler) watch(gvk schema.GroupVersionKind) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, builtin := findWorkloadKind(workloadKinds, gvk); builtin || r.watched[gvk] {
+		return nil
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	err := ctrl.NewControllerManagedBy(r.mgr).
+		Named("podtemplatetarget-" + strings.ToLower(gvk.Kind) + "." + gvk.Group).
+		For(obj).
+		WithEventFilter(workloadFilters()).
+		Complete(&workloadReconciler{Client: r.Client, GroupVersionKind: gvk})
+	if err != nil {
+		return err
+	}
+	r.watched[gvk] = true
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PodTemplateTargetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.mgr = mgr
+	r.watched = map[schema.GroupVersionKind]bool{}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&cheironv1alpha1.PodTemplateTarget{}).
+		Complete(r)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// targetClient serves the kinds of a RESTMapper and refuses to list unstructured ressources if forbidden is set
+type targetClient struct {
+	client.Client
+	mapper    meta.RESTMapper
+	forbidden bool
+}
+
+func (c *targetClient) RESTMapper() meta.RESTMapper {
+	return c.mapper
+}
+
+func (c *targetClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if u, ok := list.(*unstructured.UnstructuredList); ok {
+		if c.forbidden {
+			return errors.NewForbidden(schema.GroupResource{Group: u.GroupVersionKind().Group, Resource: "workflows"}, "", nil)
+		}
+		return nil
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+// podTemplateTarget returns a PodTemplateTarget of Argo Workflows with the given paths
+func podTemplateTarget(name string, paths ...string) *cheironv1alpha1.PodTemplateTarget {
+	return &cheironv1alpha1.PodTemplateTarget{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       cheironv1alpha1.PodTemplateTargetSpec{Group: "argoproj.io", Version: "v1alpha1", Kind: "Workflow", Paths: paths},
+	}
+}
+
+func TestParsePullSecretsPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []string
+		invalid bool
+	}{
+		{path: "{.spec.podTemplate.imagePullSecrets}", want: []string{"spec", "podTemplate", "imagePullSecrets"}},
+		{path: "$.spec.imagePullSecrets", want: []string{"spec", "imagePullSecrets"}},
+		{path: " .spec.template.spec.imagePullSecrets ", want: []string{"spec", "template", "spec", "imagePullSecrets"}},
+		{path: ".spec.templates[*].imagePullSecrets", invalid: true},
+		{path: ".spec..imagePullSecrets", invalid: true},
+		{path: ".imagePullSecrets", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := parsePullSecretsPath(tt.path)
+			if (err != nil) != tt.invalid {
+				t.Fatalf("parsePullSecretsPath() error = %v, invalid %v", err, tt.invalid)
+			}
+			if !tt.invalid && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePullSecretsPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllWorkloadKinds(t *testing.T) {
+	c := fakeClient(
+		podTemplateTarget("workflows", ".spec.podSpecPatch.imagePullSecrets"),
+		podTemplateTarget("workflow-templates", ".spec.templates.imagePullSecrets"),
+		podTemplateTarget("invalid", ".spec.templates[0].imagePullSecrets"),
+	)
+	kinds, err := allWorkloadKinds(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kinds) != len(workloadKinds)+1 {
+		t.Fatalf("allWorkloadKinds() returned %d kinds, want the built-in ones and Workflow", len(kinds))
+	}
+	workflow, ok := findWorkloadKind(kinds, schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Workflow"})
+	if !ok {
+		t.Fatalf("allWorkloadKinds() lacks Workflow")
+	}
+	paths := [][]string{}
+	for _, list := range workflow.PullSecrets {
+		if !list.Atomic {
+			t.Errorf("list %v of a custom resource is not atomic", list.Path)
+		}
+		paths = append(paths, list.Path)
+	}
+	want := [][]string{{"spec", "templates", "imagePullSecrets"}, {"spec", "podSpecPatch", "imagePullSecrets"}}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("Workflow paths = %v, want the paths of both valid targets %v", paths, want)
+	}
+}
+
+func TestPodTemplateTargetReconcile(t *testing.T) {
+	workflow := schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Workflow"}
+	tests := []struct {
+		name      string
+		target    *cheironv1alpha1.PodTemplateTarget
+		served    bool
+		forbidden bool
+		reason    string
+		requeue   bool
+	}{
+		{name: "invalid paths", target: podTemplateTarget("workflows", ".spec.templates[*].imagePullSecrets"), served: true, reason: cheironv1alpha1.ReasonInvalidPaths},
+		{name: "kind not served", target: podTemplateTarget("workflows", ".spec.podSpecPatch.imagePullSecrets"), reason: cheironv1alpha1.ReasonKindNotFound, requeue: true},
+		{name: "kind not permitted", target: podTemplateTarget("workflows", ".spec.podSpecPatch.imagePullSecrets"), served: true, forbidden: true, reason: cheironv1alpha1.ReasonForbidden, requeue: true},
+		{name: "kind watched", target: podTemplateTarget("workflows", ".spec.podSpecPatch.imagePullSecrets"), served: true, reason: cheironv1alpha1.ReasonWatching},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapper := meta.NewDefaultRESTMapper(nil)
+			if tt.served {
+				mapper.Add(workflow, meta.RESTScopeNamespace)
+			}
+			c := &targetClient{Client: fakeClient(tt.target), mapper: mapper, forbidden: tt.forbidden}
+			// the controller of the kind runs already, which leaves the manager out of the test
+			r := &PodTemplateTargetReconciler{Client: c, watched: map[schema.GroupVersionKind]bool{workflow: true}}
+			result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(tt.target)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if requeue := result.RequeueAfter > 0; requeue != tt.requeue {
+				t.Errorf("requeue = %v, want %v", requeue, tt.requeue)
+			}
+			updated := &cheironv1alpha1.PodTemplateTarget{}
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(tt.target), updated); err != nil {
+				t.Fatal(err)
+			}
+			condition := meta.FindStatusCondition(updated.Status.Conditions, cheironv1alpha1.ConditionReady)
+			if condition == nil || condition.Reason != tt.reason {
+				t.Errorf("Ready condition = %+v, want reason %s", condition, tt.reason)
+			}
+		})
+	}
+}
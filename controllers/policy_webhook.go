@@ -0,0 +1,182 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+//+kubebuilder:rbac:groups=cheiron.anny.co,resources=clusterimagepullsecretpolicies,verbs=get;list;watch
+//+kubebuilder:webhook:path=/validate-v1-pod-policy,mutating=false,failurePolicy=fail,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=policy.cheiron.anny.co,admissionReviewVersions=v1
+
+// ImagePullSecretPolicyValidator rejects or warns about pods violating a ClusterImagePullSecretPolicy, i.e. pulling
+// from registries not allowed or without credentials for registries requiring them. Validating webhooks run after
+// all mutating webhooks, so images rewritten to mirrors and secrets attached for them are validated. The webhook fails
+// closed, the system namespaces and the namespace of cheiron are excluded by the namespaceSelector of
+// config/webhook/policy_namespaceselector_patch.yaml, s.t. cheiron can start while its webhook is unavailable.
+type ImagePullSecretPolicyValidator struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+// Handle validates all containers and init containers of a pod against the policies selecting its namespace
+func (v *ImagePullSecretPolicyValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := v.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
+
+	var policies cheironv1alpha1.ClusterImagePullSecretPolicyList
+	if err := v.Client.List(ctx, &policies); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(policies.Items) == 0 {
+		return admission.Allowed("no policies")
+	}
+	ns := &corev1.Namespace{}
+	if err := v.Client.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	catalog, err := loadRegistryCatalog(ctx, v.Client)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	hosts, err := v.credentialHosts(ctx, pod, namespace)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	denials, warnings := []string{}, []string{}
+	sort.Slice(policies.Items, func(i, j int) bool { return policies.Items[i].Name < policies.Items[j].Name })
+	for _, policy := range policies.Items {
+		if !selectsNamespace(policy.Spec.NamespaceSelector, ns) {
+			continue
+		}
+		violations := policyViolations(policy.Spec, pod, catalog, hosts)
+		for _, violation := range violations {
+			msg := fmt.Sprintf("%s (ClusterImagePullSecretPolicy %s)", violation, policy.Name)
+			if policy.Spec.Action == cheironv1alpha1.WarnAction {
+				warnings = append(warnings, msg)
+			} else {
+				denials = append(denials, msg)
+			}
+		}
+	}
+	if len(denials) > 0 {
+		return admission.Denied(strings.Join(denials, "; ")).WithWarnings(warnings...)
+	}
+	return admission.Allowed("").WithWarnings(warnings...)
+}
+
+// InjectDecoder injects the decoder of admission requests
+func (v *ImagePullSecretPolicyValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// credentialHosts returns the registry hosts the imagePullSecrets of the pod and of its service account hold
+// credentials for. Secrets that do not exist (yet) hold no credentials
+func (v *ImagePullSecretPolicyValidator) credentialHosts(ctx context.Context, pod *corev1.Pod, namespace string) ([]string, error) {
+	refs := append([]corev1.LocalObjectReference{}, pod.Spec.ImagePullSecrets...)
+	name := pod.Spec.ServiceAccountName
+	if name == "" {
+		name = "default"
+	}
+	sa := &corev1.ServiceAccount{}
+	if err := v.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, sa); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+	} else {
+		refs = append(refs, sa.ImagePullSecrets...)
+	}
+
+	hosts := []string{}
+	for _, ref := range refs {
+		secret := &corev1.Secret{}
+		if err := v.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, secret); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		// legacy .dockercfg secrets hold the auths map without the enclosing object
+		var config DockerConfigJSON
+		if data, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+			_ = json.Unmarshal(data, &config)
+		} else if data, ok := secret.Data[corev1.DockerConfigKey]; ok {
+			_ = json.Unmarshal(data, &config.Auths)
+		}
+		for host := range config.Auths {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// policyViolations returns a message for each image of the pod pulled from a registry not allowed by the policy, or
+// without credentials from a registry requiring them
+func policyViolations(policy cheironv1alpha1.ClusterImagePullSecretPolicySpec, pod *corev1.Pod, catalog registryCatalog, hosts []string) []string {
+	violations := []string{}
+	check := func(c corev1.Container) {
+		host := imageRegistry(c.Image)
+		if len(policy.AllowedRegistries) > 0 && !coversRegistry(catalog, policy.AllowedRegistries, host) {
+			violations = append(violations, fmt.Sprintf("image %s of container %s is pulled from registry %s, which is not allowed",
+				c.Image, c.Name, host))
+			return
+		}
+		if coversRegistry(catalog, policy.CredentialsRequired, host) && !coversRegistry(catalog, hosts, host) {
+			violations = append(violations, fmt.Sprintf("image %s of container %s is pulled from registry %s, which requires credentials the pod's imagePullSecrets and service account lack",
+				c.Image, c.Name, host))
+		}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		check(c)
+	}
+	for _, c := range pod.Spec.Containers {
+		check(c)
+	}
+	return violations
+}
+
+// coversRegistry reports whether any of the hosts or patterns refers to the registry host, directly or as host, alias
+// or pattern of the same Registry
+func coversRegistry(catalog registryCatalog, patterns []string, host string) bool {
+	canonical := catalog.canonical(host)
+	for _, pattern := range patterns {
+		if matchesRegistry(pattern, host) || catalog.canonical(pattern) == canonical {
+			return true
+		}
+	}
+	return false
+}
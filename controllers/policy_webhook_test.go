@@ -0,0 +1,201 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// podWithImages returns a pod with an init container of the first image and containers of the remaining ones
+func podWithImages(images ...string) *corev1.Pod {
+	pod := &corev1.Pod{}
+	for i, image := range images {
+		container := corev1.Container{Name: fmt.Sprintf("c%d", i), Image: image}
+		if i == 0 {
+			pod.Spec.InitContainers = append(pod.Spec.InitContainers, container)
+			continue
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, container)
+	}
+	return pod
+}
+
+func TestPolicyViolations(t *testing.T) {
+	catalog := registryCatalog{registries: map[string]cheironv1alpha1.RegistrySpec{
+		"internal": {Host: "registry.example.com", Aliases: []string{"cr.example.com"}},
+	}}
+
+	tests := []struct {
+		name   string
+		policy cheironv1alpha1.ClusterImagePullSecretPolicySpec
+		pod    *corev1.Pod
+		hosts  []string
+		want   []string
+	}{
+		{
+			name: "pods are allowed by an empty policy",
+			pod:  podWithImages("busybox", "quay.io/app"),
+		},
+		{
+			name:   "images of registries not allowed are reported",
+			policy: cheironv1alpha1.ClusterImagePullSecretPolicySpec{AllowedRegistries: []string{"quay.io"}},
+			pod:    podWithImages("busybox", "quay.io/app", "ghcr.io/app"),
+			want:   []string{"image busybox of container c0 is pulled from registry docker.io", "image ghcr.io/app of container c2 is pulled from registry ghcr.io"},
+		},
+		{
+			name:   "registries are allowed by pattern",
+			policy: cheironv1alpha1.ClusterImagePullSecretPolicySpec{AllowedRegistries: []string{"*.dkr.ecr.*.amazonaws.com"}},
+			pod:    podWithImages("123456789012.dkr.ecr.eu-west-1.amazonaws.com/app"),
+		},
+		{
+			name:   "registries are allowed by alias of a Registry",
+			policy: cheironv1alpha1.ClusterImagePullSecretPolicySpec{AllowedRegistries: []string{"registry.example.com"}},
+			pod:    podWithImages("cr.example.com/app"),
+		},
+		{
+			name:   "images without required credentials are reported",
+			policy: cheironv1alpha1.ClusterImagePullSecretPolicySpec{CredentialsRequired: []string{"quay.io", "registry.example.com"}},
+			pod:    podWithImages("busybox", "quay.io/app", "cr.example.com/app"),
+			hosts:  []string{"https://quay.io"},
+			want:   []string{"image cr.example.com/app of container c2 is pulled from registry cr.example.com, which requires credentials"},
+		},
+		{
+			name:   "credentials for an alias satisfy the Registry",
+			policy: cheironv1alpha1.ClusterImagePullSecretPolicySpec{CredentialsRequired: []string{"registry.example.com"}},
+			pod:    podWithImages("registry.example.com/app"),
+			hosts:  []string{"cr.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policyViolations(tt.policy, tt.pod, catalog, tt.hosts)
+			if len(got) != len(tt.want) {
+				t.Fatalf("violations = %v, want %d", got, len(tt.want))
+			}
+			for i := range got {
+				if !strings.HasPrefix(got[i], tt.want[i]) {
+					t.Errorf("violation %d = %q, want prefix %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCredentialHosts(t *testing.T) {
+	legacy := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "shop"},
+		Type:       corev1.SecretTypeDockercfg,
+		Data:       map[string][]byte{corev1.DockerConfigKey: []byte(`{"https://index.docker.io/v1/":{"auth":"dXNlcjpwYXNzd29yZA=="}}`)},
+	}
+	builder := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "builder", Namespace: "shop"}, ImagePullSecrets: pullSecretRefs("legacy")}
+	v := &ImagePullSecretPolicyValidator{Client: fakeClient(
+		authSecret("quay", map[string]string{"quay.io": "team"}),
+		authSecret("ghcr", map[string]string{"ghcr.io": "team"}),
+		legacy, builder,
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "shop"}, ImagePullSecrets: pullSecretRefs("ghcr")},
+	)}
+
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want []string
+	}{
+		{name: "secrets of the pod and default service account", pod: &corev1.Pod{Spec: corev1.PodSpec{ImagePullSecrets: pullSecretRefs("quay", "missing")}}, want: []string{"ghcr.io", "quay.io"}},
+		{name: "legacy secret of service account", pod: &corev1.Pod{Spec: corev1.PodSpec{ServiceAccountName: "builder"}}, want: []string{"https://index.docker.io/v1/"}},
+		{name: "missing service account", pod: &corev1.Pod{Spec: corev1.PodSpec{ServiceAccountName: "missing"}}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, err := v.credentialHosts(context.Background(), tt.pod, "shop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(hosts)
+			if !reflect.DeepEqual(hosts, tt.want) {
+				t.Errorf("credentialHosts() = %v, want %v", hosts, tt.want)
+			}
+		})
+	}
+}
+
+func TestImagePullSecretPolicyValidator(t *testing.T) {
+	decoder, err := admission.NewDecoder(clientgoscheme.Scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny := &cheironv1alpha1.ClusterImagePullSecretPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "allowed-registries"},
+		Spec: cheironv1alpha1.ClusterImagePullSecretPolicySpec{
+			AllowedRegistries: []string{"quay.io", "docker.io"},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"policy": "strict"}},
+		},
+	}
+	warn := &cheironv1alpha1.ClusterImagePullSecretPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials"},
+		Spec:       cheironv1alpha1.ClusterImagePullSecretPolicySpec{CredentialsRequired: []string{"docker.io"}, Action: cheironv1alpha1.WarnAction},
+	}
+	namespaces := []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{"policy": "strict"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "lab"}},
+	}
+
+	tests := []struct {
+		name         string
+		noPolicies   bool
+		namespace    string
+		images       []string
+		allowed      bool
+		wantWarnings int
+	}{
+		{name: "no policies", noPolicies: true, namespace: "shop", images: []string{"ghcr.io/app"}, allowed: true},
+		{name: "compliant pod", namespace: "shop", images: []string{"quay.io/app"}, allowed: true},
+		{name: "registry not allowed", namespace: "shop", images: []string{"ghcr.io/app"}},
+		{name: "registry not allowed and missing credentials", namespace: "shop", images: []string{"ghcr.io/app", "busybox"}, wantWarnings: 1},
+		{name: "namespace not selected", namespace: "lab", images: []string{"ghcr.io/app"}, allowed: true},
+		{name: "missing credentials only warned about", namespace: "lab", images: []string{"busybox"}, allowed: true, wantWarnings: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fakeClient(namespaces[0], namespaces[1], deny, warn)
+			if tt.noPolicies {
+				c = fakeClient(namespaces[0], namespaces[1])
+			}
+			v := &ImagePullSecretPolicyValidator{Client: c}
+			if err := v.InjectDecoder(decoder); err != nil {
+				t.Fatal(err)
+			}
+			req := admissionRequest(t, podWithImages(tt.images...))
+			req.Namespace = tt.namespace
+			resp := v.Handle(context.Background(), req)
+			if resp.Allowed != tt.allowed || len(resp.Warnings) != tt.wantWarnings {
+				t.Errorf("Handle() = allowed %v with warnings %v (%v), want allowed %v with %d warnings", resp.Allowed, resp.Warnings, resp.Result, tt.allowed, tt.wantWarnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+var (
+	// poolLabel marks secrets holding a member of a credential pool with the name of the pool
+	poolLabel = "cheiron.anny.co/pool"
+	// poolMemberAnnotation records the index of the pool member a secret holds
+	poolMemberAnnotation = "cheiron.anny.co/pool-member"
+)
+
+// poolSecretName returns the name of the secret holding a single member of a pool assigned per service account
+func poolSecretName(pool string, member int) string {
+	return pool + "-" + strconv.Itoa(member)
+}
+
+// perServiceAccount reports whether the members of the candidate's pool are assigned per service account
+func (c candidate) perServiceAccount() bool {
+	return c.Secret.Provider == nil && c.Secret.Pool != nil && c.Secret.Pool.Scope == cheironv1alpha1.ServiceAccountPoolScope &&
+		c.Manager.Mode == cheironv1alpha1.ServiceAccountMode
+}
+
+// poolIsFullySpecified validates a secret spec holding a credential pool
+func poolIsFullySpecified(secret *cheironv1alpha1.ImagePullSecretSpec) bool {
+	if secret.Name == "" || secret.Registry == "" || len(secret.Pool.Credentials) == 0 {
+		return false
+	}
+	for _, credential := range secret.Pool.Credentials {
+		if credential.Username == "" || credential.Password == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// memberSpec returns the spec of the secret holding a single member of a pool
+func memberSpec(secret *cheironv1alpha1.ImagePullSecretSpec, member int, name string) *cheironv1alpha1.ImagePullSecretSpec {
+	credential := secret.Pool.Credentials[member]
+	return &cheironv1alpha1.ImagePullSecretSpec{
+		Name:        name,
+		Registry:    secret.Registry,
+		RegistryRef: secret.RegistryRef,
+		Username:    credential.Username,
+		Password:    credential.Password,
+		Email:       credential.Email,
+	}
+}
+
+// memberRateLimit returns the latest probe result of a pool member, if there is one
+func (c candidate) memberRateLimit(member int) (cheironv1alpha1.RateLimit, bool) {
+	for _, l := range c.RateLimits {
+		if l.Secret == c.Secret.Name && l.Member != nil && int(*l.Member) == member {
+			return l, true
+		}
+	}
+	return cheironv1alpha1.RateLimit{}, false
+}
+
+// healthyMembers returns the members of the candidate's pool that are neither exhausted nor rejected by the
+// registry. If no member is healthy, all members are returned, as some credential is better than none.
+func (c candidate) healthyMembers() []int {
+	healthy := []int{}
+	for i := range c.Secret.Pool.Credentials {
+		l, ok := c.memberRateLimit(i)
+		if ok && (l.Invalid || (l.Remaining != nil && *l.Remaining <= 0)) {
+			continue
+		}
+		healthy = append(healthy, i)
+	}
+	if len(healthy) == 0 {
+		for i := range c.Secret.Pool.Credentials {
+			healthy = append(healthy, i)
+		}
+	}
+	return healthy
+}
+
+// selectPoolMember returns the member of the candidate's pool assigned to the assignee, i.e. a namespace or a service
+// account. The current member is kept as long as it is healthy, s.t. assignments only change when a member is
+// exhausted or rejected. Load counts the assignments of each member for the RoundRobin strategy.
+func (c candidate) selectPoolMember(assignee string, current int, load map[int]int) int {
+	healthy := c.healthyMembers()
+	for _, m := range healthy {
+		if m == current {
+			return current
+		}
+	}
+
+	best := healthy[0]
+	switch c.Secret.Pool.Strategy {
+	case cheironv1alpha1.RoundRobinStrategy:
+		for _, m := range healthy {
+			if load[m] < load[best] {
+				best = m
+			}
+		}
+	case cheironv1alpha1.MostRemainingStrategy:
+		remaining := func(m int) int64 {
+			if l, ok := c.memberRateLimit(m); ok && l.Remaining != nil {
+				return int64(*l.Remaining)
+			}
+			// members without known limit, e.g. not probed yet, are considered unlimited
+			return math.MaxInt64
+		}
+		for _, m := range healthy {
+			if remaining(m) > remaining(best) || (remaining(m) == remaining(best) && load[m] < load[best]) {
+				best = m
+			}
+		}
+	default:
+		// ConsistentHash uses rendezvous hashing, s.t. only the assignees of an unhealthy member move
+		score := func(m int) uint64 {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(assignee + "/" + strconv.Itoa(m)))
+			return h.Sum64()
+		}
+		for _, m := range healthy {
+			if score(m) > score(best) {
+				best = m
+			}
+		}
+	}
+	return best
+}
+
+// assignedMember returns the pool member recorded in an annotation, or -1 if there is none
+func assignedMember(annotations map[string]string) int {
+	member, err := strconv.Atoi(annotations[poolMemberAnnotation])
+	if err != nil {
+		return -1
+	}
+	return member
+}
+
+// createOrUpdatePoolSecrets creates the secrets of a winning pool in a namespace. Pools assigned per namespace store
+// the assigned member in the secret named after the pool, pools assigned per service account store every member in
+// its own secret, s.t. service accounts can be moved between members without creating secrets.
+func createOrUpdatePoolSecrets(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner client.Object, namespace string, winner candidate) (time.Duration, error) {
+	labels := map[string]string{poolLabel: winner.Secret.Name}
+	if winner.perServiceAccount() {
+		for i := range winner.Secret.Pool.Credentials {
+			annotations := map[string]string{poolMemberAnnotation: strconv.Itoa(i)}
+			spec := memberSpec(&winner.Secret, i, poolSecretName(winner.Secret.Name, i))
+			if _, err := createOrUpdateSecret(ctx, c, scheme, owner, namespace, spec, labels, annotations); err != nil {
+				return 0, err
+			}
+		}
+		return 0, nil
+	}
+
+	current := -1
+	if winner.versioned() {
+		versions, err := secretVersions(ctx, c, namespace, winner)
+		if err != nil {
+			return 0, err
+		}
+		if len(versions) > 0 {
+			current = assignedMember(versions[0].Annotations)
+		}
+	} else {
+		existing := &corev1.Secret{}
+		err := c.Get(ctx, types.NamespacedName{Name: winner.Secret.Name, Namespace: namespace}, existing)
+		if err == nil {
+			current = assignedMember(existing.Annotations)
+		} else if !errors.IsNotFound(err) {
+			return 0, err
+		}
+	}
+
+	// the assignments of the pool in other namespaces are read from the pool's secrets, superseded versions do not
+	// count as assignment
+	load := map[int]int{}
+	var secrets corev1.SecretList
+	if err := c.List(ctx, &secrets, client.MatchingLabels(labels)); err != nil {
+		return 0, err
+	}
+	for _, s := range secrets.Items {
+		if _, superseded := supersededAt(&s); superseded || s.Namespace == namespace || logicalSecretName(&s) != winner.Secret.Name {
+			continue
+		}
+		if ref := metav1.GetControllerOf(&s); ref == nil || ref.UID != owner.GetUID() {
+			continue
+		}
+		if m := assignedMember(s.Annotations); m >= 0 {
+			load[m]++
+		}
+	}
+
+	member := winner.selectPoolMember(namespace, current, load)
+	annotations := map[string]string{poolMemberAnnotation: strconv.Itoa(member)}
+	return writeCandidateSecret(ctx, c, scheme, owner, namespace, winner, memberSpec(&winner.Secret, member, winner.Secret.Name), labels, annotations)
+}
+
+// serviceAccountSecrets returns the comma-separated names of the secrets attached to a service account by managers
+// in ServiceAccount mode. Pools assigned per service account contribute the secret of the member assigned to the
+// service account; load counts the assignments made so far in the namespace per pool and member.
+func (r *resolution) serviceAccountSecrets(sa *corev1.ServiceAccount, load map[string]map[int]int) string {
+	current := map[string]bool{}
+	for _, name := range splitSecretNames(sa.Annotations[reconcileWithAnnotation]) {
+		current[name] = true
+	}
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, w := range r.Winners {
+		if w.Manager.Mode != cheironv1alpha1.ServiceAccountMode {
+			continue
+		}
+		attached := w.attachedNames()
+		if w.perServiceAccount() {
+			assigned := -1
+			for i := range w.Secret.Pool.Credentials {
+				if current[poolSecretName(w.Secret.Name, i)] {
+					assigned = i
+					break
+				}
+			}
+			if load[w.Secret.Name] == nil {
+				load[w.Secret.Name] = map[int]int{}
+			}
+			member := w.selectPoolMember(fmt.Sprintf("%s/%s", sa.Namespace, sa.Name), assigned, load[w.Secret.Name])
+			load[w.Secret.Name][member]++
+			attached = []string{poolSecretName(w.Secret.Name, member)}
+		}
+		for _, name := range attached {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
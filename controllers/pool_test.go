@@ -0,0 +1,322 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// poolCandidate returns a candidate of a Docker Hub pool with the given number of members
+func poolCandidate(strategy cheironv1alpha1.PoolStrategy, members int, limits ...cheironv1alpha1.RateLimit) candidate {
+	pool := &cheironv1alpha1.CredentialPool{Strategy: strategy}
+	for i := 0; i < members; i++ {
+		pool.Credentials = append(pool.Credentials, cheironv1alpha1.Credential{Username: fmt.Sprintf("user%d", i), Password: "secret"})
+	}
+	return candidate{
+		Manager:    managerRef{Name: "hub", Namespace: "shop", Mode: cheironv1alpha1.WorkloadMode},
+		Secret:     cheironv1alpha1.ImagePullSecretSpec{Name: "hub", Registry: "docker.io", Pool: pool},
+		RateLimits: limits,
+	}
+}
+
+// memberLimit returns the probe result of a pool member with the given remaining pulls, nil means not limited
+func memberLimit(member int32, remaining *int32, invalid bool) cheironv1alpha1.RateLimit {
+	return cheironv1alpha1.RateLimit{Secret: "hub", Member: &member, Remaining: remaining, Invalid: invalid}
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func TestPoolIsFullySpecified(t *testing.T) {
+	tests := map[string]struct {
+		secret cheironv1alpha1.ImagePullSecretSpec
+		want   bool
+	}{
+		"complete": {
+			secret: poolCandidate("", 2).Secret,
+			want:   true,
+		},
+		"no members": {
+			secret: cheironv1alpha1.ImagePullSecretSpec{Name: "hub", Registry: "docker.io", Pool: &cheironv1alpha1.CredentialPool{}},
+		},
+		"no registry": {
+			secret: cheironv1alpha1.ImagePullSecretSpec{Name: "hub", Pool: poolCandidate("", 1).Secret.Pool},
+		},
+		"member without password": {
+			secret: cheironv1alpha1.ImagePullSecretSpec{Name: "hub", Registry: "docker.io", Pool: &cheironv1alpha1.CredentialPool{
+				Credentials: []cheironv1alpha1.Credential{{Username: "alice", Password: "secret"}, {Username: "bob"}},
+			}},
+		},
+	}
+	for name, tt := range tests {
+		if got := poolIsFullySpecified(&tt.secret); got != tt.want {
+			t.Errorf("%s: poolIsFullySpecified() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestHealthyMembers(t *testing.T) {
+	tests := map[string]struct {
+		limits []cheironv1alpha1.RateLimit
+		want   []int
+	}{
+		"not probed":   {want: []int{0, 1, 2}},
+		"unlimited":    {limits: []cheironv1alpha1.RateLimit{memberLimit(0, nil, false)}, want: []int{0, 1, 2}},
+		"exhausted":    {limits: []cheironv1alpha1.RateLimit{memberLimit(1, int32Ptr(0), false)}, want: []int{0, 2}},
+		"rejected":     {limits: []cheironv1alpha1.RateLimit{memberLimit(2, int32Ptr(50), true)}, want: []int{0, 1}},
+		"other secret": {limits: []cheironv1alpha1.RateLimit{{Secret: "quay", Member: int32Ptr(0), Invalid: true}}, want: []int{0, 1, 2}},
+		"all unhealthy": {
+			limits: []cheironv1alpha1.RateLimit{memberLimit(0, int32Ptr(0), false), memberLimit(1, nil, true), memberLimit(2, int32Ptr(-1), false)},
+			want:   []int{0, 1, 2},
+		},
+	}
+	for name, tt := range tests {
+		if got := poolCandidate("", 3, tt.limits...).healthyMembers(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: healthyMembers() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectPoolMember(t *testing.T) {
+	tests := map[string]struct {
+		strategy cheironv1alpha1.PoolStrategy
+		limits   []cheironv1alpha1.RateLimit
+		current  int
+		load     map[int]int
+		want     int
+	}{
+		"healthy current member is kept": {
+			strategy: cheironv1alpha1.RoundRobinStrategy,
+			current:  2,
+			load:     map[int]int{2: 10},
+			want:     2,
+		},
+		"round robin picks least loaded member": {
+			strategy: cheironv1alpha1.RoundRobinStrategy,
+			current:  -1,
+			load:     map[int]int{0: 2, 1: 1, 2: 2},
+			want:     1,
+		},
+		"round robin moves off exhausted member": {
+			strategy: cheironv1alpha1.RoundRobinStrategy,
+			limits:   []cheironv1alpha1.RateLimit{memberLimit(1, int32Ptr(0), false)},
+			current:  1,
+			load:     map[int]int{0: 3, 1: 0, 2: 1},
+			want:     2,
+		},
+		"most remaining picks member with most pulls left": {
+			strategy: cheironv1alpha1.MostRemainingStrategy,
+			limits: []cheironv1alpha1.RateLimit{
+				memberLimit(0, int32Ptr(10), false), memberLimit(1, int32Ptr(80), false), memberLimit(2, int32Ptr(40), false),
+			},
+			current: -1,
+			want:    1,
+		},
+		"most remaining prefers unprobed members": {
+			strategy: cheironv1alpha1.MostRemainingStrategy,
+			limits:   []cheironv1alpha1.RateLimit{memberLimit(0, int32Ptr(90), false), memberLimit(1, int32Ptr(80), false)},
+			current:  -1,
+			want:     2,
+		},
+		"most remaining breaks ties by load": {
+			strategy: cheironv1alpha1.MostRemainingStrategy,
+			current:  -1,
+			load:     map[int]int{0: 1, 1: 1, 2: 0},
+			want:     2,
+		},
+		"rejected current member is replaced": {
+			strategy: cheironv1alpha1.MostRemainingStrategy,
+			limits: []cheironv1alpha1.RateLimit{
+				memberLimit(0, int32Ptr(90), true), memberLimit(1, int32Ptr(20), false), memberLimit(2, int32Ptr(30), false),
+			},
+			current: 0,
+			want:    2,
+		},
+	}
+	for name, tt := range tests {
+		c := poolCandidate(tt.strategy, 3, tt.limits...)
+		if got := c.selectPoolMember("shop", tt.current, tt.load); got != tt.want {
+			t.Errorf("%s: selectPoolMember() = %d, want %d", name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectPoolMemberConsistentHash(t *testing.T) {
+	c := poolCandidate(cheironv1alpha1.ConsistentHashStrategy, 4)
+	assigned := map[string]int{}
+	for i := 0; i < 50; i++ {
+		assignee := fmt.Sprintf("namespace-%d", i)
+		assigned[assignee] = c.selectPoolMember(assignee, -1, nil)
+		if again := c.selectPoolMember(assignee, -1, map[int]int{0: 100}); again != assigned[assignee] {
+			t.Fatalf("assignment of %s changed from %d to %d with the load", assignee, assigned[assignee], again)
+		}
+	}
+
+	// exhausting a member only moves its own assignees
+	exhausted := poolCandidate(cheironv1alpha1.ConsistentHashStrategy, 4, memberLimit(1, int32Ptr(0), false))
+	for assignee, member := range assigned {
+		got := exhausted.selectPoolMember(assignee, -1, nil)
+		if member != 1 && got != member {
+			t.Errorf("assignee %s moved from healthy member %d to %d", assignee, member, got)
+		}
+		if got == 1 {
+			t.Errorf("assignee %s assigned to exhausted member", assignee)
+		}
+	}
+}
+
+func TestAssignedMember(t *testing.T) {
+	tests := map[string]int{
+		"":    -1,
+		"two": -1,
+		"0":   0,
+		"3":   3,
+	}
+	for value, want := range tests {
+		annotations := map[string]string{}
+		if value != "" {
+			annotations[poolMemberAnnotation] = value
+		}
+		if got := assignedMember(annotations); got != want {
+			t.Errorf("assignedMember(%q) = %d, want %d", value, got, want)
+		}
+	}
+}
+
+func TestCreateOrUpdatePoolSecrets(t *testing.T) {
+	owner := &cheironv1alpha1.ImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "hub", Namespace: "shop", UID: "hub-uid"}}
+	// poolSecret returns a pool secret of the owner in another namespace holding the given member
+	poolSecret := func(namespace string, member string, annotations ...string) *corev1.Secret {
+		s := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name: "hub", Namespace: namespace,
+			Labels:          map[string]string{poolLabel: "hub"},
+			Annotations:     map[string]string{poolMemberAnnotation: member},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(owner, cheironv1alpha1.GroupVersion.WithKind("ImagePullSecretManager"))},
+		}}
+		for i := 0; i+1 < len(annotations); i += 2 {
+			s.Annotations[annotations[i]] = annotations[i+1]
+		}
+		return s
+	}
+
+	tests := map[string]struct {
+		scope    cheironv1alpha1.PoolScope
+		mode     cheironv1alpha1.ReconciliationMode
+		existing []client.Object
+		// want maps the names of the secrets in the namespace to the member they hold
+		want map[string]string
+	}{
+		"namespace scope assigns least loaded member": {
+			scope: cheironv1alpha1.NamespacePoolScope,
+			mode:  cheironv1alpha1.WorkloadMode,
+			existing: []client.Object{
+				poolSecret("default", "0"),
+				poolSecret("kube-public", "1"),
+				poolSecret("batch", "0", supersededAnnotation, "2021-01-01T00:00:00Z"),
+			},
+			want: map[string]string{"hub": "2"},
+		},
+		"namespace scope keeps assigned member": {
+			scope:    cheironv1alpha1.NamespacePoolScope,
+			mode:     cheironv1alpha1.WorkloadMode,
+			existing: []client.Object{poolSecret("shop", "1"), poolSecret("default", "1")},
+			want:     map[string]string{"hub": "1"},
+		},
+		"service account scope stores every member": {
+			scope: cheironv1alpha1.ServiceAccountPoolScope,
+			mode:  cheironv1alpha1.ServiceAccountMode,
+			want:  map[string]string{"hub-0": "0", "hub-1": "1", "hub-2": "2"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := fakeClient(tt.existing...)
+			winner := poolCandidate(cheironv1alpha1.RoundRobinStrategy, 3)
+			winner.Manager.Mode = tt.mode
+			winner.Secret.Pool.Scope = tt.scope
+
+			if _, err := createOrUpdatePoolSecrets(context.Background(), c, c.Scheme(), owner, "shop", winner); err != nil {
+				t.Fatal(err)
+			}
+			for name, member := range tt.want {
+				var secret corev1.Secret
+				if err := c.Get(context.Background(), types.NamespacedName{Namespace: "shop", Name: name}, &secret); err != nil {
+					t.Fatal(err)
+				}
+				if got := secret.Annotations[poolMemberAnnotation]; got != member {
+					t.Errorf("secret %s holds member %s, want %s", name, got, member)
+				}
+				if secret.Labels[poolLabel] != "hub" || len(secret.Data[corev1.DockerConfigJsonKey]) == 0 {
+					t.Errorf("secret %s = %+v, want pool label and credentials", name, secret)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceAccountSecrets(t *testing.T) {
+	pool := poolCandidate(cheironv1alpha1.RoundRobinStrategy, 2)
+	pool.Manager.Mode = cheironv1alpha1.ServiceAccountMode
+	pool.Secret.Pool.Scope = cheironv1alpha1.ServiceAccountPoolScope
+	static := candidate{
+		Manager: managerRef{Name: "quay", Namespace: "shop", Mode: cheironv1alpha1.ServiceAccountMode},
+		Secret:  basicSecret("quay", "quay.io"),
+	}
+	namespaced := candidate{
+		Manager: managerRef{Name: "ghcr", Namespace: "shop", Mode: cheironv1alpha1.WorkloadMode},
+		Secret:  basicSecret("ghcr", "ghcr.io"),
+	}
+	r := &resolution{Namespace: "shop", Winners: []candidate{pool, static, namespaced}}
+
+	serviceAccount := func(name, attached string) *corev1.ServiceAccount {
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop"}}
+		if attached != "" {
+			sa.Annotations = map[string]string{reconcileWithAnnotation: attached}
+		}
+		return sa
+	}
+
+	load := map[string]map[int]int{}
+	tests := []struct {
+		sa   *corev1.ServiceAccount
+		want string
+	}{
+		{sa: serviceAccount("default", ""), want: "hub-0,quay"},
+		{sa: serviceAccount("builder", ""), want: "hub-1,quay"},
+		{sa: serviceAccount("deployer", "hub-1,quay"), want: "hub-1,quay"},
+		{sa: serviceAccount("runner", ""), want: "hub-0,quay"},
+	}
+	for _, tt := range tests {
+		if got := r.serviceAccountSecrets(tt.sa, load); got != tt.want {
+			t.Errorf("serviceAccountSecrets(%s) = %q, want %q", tt.sa.Name, got, tt.want)
+		}
+	}
+	if want := map[int]int{0: 2, 1: 2}; !reflect.DeepEqual(load["hub"], want) {
+		t.Errorf("load = %v, want %v", load["hub"], want)
+	}
+}
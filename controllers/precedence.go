@@ -0,0 +1,319 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// managerRef identifies the manager that contributes secrets to a namespace, together with the settings relevant for
+// resolving conflicts with other managers
+type managerRef struct {
+	Cluster   bool
+	Name      string
+	Namespace string
+	UID       types.UID
+	Priority  int32
+	Policy    cheironv1alpha1.ConflictPolicy
+	Mode      cheironv1alpha1.ReconciliationMode
+}
+
+// String returns a human readable identifier of the manager used in conflict messages
+func (m managerRef) String() string {
+	if m.Cluster {
+		return "ClusterImagePullSecretManager/" + m.Name
+	}
+	return "ImagePullSecretManager/" + m.Namespace + "/" + m.Name
+}
+
+// candidate is a single secret a manager wants to attach to the targets of a namespace
+type candidate struct {
+	Manager managerRef
+	Secret  cheironv1alpha1.ImagePullSecretSpec
+	// RateLimits are the probe results reported by the manager, which decide about the health of pool members
+	RateLimits []cheironv1alpha1.RateLimit
+	// Failover is the failover status reported by the manager, which decides about the credential in use
+	Failover []cheironv1alpha1.Failover
+	// Rotation is the rotation policy of the manager
+	Rotation *cheironv1alpha1.RotationPolicy
+	// Versions are the names of the attached versions of a versioned secret, see resolveVersions()
+	Versions []string
+}
+
+// secretName returns the name of the secret attached to targets for the candidate
+func (c candidate) secretName() string {
+	if c.Secret.ExistingSecretRef.Name != "" {
+		return c.Secret.ExistingSecretRef.Name
+	}
+	return c.Secret.Name
+}
+
+// conflict records that the secret of a manager lost against the secret of another manager for the same registry
+type conflict struct {
+	Namespace string
+	Registry  string
+	Loser     candidate
+	Winner    candidate
+}
+
+// resolution is the outcome of resolving all managers' secrets for a single namespace
+type resolution struct {
+	Namespace string
+	Winners   []candidate
+	Conflicts []conflict
+}
+
+// secretNames returns the names of all winning secrets of managers with the given mode, in the order of resolution
+func (r *resolution) secretNames(mode cheironv1alpha1.ReconciliationMode) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, w := range r.Winners {
+		if w.Manager.Mode != mode {
+			continue
+		}
+		for _, name := range w.attachedNames() {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// winnersOf returns the winning candidates contributed by the given manager
+func (r *resolution) winnersOf(m managerRef) []candidate {
+	winners := []candidate{}
+	for _, w := range r.Winners {
+		if w.Manager.Cluster == m.Cluster && w.Manager.Namespace == m.Namespace && w.Manager.Name == m.Name {
+			winners = append(winners, w)
+		}
+	}
+	return winners
+}
+
+// conflictsOf returns the conflicts the given manager lost
+func (r *resolution) conflictsOf(m managerRef) []conflict {
+	conflicts := []conflict{}
+	for _, c := range r.Conflicts {
+		if c.Loser.Manager.Cluster == m.Cluster && c.Loser.Manager.Namespace == m.Namespace && c.Loser.Manager.Name == m.Name {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+// refForManager returns the managerRef of a namespaced manager
+func refForManager(m *cheironv1alpha1.ImagePullSecretManager) managerRef {
+	return managerRef{
+		Name:      m.Name,
+		Namespace: m.Namespace,
+		UID:       m.UID,
+		Priority:  m.Spec.Priority,
+		Policy:    m.Spec.ConflictPolicy,
+		Mode:      m.Spec.Mode,
+	}
+}
+
+// refForClusterManager returns the managerRef of a cluster manager
+func refForClusterManager(m *cheironv1alpha1.ClusterImagePullSecretManager) managerRef {
+	return managerRef{
+		Cluster:  true,
+		Name:     m.Name,
+		UID:      m.UID,
+		Priority: m.Spec.Priority,
+		Policy:   m.Spec.ConflictPolicy,
+		Mode:     m.Spec.Mode,
+	}
+}
+
+// ranksBefore orders managers by descending priority, namespaced managers before cluster managers and finally by name
+func ranksBefore(a, b managerRef) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if a.Cluster != b.Cluster {
+		return !a.Cluster
+	}
+	return a.String() < b.String()
+}
+
+// resolveSecrets resolves the secrets of all given managers for a namespace. Secrets with the same registry of
+// different managers conflict; the conflict policy of the highest ranked manager decides which of them are attached.
+// Secrets without a registry, e.g. plain existingSecretRefs, never conflict. Secrets expired in the namespace by the
+// cleanup policy of their manager are left out.
+func resolveSecrets(namespace string, managers []cheironv1alpha1.ImagePullSecretManager, clusterManagers []cheironv1alpha1.ClusterImagePullSecretManager) resolution {
+	candidates := []candidate{}
+	for i := range managers {
+		m := &managers[i]
+		if m.Namespace != namespace || m.DeletionTimestamp != nil {
+			continue
+		}
+		for _, s := range m.Spec.Secrets {
+			if isExpired(m.Status.Expired, s.Name, namespace) {
+				continue
+			}
+			candidates = append(candidates, candidate{Manager: refForManager(m), Secret: s, RateLimits: m.Status.RateLimits, Failover: m.Status.Failover, Rotation: m.Spec.Rotation})
+		}
+	}
+	for i := range clusterManagers {
+		m := &clusterManagers[i]
+		if m.DeletionTimestamp != nil {
+			continue
+		}
+		for _, s := range m.Spec.Secrets {
+			if isExpired(m.Status.Expired, s.Name, namespace) {
+				continue
+			}
+			candidates = append(candidates, candidate{Manager: refForClusterManager(m), Secret: s, RateLimits: m.Status.RateLimits, Failover: m.Status.Failover, Rotation: m.Spec.Rotation})
+		}
+	}
+
+	res := resolution{Namespace: namespace}
+	groups := map[string][]candidate{}
+	registries := []string{}
+	for _, c := range candidates {
+		if !secretIsFullySpecified(&c.Secret) {
+			continue
+		}
+		registry := normalizeRegistry(c.Secret.Registry)
+		if registry == "" {
+			res.Winners = append(res.Winners, c)
+			continue
+		}
+		if _, ok := groups[registry]; !ok {
+			registries = append(registries, registry)
+		}
+		groups[registry] = append(groups[registry], c)
+	}
+
+	sort.Strings(registries)
+	for _, registry := range registries {
+		group := groups[registry]
+		sort.SliceStable(group, func(i, j int) bool {
+			return ranksBefore(group[i].Manager, group[j].Manager)
+		})
+
+		winner := group[0]
+		switch winner.Manager.Policy {
+		case cheironv1alpha1.Union:
+			res.Winners = append(res.Winners, group...)
+			continue
+		case cheironv1alpha1.HighestPriority:
+		default:
+			// NamespacedOverridesCluster, the highest ranked namespaced manager wins if there is one
+			for _, c := range group {
+				if !c.Manager.Cluster {
+					winner = c
+					break
+				}
+			}
+		}
+
+		for _, c := range group {
+			if c.Manager == winner.Manager {
+				res.Winners = append(res.Winners, c)
+				continue
+			}
+			res.Conflicts = append(res.Conflicts, conflict{
+				Namespace: namespace,
+				Registry:  registry,
+				Loser:     c,
+				Winner:    winner,
+			})
+		}
+	}
+	return res
+}
+
+// resolveNamespace fetches all managers relevant for a namespace and resolves their secrets. Secrets referencing a
+// Registry are resolved for its canonical host
+func resolveNamespace(ctx context.Context, c client.Client, namespace string) (resolution, error) {
+	catalog, err := loadRegistryCatalog(ctx, c)
+	if err != nil {
+		return resolution{}, err
+	}
+	var managers cheironv1alpha1.ImagePullSecretManagerList
+	if err := c.List(ctx, &managers, client.InNamespace(namespace)); err != nil {
+		return resolution{}, err
+	}
+	var clusterManagers cheironv1alpha1.ClusterImagePullSecretManagerList
+	if err := c.List(ctx, &clusterManagers); err != nil {
+		return resolution{}, err
+	}
+	catalog.expandManagers(managers.Items, clusterManagers.Items)
+	return resolveSecrets(namespace, managers.Items, clusterManagers.Items), nil
+}
+
+// maxConditionMessage is the maximum length of the message of a metav1.Condition
+const maxConditionMessage = 32768
+
+// conflictMessage summarizes lost conflicts for the Conflicted condition of a manager. Conflicts of the same secret
+// with the same winner are summarized over all namespaces, s.t. the message of cluster managers stays short, and the
+// message is truncated to the maximum length of condition messages.
+func conflictMessage(conflicts []conflict) string {
+	namespaces := map[string][]string{}
+	for _, c := range conflicts {
+		key := fmt.Sprintf("secret %s for registry %s is overridden by %s", c.Loser.secretName(), c.Registry, c.Winner.Manager)
+		namespaces[key] = append(namespaces[key], c.Namespace)
+	}
+	msgs := []string{}
+	for key, nss := range namespaces {
+		if len(nss) == 1 {
+			msgs = append(msgs, fmt.Sprintf("%s in namespace %s", key, nss[0]))
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("%s in %d namespaces", key, len(nss)))
+	}
+	sort.Strings(msgs)
+	msg := strings.Join(msgs, "; ")
+	if len(msg) > maxConditionMessage {
+		suffix := "..."
+		msg = msg[:maxConditionMessage-len(suffix)] + suffix
+	}
+	return msg
+}
+
+// conflictCondition returns the Conflicted condition of a manager for the conflicts it lost
+func conflictCondition(generation int64, conflicts []conflict) metav1.Condition {
+	if len(conflicts) == 0 {
+		return metav1.Condition{
+			Type:               cheironv1alpha1.ConditionConflicted,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: generation,
+			Reason:             cheironv1alpha1.ReasonNoConflicts,
+			Message:            "All secrets of the manager are attached",
+		}
+	}
+	return metav1.Condition{
+		Type:               cheironv1alpha1.ConditionConflicted,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             cheironv1alpha1.ReasonOverridden,
+		Message:            conflictMessage(conflicts),
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// basicSecret returns a fully specified secret spec with static credentials for a registry
+func basicSecret(name, registry string) cheironv1alpha1.ImagePullSecretSpec {
+	return cheironv1alpha1.ImagePullSecretSpec{
+		Name:     name,
+		Registry: registry,
+		Username: "user",
+		Password: "password",
+		Email:    "user@example.com",
+	}
+}
+
+// namespacedManager returns an ImagePullSecretManager in the namespace shop
+func namespacedManager(name string, priority int32, policy cheironv1alpha1.ConflictPolicy, secrets ...cheironv1alpha1.ImagePullSecretSpec) cheironv1alpha1.ImagePullSecretManager {
+	return cheironv1alpha1.ImagePullSecretManager{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop"},
+		Spec:       cheironv1alpha1.ImagePullSecretManagerSpec{Secrets: secrets, Priority: priority, ConflictPolicy: policy},
+	}
+}
+
+// clusterManager returns a ClusterImagePullSecretManager
+func clusterManager(name string, priority int32, policy cheironv1alpha1.ConflictPolicy, secrets ...cheironv1alpha1.ImagePullSecretSpec) cheironv1alpha1.ClusterImagePullSecretManager {
+	return cheironv1alpha1.ClusterImagePullSecretManager{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       cheironv1alpha1.ClusterImagePullSecretManagerSpec{Secrets: secrets, Priority: priority, ConflictPolicy: policy},
+	}
+}
+
+// candidateNames returns manager and secret of each candidate, e.g. ImagePullSecretManager/shop/team:quay
+func candidateNames(candidates []candidate) []string {
+	names := []string{}
+	for _, c := range candidates {
+		names = append(names, c.Manager.String()+":"+c.Secret.Name)
+	}
+	return names
+}
+
+func TestResolveSecrets(t *testing.T) {
+	expired := namespacedManager("team", 0, "", basicSecret("quay", "quay.io"))
+	expired.Status.Expired = []cheironv1alpha1.ExpiredSecret{{Name: "quay", Namespace: "shop"}}
+	deleted := namespacedManager("team", 0, "", basicSecret("quay", "quay.io"))
+	deleted.DeletionTimestamp = &metav1.Time{}
+	foreign := namespacedManager("team", 0, "", basicSecret("quay", "quay.io"))
+	foreign.Namespace = "other"
+
+	tests := []struct {
+		name            string
+		managers        []cheironv1alpha1.ImagePullSecretManager
+		clusterManagers []cheironv1alpha1.ClusterImagePullSecretManager
+		winners         []string
+		losers          []string
+	}{
+		{
+			name:            "namespaced managers override cluster managers by default",
+			managers:        []cheironv1alpha1.ImagePullSecretManager{namespacedManager("team", 0, "", basicSecret("quay", "quay.io"))},
+			clusterManagers: []cheironv1alpha1.ClusterImagePullSecretManager{clusterManager("platform", 10, "", basicSecret("quay", "quay.io"))},
+			winners:         []string{"ImagePullSecretManager/shop/team:quay"},
+			losers:          []string{"ClusterImagePullSecretManager/platform:quay"},
+		},
+		{
+			name:            "the highest priority wins regardless of scope",
+			managers:        []cheironv1alpha1.ImagePullSecretManager{namespacedManager("team", 0, "", basicSecret("quay", "quay.io"))},
+			clusterManagers: []cheironv1alpha1.ClusterImagePullSecretManager{clusterManager("platform", 10, cheironv1alpha1.HighestPriority, basicSecret("quay", "quay.io"))},
+			winners:         []string{"ClusterImagePullSecretManager/platform:quay"},
+			losers:          []string{"ImagePullSecretManager/shop/team:quay"},
+		},
+		{
+			name:            "the policy of the highest ranked manager applies",
+			managers:        []cheironv1alpha1.ImagePullSecretManager{namespacedManager("team", 20, "", basicSecret("quay", "quay.io"))},
+			clusterManagers: []cheironv1alpha1.ClusterImagePullSecretManager{clusterManager("platform", 10, cheironv1alpha1.HighestPriority, basicSecret("quay", "quay.io"))},
+			winners:         []string{"ImagePullSecretManager/shop/team:quay"},
+			losers:          []string{"ClusterImagePullSecretManager/platform:quay"},
+		},
+		{
+			name:            "union attaches the secrets of all managers",
+			managers:        []cheironv1alpha1.ImagePullSecretManager{namespacedManager("team", 0, "", basicSecret("quay", "quay.io"))},
+			clusterManagers: []cheironv1alpha1.ClusterImagePullSecretManager{clusterManager("platform", 10, cheironv1alpha1.Union, basicSecret("robot", "quay.io"))},
+			winners:         []string{"ClusterImagePullSecretManager/platform:robot", "ImagePullSecretManager/shop/team:quay"},
+		},
+		{
+			name:            "aliases of the same registry conflict",
+			managers:        []cheironv1alpha1.ImagePullSecretManager{namespacedManager("team", 0, "", basicSecret("hub", "https://index.docker.io/v1/"))},
+			clusterManagers: []cheironv1alpha1.ClusterImagePullSecretManager{clusterManager("platform", 0, "", basicSecret("hub", "docker.io"))},
+			winners:         []string{"ImagePullSecretManager/shop/team:hub"},
+			losers:          []string{"ClusterImagePullSecretManager/platform:hub"},
+		},
+		{
+			name: "existing secrets without registry never conflict",
+			managers: []cheironv1alpha1.ImagePullSecretManager{namespacedManager("team", 0, "", cheironv1alpha1.ImagePullSecretSpec{
+				Name:              "legacy",
+				ExistingSecretRef: corev1.LocalObjectReference{Name: "legacy"},
+			})},
+			clusterManagers: []cheironv1alpha1.ClusterImagePullSecretManager{clusterManager("platform", 0, "", cheironv1alpha1.ImagePullSecretSpec{
+				Name:              "legacy",
+				ExistingSecretRef: corev1.LocalObjectReference{Name: "legacy"},
+			})},
+			winners: []string{"ImagePullSecretManager/shop/team:legacy", "ClusterImagePullSecretManager/platform:legacy"},
+		},
+		{
+			name:     "expired, deleted and foreign managers' secrets are left out",
+			managers: []cheironv1alpha1.ImagePullSecretManager{expired, deleted, foreign},
+			clusterManagers: []cheironv1alpha1.ClusterImagePullSecretManager{clusterManager("platform", 0, "", cheironv1alpha1.ImagePullSecretSpec{
+				Name:     "incomplete",
+				Registry: "quay.io",
+			})},
+			winners: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := resolveSecrets("shop", tt.managers, tt.clusterManagers)
+			if got := candidateNames(res.Winners); !reflect.DeepEqual(got, tt.winners) {
+				t.Errorf("winners = %v, want %v", got, tt.winners)
+			}
+			losers := []string{}
+			for _, c := range res.Conflicts {
+				losers = append(losers, c.Loser.Manager.String()+":"+c.Loser.Secret.Name)
+			}
+			if tt.losers == nil {
+				tt.losers = []string{}
+			}
+			if !reflect.DeepEqual(losers, tt.losers) {
+				t.Errorf("losers = %v, want %v", losers, tt.losers)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// providerHTTPClient is used by all providers for their requests
+var providerHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// expiresAtAnnotation records when the credentials issued by a provider expire, s.t. readers of the managed secret
+// like the kubelet credential provider know how long they may cache them
+var expiresAtAnnotation = "cheiron.anny.co/expires-at"
+
+// providedCredential is a short-lived credential issued by a provider
+type providedCredential struct {
+	Username string
+	Password string
+	// Email overrides the email of the spec, if set
+	Email     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// refreshAt returns the time the credential is replaced, which is after half of its lifetime s.t. failing refreshes
+// are retried long before the credential expires
+func (p providedCredential) refreshAt() time.Time {
+	return p.IssuedAt.Add(p.ExpiresAt.Sub(p.IssuedAt) / 2)
+}
+
+// credentialProvider issues credentials for a registry
+type credentialProvider interface {
+	issue(ctx context.Context) (providedCredential, error)
+}
+
+// providerIsFullySpecified validates a secret spec using a provider
+func providerIsFullySpecified(secret *cheironv1alpha1.ImagePullSecretSpec) bool {
+	if secret.Name == "" || secret.Registry == "" {
+		return false
+	}
+	p := secret.Provider
+	switch {
+	case p.ECR != nil:
+		return p.ECR.Region != ""
+	case p.ACR != nil, p.GAR != nil:
+		return true
+	case p.TokenExchange != nil:
+		return p.TokenExchange.ServiceAccountName != "" && p.TokenExchange.Audience != "" && p.TokenExchange.Endpoint != ""
+	case p.Harbor != nil:
+		return p.Harbor.CredentialsSecretRef.Name != "" && len(p.Harbor.Projects) > 0
+	case p.GitHubApp != nil:
+		return p.GitHubApp.AppID != 0 && p.GitHubApp.PrivateKeySecretRef.Name != ""
+	case p.Vault != nil:
+		return p.Vault.Address != "" && p.Vault.Path != "" && p.Vault.Role != ""
+	case p.Exec != nil:
+		return p.Exec.Plugin != ""
+	}
+	return false
+}
+
+// providerDeps are the dependencies of providers besides the client of the manager
+type providerDeps struct {
+	// Tokens requests projected service account tokens
+	Tokens corev1client.ServiceAccountsGetter
+	// PluginDir is the directory of exec plugins, exec plugins are disabled without it
+	PluginDir string
+	// PluginEnv are the names of the environment variables of cheiron passed to exec plugins
+	PluginEnv []string
+	// NamespacedPlugins are the exec plugins namespaced managers may run, cluster managers may run all plugins
+	NamespacedPlugins []string
+	// NamespacedPluginEnv are the environment variables namespaced managers may pass to exec plugins, cluster managers
+	// may pass all variables
+	NamespacedPluginEnv []string
+	// NamespacedTokenEndpoints are the endpoints namespaced managers may send service account tokens to, i.e. token
+	// exchange endpoints and Vault addresses. Cluster managers may send them to all endpoints
+	NamespacedTokenEndpoints []string
+	// APIAudiences are audiences of the API server besides the defaults, which tokens are never requested for
+	APIAudiences []string
+}
+
+// clusterProviderSettings returns the settings of a provider only cluster managers may use. They make the operator
+// authenticate with its own identity or send credentials to endpoints of the spec's choosing, which namespaced
+// managers must not be able to do on behalf of the operator.
+func clusterProviderSettings(p *cheironv1alpha1.CredentialProvider) []string {
+	settings := []string{}
+	switch {
+	case p.ECR != nil:
+		if p.ECR.CredentialsSecretRef == nil {
+			settings = append(settings, "ecr without credentialsSecretRef")
+		}
+		if p.ECR.Endpoint != "" {
+			settings = append(settings, "ecr.endpoint")
+		}
+		if p.ECR.STSEndpoint != "" {
+			settings = append(settings, "ecr.stsEndpoint")
+		}
+	case p.ACR != nil:
+		if p.ACR.CredentialsSecretRef == nil {
+			settings = append(settings, "acr without credentialsSecretRef")
+		}
+		if p.ACR.AuthorityEndpoint != "" {
+			settings = append(settings, "acr.authorityEndpoint")
+		}
+	case p.GAR != nil:
+		if p.GAR.CredentialsSecretRef == nil {
+			settings = append(settings, "gar without credentialsSecretRef")
+		}
+		if p.GAR.MetadataEndpoint != "" {
+			settings = append(settings, "gar.metadataEndpoint")
+		}
+		if p.GAR.TokenEndpoint != "" {
+			settings = append(settings, "gar.tokenEndpoint")
+		}
+	case p.Harbor != nil:
+		if p.Harbor.URL != "" {
+			settings = append(settings, "harbor.url")
+		}
+	case p.GitHubApp != nil:
+		if p.GitHubApp.APIURL != "" {
+			settings = append(settings, "githubApp.apiURL")
+		}
+	case p.Vault != nil:
+		if p.Vault.ServiceAccountName == "" {
+			settings = append(settings, "vault without serviceAccountName")
+		}
+	case p.Exec != nil:
+		if len(p.Exec.Args) > 0 {
+			settings = append(settings, "exec.args")
+		}
+	}
+	return settings
+}
+
+// providerFor returns the provider of a secret spec, namespace is the namespace of the manager
+func providerFor(c client.Client, deps providerDeps, secret *cheironv1alpha1.ImagePullSecretSpec, namespace string) (credentialProvider, error) {
+	p := secret.Provider
+	if settings := clusterProviderSettings(p); namespace != "" && len(settings) > 0 {
+		return nil, fmt.Errorf("secret %s uses %s, which only cluster managers may use", secret.Name, strings.Join(settings, ", "))
+	}
+	switch {
+	case p.ECR != nil:
+		return &ecrProvider{Client: c, Spec: p.ECR, Namespace: namespace}, nil
+	case p.ACR != nil:
+		return &acrProvider{Client: c, Spec: p.ACR, Namespace: namespace, Registry: normalizeRegistry(secret.Registry)}, nil
+	case p.GAR != nil:
+		return &garProvider{Client: c, Spec: p.GAR, Namespace: namespace}, nil
+	case p.TokenExchange != nil:
+		return newTokenExchangeProvider(deps, p.TokenExchange, namespace)
+	case p.GitHubApp != nil:
+		return &githubAppProvider{Client: c, Spec: p.GitHubApp, Namespace: namespace}, nil
+	case p.Vault != nil:
+		return newVaultProvider(deps, p.Vault, namespace)
+	case p.Exec != nil:
+		if namespace != "" && !containsString(deps.NamespacedPlugins, p.Exec.Plugin) {
+			return nil, fmt.Errorf("secret %s uses exec plugin %s, which namespaced managers may not run, see --namespaced-credential-plugins", secret.Name, p.Exec.Plugin)
+		}
+		for _, e := range p.Exec.Env {
+			if namespace != "" && !containsString(deps.NamespacedPluginEnv, e.Name) {
+				return nil, fmt.Errorf("secret %s passes %s to exec plugin %s, which namespaced managers may not set, see --namespaced-credential-plugin-env", secret.Name, e.Name, p.Exec.Plugin)
+			}
+		}
+		return &execProvider{Spec: p.Exec, PluginDir: deps.PluginDir, PluginEnv: deps.PluginEnv, Registry: normalizeRegistry(secret.Registry)}, nil
+	}
+	return nil, fmt.Errorf("secret %s specifies no known provider", secret.Name)
+}
+
+// providerSecret fetches a secret referenced by a provider, its namespace defaults to the namespace of the manager.
+// Namespaced managers may only reference secrets of their own namespace.
+func providerSecret(ctx context.Context, c client.Client, ref *corev1.SecretReference, namespace string) (*corev1.Secret, error) {
+	if namespace != "" && ref.Namespace != "" && ref.Namespace != namespace {
+		return nil, fmt.Errorf("secret reference %s/%s is outside of the manager's namespace %s", ref.Namespace, ref.Name, namespace)
+	}
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+	if namespace == "" {
+		return nil, fmt.Errorf("credentialsSecretRef %s requires a namespace", ref.Name)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: namespace}, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// oauthToken is the response of an OAuth2 token endpoint
+type oauthToken struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    time.Duration
+}
+
+// requestToken posts a form to an OAuth2 token endpoint and decodes the token of the response
+func requestToken(ctx context.Context, endpoint string, form url.Values) (oauthToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauthToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(req)
+}
+
+// doTokenRequest sends a request to a token endpoint and decodes the token of the response
+func doTokenRequest(req *http.Request) (oauthToken, error) {
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return oauthToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return oauthToken{}, fmt.Errorf("token request to %s failed with status %s: %s", req.URL.Host, resp.Status, msg)
+	}
+	var body struct {
+		AccessToken  string      `json:"access_token"`
+		RefreshToken string      `json:"refresh_token"`
+		ExpiresIn    json.Number `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return oauthToken{}, err
+	}
+	token := oauthToken{AccessToken: body.AccessToken, RefreshToken: body.RefreshToken}
+	if seconds, err := body.ExpiresIn.Int64(); err == nil {
+		token.ExpiresIn = time.Duration(seconds) * time.Second
+	}
+	return token, nil
+}
+
+// jwtExpiry returns the expiry of a JWT from its exp claim, without verifying the token
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("token has no expiry")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
+
+// parseRSAPrivateKey parses a PEM encoded RSA private key in PKCS #8 or PKCS #1 form
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// signRS256JWT returns a JWT with the given claims signed with RS256, keyID is omitted from the header if empty
+func signRS256JWT(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(encodedClaims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// credentialCache keeps issued credentials until they have to be refreshed
+type credentialCache struct {
+	mu      sync.Mutex
+	entries map[string]providedCredential
+}
+
+// providedCredentials caches the credentials of all managers, s.t. a cluster manager requests a single credential
+// for all namespaces
+var providedCredentials = &credentialCache{entries: map[string]providedCredential{}}
+
+// get returns the cached credential for the key or issues a new one if there is none or it has to be refreshed
+func (cache *credentialCache) get(ctx context.Context, key string, provider credentialProvider) (providedCredential, error) {
+	cache.mu.Lock()
+	cached, ok := cache.entries[key]
+	cache.mu.Unlock()
+	if ok && time.Now().Before(cached.refreshAt()) {
+		return cached, nil
+	}
+
+	issued, err := provider.issue(ctx)
+	if err != nil {
+		if ok && time.Now().Before(cached.ExpiresAt) {
+			// keep the valid credential and retry the refresh later
+			return cached, nil
+		}
+		return providedCredential{}, err
+	}
+	cache.mu.Lock()
+	cache.entries[key] = issued
+	cache.mu.Unlock()
+	return issued, nil
+}
+
+// provideCredentials returns a spec with the credentials issued by the provider of the given spec, together with the
+// annotations recording their expiry and the time until the credentials have to be refreshed
+func provideCredentials(ctx context.Context, c client.Client, deps providerDeps, owner client.Object, secret *cheironv1alpha1.ImagePullSecretSpec) (*cheironv1alpha1.ImagePullSecretSpec, map[string]string, time.Duration, error) {
+	provider, err := providerFor(c, deps, secret, owner.GetNamespace())
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	config, err := json.Marshal(secret.Provider)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sum := sha256.Sum256(config)
+	key := fmt.Sprintf("%T/%s/%s/%s/%s", owner, owner.GetNamespace(), owner.GetName(), secret.Name, hex.EncodeToString(sum[:]))
+
+	credential, err := providedCredentials.get(ctx, key, provider)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to issue credentials for secret %s: %w", secret.Name, err)
+	}
+	refreshAfter := time.Until(credential.refreshAt())
+	if refreshAfter <= 0 {
+		// the refresh failed, retry soon while the credential is still valid
+		refreshAfter = time.Minute
+	}
+	email := secret.Email
+	if credential.Email != "" {
+		email = credential.Email
+	}
+	annotations := map[string]string{}
+	if !credential.ExpiresAt.IsZero() {
+		annotations[expiresAtAnnotation] = credential.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return &cheironv1alpha1.ImagePullSecretSpec{
+		Name:        secret.Name,
+		Registry:    secret.Registry,
+		RegistryRef: secret.RegistryRef,
+		Username:    credential.Username,
+		Password:    credential.Password,
+		Email:       email,
+	}, annotations, refreshAfter, nil
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// credentialsSecret returns a secret of the namespace cheiron holding the given data
+func credentialsSecret(name string, data map[string]string) *corev1.Secret {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "cheiron"}, Data: map[string][]byte{}}
+	for k, v := range data {
+		secret.Data[k] = []byte(v)
+	}
+	return secret
+}
+
+// secretRef references a secret of the namespace cheiron
+func secretRef(name string) *corev1.SecretReference {
+	return &corev1.SecretReference{Name: name, Namespace: "cheiron"}
+}
+
+// writeJSON writes the value as JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// countingProvider issues the given credential or error and counts how often it was asked to
+type countingProvider struct {
+	credential providedCredential
+	err        error
+	issued     int
+}
+
+func (p *countingProvider) issue(context.Context) (providedCredential, error) {
+	p.issued++
+	return p.credential, p.err
+}
+
+func TestProviderIsFullySpecified(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider cheironv1alpha1.CredentialProvider
+		want     bool
+	}{
+		{name: "ECR", provider: cheironv1alpha1.CredentialProvider{ECR: &cheironv1alpha1.ECRProvider{Region: "eu-west-1"}}, want: true},
+		{name: "ECR without region", provider: cheironv1alpha1.CredentialProvider{ECR: &cheironv1alpha1.ECRProvider{}}},
+		{name: "ACR", provider: cheironv1alpha1.CredentialProvider{ACR: &cheironv1alpha1.ACRProvider{}}, want: true},
+		{name: "GAR", provider: cheironv1alpha1.CredentialProvider{GAR: &cheironv1alpha1.GARProvider{}}, want: true},
+		{name: "no provider"},
+	}
+	for _, tt := range tests {
+		secret := &cheironv1alpha1.ImagePullSecretSpec{Name: "registry", Registry: "registry.example.com", Provider: &tt.provider}
+		if got := providerIsFullySpecified(secret); got != tt.want {
+			t.Errorf("%s: providerIsFullySpecified() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProviderForRestrictsNamespacedManagers(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider cheironv1alpha1.CredentialProvider
+		allowed  bool
+	}{
+		{name: "ECR with credentials secret", provider: cheironv1alpha1.CredentialProvider{ECR: &cheironv1alpha1.ECRProvider{Region: "eu-west-1", CredentialsSecretRef: secretRef("aws")}}, allowed: true},
+		{name: "ECR with web identity", provider: cheironv1alpha1.CredentialProvider{ECR: &cheironv1alpha1.ECRProvider{Region: "eu-west-1"}}},
+		{name: "ECR with endpoint", provider: cheironv1alpha1.CredentialProvider{ECR: &cheironv1alpha1.ECRProvider{Region: "eu-west-1", CredentialsSecretRef: secretRef("aws"), Endpoint: "http://ecr"}}},
+		{name: "ECR with STS endpoint", provider: cheironv1alpha1.CredentialProvider{ECR: &cheironv1alpha1.ECRProvider{Region: "eu-west-1", CredentialsSecretRef: secretRef("aws"), STSEndpoint: "http://sts"}}},
+		{name: "ACR with credentials secret", provider: cheironv1alpha1.CredentialProvider{ACR: &cheironv1alpha1.ACRProvider{CredentialsSecretRef: secretRef("azure"), Endpoint: "http://acr"}}, allowed: true},
+		{name: "ACR with workload identity", provider: cheironv1alpha1.CredentialProvider{ACR: &cheironv1alpha1.ACRProvider{}}},
+		{name: "ACR with authority endpoint", provider: cheironv1alpha1.CredentialProvider{ACR: &cheironv1alpha1.ACRProvider{CredentialsSecretRef: secretRef("azure"), AuthorityEndpoint: "http://aad"}}},
+		{name: "GAR with credentials secret", provider: cheironv1alpha1.CredentialProvider{GAR: &cheironv1alpha1.GARProvider{CredentialsSecretRef: secretRef("google")}}, allowed: true},
+		{name: "GAR with metadata server", provider: cheironv1alpha1.CredentialProvider{GAR: &cheironv1alpha1.GARProvider{}}},
+		{name: "GAR with metadata endpoint", provider: cheironv1alpha1.CredentialProvider{GAR: &cheironv1alpha1.GARProvider{CredentialsSecretRef: secretRef("google"), MetadataEndpoint: "http://metadata"}}},
+		{name: "GAR with token endpoint", provider: cheironv1alpha1.CredentialProvider{GAR: &cheironv1alpha1.GARProvider{CredentialsSecretRef: secretRef("google"), TokenEndpoint: "http://token"}}},
+		{name: "GitHub App", provider: cheironv1alpha1.CredentialProvider{GitHubApp: &cheironv1alpha1.GitHubAppProvider{AppID: 42, PrivateKeySecretRef: *secretRef("github")}}, allowed: true},
+		{name: "GitHub App with API URL", provider: cheironv1alpha1.CredentialProvider{GitHubApp: &cheironv1alpha1.GitHubAppProvider{AppID: 42, PrivateKeySecretRef: *secretRef("github"), APIURL: "http://github"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &cheironv1alpha1.ImagePullSecretSpec{Name: "registry", Registry: "registry.example.com", Provider: &tt.provider}
+			if _, err := providerFor(fakeClient(), providerDeps{}, secret, ""); err != nil {
+				t.Fatalf("providerFor() of cluster manager failed: %v", err)
+			}
+			_, err := providerFor(fakeClient(), providerDeps{}, secret, "shop")
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("providerFor() of namespaced manager error = %v, allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestProviderSecretRestrictsNamespacedManagers(t *testing.T) {
+	c := fakeClient(credentialsSecret("aws", nil))
+	if _, err := providerSecret(context.Background(), c, secretRef("aws"), ""); err != nil {
+		t.Errorf("cluster manager: %v", err)
+	}
+	if _, err := providerSecret(context.Background(), c, secretRef("aws"), "shop"); err == nil {
+		t.Errorf("namespaced manager may reference a secret of another namespace")
+	}
+	if _, err := providerSecret(context.Background(), c, &corev1.SecretReference{Name: "aws"}, ""); err == nil {
+		t.Errorf("cluster manager may reference a secret without namespace")
+	}
+}
+
+func TestRefreshAt(t *testing.T) {
+	issuedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	credential := providedCredential{IssuedAt: issuedAt, ExpiresAt: issuedAt.Add(12 * time.Hour)}
+	if got, want := credential.refreshAt(), issuedAt.Add(6*time.Hour); !got.Equal(want) {
+		t.Errorf("refreshAt() = %v, want %v", got, want)
+	}
+}
+
+func TestCredentialCache(t *testing.T) {
+	now := time.Now()
+	fresh := providedCredential{Password: "fresh", IssuedAt: now, ExpiresAt: now.Add(time.Hour)}
+	due := providedCredential{Password: "due", IssuedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Minute)}
+	expired := providedCredential{Password: "expired", IssuedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+	failure := errors.New("provider unavailable")
+
+	tests := map[string]struct {
+		cached   *providedCredential
+		provider *countingProvider
+		want     string
+		issued   int
+		err      bool
+	}{
+		"issues without cache":            {provider: &countingProvider{credential: fresh}, want: "fresh", issued: 1},
+		"serves cached credential":        {cached: &fresh, provider: &countingProvider{}, want: "fresh"},
+		"refreshes after half lifetime":   {cached: &due, provider: &countingProvider{credential: fresh}, want: "fresh", issued: 1},
+		"keeps valid credential on error": {cached: &due, provider: &countingProvider{err: failure}, want: "due", issued: 1},
+		"fails with expired credential":   {cached: &expired, provider: &countingProvider{err: failure}, issued: 1, err: true},
+		"fails without cache":             {provider: &countingProvider{err: failure}, issued: 1, err: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache := &credentialCache{entries: map[string]providedCredential{}}
+			if tt.cached != nil {
+				cache.entries["key"] = *tt.cached
+			}
+			got, err := cache.get(context.Background(), "key", tt.provider)
+			if (err != nil) != tt.err {
+				t.Fatalf("get() error = %v, want error %v", err, tt.err)
+			}
+			if got.Password != tt.want || tt.provider.issued != tt.issued {
+				t.Errorf("get() = %q after %d issues, want %q after %d", got.Password, tt.provider.issued, tt.want, tt.issued)
+			}
+		})
+	}
+}
+
+func TestProvideCredentials(t *testing.T) {
+	expiresAt := time.Now().Add(12 * time.Hour).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"authorizationData": []map[string]interface{}{{
+			"authorizationToken": base64.StdEncoding.EncodeToString([]byte("AWS:ecr-password")),
+			"expiresAt":          float64(expiresAt.Unix()),
+		}}})
+	}))
+	defer server.Close()
+
+	c := fakeClient(credentialsSecret("aws", map[string]string{"aws_access_key_id": "AKID", "aws_secret_access_key": "secret"}))
+	owner := &cheironv1alpha1.ClusterImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "provide-credentials"}}
+	secret := &cheironv1alpha1.ImagePullSecretSpec{
+		Name:     "ecr",
+		Registry: "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+		Email:    "ops@example.com",
+		Provider: &cheironv1alpha1.CredentialProvider{ECR: &cheironv1alpha1.ECRProvider{
+			Region: "eu-west-1", CredentialsSecretRef: secretRef("aws"), Endpoint: server.URL,
+		}},
+	}
+
+	spec, annotations, refreshAfter, err := provideCredentials(context.Background(), c, providerDeps{}, owner, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &cheironv1alpha1.ImagePullSecretSpec{Name: "ecr", Registry: secret.Registry, Username: "AWS", Password: "ecr-password", Email: "ops@example.com"}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("spec = %+v, want %+v", spec, want)
+	}
+	if annotations[expiresAtAnnotation] != expiresAt.UTC().Format(time.RFC3339) {
+		t.Errorf("annotations = %v, want expiry %v", annotations, expiresAt)
+	}
+	if refreshAfter <= 5*time.Hour || refreshAfter > 6*time.Hour {
+		t.Errorf("refreshAfter = %v, want half of the 12h lifetime", refreshAfter)
+	}
+
+	namespaced := &cheironv1alpha1.ImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "provide-credentials", Namespace: "shop"}}
+	if _, _, _, err := provideCredentials(context.Background(), c, providerDeps{}, namespaced, secret); err == nil {
+		t.Errorf("namespaced manager may use the ECR endpoint")
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	exp := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		token string
+		err   bool
+	}{
+		"expiring token": {token: unsignedJWT(exp)},
+		"padded payload": {token: strings.Replace(unsignedJWT(exp), ".sig", "", 1) + "==.sig"},
+		"no JWT":         {token: "opaque", err: true},
+		"no expiry":      {token: "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"cheiron"}`)) + ".sig", err: true},
+		"invalid claims": {token: "eyJhbGciOiJub25lIn0.not-base64!.sig", err: true},
+	}
+	for name, tt := range tests {
+		got, err := jwtExpiry(tt.token)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: jwtExpiry() error = %v, want error %v", name, err, tt.err)
+			continue
+		}
+		if !tt.err && !got.Equal(exp) {
+			t.Errorf("%s: jwtExpiry() = %v, want %v", name, got, exp)
+		}
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "client_credentials" {
+			http.Error(w, "unsupported grant", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"access_token": "access", "refresh_token": "refresh", "expires_in": "3600"})
+	}))
+	defer server.Close()
+
+	token, err := requestToken(context.Background(), server.URL, url.Values{"grant_type": {"client_credentials"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != (oauthToken{AccessToken: "access", RefreshToken: "refresh", ExpiresIn: time.Hour}) {
+		t.Errorf("requestToken() = %+v", token)
+	}
+	if _, err := requestToken(context.Background(), server.URL, url.Values{"grant_type": {"password"}}); err == nil || !strings.Contains(err.Error(), "unsupported grant") {
+		t.Errorf("requestToken() error = %v, want the response of the endpoint", err)
+	}
+}
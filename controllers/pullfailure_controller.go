@@ -0,0 +1,512 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	types "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+const (
+	// maxPullFailures caps the number of pull failures reported in the status of a single manager
+	maxPullFailures = 50
+	// maxRecreateAttempts caps the number of pods of the same controller recreated in a row without success
+	maxRecreateAttempts = 5
+	// recreateBackoff is the time between the first recreations of pods of the same controller, it doubles with every
+	// further attempt
+	recreateBackoff = time.Minute
+)
+
+// pullFailureReasons are the waiting reasons of containers failing to pull their image
+var pullFailureReasons = map[string]bool{
+	"ErrImagePull":     true,
+	"ImagePullBackOff": true,
+}
+
+// PullFailureReconciler watches pods failing to pull their images, reports them in the status of the managers
+// attaching secrets for the image's registry, and recreates them if the manager asks for it
+type PullFailureReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	mu       sync.Mutex
+	attempts map[types.UID]recreateAttempts
+}
+
+// recreateAttempts tracks the recreations of the failing pods of a single controller
+type recreateAttempts struct {
+	Namespace string
+	Count     int
+	Last      time.Time
+}
+
+// recreateAfter returns the time until another pod of the controller may be recreated, and false if the controller
+// ran out of attempts
+func (r *PullFailureReconciler) recreateAfter(controller types.UID, now time.Time) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.attempts[controller]
+	if !ok {
+		return 0, true
+	}
+	if a.Count >= maxRecreateAttempts {
+		return 0, false
+	}
+	wait := recreateBackoff<<(a.Count-1) - now.Sub(a.Last)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// recordRecreate records the recreation of a pod of the controller
+func (r *PullFailureReconciler) recordRecreate(namespace string, controller types.UID, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.attempts == nil {
+		r.attempts = map[types.UID]recreateAttempts{}
+	}
+	a := r.attempts[controller]
+	r.attempts[controller] = recreateAttempts{Namespace: namespace, Count: a.Count + 1, Last: now}
+}
+
+// resetRecreate forgets the recreations of the pods of a controller once one of its pods pulled its images
+func (r *PullFailureReconciler) resetRecreate(controller types.UID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.attempts, controller)
+}
+
+// pruneRecreate forgets the recreations of the controllers of a namespace which have no pods anymore, e.g. as they
+// were deleted
+func (r *PullFailureReconciler) pruneRecreate(ctx context.Context, namespace string) error {
+	r.mu.Lock()
+	tracked := false
+	for _, a := range r.attempts {
+		tracked = tracked || a.Namespace == namespace
+	}
+	r.mu.Unlock()
+	if !tracked {
+		return nil
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(namespace)); err != nil {
+		return err
+	}
+	controllers := map[types.UID]bool{}
+	for i := range pods.Items {
+		if controller := metav1.GetControllerOf(&pods.Items[i]); controller != nil {
+			controllers[controller.UID] = true
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for uid, a := range r.attempts {
+		if a.Namespace == namespace && !controllers[uid] {
+			delete(r.attempts, uid)
+		}
+	}
+	return nil
+}
+
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=get;list;watch;create;patch
+
+// pullFailures returns the containers of a pod waiting for a failed image pull
+func pullFailures(pod *corev1.Pod) []cheironv1alpha1.PullFailure {
+	failures := []cheironv1alpha1.PullFailure{}
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		waiting := status.State.Waiting
+		if waiting == nil || !pullFailureReasons[waiting.Reason] {
+			continue
+		}
+		failures = append(failures, cheironv1alpha1.PullFailure{
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			Container: status.Name,
+			Image:     status.Image,
+			Registry:  imageRegistry(status.Image),
+			Reason:    waiting.Reason,
+			Message:   waiting.Message,
+		})
+	}
+	return failures
+}
+
+// hasPullFailures reports whether any container of the object, if it is a pod, fails to pull its image
+func hasPullFailures(obj client.Object) bool {
+	pod, ok := obj.(*corev1.Pod)
+	return ok && len(pullFailures(pod)) > 0
+}
+
+// replacePullFailures replaces the reported failures of a pod in a list of pull failures
+func replacePullFailures(list []cheironv1alpha1.PullFailure, pod types.NamespacedName, failures []cheironv1alpha1.PullFailure) []cheironv1alpha1.PullFailure {
+	result := []cheironv1alpha1.PullFailure{}
+	for _, f := range list {
+		if f.Namespace == pod.Namespace && f.Pod == pod.Name {
+			continue
+		}
+		result = append(result, f)
+	}
+	result = append(result, failures...)
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		if result[i].Pod != result[j].Pod {
+			return result[i].Pod < result[j].Pod
+		}
+		return result[i].Container < result[j].Container
+	})
+	if len(result) > maxPullFailures {
+		result = result[:maxPullFailures]
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// containsString reports whether the list contains the string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// responsibleFailures returns the failures for registries the given manager attaches winning secrets for in the
+// resolved namespace, together with the names of the manager's secrets for these registries. Each failure records
+// which of the manager's secrets the failing pod references.
+func responsibleFailures(res *resolution, m managerRef, pod *corev1.Pod, failures []cheironv1alpha1.PullFailure) ([]cheironv1alpha1.PullFailure, map[string][]string) {
+	secrets := map[string][]string{}
+	specs := map[string]map[string]string{}
+	for _, w := range res.winnersOf(m) {
+		registry := normalizeRegistry(w.Secret.Registry)
+		if registry == "" {
+			continue
+		}
+		secrets[registry] = append(secrets[registry], w.attachedNames()...)
+		if specs[registry] == nil {
+			specs[registry] = map[string]string{}
+		}
+		for _, name := range w.attachedNames() {
+			specs[registry][name] = w.Secret.Name
+		}
+	}
+	responsible := []cheironv1alpha1.PullFailure{}
+	for _, f := range failures {
+		if _, ok := secrets[f.Registry]; !ok {
+			continue
+		}
+		f.Secrets = nil
+		if pod != nil {
+			for _, ref := range pod.Spec.ImagePullSecrets {
+				if spec, ok := specs[f.Registry][ref.Name]; ok && !containsString(f.Secrets, spec) {
+					f.Secrets = append(f.Secrets, spec)
+				}
+			}
+		}
+		sort.Strings(f.Secrets)
+		responsible = append(responsible, f)
+	}
+	return responsible, secrets
+}
+
+// shouldRecreate reports whether a failing pod is recreated to receive credentials. Only pods owned by a controller
+// are deleted, and only if they lack all of the manager's secrets for a failing registry, as recreating pods that
+// already carry the credentials would not help. Available are the secrets per registry a replacement of the pod
+// would receive, without any the replacement would fail just like the pod.
+func shouldRecreate(pod *corev1.Pod, failures []cheironv1alpha1.PullFailure, secrets, available map[string][]string) bool {
+	if metav1.GetControllerOf(pod) == nil || pod.DeletionTimestamp != nil {
+		return false
+	}
+	attached := map[string]bool{}
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		attached[ref.Name] = true
+	}
+	for _, f := range failures {
+		carried := false
+		for _, name := range secrets[f.Registry] {
+			carried = carried || attached[name]
+		}
+		if !carried && len(available[f.Registry]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// availableSecrets returns the secrets per registry a replacement of the pod would receive from a manager with the
+// given mode. Only replacements of pods in ServiceAccount mode receive secrets, namely those of their service account
+// that exist. Workloads receive their secrets with their next rollout and the imagePullSecrets of pods can't be changed
+// once they are created, so pods of both modes are never recreated.
+func availableSecrets(ctx context.Context, c client.Client, pod *corev1.Pod, mode cheironv1alpha1.ReconciliationMode, secrets map[string][]string) (map[string][]string, error) {
+	available := map[string][]string{}
+	if mode != cheironv1alpha1.ServiceAccountMode {
+		return available, nil
+	}
+	name := pod.Spec.ServiceAccountName
+	if name == "" {
+		name = "default"
+	}
+	sa := &corev1.ServiceAccount{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: name}, sa); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	carried := map[string]bool{}
+	for _, ref := range sa.ImagePullSecrets {
+		carried[ref.Name] = true
+	}
+	for registry, names := range secrets {
+		for _, name := range names {
+			if !carried[name] {
+				continue
+			}
+			err := c.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: name}, &corev1.Secret{})
+			if errors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			available[registry] = append(available[registry], name)
+		}
+	}
+	return available, nil
+}
+
+// Reconcile correlates the failing pulls of a pod with the managers of its namespace and updates their status. Deleted
+// and recovered pods are removed from the status again.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.9.2/pkg/reconcile
+func (r *PullFailureReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	failures := []cheironv1alpha1.PullFailure{}
+	pod := &corev1.Pod{}
+	if err := r.Get(ctx, req.NamespacedName, pod); err != nil {
+		if !errors.IsNotFound(err) {
+			log.Error(err, "Unable to fetch Pod")
+			return ctrl.Result{}, err
+		}
+		pod = nil
+	} else {
+		failures = pullFailures(pod)
+	}
+
+	var managers cheironv1alpha1.ImagePullSecretManagerList
+	if err := r.List(ctx, &managers, client.InNamespace(req.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+	var clusterManagers cheironv1alpha1.ClusterImagePullSecretManagerList
+	if err := r.List(ctx, &clusterManagers); err != nil {
+		return ctrl.Result{}, err
+	}
+	// images pulled from aliases of a Registry fail for the secrets of its canonical host
+	catalog, err := loadRegistryCatalog(ctx, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	catalog.expandManagers(managers.Items, clusterManagers.Items)
+	for i := range failures {
+		failures[i].Registry = catalog.canonical(failures[i].Registry)
+	}
+	res := resolveSecrets(req.Namespace, managers.Items, clusterManagers.Items)
+	if err := res.dropRefused(ctx, r.Client); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := res.resolveVersions(ctx, r.Client); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	recreate := false
+	recreating := []client.Object{}
+	for i := range managers.Items {
+		m := &managers.Items[i]
+		responsible, secrets := responsibleFailures(&res, refForManager(m), pod, failures)
+		if pod != nil && m.Spec.Remediation == cheironv1alpha1.RemediationRecreate && len(responsible) > 0 {
+			available, err := availableSecrets(ctx, r.Client, pod, m.Spec.Mode, secrets)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if shouldRecreate(pod, responsible, secrets, available) {
+				recreate = true
+				recreating = append(recreating, m)
+			}
+		}
+		status := m.Status.DeepCopy()
+		status.PullFailures = replacePullFailures(status.PullFailures, req.NamespacedName, responsible)
+		if !equality.Semantic.DeepEqual(status, &m.Status) {
+			m.Status = *status
+			if err := r.Status().Update(ctx, m); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+	for i := range clusterManagers.Items {
+		m := &clusterManagers.Items[i]
+		responsible, secrets := responsibleFailures(&res, refForClusterManager(m), pod, failures)
+		if pod != nil && m.Spec.Remediation == cheironv1alpha1.RemediationRecreate && len(responsible) > 0 {
+			available, err := availableSecrets(ctx, r.Client, pod, m.Spec.Mode, secrets)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if shouldRecreate(pod, responsible, secrets, available) {
+				recreate = true
+				recreating = append(recreating, m)
+			}
+		}
+		status := m.Status.DeepCopy()
+		status.PullFailures = replacePullFailures(status.PullFailures, req.NamespacedName, responsible)
+		if !equality.Semantic.DeepEqual(status, &m.Status) {
+			m.Status = *status
+			if err := r.Status().Update(ctx, m); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	if pod == nil {
+		return ctrl.Result{}, r.pruneRecreate(ctx, req.Namespace)
+	}
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		return ctrl.Result{}, nil
+	}
+	if len(failures) == 0 {
+		r.resetRecreate(controller.UID)
+		return ctrl.Result{}, nil
+	}
+	if !recreate {
+		return ctrl.Result{}, nil
+	}
+
+	// replacements failing as well are not recreated over and over, but with a growing backoff and only a few times
+	now := time.Now()
+	wait, ok := r.recreateAfter(controller.UID, now)
+	if !ok {
+		log.Info("Not recreating pod failing to pull images, its controller ran out of attempts", "pod", pod.Name, "controller", controller.Name)
+		return ctrl.Result{}, nil
+	}
+	if wait > 0 {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+	for _, m := range recreating {
+		r.Recorder.Eventf(m, corev1.EventTypeNormal, "Recreating", "Recreating pod %s/%s failing to pull images", pod.Namespace, pod.Name)
+	}
+	// the controller of the pod creates a replacement, which receives the secrets of its service account
+	if err := r.Delete(ctx, pod, client.Preconditions{UID: &pod.UID}); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+	r.recordRecreate(pod.Namespace, controller.UID, now)
+	log.Info("Deleted pod failing to pull images to recreate it with credentials", "pod", pod.Name)
+
+	return ctrl.Result{}, nil
+}
+
+// pullFailureFilters only passes pods that fail or failed to pull images
+func pullFailureFilters() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return hasPullFailures(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return hasPullFailures(e.ObjectOld) || hasPullFailures(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return hasPullFailures(e.Object)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// pullFailureEventFilters only passes Failed events of pods about pulling images
+func pullFailureEventFilters() predicate.Predicate {
+	isPullFailure := func(obj client.Object) bool {
+		ev, ok := obj.(*corev1.Event)
+		return ok && ev.Reason == "Failed" && ev.InvolvedObject.Kind == "Pod" &&
+			strings.Contains(strings.ToLower(ev.Message), "pull")
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return isPullFailure(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return isPullFailure(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return false
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// eventToPod maps an event to a reconcile request for the pod it is about
+func eventToPod(obj client.Object) []reconcile.Request {
+	ev, ok := obj.(*corev1.Event)
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{
+		Name:      ev.InvolvedObject.Name,
+		Namespace: ev.InvolvedObject.Namespace,
+	}}}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PullFailureReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pullfailure").
+		For(&corev1.Pod{}, builder.WithPredicates(pullFailureFilters())).
+		Watches(&source.Kind{Type: &corev1.Event{}},
+			handler.EnqueueRequestsFromMapFunc(eventToPod),
+			builder.WithPredicates(pullFailureEventFilters())).
+		Complete(r)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// controllerRef returns a controller owner reference
+func controllerRef(kind, name string, uid types.UID) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{APIVersion: "v1", Kind: kind, Name: name, UID: uid, Controller: &controller}
+}
+
+// failingPod returns a pod of the ReplicaSet shop failing to pull the given images, which references the given secrets
+func failingPod(images []string, secrets ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "shop-1",
+			Namespace:       "shop",
+			OwnerReferences: []metav1.OwnerReference{controllerRef("ReplicaSet", "shop", "replicaset")},
+		},
+		Spec: corev1.PodSpec{ImagePullSecrets: pullSecretRefs(secrets...)},
+	}
+	for i, image := range images {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{
+			Name:  []string{"app", "sidecar", "proxy"}[i],
+			Image: image,
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "unauthorized"}},
+		})
+	}
+	return pod
+}
+
+func TestPullFailures(t *testing.T) {
+	pod := failingPod([]string{"quay.io/anny-co/shop", "nginx"})
+	pod.Status.InitContainerStatuses = []corev1.ContainerStatus{{
+		Name:  "init",
+		Image: "ghcr.io/anny-co/init",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ErrImagePull"}},
+	}}
+	pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{
+		Name:  "running",
+		Image: "quay.io/anny-co/running",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+	})
+
+	failures := pullFailures(pod)
+	registries := []string{}
+	for _, f := range failures {
+		registries = append(registries, f.Container+"@"+f.Registry)
+	}
+	want := []string{"init@ghcr.io", "app@quay.io", "sidecar@docker.io"}
+	if !reflect.DeepEqual(registries, want) {
+		t.Errorf("pullFailures() = %v, want %v", registries, want)
+	}
+	if !hasPullFailures(pod) || hasPullFailures(&corev1.Pod{}) || hasPullFailures(&corev1.Secret{}) {
+		t.Errorf("hasPullFailures() misses or invents failures")
+	}
+}
+
+func TestReplacePullFailures(t *testing.T) {
+	list := []cheironv1alpha1.PullFailure{
+		{Namespace: "shop", Pod: "shop-1", Container: "app"},
+		{Namespace: "billing", Pod: "billing-1", Container: "app"},
+	}
+	got := replacePullFailures(list, types.NamespacedName{Namespace: "shop", Name: "shop-1"}, []cheironv1alpha1.PullFailure{
+		{Namespace: "shop", Pod: "shop-1", Container: "sidecar"},
+	})
+	want := []cheironv1alpha1.PullFailure{
+		{Namespace: "billing", Pod: "billing-1", Container: "app"},
+		{Namespace: "shop", Pod: "shop-1", Container: "sidecar"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replacePullFailures() = %v, want %v", got, want)
+	}
+	if got := replacePullFailures(want[1:], types.NamespacedName{Namespace: "shop", Name: "shop-1"}, nil); got != nil {
+		t.Errorf("replacePullFailures() of recovered pod = %v, want nil", got)
+	}
+
+	many := []cheironv1alpha1.PullFailure{}
+	for i := 0; i < maxPullFailures+10; i++ {
+		many = append(many, cheironv1alpha1.PullFailure{Namespace: "shop", Pod: "pod", Container: fmt.Sprintf("c%d", i)})
+	}
+	if got := replacePullFailures(nil, types.NamespacedName{}, many); len(got) != maxPullFailures {
+		t.Errorf("replacePullFailures() reported %d failures, want at most %d", len(got), maxPullFailures)
+	}
+}
+
+func TestResponsibleFailures(t *testing.T) {
+	team := namespacedManager("team", 0, "", basicSecret("quay", "quay.io"), basicSecret("ghcr", "ghcr.io"))
+	res := resolveSecrets("shop", []cheironv1alpha1.ImagePullSecretManager{team}, nil)
+	pod := failingPod([]string{"quay.io/anny-co/shop", "nginx", "ghcr.io/anny-co/proxy"}, "quay", "foreign")
+
+	responsible, secrets := responsibleFailures(&res, refForManager(&team), pod, pullFailures(pod))
+	got := map[string][]string{}
+	for _, f := range responsible {
+		got[f.Registry] = f.Secrets
+	}
+	want := map[string][]string{"quay.io": {"quay"}, "ghcr.io": nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("responsible failures = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(secrets, map[string][]string{"quay.io": {"quay"}, "ghcr.io": {"ghcr"}}) {
+		t.Errorf("secrets = %v", secrets)
+	}
+
+	other := namespacedManager("other", 0, "")
+	if responsible, _ := responsibleFailures(&res, refForManager(&other), pod, pullFailures(pod)); len(responsible) != 0 {
+		t.Errorf("manager without secrets is responsible for %v", responsible)
+	}
+}
+
+func TestShouldRecreate(t *testing.T) {
+	secrets := map[string][]string{"quay.io": {"quay"}}
+	orphan := failingPod([]string{"quay.io/anny-co/shop"})
+	orphan.OwnerReferences = nil
+
+	tests := []struct {
+		name      string
+		pod       *corev1.Pod
+		available map[string][]string
+		want      bool
+	}{
+		{name: "pods lacking available secrets are recreated", pod: failingPod([]string{"quay.io/anny-co/shop"}), available: secrets, want: true},
+		{name: "pods carrying the secrets are kept", pod: failingPod([]string{"quay.io/anny-co/shop"}, "quay"), available: secrets},
+		{name: "pods whose replacement lacks the secrets are kept", pod: failingPod([]string{"quay.io/anny-co/shop"}), available: map[string][]string{}},
+		{name: "pods without controller are kept", pod: orphan, available: secrets},
+		{name: "pods failing for other registries are kept", pod: failingPod([]string{"ghcr.io/anny-co/shop"}), available: secrets},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures := pullFailures(tt.pod)
+			for i := range failures {
+				failures[i].Registry = normalizeRegistry(failures[i].Registry)
+			}
+			if got := shouldRecreate(tt.pod, failures, secrets, tt.available); got != tt.want {
+				t.Errorf("shouldRecreate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvailableSecrets(t *testing.T) {
+	secrets := map[string][]string{"quay.io": {"quay", "quay-missing"}, "ghcr.io": {"ghcr"}}
+	c := fakeClient(
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "shop"}, ImagePullSecrets: pullSecretRefs("quay", "quay-missing")},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "quay", Namespace: "shop"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "ghcr", Namespace: "shop"}},
+	)
+
+	tests := []struct {
+		name           string
+		mode           cheironv1alpha1.ReconciliationMode
+		serviceAccount string
+		want           map[string][]string
+	}{
+		{name: "existing secrets of the service account", mode: cheironv1alpha1.ServiceAccountMode, want: map[string][]string{"quay.io": {"quay"}}},
+		{name: "missing service account", mode: cheironv1alpha1.ServiceAccountMode, serviceAccount: "missing", want: map[string][]string{}},
+		{name: "pods never receive secrets after creation", mode: cheironv1alpha1.PodMode, want: map[string][]string{}},
+		{name: "workloads receive secrets with their rollout", mode: cheironv1alpha1.WorkloadMode, want: map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := failingPod(nil)
+			pod.Spec.ServiceAccountName = tt.serviceAccount
+			got, err := availableSecrets(context.Background(), c, pod, tt.mode, secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil {
+				got = map[string][]string{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("availableSecrets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecreateBackoff(t *testing.T) {
+	r := &PullFailureReconciler{}
+	now := time.Now()
+	if wait, ok := r.recreateAfter("replicaset", now); !ok || wait != 0 {
+		t.Fatalf("first recreation waits %v, allowed %v", wait, ok)
+	}
+	for attempt := 1; attempt < maxRecreateAttempts; attempt++ {
+		r.recordRecreate("shop", "replicaset", now)
+		wait, ok := r.recreateAfter("replicaset", now)
+		if want := recreateBackoff << (attempt - 1); !ok || wait != want {
+			t.Errorf("after %d attempts: wait %v, allowed %v, want %v", attempt, wait, ok, want)
+		}
+		if wait, _ := r.recreateAfter("replicaset", now.Add(2*wait)); wait != 0 {
+			t.Errorf("after %d attempts: still waiting %v once the backoff passed", attempt, wait)
+		}
+	}
+	r.recordRecreate("shop", "replicaset", now)
+	if _, ok := r.recreateAfter("replicaset", now.Add(24*time.Hour)); ok {
+		t.Errorf("recreation allowed after %d attempts", maxRecreateAttempts)
+	}
+	r.resetRecreate("replicaset")
+	if wait, ok := r.recreateAfter("replicaset", now); !ok || wait != 0 {
+		t.Errorf("recreation after recovery waits %v, allowed %v", wait, ok)
+	}
+}
+
+func TestPruneRecreate(t *testing.T) {
+	remaining := failingPod(nil)
+	remaining.OwnerReferences = []metav1.OwnerReference{controllerRef("ReplicaSet", "remaining", "remaining")}
+	r := &PullFailureReconciler{Client: fakeClient(remaining)}
+	now := time.Now()
+	r.recordRecreate("shop", "remaining", now)
+	r.recordRecreate("shop", "deleted", now)
+	r.recordRecreate("billing", "elsewhere", now)
+
+	if err := r.pruneRecreate(context.Background(), "shop"); err != nil {
+		t.Fatal(err)
+	}
+	tracked := []string{}
+	for uid := range r.attempts {
+		tracked = append(tracked, string(uid))
+	}
+	if len(tracked) != 2 || r.attempts["remaining"].Count != 1 || r.attempts["elsewhere"].Count != 1 {
+		t.Errorf("tracked controllers = %v, want remaining and elsewhere", tracked)
+	}
+}
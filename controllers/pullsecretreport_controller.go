@@ -0,0 +1,502 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// PullSecretReportName is the name of the PullSecretReport of each namespace
+const PullSecretReportName = "cheiron"
+
+// maxReportWorkloads caps the number of workloads listed in a report, s.t. reports of large namespaces stay well below
+// the size limit of objects
+const maxReportWorkloads = 250
+
+// PullSecretReportReconciler maintains the PullSecretReport of each namespace
+type PullSecretReportReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Interval is the interval reports are refreshed in besides on changes, 0 disables periodic refreshes
+	Interval time.Duration
+}
+
+//+kubebuilder:rbac:groups=cheiron.anny.co,resources=pullsecretreports,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile writes the report of a namespace, the request is named after the namespace.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.9.2/pkg/reconcile
+func (r *PullSecretReportReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	ns := &corev1.Namespace{}
+	if err := r.Get(ctx, client.ObjectKey{Name: req.Name}, ns); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if ns.DeletionTimestamp != nil {
+		// the report is deleted together with the namespace
+		return ctrl.Result{}, nil
+	}
+
+	workloads, err := namespaceReport(ctx, r.Client, ns)
+	if err != nil {
+		log.Error(err, "Failed to report pull secrets of namespace", "namespace", ns.Name)
+		return ctrl.Result{}, err
+	}
+	summary := cheironv1alpha1.PullSecretReportSummary{Workloads: int32(len(workloads))}
+	for _, w := range workloads {
+		if len(w.Gaps) == 0 {
+			summary.Compliant++
+		}
+		summary.Gaps += int32(len(w.Gaps))
+	}
+	workloads = capWorkloads(workloads, maxReportWorkloads)
+	summary.Omitted = summary.Workloads - int32(len(workloads))
+
+	report := &cheironv1alpha1.PullSecretReport{}
+	err = r.Get(ctx, client.ObjectKey{Namespace: ns.Name, Name: PullSecretReportName}, report)
+	switch {
+	case errors.IsNotFound(err):
+		report = &cheironv1alpha1.PullSecretReport{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns.Name, Name: PullSecretReportName},
+			Summary:    summary,
+			Workloads:  workloads,
+		}
+		if err := r.Create(ctx, report); err != nil {
+			return ctrl.Result{}, err
+		}
+	case err != nil:
+		return ctrl.Result{}, err
+	case !equality.Semantic.DeepEqual(report.Summary, summary) || !equality.Semantic.DeepEqual(report.Workloads, workloads):
+		report.Summary = summary
+		report.Workloads = workloads
+		if err := r.Update(ctx, report); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: r.Interval}, nil
+}
+
+// capWorkloads returns at most max of the workloads, preferring workloads with gaps over compliant ones. The order of
+// the workloads is kept.
+func capWorkloads(workloads []cheironv1alpha1.WorkloadReport, max int) []cheironv1alpha1.WorkloadReport {
+	if len(workloads) <= max {
+		return workloads
+	}
+	keep := make([]bool, len(workloads))
+	kept := 0
+	for _, gaps := range []bool{true, false} {
+		for i, w := range workloads {
+			if kept < max && !keep[i] && (len(w.Gaps) > 0) == gaps {
+				keep[i] = true
+				kept++
+			}
+		}
+	}
+	capped := make([]cheironv1alpha1.WorkloadReport, 0, max)
+	for i, w := range workloads {
+		if keep[i] {
+			capped = append(capped, w)
+		}
+	}
+	return capped
+}
+
+// reportContext holds what the reports of all workloads of a namespace are evaluated against
+type reportContext struct {
+	client.Client
+	Namespace string
+	Catalog   registryCatalog
+	// Managers maps the names of secrets attached by managers to the manager
+	Managers map[string]string
+	// Provided are the canonical registries managers attach secrets for in the namespace
+	Provided map[string]bool
+	// Required are the registries of ClusterImagePullSecretPolicies requiring credentials in the namespace
+	Required []string
+	secrets  map[string]*corev1.Secret
+	accounts map[string]*corev1.ServiceAccount
+}
+
+// namespaceReport reports every workload of the namespace, i.e. all objects of the workload kinds and pods not
+// controlled by one of them, sorted by kind and name
+func namespaceReport(ctx context.Context, c client.Client, ns *corev1.Namespace) ([]cheironv1alpha1.WorkloadReport, error) {
+	rc, err := newReportContext(ctx, c, ns)
+	if err != nil {
+		return nil, err
+	}
+	kinds, err := allWorkloadKinds(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []cheironv1alpha1.WorkloadReport{}
+	for _, kind := range kinds {
+		workloads := &unstructured.UnstructuredList{}
+		workloads.SetGroupVersionKind(kind.GroupVersion().WithKind(kind.Kind + "List"))
+		if err := c.List(ctx, workloads, client.InNamespace(ns.Name)); err != nil {
+			if meta.IsNoMatchError(err) {
+				continue
+			}
+			return nil, err
+		}
+		for i := range workloads.Items {
+			workload := &workloads.Items[i]
+			if isControlledByWorkload(workload, kinds) {
+				continue
+			}
+			specs := []corev1.PodSpec{}
+			for _, list := range kind.PullSecrets {
+				podSpec, found, err := unstructured.NestedMap(workload.Object, list.Path[:len(list.Path)-1]...)
+				if err != nil || !found {
+					continue
+				}
+				var spec corev1.PodSpec
+				if err := runtime.DefaultUnstructuredConverter.FromUnstructured(podSpec, &spec); err != nil {
+					continue
+				}
+				specs = append(specs, spec)
+			}
+			report, err := rc.workloadReport(ctx, kind.Kind, workload.GetName(), specs)
+			if err != nil {
+				return nil, err
+			}
+			reports = append(reports, report)
+		}
+	}
+
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(ns.Name)); err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if isControlledByWorkload(pod, kinds) {
+			continue
+		}
+		report, err := rc.workloadReport(ctx, "Pod", pod.Name, []corev1.PodSpec{pod.Spec})
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Kind != reports[j].Kind {
+			return reports[i].Kind < reports[j].Kind
+		}
+		return reports[i].Name < reports[j].Name
+	})
+	return reports, nil
+}
+
+// newReportContext resolves the managers and policies of the namespace
+func newReportContext(ctx context.Context, c client.Client, ns *corev1.Namespace) (*reportContext, error) {
+	catalog, err := loadRegistryCatalog(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resolveNamespace(ctx, c, ns.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.resolveVersions(ctx, c); err != nil {
+		return nil, err
+	}
+	var policies cheironv1alpha1.ClusterImagePullSecretPolicyList
+	if err := c.List(ctx, &policies); err != nil {
+		return nil, err
+	}
+
+	rc := &reportContext{
+		Client:    c,
+		Namespace: ns.Name,
+		Catalog:   catalog,
+		Managers:  map[string]string{},
+		Provided:  map[string]bool{},
+		secrets:   map[string]*corev1.Secret{},
+		accounts:  map[string]*corev1.ServiceAccount{},
+	}
+	for _, w := range res.Winners {
+		rc.Provided[catalog.canonical(w.Secret.Registry)] = true
+		for _, name := range w.attachedNames() {
+			rc.Managers[name] = w.Manager.String()
+		}
+		if w.Secret.Pool != nil {
+			for m := range w.Secret.Pool.Credentials {
+				rc.Managers[poolSecretName(w.Secret.Name, m)] = w.Manager.String()
+			}
+		}
+	}
+	for _, policy := range policies.Items {
+		if selectsNamespace(policy.Spec.NamespaceSelector, ns) {
+			rc.Required = append(rc.Required, policy.Spec.CredentialsRequired...)
+		}
+	}
+	return rc, nil
+}
+
+// requiresCredentials reports whether images of a registry host need credentials: Docker Hub because of its rate
+// limits, registries managers attach secrets for in the namespace, and registries policies require credentials for
+func (rc *reportContext) requiresCredentials(host string) bool {
+	canonical := rc.Catalog.canonical(host)
+	return canonical == dockerHubRegistry || rc.Provided[canonical] || coversRegistry(rc.Catalog, rc.Required, host)
+}
+
+// secret returns a secret of the namespace, or nil if it does not exist
+func (rc *reportContext) secret(ctx context.Context, name string) (*corev1.Secret, error) {
+	if s, ok := rc.secrets[name]; ok {
+		return s, nil
+	}
+	s := &corev1.Secret{}
+	if err := rc.Get(ctx, client.ObjectKey{Namespace: rc.Namespace, Name: name}, s); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		s = nil
+	}
+	rc.secrets[name] = s
+	return s, nil
+}
+
+// serviceAccount returns a service account of the namespace, or nil if it does not exist
+func (rc *reportContext) serviceAccount(ctx context.Context, name string) (*corev1.ServiceAccount, error) {
+	if sa, ok := rc.accounts[name]; ok {
+		return sa, nil
+	}
+	sa := &corev1.ServiceAccount{}
+	if err := rc.Get(ctx, client.ObjectKey{Namespace: rc.Namespace, Name: name}, sa); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		sa = nil
+	}
+	rc.accounts[name] = sa
+	return sa, nil
+}
+
+// manager returns the manager that attached a secret, the controller of managed secrets or the manager whose winning
+// secret it is, e.g. for existingSecretRefs. Foreign secrets have no manager
+func (rc *reportContext) manager(secret *corev1.Secret, name string) string {
+	if secret != nil {
+		if owner := metav1.GetControllerOf(secret); owner != nil {
+			switch owner.Kind {
+			case "ImagePullSecretManager":
+				return managerRef{Name: owner.Name, Namespace: secret.Namespace}.String()
+			case "ClusterImagePullSecretManager":
+				return managerRef{Cluster: true, Name: owner.Name}.String()
+			}
+		}
+	}
+	return rc.Managers[name]
+}
+
+// workloadReport reports the registries and secrets of a workload with the given pod specs
+func (rc *reportContext) workloadReport(ctx context.Context, kind, name string, specs []corev1.PodSpec) (cheironv1alpha1.WorkloadReport, error) {
+	report := cheironv1alpha1.WorkloadReport{Kind: kind, Name: name, ServiceAccount: "default"}
+
+	images := map[string][]string{}
+	refs := []cheironv1alpha1.SecretReport{}
+	seen := map[string]bool{}
+	addRef := func(secret string, source cheironv1alpha1.SecretSource) {
+		if !seen[secret] {
+			seen[secret] = true
+			refs = append(refs, cheironv1alpha1.SecretReport{Name: secret, Source: source})
+		}
+	}
+	for _, spec := range specs {
+		if spec.ServiceAccountName != "" {
+			report.ServiceAccount = spec.ServiceAccountName
+		}
+		for _, c := range append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...) {
+			if c.Image == "" {
+				continue
+			}
+			registry := rc.Catalog.canonical(imageRegistry(c.Image))
+			images[registry] = appendUnique(images[registry], c.Image)
+		}
+		for _, ref := range spec.ImagePullSecrets {
+			addRef(ref.Name, cheironv1alpha1.PodSpecSource)
+		}
+	}
+	sa, err := rc.serviceAccount(ctx, report.ServiceAccount)
+	if err != nil {
+		return report, err
+	}
+	if sa != nil {
+		for _, ref := range sa.ImagePullSecrets {
+			addRef(ref.Name, cheironv1alpha1.ServiceAccountSource)
+		}
+	}
+
+	hosts := map[string][]string{}
+	for i := range refs {
+		secret, err := rc.secret(ctx, refs[i].Name)
+		if err != nil {
+			return report, err
+		}
+		refs[i].Manager = rc.manager(secret, refs[i].Name)
+		if secret == nil {
+			refs[i].Missing = true
+			report.Gaps = append(report.Gaps, cheironv1alpha1.ReportGap{
+				Reason:  cheironv1alpha1.MissingSecretGap,
+				Secret:  refs[i].Name,
+				Message: fmt.Sprintf("imagePullSecret %s of the %s does not exist", refs[i].Name, sourceName(refs[i].Source)),
+			})
+			continue
+		}
+		refs[i].Registries = secretHosts(secret)
+		hosts[refs[i].Name] = refs[i].Registries
+	}
+	report.Secrets = refs
+
+	registries := make([]string, 0, len(images))
+	for registry := range images {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	for _, registry := range registries {
+		r := cheironv1alpha1.RegistryReport{Registry: registry, Images: images[registry]}
+		for _, ref := range refs {
+			if coversRegistry(rc.Catalog, hosts[ref.Name], registry) {
+				r.Secrets = append(r.Secrets, ref.Name)
+			}
+		}
+		if len(r.Secrets) == 0 && rc.requiresCredentials(registry) {
+			report.Gaps = append(report.Gaps, cheironv1alpha1.ReportGap{
+				Reason:   cheironv1alpha1.MissingCredentialsGap,
+				Registry: registry,
+				Message:  fmt.Sprintf("images are pulled from %s without credentials", registry),
+			})
+		}
+		report.Registries = append(report.Registries, r)
+	}
+	return report, nil
+}
+
+// secretHosts returns the sorted registry hosts a dockerconfigjson or legacy dockercfg secret holds credentials for
+func secretHosts(secret *corev1.Secret) []string {
+	var config DockerConfigJSON
+	if data, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+		_ = json.Unmarshal(data, &config)
+	} else if data, ok := secret.Data[corev1.DockerConfigKey]; ok {
+		_ = json.Unmarshal(data, &config.Auths)
+	}
+	hosts := []string{}
+	for host := range config.Auths {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// sourceName describes the source of a secret in gap messages
+func sourceName(source cheironv1alpha1.SecretSource) string {
+	if source == cheironv1alpha1.ServiceAccountSource {
+		return "service account"
+	}
+	return "pod spec"
+}
+
+// appendUnique appends a value to a list unless it is contained already
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// namespaceOf maps an object to a reconcile request for its namespace
+func namespaceOf(obj client.Object) []reconcile.Request {
+	if obj.GetNamespace() == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+}
+
+// allNamespaces maps any object to reconcile requests for all namespaces
+func (r *PullSecretReportReconciler) allNamespaces(_ client.Object) []reconcile.Request {
+	var namespaces corev1.NamespaceList
+	if err := r.List(context.Background(), &namespaces); err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, ns := range namespaces.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: ns.Name}})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Reports are refreshed whenever pods are created or deleted, or service accounts, secrets and managers of the
+// namespace change. Cluster managers, policies and Registries change the reports of all namespaces. Changes to
+// workloads show through their pods, or at the latest after the interval.
+func (r *PullSecretReportReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pullsecretreport").
+		For(&corev1.Namespace{}, builder.WithPredicates(predicate.Funcs{
+			UpdateFunc: func(e event.UpdateEvent) bool { return false },
+		})).
+		Watches(&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(namespaceOf),
+			builder.WithPredicates(predicate.Funcs{
+				UpdateFunc: func(e event.UpdateEvent) bool { return false },
+			})).
+		Watches(&source.Kind{Type: &corev1.ServiceAccount{}},
+			handler.EnqueueRequestsFromMapFunc(namespaceOf)).
+		Watches(&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(namespaceOf)).
+		Watches(&source.Kind{Type: &cheironv1alpha1.ImagePullSecretManager{}},
+			handler.EnqueueRequestsFromMapFunc(namespaceOf),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &cheironv1alpha1.ClusterImagePullSecretManager{}},
+			handler.EnqueueRequestsFromMapFunc(r.allNamespaces),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &cheironv1alpha1.ClusterImagePullSecretPolicy{}},
+			handler.EnqueueRequestsFromMapFunc(r.allNamespaces),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &cheironv1alpha1.Registry{}},
+			handler.EnqueueRequestsFromMapFunc(r.allNamespaces),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// gapReasons returns the reason and subject of each gap of a report, e.g. MissingSecret:quay
+func gapReasons(report cheironv1alpha1.WorkloadReport) []string {
+	reasons := []string{}
+	for _, g := range report.Gaps {
+		reasons = append(reasons, string(g.Reason)+":"+g.Secret+g.Registry)
+	}
+	return reasons
+}
+
+func TestCapWorkloads(t *testing.T) {
+	workloads := []cheironv1alpha1.WorkloadReport{}
+	for i := 0; i < 6; i++ {
+		w := cheironv1alpha1.WorkloadReport{Kind: "Pod", Name: fmt.Sprintf("pod-%d", i)}
+		if i%3 == 1 {
+			w.Gaps = []cheironv1alpha1.ReportGap{{Reason: cheironv1alpha1.MissingCredentialsGap}}
+		}
+		workloads = append(workloads, w)
+	}
+	tests := []struct {
+		max  int
+		want []string
+	}{
+		{max: 10, want: []string{"pod-0", "pod-1", "pod-2", "pod-3", "pod-4", "pod-5"}},
+		{max: 3, want: []string{"pod-0", "pod-1", "pod-4"}},
+		{max: 1, want: []string{"pod-1"}},
+	}
+	for _, tt := range tests {
+		names := []string{}
+		for _, w := range capWorkloads(workloads, tt.max) {
+			names = append(names, w.Name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("capWorkloads() to %d = %v, want %v", tt.max, names, tt.want)
+		}
+	}
+}
+
+func TestSecretHosts(t *testing.T) {
+	legacy := &corev1.Secret{Data: map[string][]byte{corev1.DockerConfigKey: []byte(`{"quay.io":{},"https://index.docker.io/v1/":{}}`)}}
+	opaque := &corev1.Secret{Data: map[string][]byte{"token": []byte("token")}}
+	tests := []struct {
+		name   string
+		secret *corev1.Secret
+		want   []string
+	}{
+		{name: "dockerconfigjson", secret: authSecret("quay", map[string]string{"quay.io": "team", "ghcr.io": "team"}), want: []string{"ghcr.io", "quay.io"}},
+		{name: "legacy dockercfg", secret: legacy, want: []string{"https://index.docker.io/v1/", "quay.io"}},
+		{name: "other type", secret: opaque, want: []string{}},
+	}
+	for _, tt := range tests {
+		if got := secretHosts(tt.secret); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("secretHosts() of %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWorkloadReport(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{"policy": "strict"}}}
+	manager := namespacedManager("team", 0, "", basicSecret("quay", "quay.io"))
+	manager.UID = "team-uid"
+	managed := authSecret("quay", map[string]string{"quay.io": "team"})
+	managed.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(&manager, cheironv1alpha1.GroupVersion.WithKind("ImagePullSecretManager"))}
+	policy := &cheironv1alpha1.ClusterImagePullSecretPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitlab"},
+		Spec: cheironv1alpha1.ClusterImagePullSecretPolicySpec{
+			CredentialsRequired: []string{"registry.gitlab.com"},
+			NamespaceSelector:   &metav1.LabelSelector{MatchLabels: map[string]string{"policy": "strict"}},
+		},
+	}
+	c := fakeClient(ns, &manager, managed, policy,
+		authSecret("hub", map[string]string{"https://index.docker.io/v1/": "team"}),
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "shop"}, ImagePullSecrets: pullSecretRefs("quay", "gone")},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "builder", Namespace: "shop"}, ImagePullSecrets: pullSecretRefs("hub")},
+	)
+	rc, err := newReportContext(context.Background(), c, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		specs          []corev1.PodSpec
+		serviceAccount string
+		wantSecrets    []cheironv1alpha1.SecretReport
+		wantGaps       []string
+	}{
+		{
+			name: "secrets of service account",
+			specs: []corev1.PodSpec{{
+				InitContainers: []corev1.Container{{Image: "quay.io/anny/migrate"}},
+				Containers:     []corev1.Container{{Image: "quay.io/anny/app"}, {Image: "ghcr.io/anny/sidecar"}},
+			}},
+			serviceAccount: "default",
+			wantSecrets: []cheironv1alpha1.SecretReport{
+				{Name: "quay", Source: cheironv1alpha1.ServiceAccountSource, Manager: "ImagePullSecretManager/shop/team", Registries: []string{"quay.io"}},
+				{Name: "gone", Source: cheironv1alpha1.ServiceAccountSource, Missing: true},
+			},
+			wantGaps: []string{"MissingSecret:gone"},
+		},
+		{
+			name:           "secrets of pod spec and other service account",
+			specs:          []corev1.PodSpec{{ServiceAccountName: "builder", ImagePullSecrets: pullSecretRefs("hub"), Containers: []corev1.Container{{Image: "nginx"}, {Image: "quay.io/anny/app"}}}},
+			serviceAccount: "builder",
+			wantSecrets: []cheironv1alpha1.SecretReport{
+				{Name: "hub", Source: cheironv1alpha1.PodSpecSource, Registries: []string{"https://index.docker.io/v1/"}},
+			},
+			wantGaps: []string{"MissingCredentials:quay.io"},
+		},
+		{
+			name:           "registries required by policy",
+			specs:          []corev1.PodSpec{{ServiceAccountName: "missing", Containers: []corev1.Container{{Image: "registry.gitlab.com/anny/app"}, {Image: "ghcr.io/anny/app"}}}},
+			serviceAccount: "missing",
+			wantSecrets:    []cheironv1alpha1.SecretReport{},
+			wantGaps:       []string{"MissingCredentials:registry.gitlab.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := rc.workloadReport(context.Background(), "Deployment", "app", tt.specs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.ServiceAccount != tt.serviceAccount || !reflect.DeepEqual(report.Secrets, tt.wantSecrets) {
+				t.Errorf("workloadReport() = service account %s with secrets %+v, want %s with %+v", report.ServiceAccount, report.Secrets, tt.serviceAccount, tt.wantSecrets)
+			}
+			if got := gapReasons(report); !reflect.DeepEqual(got, tt.wantGaps) {
+				t.Errorf("workloadReport() gaps = %v, want %v", got, tt.wantGaps)
+			}
+		})
+	}
+}
+
+func TestPullSecretReportReconciler(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop", UID: "web-uid"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			ImagePullSecrets: pullSecretRefs("hub"),
+			Containers:       []corev1.Container{{Name: "web", Image: "nginx"}},
+		}}},
+	}
+	// pods of workloads are reported with their workload
+	owned := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-abcde", Namespace: "shop", OwnerReferences: []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-abc", UID: "rs-uid", Controller: &[]bool{true}[0]},
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}}},
+	}
+	standalone := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "debug", Namespace: "shop"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "debug", Image: "busybox"}}},
+	}
+	c := fakeClient(ns, deployment, owned, standalone, authSecret("hub", map[string]string{"docker.io": "team"}))
+	r := &PullSecretReportReconciler{Client: c, Scheme: c.Scheme()}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Name: "shop"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := &cheironv1alpha1.PullSecretReport{}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "shop", Name: PullSecretReportName}, report); err != nil {
+		t.Fatal(err)
+	}
+	if want := (cheironv1alpha1.PullSecretReportSummary{Workloads: 2, Compliant: 1, Gaps: 1}); report.Summary != want {
+		t.Errorf("summary = %+v, want %+v", report.Summary, want)
+	}
+	names := []string{}
+	for _, w := range report.Workloads {
+		names = append(names, w.Kind+"/"+w.Name+fmt.Sprint(gapReasons(w)))
+	}
+	if want := []string{"Deployment/web[]", "Pod/debug[MissingCredentials:docker.io]"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("workloads = %v, want %v", names, want)
+	}
+
+	// reports of deleted namespaces are left to the garbage collector
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Name: "gone"}}); err != nil {
+		t.Errorf("Reconcile() of missing namespace: %v", err)
+	}
+}
@@ -0,0 +1,424 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+const (
+	// DefaultDockerHubAuthURL is the token endpoint of Docker Hub
+	DefaultDockerHubAuthURL = "https://auth.docker.io/token"
+	// DefaultDockerHubRegistryURL is the registry endpoint of Docker Hub
+	DefaultDockerHubRegistryURL = "https://registry-1.docker.io"
+
+	// rateLimitService is the service the token for the probe is requested for
+	rateLimitService = "registry.docker.io"
+	// rateLimitRepository is the repository Docker provides for checking the rate limit, HEAD requests on its
+	// manifests don't count against the limit
+	rateLimitRepository = "ratelimitpreview/test"
+)
+
+var (
+	rateLimitLabels = []string{"kind", "namespace", "manager", "secret", "member", "source"}
+
+	rateLimitLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cheiron_dockerhub_ratelimit_limit",
+		Help: "Number of pulls allowed per rate limit window for a Docker Hub credential",
+	}, rateLimitLabels)
+	rateLimitRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cheiron_dockerhub_ratelimit_remaining",
+		Help: "Number of pulls left in the current rate limit window for a Docker Hub credential",
+	}, rateLimitLabels)
+	rateLimitProbeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cheiron_dockerhub_ratelimit_probe_errors_total",
+		Help: "Number of failed rate limit probes for a Docker Hub credential",
+	}, []string{"kind", "namespace", "manager", "secret", "member"})
+
+	// errCredentialRejected is returned when the registry rejects a credential
+	errCredentialRejected = errors.New("credential rejected by registry")
+)
+
+func init() {
+	metrics.Registry.MustRegister(rateLimitLimit, rateLimitRemaining, rateLimitProbeErrors)
+}
+
+// RateLimitProber periodically requests the Docker Hub pull rate limit of every Docker Hub credential managed by
+// cheiron, and publishes it as metrics and in the status of the managers
+type RateLimitProber struct {
+	client.Client
+
+	// AuthURL is the token endpoint, defaults to DefaultDockerHubAuthURL
+	AuthURL string
+	// RegistryURL is the registry endpoint, defaults to DefaultDockerHubRegistryURL
+	RegistryURL string
+	// Interval is the time between two probes of all credentials
+	Interval time.Duration
+	// HTTPClient is used for all requests, defaults to the client of the credential providers, whose timeout keeps
+	// stalling registries from blocking the probes
+	HTTPClient *http.Client
+}
+
+//+kubebuilder:rbac:groups=cheiron.anny.co,resources=imagepullsecretmanagers/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=cheiron.anny.co,resources=clusterimagepullsecretmanagers/status,verbs=get;update;patch
+
+// rateLimitSample is a single observed rate limit
+type rateLimitSample struct {
+	Kind      string
+	Namespace string
+	Manager   string
+	Status    cheironv1alpha1.RateLimit
+}
+
+// isDockerHubCredential reports whether the prober can use a secret spec, which requires cheiron to manage the
+// credentials of the secret
+func isDockerHubCredential(secret *cheironv1alpha1.ImagePullSecretSpec) bool {
+	return secret.ExistingSecretRef.Name == "" && secret.Username != "" && secret.Password != "" &&
+		normalizeRegistry(secret.Registry) == dockerHubRegistry
+}
+
+// parseRateLimitHeader parses a header such as "100;w=21600" to the limit and the window in seconds
+func parseRateLimitHeader(value string) (int32, int32, error) {
+	parts := strings.Split(value, ";")
+	limit, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rate limit %q: %w", value, err)
+	}
+	var window int64
+	for _, p := range parts[1:] {
+		if w := strings.TrimPrefix(strings.TrimSpace(p), "w="); w != strings.TrimSpace(p) {
+			if window, err = strconv.ParseInt(w, 10, 32); err != nil {
+				return 0, 0, fmt.Errorf("invalid rate limit window %q: %w", value, err)
+			}
+		}
+	}
+	return int32(limit), int32(window), nil
+}
+
+// httpClient returns the client used for all requests of the prober
+func (p *RateLimitProber) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return providerHTTPClient
+}
+
+// token requests a pull token for the rate limit repository with the given credentials
+func (p *RateLimitProber) token(ctx context.Context, username, password string) (string, error) {
+	authURL := p.AuthURL
+	if authURL == "" {
+		authURL = DefaultDockerHubAuthURL
+	}
+	query := url.Values{}
+	query.Set("service", rateLimitService)
+	query.Set("scope", "repository:"+rateLimitRepository+":pull")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, authURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(username, password)
+
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("%w: token request failed with status %s", errCredentialRejected, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed with status %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	if body.Token == "" {
+		return "", fmt.Errorf("token response contains no token")
+	}
+	return body.Token, nil
+}
+
+// probe requests the rate limit of a single credential
+func (p *RateLimitProber) probe(ctx context.Context, secret *cheironv1alpha1.ImagePullSecretSpec) cheironv1alpha1.RateLimit {
+	status := cheironv1alpha1.RateLimit{Secret: secret.Name, LastProbeTime: metav1.Now()}
+	if err := p.probeInto(ctx, secret, &status); err != nil {
+		status.Error = err.Error()
+		status.Invalid = errors.Is(err, errCredentialRejected)
+	}
+	return status
+}
+
+// probeMember probes one of several credentials of a secret, i.e. a member of a credential pool or the primary or a
+// fallback credential. Docker Hub credentials are probed for their rate limit, credentials for other registries are
+// only validated.
+func (p *RateLimitProber) probeMember(ctx context.Context, secret *cheironv1alpha1.ImagePullSecretSpec, spec *cheironv1alpha1.ImagePullSecretSpec, member int) cheironv1alpha1.RateLimit {
+	var status cheironv1alpha1.RateLimit
+	if normalizeRegistry(secret.Registry) == dockerHubRegistry {
+		status = p.probe(ctx, spec)
+	} else {
+		status = cheironv1alpha1.RateLimit{Secret: secret.Name, LastProbeTime: metav1.Now()}
+		if err := p.validate(ctx, normalizeRegistry(secret.Registry), spec.Username, spec.Password); err != nil {
+			status.Error = err.Error()
+			status.Invalid = errors.Is(err, errCredentialRejected)
+		}
+	}
+	index := int32(member)
+	status.Member = &index
+	return status
+}
+
+// challengeParams matches the parameters of a WWW-Authenticate header
+var challengeParams = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// validate checks a credential against the registry's API endpoint, following the token authentication of the
+// registry if it asks for it. Registries allowing anonymous access cannot be validated and always succeed.
+func (p *RateLimitProber) validate(ctx context.Context, registry, username, password string) error {
+	endpoint := "https://" + registry + "/v2/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if strings.HasPrefix(strings.ToLower(challenge), "bearer") {
+		params := map[string]string{}
+		for _, m := range challengeParams.FindAllStringSubmatch(challenge, -1) {
+			params[strings.ToLower(m[1])] = m[2]
+		}
+		if params["realm"] == "" {
+			return fmt.Errorf("registry %s sent a bearer challenge without realm", registry)
+		}
+		query := url.Values{}
+		query.Set("service", params["service"])
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	}
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(username, password)
+	resp, err = p.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: authentication failed with status %s", errCredentialRejected, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("authentication failed with status %s", resp.Status)
+	}
+	return nil
+}
+
+// probeInto requests a token with the credential and reads the rate limit headers of a manifest request into the status
+func (p *RateLimitProber) probeInto(ctx context.Context, secret *cheironv1alpha1.ImagePullSecretSpec, status *cheironv1alpha1.RateLimit) error {
+	token, err := p.token(ctx, secret.Username, secret.Password)
+	if err != nil {
+		return err
+	}
+
+	registryURL := p.RegistryURL
+	if registryURL == "" {
+		registryURL = DefaultDockerHubRegistryURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead,
+		strings.TrimSuffix(registryURL, "/")+"/v2/"+rateLimitRepository+"/manifests/latest", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("manifest request failed with status %s", resp.Status)
+	}
+
+	status.Source = resp.Header.Get("docker-ratelimit-source")
+	if value := resp.Header.Get("ratelimit-limit"); value != "" {
+		limit, window, err := parseRateLimitHeader(value)
+		if err != nil {
+			return err
+		}
+		status.Limit = &limit
+		status.WindowSeconds = window
+	}
+	if value := resp.Header.Get("ratelimit-remaining"); value != "" {
+		remaining, _, err := parseRateLimitHeader(value)
+		if err != nil {
+			return err
+		}
+		status.Remaining = &remaining
+	}
+	return nil
+}
+
+// probeSecrets probes all Docker Hub credentials and the members of all credential pools of a manager
+func (p *RateLimitProber) probeSecrets(ctx context.Context, secrets []cheironv1alpha1.ImagePullSecretSpec) []cheironv1alpha1.RateLimit {
+	var limits []cheironv1alpha1.RateLimit
+	for i := range secrets {
+		secret := &secrets[i]
+		switch {
+		case secret.ExistingSecretRef.Name == "" && secret.Provider == nil && secret.Pool != nil:
+			for member := range secret.Pool.Credentials {
+				limits = append(limits, p.probeMember(ctx, secret, memberSpec(secret, member, secret.Name), member))
+			}
+		case hasFallbacks(secret):
+			for index := 0; index <= len(secret.Fallbacks); index++ {
+				limits = append(limits, p.probeMember(ctx, secret, credentialAt(secret, index), index))
+			}
+		case isDockerHubCredential(secret):
+			limits = append(limits, p.probe(ctx, secret))
+		}
+	}
+	return limits
+}
+
+// probeAll probes the credentials of all managers, updates their status and replaces the published metrics
+func (p *RateLimitProber) probeAll(ctx context.Context) {
+	log := ctrl.Log.WithName("ratelimit")
+	samples := []rateLimitSample{}
+
+	catalog, err := loadRegistryCatalog(ctx, p.Client)
+	if err != nil {
+		log.Error(err, "Failed to list Registries")
+		return
+	}
+
+	var managers cheironv1alpha1.ImagePullSecretManagerList
+	if err := p.List(ctx, &managers); err != nil {
+		log.Error(err, "Failed to list ImagePullSecretManagers")
+		return
+	}
+	catalog.expandManagers(managers.Items, nil)
+	for i := range managers.Items {
+		m := &managers.Items[i]
+		limits := p.probeSecrets(ctx, m.Spec.Secrets)
+		for _, l := range limits {
+			samples = append(samples, rateLimitSample{Kind: "ImagePullSecretManager", Namespace: m.Namespace, Manager: m.Name, Status: l})
+		}
+		if !equality.Semantic.DeepEqual(m.Status.RateLimits, limits) {
+			m.Status.RateLimits = limits
+			if err := p.Status().Update(ctx, m); err != nil {
+				log.Error(err, "Failed to update rate limits", "manager", m.Name, "namespace", m.Namespace)
+			}
+		}
+	}
+
+	var clusterManagers cheironv1alpha1.ClusterImagePullSecretManagerList
+	if err := p.List(ctx, &clusterManagers); err != nil {
+		log.Error(err, "Failed to list ClusterImagePullSecretManagers")
+		return
+	}
+	catalog.expandManagers(nil, clusterManagers.Items)
+	for i := range clusterManagers.Items {
+		m := &clusterManagers.Items[i]
+		limits := p.probeSecrets(ctx, m.Spec.Secrets)
+		for _, l := range limits {
+			samples = append(samples, rateLimitSample{Kind: "ClusterImagePullSecretManager", Manager: m.Name, Status: l})
+		}
+		if !equality.Semantic.DeepEqual(m.Status.RateLimits, limits) {
+			m.Status.RateLimits = limits
+			if err := p.Status().Update(ctx, m); err != nil {
+				log.Error(err, "Failed to update rate limits", "manager", m.Name)
+			}
+		}
+	}
+
+	publishRateLimits(samples)
+}
+
+// publishRateLimits replaces the published rate limit metrics, which drops series of removed credentials
+func publishRateLimits(samples []rateLimitSample) {
+	rateLimitLimit.Reset()
+	rateLimitRemaining.Reset()
+	for _, s := range samples {
+		member := ""
+		if s.Status.Member != nil {
+			member = strconv.Itoa(int(*s.Status.Member))
+		}
+		if s.Status.Error != "" {
+			rateLimitProbeErrors.WithLabelValues(s.Kind, s.Namespace, s.Manager, s.Status.Secret, member).Inc()
+			continue
+		}
+		labels := []string{s.Kind, s.Namespace, s.Manager, s.Status.Secret, member, s.Status.Source}
+		if s.Status.Limit != nil {
+			rateLimitLimit.WithLabelValues(labels...).Set(float64(*s.Status.Limit))
+		}
+		if s.Status.Remaining != nil {
+			rateLimitRemaining.WithLabelValues(labels...).Set(float64(*s.Status.Remaining))
+		}
+	}
+}
+
+// Start probes all credentials every interval until the context is done
+func (p *RateLimitProber) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, p.probeAll, p.Interval)
+	return nil
+}
+
+// NeedLeaderElection makes only the leader probe, s.t. the probes of several replicas don't add up
+func (p *RateLimitProber) NeedLeaderElection() bool {
+	return true
+}
+
+// SetupWithManager adds the prober to the Manager. A non-positive interval disables probing.
+func (p *RateLimitProber) SetupWithManager(mgr ctrl.Manager) error {
+	if p.Interval <= 0 {
+		return nil
+	}
+	return mgr.Add(p)
+}
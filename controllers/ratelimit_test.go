@@ -0,0 +1,294 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// dockerHub returns a stand-in for the token and registry endpoints of Docker Hub, which accepts the password
+// "secret" for every user and reports a limit of 100 pulls of which remaining are left
+func dockerHub(t *testing.T, remaining string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); !ok || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("scope") != "repository:"+rateLimitRepository+":pull" {
+			t.Errorf("token requested for scope %q", r.URL.Query().Get("scope"))
+		}
+		_, _ = w.Write([]byte(`{"token":"pull-token"}`))
+	})
+	mux.HandleFunc("/v2/"+rateLimitRepository+"/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.Header.Get("Authorization") != "Bearer pull-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("ratelimit-limit", "100;w=21600")
+		w.Header().Set("ratelimit-remaining", remaining)
+		w.Header().Set("docker-ratelimit-source", "alice-id")
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dockerHubProber returns a prober running against the given stand-in of Docker Hub
+func dockerHubProber(server *httptest.Server) *RateLimitProber {
+	return &RateLimitProber{AuthURL: server.URL + "/token", RegistryURL: server.URL, HTTPClient: server.Client()}
+}
+
+func TestParseRateLimitHeader(t *testing.T) {
+	tests := []struct {
+		value  string
+		limit  int32
+		window int32
+		err    bool
+	}{
+		{value: "100;w=21600", limit: 100, window: 21600},
+		{value: " 76 ; w=21600 ", limit: 76, window: 21600},
+		{value: "200", limit: 200},
+		{value: "none;w=21600", err: true},
+		{value: "100;w=six-hours", err: true},
+	}
+	for _, tt := range tests {
+		limit, window, err := parseRateLimitHeader(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("parseRateLimitHeader(%q) error = %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+		if limit != tt.limit || window != tt.window {
+			t.Errorf("parseRateLimitHeader(%q) = %d, %d, want %d, %d", tt.value, limit, window, tt.limit, tt.window)
+		}
+	}
+}
+
+func TestRateLimitProberHTTPClient(t *testing.T) {
+	if client := (&RateLimitProber{}).httpClient(); client.Timeout == 0 {
+		t.Errorf("default client has no timeout")
+	}
+	own := &http.Client{}
+	if client := (&RateLimitProber{HTTPClient: own}).httpClient(); client != own {
+		t.Errorf("configured client is not used")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	prober := dockerHubProber(dockerHub(t, "42;w=21600"))
+
+	tests := map[string]struct {
+		password string
+		invalid  bool
+		err      bool
+	}{
+		"valid credential":    {password: "secret"},
+		"rejected credential": {password: "wrong", invalid: true, err: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			status := prober.probe(context.Background(), &cheironv1alpha1.ImagePullSecretSpec{
+				Name: "hub", Registry: "docker.io", Username: "alice", Password: tt.password,
+			})
+			if status.Secret != "hub" || status.LastProbeTime.IsZero() {
+				t.Errorf("status = %+v, want secret hub with probe time", status)
+			}
+			if (status.Error != "") != tt.err || status.Invalid != tt.invalid {
+				t.Fatalf("status error = %q, invalid = %v, want error %v, invalid %v", status.Error, status.Invalid, tt.err, tt.invalid)
+			}
+			if tt.err {
+				return
+			}
+			if status.Limit == nil || *status.Limit != 100 || status.Remaining == nil || *status.Remaining != 42 ||
+				status.WindowSeconds != 21600 || status.Source != "alice-id" {
+				t.Errorf("status = %+v, want limit 100, 42 remaining of a 21600s window for alice-id", status)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		handler  func(realm string) http.HandlerFunc
+		password string
+		invalid  bool
+		err      bool
+	}{
+		"anonymous registry": {
+			handler:  func(string) http.HandlerFunc { return func(http.ResponseWriter, *http.Request) {} },
+			password: "wrong",
+		},
+		"bearer token accepted": {
+			handler:  bearerRegistry,
+			password: "secret",
+		},
+		"bearer token rejected": {
+			handler:  bearerRegistry,
+			password: "wrong",
+			invalid:  true,
+			err:      true,
+		},
+		"bearer challenge without realm": {
+			handler: func(string) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("WWW-Authenticate", `Bearer service="registry"`)
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			},
+			password: "secret",
+			err:      true,
+		},
+		"basic auth rejected": {
+			handler: func(string) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					if _, password, ok := r.BasicAuth(); !ok || password != "secret" {
+						w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+						w.WriteHeader(http.StatusUnauthorized)
+					}
+				}
+			},
+			password: "wrong",
+			invalid:  true,
+			err:      true,
+		},
+		"registry failing": {
+			handler: func(string) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					if _, _, ok := r.BasicAuth(); !ok {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			},
+			password: "secret",
+			err:      true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var handler http.HandlerFunc
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handler(w, r) }))
+			defer server.Close()
+			handler = tt.handler(server.URL + "/token")
+
+			prober := &RateLimitProber{HTTPClient: server.Client()}
+			err := prober.validate(context.Background(), strings.TrimPrefix(server.URL, "https://"), "alice", tt.password)
+			if (err != nil) != tt.err {
+				t.Fatalf("validate() error = %v, want error %v", err, tt.err)
+			}
+			if invalid := err != nil && strings.Contains(err.Error(), errCredentialRejected.Error()); invalid != tt.invalid {
+				t.Errorf("validate() error = %v, want rejected %v", err, tt.invalid)
+			}
+		})
+	}
+}
+
+// bearerRegistry serves a registry requiring a token from the realm, which accepts the password "secret"
+func bearerRegistry(realm string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if _, password, ok := r.BasicAuth(); !ok || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestProbeSecrets(t *testing.T) {
+	prober := dockerHubProber(dockerHub(t, "42;w=21600"))
+	secrets := []cheironv1alpha1.ImagePullSecretSpec{
+		{Name: "hub", Registry: "docker.io", Username: "alice", Password: "secret"},
+		{Name: "pool", Registry: "index.docker.io", Pool: &cheironv1alpha1.CredentialPool{Credentials: []cheironv1alpha1.Credential{
+			{Username: "bob", Password: "secret"},
+			{Username: "carol", Password: "wrong"},
+		}}},
+		{Name: "failover", Registry: "docker.io", Username: "dave", Password: "wrong", Fallbacks: []cheironv1alpha1.Credential{
+			{Username: "erin", Password: "secret"},
+		}},
+		{Name: "existing", Registry: "docker.io", ExistingSecretRef: corev1.LocalObjectReference{Name: "hub-credentials"}},
+		{Name: "quay", Registry: "quay.io", Username: "alice", Password: "secret"},
+	}
+
+	type result struct {
+		secret  string
+		member  int32
+		invalid bool
+	}
+	want := []result{
+		{secret: "hub", member: -1},
+		{secret: "pool", member: 0},
+		{secret: "pool", member: 1, invalid: true},
+		{secret: "failover", member: 0, invalid: true},
+		{secret: "failover", member: 1},
+	}
+
+	limits := prober.probeSecrets(context.Background(), secrets)
+	if len(limits) != len(want) {
+		t.Fatalf("probeSecrets() returned %d results, want %d: %+v", len(limits), len(want), limits)
+	}
+	for i, l := range limits {
+		got := result{secret: l.Secret, member: -1, invalid: l.Invalid}
+		if l.Member != nil {
+			got.member = *l.Member
+		}
+		if got != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestProbeAllRefreshesProbeTime(t *testing.T) {
+	limit, remaining := int32(100), int32(42)
+	stale := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	manager := namespacedManager("hub", 0, "", cheironv1alpha1.ImagePullSecretSpec{
+		Name: "hub", Registry: "docker.io", Username: "alice", Password: "secret",
+	})
+	manager.Status.RateLimits = []cheironv1alpha1.RateLimit{{
+		Secret: "hub", Limit: &limit, Remaining: &remaining, WindowSeconds: 21600, Source: "alice-id", LastProbeTime: stale,
+	}}
+
+	prober := dockerHubProber(dockerHub(t, "42;w=21600"))
+	prober.Client = fakeClient(&manager)
+	prober.probeAll(context.Background())
+
+	var got cheironv1alpha1.ImagePullSecretManager
+	if err := prober.Get(context.Background(), types.NamespacedName{Namespace: manager.Namespace, Name: manager.Name}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Status.RateLimits) != 1 {
+		t.Fatalf("rate limits = %+v, want one", got.Status.RateLimits)
+	}
+	if !got.Status.RateLimits[0].LastProbeTime.After(stale.Time) {
+		t.Errorf("last probe time %v was not refreshed from %v", got.Status.RateLimits[0].LastProbeTime, stale)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// dockerHubRegistry is the canonical host name used for Docker Hub
+const dockerHubRegistry = "docker.io"
+
+// dockerHubAliases are the host names that all refer to Docker Hub
+var dockerHubAliases = map[string]bool{
+	"docker.io":               true,
+	"index.docker.io":         true,
+	"registry-1.docker.io":    true,
+	"registry.hub.docker.com": true,
+}
+
+// normalizeRegistry reduces a registry as written in an ImagePullSecretSpec to its host name, s.t. e.g.
+// https://index.docker.io/v1 and docker.io are recognized as the same registry
+func normalizeRegistry(registry string) string {
+	host := strings.ToLower(strings.TrimSpace(registry))
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	if dockerHubAliases[host] {
+		return dockerHubRegistry
+	}
+	return host
+}
+
+// imageRegistry returns the normalized registry host name of an image reference, images without registry host
+// are pulled from Docker Hub
+func imageRegistry(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return dockerHubRegistry
+	}
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		// first component is a Docker Hub user or organization, e.g. bitnami/redis
+		return dockerHubRegistry
+	}
+	return normalizeRegistry(host)
+}
+
+//+kubebuilder:rbac:groups=cheiron.anny.co,resources=registries,verbs=get;list;watch
+
+// registryCatalog holds the Registry ressources of the cluster, which secrets reference instead of a registry host
+type registryCatalog struct {
+	registries map[string]cheironv1alpha1.RegistrySpec
+}
+
+// loadRegistryCatalog lists all Registry ressources
+func loadRegistryCatalog(ctx context.Context, c client.Client) (registryCatalog, error) {
+	var registries cheironv1alpha1.RegistryList
+	if err := c.List(ctx, &registries); err != nil {
+		return registryCatalog{}, err
+	}
+	catalog := registryCatalog{registries: map[string]cheironv1alpha1.RegistrySpec{}}
+	for _, r := range registries.Items {
+		catalog.registries[r.Name] = r.Spec
+	}
+	return catalog, nil
+}
+
+// sorted returns the specs of all Registry ressources ordered by name
+func (rc registryCatalog) sorted() []cheironv1alpha1.RegistrySpec {
+	names := make([]string, 0, len(rc.registries))
+	for name := range rc.registries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	specs := make([]cheironv1alpha1.RegistrySpec, 0, len(names))
+	for _, name := range names {
+		specs = append(specs, rc.registries[name])
+	}
+	return specs
+}
+
+// canonical returns the canonical host of the Registry whose host, aliases or patterns match the given host, or the
+// normalized host itself if no Registry matches. Hosts take precedence over aliases and aliases over patterns. If
+// several Registries match alike, the first one by name wins s.t. the result does not change between calls.
+func (rc registryCatalog) canonical(host string) string {
+	host = normalizeRegistry(host)
+	registries := rc.sorted()
+	for _, r := range registries {
+		if normalizeRegistry(r.Host) == host {
+			return host
+		}
+	}
+	for _, r := range registries {
+		for _, alias := range r.Aliases {
+			if normalizeRegistry(alias) == host {
+				return normalizeRegistry(r.Host)
+			}
+		}
+	}
+	for _, r := range registries {
+		for _, pattern := range r.Patterns {
+			if matchesRegistry(pattern, host) {
+				return normalizeRegistry(r.Host)
+			}
+		}
+	}
+	return host
+}
+
+// expand sets the registry of secrets referencing a Registry to its canonical host, s.t. they are resolved and
+// matched like secrets naming the host. The registry of secrets referencing a missing Registry is cleared, which
+// leaves them not fully specified.
+func (rc registryCatalog) expand(secrets []cheironv1alpha1.ImagePullSecretSpec) {
+	for i := range secrets {
+		ref := secrets[i].RegistryRef
+		if ref == nil {
+			continue
+		}
+		secrets[i].Registry = rc.registries[ref.Name].Host
+	}
+}
+
+// expandManagers expands the secrets of all given managers, see expand()
+func (rc registryCatalog) expandManagers(managers []cheironv1alpha1.ImagePullSecretManager, clusterManagers []cheironv1alpha1.ClusterImagePullSecretManager) {
+	for i := range managers {
+		rc.expand(managers[i].Spec.Secrets)
+	}
+	for i := range clusterManagers {
+		rc.expand(clusterManagers[i].Spec.Secrets)
+	}
+}
+
+// registryEntries returns the hosts a secret holds entries for and how the credentials are written to them. Secrets
+// referencing a Registry hold an entry for its host, each alias and each pattern
+func registryEntries(ctx context.Context, c client.Client, secret *cheironv1alpha1.ImagePullSecretSpec) ([]string, cheironv1alpha1.RegistryAuthType, error) {
+	if secret.RegistryRef == nil {
+		return []string{secret.Registry}, cheironv1alpha1.BasicAuthType, nil
+	}
+	registry := &cheironv1alpha1.Registry{}
+	if err := c.Get(ctx, client.ObjectKey{Name: secret.RegistryRef.Name}, registry); err != nil {
+		return nil, "", err
+	}
+	hosts := []string{}
+	seen := map[string]bool{}
+	for _, host := range append(append([]string{registry.Spec.Host}, registry.Spec.Aliases...), registry.Spec.Patterns...) {
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	return hosts, registry.Spec.AuthType, nil
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// registry returns a Registry ressource
+func registry(name string, spec cheironv1alpha1.RegistrySpec) *cheironv1alpha1.Registry {
+	return &cheironv1alpha1.Registry{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+}
+
+func TestNormalizeRegistry(t *testing.T) {
+	tests := map[string]string{
+		"quay.io":                      "quay.io",
+		" Quay.IO ":                    "quay.io",
+		"https://quay.io/v2/":          "quay.io",
+		"http://localhost:5000":        "localhost:5000",
+		"https://index.docker.io/v1/":  "docker.io",
+		"registry-1.docker.io":         "docker.io",
+		"registry.hub.docker.com/repo": "docker.io",
+	}
+	for registry, want := range tests {
+		if got := normalizeRegistry(registry); got != want {
+			t.Errorf("normalizeRegistry(%q) = %s, want %s", registry, got, want)
+		}
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	tests := map[string]string{
+		"nginx":                        "docker.io",
+		"bitnami/redis:6.2":            "docker.io",
+		"docker.io/library/nginx":      "docker.io",
+		"quay.io/anny/app@sha256:abc":  "quay.io",
+		"localhost/app":                "localhost",
+		"localhost:5000/app":           "localhost:5000",
+		"Harbor.Example.com/shop/app":  "harbor.example.com",
+		"registry.gitlab.com/a/b/c:v1": "registry.gitlab.com",
+	}
+	for image, want := range tests {
+		if got := imageRegistry(image); got != want {
+			t.Errorf("imageRegistry(%q) = %s, want %s", image, got, want)
+		}
+	}
+}
+
+func TestRegistryCatalogCanonical(t *testing.T) {
+	c := fakeClient(
+		registry("harbor", cheironv1alpha1.RegistrySpec{Host: "harbor.example.com", Aliases: []string{"harbor.internal", "https://harbor.local/"}}),
+		registry("ecr", cheironv1alpha1.RegistrySpec{Host: "123456789012.dkr.ecr.eu-central-1.amazonaws.com", Patterns: []string{"*.dkr.ecr.*.amazonaws.com"}}),
+		// aliases of the first Registry by name win
+		registry("a-mirror", cheironv1alpha1.RegistrySpec{Host: "mirror.example.com", Aliases: []string{"harbor.local"}}),
+		// hosts take precedence over aliases and patterns of other Registries
+		registry("ecr-us", cheironv1alpha1.RegistrySpec{Host: "123456789012.dkr.ecr.us-east-1.amazonaws.com", Aliases: []string{"harbor.example.com"}}),
+	)
+	catalog, err := loadRegistryCatalog(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"harbor.example.com": "harbor.example.com",
+		"HARBOR.internal":    "harbor.example.com",
+		"harbor.local":       "mirror.example.com",
+		"210987654321.dkr.ecr.eu-west-1.amazonaws.com": "123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com": "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+		"https://index.docker.io/v1/":                  "docker.io",
+		"quay.io":                                      "quay.io",
+	}
+	for host, want := range tests {
+		if got := catalog.canonical(host); got != want {
+			t.Errorf("canonical(%q) = %s, want %s", host, got, want)
+		}
+	}
+}
+
+func TestRegistryCatalogExpand(t *testing.T) {
+	catalog, err := loadRegistryCatalog(context.Background(), fakeClient(registry("harbor", cheironv1alpha1.RegistrySpec{Host: "harbor.example.com"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	referencing := basicSecret("harbor", "")
+	referencing.RegistryRef = &corev1.LocalObjectReference{Name: "harbor"}
+	missing := basicSecret("gone", "gone.example.com")
+	missing.RegistryRef = &corev1.LocalObjectReference{Name: "gone"}
+	manager := namespacedManager("team", 0, "", referencing, missing, basicSecret("quay", "quay.io"))
+	cluster := clusterManager("cluster", 0, "", referencing)
+
+	managers := []cheironv1alpha1.ImagePullSecretManager{manager}
+	clusterManagers := []cheironv1alpha1.ClusterImagePullSecretManager{cluster}
+	catalog.expandManagers(managers, clusterManagers)
+	got := []string{}
+	for _, s := range append(managers[0].Spec.Secrets, clusterManagers[0].Spec.Secrets...) {
+		got = append(got, s.Registry)
+	}
+	if want := []string{"harbor.example.com", "", "quay.io", "harbor.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expandManagers() registries = %v, want %v", got, want)
+	}
+	if secretIsFullySpecified(&managers[0].Spec.Secrets[1]) {
+		t.Errorf("secret referencing a missing Registry is fully specified")
+	}
+}
+
+func TestRegistryEntries(t *testing.T) {
+	c := fakeClient(registry("harbor", cheironv1alpha1.RegistrySpec{
+		Host:     "harbor.example.com",
+		Aliases:  []string{"harbor.internal", "harbor.example.com"},
+		Patterns: []string{"*.harbor.example.com"},
+		AuthType: cheironv1alpha1.RegistryTokenAuthType,
+	}))
+	tests := []struct {
+		name         string
+		registryRef  string
+		wantHosts    []string
+		wantAuthType cheironv1alpha1.RegistryAuthType
+		fails        bool
+	}{
+		{name: "registry host", wantHosts: []string{"quay.io"}, wantAuthType: cheironv1alpha1.BasicAuthType},
+		{name: "Registry", registryRef: "harbor", wantHosts: []string{"harbor.example.com", "harbor.internal", "*.harbor.example.com"}, wantAuthType: cheironv1alpha1.RegistryTokenAuthType},
+		{name: "missing Registry", registryRef: "gone", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := basicSecret("registry", "quay.io")
+			if tt.registryRef != "" {
+				secret.RegistryRef = &corev1.LocalObjectReference{Name: tt.registryRef}
+			}
+			hosts, authType, err := registryEntries(context.Background(), c, &secret)
+			if (err != nil) != tt.fails {
+				t.Fatalf("registryEntries() error = %v, want error %v", err, tt.fails)
+			}
+			if !tt.fails && (!reflect.DeepEqual(hosts, tt.wantHosts) || authType != tt.wantAuthType) {
+				t.Errorf("registryEntries() = %v, %s, want %v, %s", hosts, authType, tt.wantHosts, tt.wantAuthType)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+const (
+	// defaultRotationOverlap is the time superseded versions stay attached if the rotation policy does not specify it
+	defaultRotationOverlap = 10 * time.Minute
+	// versionSuffixLength is the number of characters of the content hash the names of versions are suffixed with
+	versionSuffixLength = 10
+)
+
+var (
+	// versionLabel marks versioned secrets with the name of the ImagePullSecretSpec they are a version of
+	versionLabel = "cheiron.anny.co/version-of"
+	// supersededAnnotation records when a version was superseded by a newer version
+	supersededAnnotation = "cheiron.anny.co/superseded-at"
+)
+
+// versioned reports whether the candidate's credentials are written to versioned secrets. Pools assigned per service
+// account keep their member secrets, as their names are attached per service account.
+func (c candidate) versioned() bool {
+	return c.Rotation != nil && c.Rotation.Strategy == cheironv1alpha1.VersionedRotation &&
+		c.Secret.ExistingSecretRef.Name == "" && !c.perServiceAccount()
+}
+
+// overlap returns the time superseded versions of the candidate stay attached
+func (c candidate) overlap() time.Duration {
+	if c.Rotation == nil || c.Rotation.Overlap == nil {
+		return defaultRotationOverlap
+	}
+	return c.Rotation.Overlap.Duration
+}
+
+// attachedNames returns the names of the secrets attached to targets for the candidate. For versioned secrets these
+// are the current version and all superseded versions within the overlap, see resolveVersions().
+func (c candidate) attachedNames() []string {
+	if c.versioned() {
+		return c.Versions
+	}
+	return []string{c.secretName()}
+}
+
+// versionedSecretName returns the name of the version of a secret with the given content hash, s.t. the same content
+// always maps to the same version
+func versionedSecretName(name, hash string) string {
+	if len(hash) > versionSuffixLength {
+		hash = hash[:versionSuffixLength]
+	}
+	return name + "-" + hash
+}
+
+// versionContentHash returns the content hash of a version, versions written before the hash was recorded are hashed
+func versionContentHash(secret *corev1.Secret) string {
+	if hash, ok := secret.Annotations[contentHashAnnotation]; ok {
+		return hash
+	}
+	return contentHash(secret.Data[corev1.DockerConfigJsonKey])
+}
+
+// logicalSecretName returns the name of the ImagePullSecretSpec a secret was written for
+func logicalSecretName(secret *corev1.Secret) string {
+	if name, ok := secret.Labels[versionLabel]; ok {
+		return name
+	}
+	return secret.Name
+}
+
+// isControlledByManager reports whether an object is controlled by the given manager
+func isControlledByManager(obj metav1.Object, m managerRef) bool {
+	ref := metav1.GetControllerOf(obj)
+	if ref == nil {
+		return false
+	}
+	kind := "ImagePullSecretManager"
+	if m.Cluster {
+		kind = "ClusterImagePullSecretManager"
+	}
+	return ref.Kind == kind && ref.Name == m.Name
+}
+
+// supersededAt returns the time a version was superseded, if it was
+func supersededAt(secret *corev1.Secret) (time.Time, bool) {
+	value, ok := secret.Annotations[supersededAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		// unparseable timestamps are treated as superseded long ago
+		return time.Time{}, true
+	}
+	return at, true
+}
+
+// secretVersions returns the versions of the candidate's secret in a namespace, the current version first followed by
+// the superseded versions from newest to oldest
+func secretVersions(ctx context.Context, c client.Client, namespace string, cand candidate) ([]corev1.Secret, error) {
+	var secrets corev1.SecretList
+	if err := c.List(ctx, &secrets, client.InNamespace(namespace), client.MatchingLabels{versionLabel: cand.Secret.Name}); err != nil {
+		return nil, err
+	}
+	versions := []corev1.Secret{}
+	for _, s := range secrets.Items {
+		if isControlledByManager(&s, cand.Manager) {
+			versions = append(versions, s)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, aSuperseded := supersededAt(&versions[i])
+		b, bSuperseded := supersededAt(&versions[j])
+		if aSuperseded != bSuperseded {
+			return !aSuperseded
+		}
+		return a.After(b)
+	})
+	return versions, nil
+}
+
+// createSecretVersion writes the credentials of a spec to a new secret version, unless a version with the same
+// content exists already. All other versions are marked as superseded and deleted once the overlap has passed. The
+// returned duration is the time until the next superseded version expires.
+func createSecretVersion(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner client.Object, namespace string, cand candidate, pullSecret *cheironv1alpha1.ImagePullSecretSpec, labels, annotations map[string]string) (time.Duration, error) {
+	registries, authType, err := registryEntries(ctx, c, pullSecret)
+	if err != nil {
+		return 0, err
+	}
+	content, err := handleDockerCfgJSONContent(pullSecret.Username, pullSecret.Password, pullSecret.Email, registries, authType)
+	if err != nil {
+		return 0, err
+	}
+	hash := contentHash(content)
+
+	versions, err := secretVersions(ctx, c, namespace, cand)
+	if err != nil {
+		return 0, err
+	}
+
+	// the new version is created before superseding the previous one, s.t. targets always have a valid secret
+	name := ""
+	for i := range versions {
+		v := &versions[i]
+		if name != "" || versionContentHash(v) != hash {
+			continue
+		}
+		name = v.Name
+		if _, superseded := v.Annotations[supersededAnnotation]; superseded {
+			// the credentials were reverted to an earlier version, which is current again
+			delete(v.Annotations, supersededAnnotation)
+			if err := c.Update(ctx, v); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if name == "" {
+		name = versionedSecretName(cand.Secret.Name, hash)
+		secret := newDockerSecretObj(name, namespace)
+		secret.Data[corev1.DockerConfigJsonKey] = content
+		secret.Labels = map[string]string{versionLabel: cand.Secret.Name}
+		for k, v := range labels {
+			secret.Labels[k] = v
+		}
+		secret.Annotations = map[string]string{contentHashAnnotation: hash}
+		for k, v := range annotations {
+			secret.Annotations[k] = v
+		}
+		if cand.Rotation.Immutable {
+			immutable := true
+			secret.Immutable = &immutable
+		}
+		if err := ctrl.SetControllerReference(owner, secret, scheme); err != nil {
+			return 0, err
+		}
+		if err := c.Create(ctx, secret); errors.IsAlreadyExists(err) {
+			// the version was created since the cache was filled, as its name is derived from the content
+			existing := &corev1.Secret{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(secret), existing); err != nil {
+				return 0, err
+			}
+			if !metav1.IsControlledBy(existing, owner) || versionContentHash(existing) != hash {
+				return 0, &adoptionError{Namespace: namespace, Name: name, Reason: "secret is not a version written by the manager"}
+			}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	var requeueAfter time.Duration
+	now := time.Now()
+	for i := range versions {
+		v := &versions[i]
+		if v.Name == name {
+			continue
+		}
+		at, superseded := supersededAt(v)
+		if !superseded {
+			if v.Annotations == nil {
+				v.Annotations = map[string]string{}
+			}
+			v.Annotations[supersededAnnotation] = now.UTC().Format(time.RFC3339)
+			if err := c.Update(ctx, v); err != nil {
+				return 0, err
+			}
+			at = now
+		}
+		if remaining := cand.overlap() - now.Sub(at); remaining > 0 {
+			if requeueAfter == 0 || remaining < requeueAfter {
+				requeueAfter = remaining
+			}
+			continue
+		}
+		// the overlap has passed, targets are re-annotated without the version in the same reconcile
+		if err := c.Delete(ctx, v); client.IgnoreNotFound(err) != nil {
+			return 0, err
+		}
+	}
+	return requeueAfter, nil
+}
+
+// resolveVersions looks up the attached versions of all versioned winners of the resolution, i.e. the current version
+// and all superseded versions within the overlap
+func (r *resolution) resolveVersions(ctx context.Context, c client.Client) error {
+	now := time.Now()
+	for i := range r.Winners {
+		w := &r.Winners[i]
+		if !w.versioned() {
+			continue
+		}
+		versions, err := secretVersions(ctx, c, r.Namespace, *w)
+		if err != nil {
+			return err
+		}
+		w.Versions = []string{}
+		for j := range versions {
+			if at, superseded := supersededAt(&versions[j]); superseded && now.Sub(at) >= w.overlap() {
+				continue
+			}
+			w.Versions = append(w.Versions, versions[j].Name)
+		}
+	}
+	return nil
+}
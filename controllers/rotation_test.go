@@ -0,0 +1,284 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// versionedCandidate returns a candidate of the manager shop/hub writing versions of the secret hub
+func versionedCandidate(password string) candidate {
+	secret := basicSecret("hub", "docker.io")
+	secret.Password = password
+	return candidate{
+		Manager:  managerRef{Name: "hub", Namespace: "shop", UID: "hub-uid"},
+		Secret:   secret,
+		Rotation: &cheironv1alpha1.RotationPolicy{Strategy: cheironv1alpha1.VersionedRotation, Immutable: true},
+	}
+}
+
+// rotationOwner returns the manager shop/hub
+func rotationOwner() *cheironv1alpha1.ImagePullSecretManager {
+	return &cheironv1alpha1.ImagePullSecretManager{ObjectMeta: metav1.ObjectMeta{Name: "hub", Namespace: "shop", UID: "hub-uid"}}
+}
+
+// staleSecretLister serves no secrets on List, like a cache missing secrets just created
+type staleSecretLister struct {
+	client.Client
+}
+
+func (s staleSecretLister) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*corev1.SecretList); ok {
+		return nil
+	}
+	return s.Client.List(ctx, list, opts...)
+}
+
+func TestVersionedSecretName(t *testing.T) {
+	hash := contentHash([]byte("credentials"))
+	name := versionedSecretName("hub", hash)
+	if name != "hub-"+hash[:versionSuffixLength] {
+		t.Errorf("versionedSecretName() = %s, want hub suffixed with the content hash", name)
+	}
+	if again := versionedSecretName("hub", hash); again != name {
+		t.Errorf("versionedSecretName() = %s for the same content, want %s", again, name)
+	}
+	if other := versionedSecretName("hub", contentHash([]byte("rotated"))); other == name {
+		t.Errorf("versionedSecretName() = %s for other content, want a different name", other)
+	}
+	if short := versionedSecretName("hub", "abc"); short != "hub-abc" {
+		t.Errorf("versionedSecretName() = %s for a short hash, want hub-abc", short)
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	existing := versionedCandidate("secret")
+	existing.Secret.ExistingSecretRef.Name = "hub-credentials"
+	inPlace := versionedCandidate("secret")
+	inPlace.Rotation.Strategy = cheironv1alpha1.InPlaceRotation
+	perServiceAccount := poolCandidate(cheironv1alpha1.RoundRobinStrategy, 2)
+	perServiceAccount.Manager.Mode = cheironv1alpha1.ServiceAccountMode
+	perServiceAccount.Secret.Pool.Scope = cheironv1alpha1.ServiceAccountPoolScope
+	perServiceAccount.Rotation = versionedCandidate("secret").Rotation
+	perNamespace := poolCandidate(cheironv1alpha1.RoundRobinStrategy, 2)
+	perNamespace.Rotation = versionedCandidate("secret").Rotation
+
+	tests := map[string]struct {
+		cand candidate
+		want bool
+	}{
+		"versioned":                {cand: versionedCandidate("secret"), want: true},
+		"no rotation policy":       {cand: candidate{Secret: basicSecret("hub", "docker.io")}},
+		"in place":                 {cand: inPlace},
+		"existing secret":          {cand: existing},
+		"pool per service account": {cand: perServiceAccount},
+		"pool per namespace":       {cand: perNamespace, want: true},
+	}
+	for name, tt := range tests {
+		if got := tt.cand.versioned(); got != tt.want {
+			t.Errorf("%s: versioned() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	cand := versionedCandidate("secret")
+	if got := cand.overlap(); got != defaultRotationOverlap {
+		t.Errorf("overlap() = %v, want default %v", got, defaultRotationOverlap)
+	}
+	cand.Rotation.Overlap = &metav1.Duration{Duration: time.Hour}
+	if got := cand.overlap(); got != time.Hour {
+		t.Errorf("overlap() = %v, want 1h", got)
+	}
+}
+
+func TestSupersededAt(t *testing.T) {
+	tests := map[string]struct {
+		annotations map[string]string
+		at          time.Time
+		superseded  bool
+	}{
+		"current":     {},
+		"superseded":  {annotations: map[string]string{supersededAnnotation: "2021-06-01T12:00:00Z"}, at: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), superseded: true},
+		"unparseable": {annotations: map[string]string{supersededAnnotation: "yesterday"}, superseded: true},
+	}
+	for name, tt := range tests {
+		at, superseded := supersededAt(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}})
+		if !at.Equal(tt.at) || superseded != tt.superseded {
+			t.Errorf("%s: supersededAt() = %v, %v, want %v, %v", name, at, superseded, tt.at, tt.superseded)
+		}
+	}
+}
+
+// version returns a version of the secret hub controlled by the manager shop/hub, superseded the given time ago
+func version(name string, superseded time.Duration) *corev1.Secret {
+	owner := rotationOwner()
+	secret := newDockerSecretObj(name, "shop")
+	secret.Labels = map[string]string{versionLabel: "hub"}
+	secret.Annotations = map[string]string{contentHashAnnotation: name}
+	secret.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(owner, cheironv1alpha1.GroupVersion.WithKind("ImagePullSecretManager"))}
+	if superseded > 0 {
+		secret.Annotations[supersededAnnotation] = time.Now().Add(-superseded).UTC().Format(time.RFC3339)
+	}
+	return secret
+}
+
+func TestSecretVersions(t *testing.T) {
+	foreign := version("hub-foreign", 0)
+	foreign.OwnerReferences = nil
+	c := fakeClient(version("hub-old", time.Hour), version("hub-current", 0), version("hub-newer", time.Minute), foreign)
+
+	versions, err := secretVersions(context.Background(), c, "shop", versionedCandidate("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, v := range versions {
+		names = append(names, v.Name)
+	}
+	if want := []string{"hub-current", "hub-newer", "hub-old"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("secretVersions() = %v, want %v", names, want)
+	}
+}
+
+func TestCreateSecretVersion(t *testing.T) {
+	// hashedVersion returns the version of the candidate's content as written by createSecretVersion
+	hashedVersion := func(password string, superseded time.Duration) *corev1.Secret {
+		c := fakeClient()
+		cand := versionedCandidate(password)
+		if _, err := createSecretVersion(context.Background(), c, c.Scheme(), rotationOwner(), "shop", cand, &cand.Secret, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		versions, err := secretVersions(context.Background(), c, "shop", cand)
+		if err != nil || len(versions) != 1 {
+			t.Fatalf("versions = %v, %v, want one", versions, err)
+		}
+		v := versions[0].DeepCopy()
+		v.ResourceVersion = ""
+		if superseded > 0 {
+			v.Annotations[supersededAnnotation] = time.Now().Add(-superseded).UTC().Format(time.RFC3339)
+		}
+		return v
+	}
+	foreign := hashedVersion("secret", 0)
+	foreign.OwnerReferences = nil
+	foreign.Labels = nil
+
+	tests := map[string]struct {
+		existing []client.Object
+		stale    bool
+		// want maps the versions left to whether they are superseded
+		want    map[string]bool
+		requeue bool
+		err     bool
+	}{
+		"first version": {
+			want: map[string]bool{hashedVersion("secret", 0).Name: false},
+		},
+		"unchanged content": {
+			existing: []client.Object{hashedVersion("secret", 0)},
+			want:     map[string]bool{hashedVersion("secret", 0).Name: false},
+		},
+		"changed content supersedes previous version": {
+			existing: []client.Object{hashedVersion("previous", 0)},
+			want:     map[string]bool{hashedVersion("secret", 0).Name: false, hashedVersion("previous", 0).Name: true},
+			requeue:  true,
+		},
+		"expired version is deleted": {
+			existing: []client.Object{hashedVersion("previous", time.Hour), hashedVersion("older", 20*time.Minute)},
+			want:     map[string]bool{hashedVersion("secret", 0).Name: false},
+		},
+		"reverted content reuses version": {
+			existing: []client.Object{hashedVersion("secret", time.Minute), hashedVersion("previous", 0)},
+			want:     map[string]bool{hashedVersion("secret", 0).Name: false, hashedVersion("previous", 0).Name: true},
+			requeue:  true,
+		},
+		"version missing in cache": {
+			existing: []client.Object{hashedVersion("secret", 0)},
+			stale:    true,
+			want:     map[string]bool{hashedVersion("secret", 0).Name: false},
+		},
+		"foreign secret with version name": {
+			existing: []client.Object{foreign},
+			err:      true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := fakeClient(tt.existing...)
+			var writer client.Client = c
+			if tt.stale {
+				writer = staleSecretLister{c}
+			}
+			cand := versionedCandidate("secret")
+			requeue, err := createSecretVersion(context.Background(), writer, c.Scheme(), rotationOwner(), "shop", cand, &cand.Secret, nil, nil)
+			if tt.err {
+				if _, refused := asAdoptionError(err); !refused {
+					t.Errorf("createSecretVersion() error = %v, want refusal", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (requeue > 0) != tt.requeue || requeue > defaultRotationOverlap {
+				t.Errorf("requeue = %v, want requeue %v within the overlap", requeue, tt.requeue)
+			}
+
+			versions, err := secretVersions(context.Background(), c, "shop", cand)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]bool{}
+			for _, v := range versions {
+				_, got[v.Name] = supersededAt(&v)
+				if !strings.HasPrefix(v.Name, "hub-") || v.Immutable == nil || !*v.Immutable {
+					t.Errorf("version %s is not an immutable version of hub", v.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("versions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveVersions(t *testing.T) {
+	c := fakeClient(version("hub-current", 0), version("hub-previous", time.Minute), version("hub-expired", time.Hour))
+	inPlace := candidate{Manager: managerRef{Name: "quay", Namespace: "shop"}, Secret: basicSecret("quay", "quay.io")}
+	r := &resolution{Namespace: "shop", Winners: []candidate{versionedCandidate("secret"), inPlace}}
+
+	if err := r.resolveVersions(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"hub-current", "hub-previous"}; !reflect.DeepEqual(r.Winners[0].attachedNames(), want) {
+		t.Errorf("attached versions = %v, want %v", r.Winners[0].attachedNames(), want)
+	}
+	if want := []string{"quay"}; !reflect.DeepEqual(r.Winners[1].attachedNames(), want) {
+		t.Errorf("attached secrets = %v, want %v", r.Winners[1].attachedNames(), want)
+	}
+}
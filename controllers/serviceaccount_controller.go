@@ -18,7 +18,6 @@ package controllers
 
 import (
 	"context"
-	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -33,9 +32,9 @@ type ImagePullSecretManagerServiceAccountReconciler struct {
 	Scheme *runtime.Scheme
 }
 
-//+kubebuilder:rbac:groups=cheiron.anny.co,resources=serviceaccounts,verbs=get;list;watch;update;patch
-//+kubebuilder:rbac:groups=cheiron.anny.co,resources=serviceaccounts/status,verbs=get;update;patch
-//+kubebuilder:rbac:groups=cheiron.anny.co,resources=serviceaccounts/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts/finalizers,verbs=update
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -61,7 +60,7 @@ func (r *ImagePullSecretManagerServiceAccountReconciler) Reconcile(ctx context.C
 	isReconcilable, isReconcilablePresent := annotations[reconcilableAnnotation]
 	reconcileWith, isReconcilableWithPresent := annotations[reconcileWithAnnotation]
 
-	if !isReconcilablePresent || isReconcilable != "true" {
+	if !isReconcilablePresent || isReconcilable != "true" || annotations[ignoreAnnotation] == "true" {
 		log.Info("Resource is marked as non-reconcilable", "serviceAccount", serviceAccount.Name)
 		return ctrl.Result{}, nil
 	}
@@ -70,31 +69,15 @@ func (r *ImagePullSecretManagerServiceAccountReconciler) Reconcile(ctx context.C
 		log.Info("No secrets attached to the resource, not adding secrets", "serviceAccount", serviceAccount.Name)
 	}
 
-	secrets := strings.Split(reconcileWith, ",")
-
-	imagePullSecrets := []corev1.LocalObjectReference{}
-
-	for _, s := range secrets {
-		imagePullSecrets = append(imagePullSecrets, corev1.LocalObjectReference{
-			Name: strings.TrimSpace(s),
-		})
-	}
-
-	serviceAccount.ImagePullSecrets = imagePullSecrets
-
-	// mark serviceAccount as reconciled s.t. later reconciles don't pick up this serviceAccount again (see filters())
-	serviceAccount.Annotations[reconciledAnnotation] = "true"
-
-	if err := r.Update(ctx, serviceAccount); err != nil {
+	// apply the secrets under cheiron's field manager, only the cheiron annotations and imagePullSecrets entries are
+	// owned by cheiron s.t. other tools managing the service account are not overwritten
+	if err := applyPullSecrets(ctx, r.Client, serviceAccount, serviceAccountPullSecrets, splitSecretNames(reconcileWith)); err != nil {
 		return ctrl.Result{}, err
 	}
 
 	log.Info("Updated ServiceAccount with imagePullSecrets", "serviceAccount", serviceAccount.Name)
 
-	// TODO(fix): clarify if this operator's actions would clash with flux operator
-
 	return ctrl.Result{}, nil
-
 }
 
 // SetupWithManager sets up the controller with the Manager.
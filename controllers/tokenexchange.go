@@ -0,0 +1,192 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+const (
+	// defaultTokenExpirationSeconds is the lifetime of projected tokens if the provider does not specify it
+	defaultTokenExpirationSeconds = int64(3600)
+	// defaultTokenExchangeUsername is the username issued tokens are used with if the provider does not specify it
+	defaultTokenExchangeUsername = "oauth2accesstoken"
+)
+
+var (
+	// tokenAudiencesAnnotation lists the audiences cheiron may request tokens of a service account for. Service accounts
+	// without it can't be used by providers, s.t. their owners opt in to tokens leaving the cluster.
+	tokenAudiencesAnnotation = "cheiron.anny.co/token-audiences"
+
+	// defaultAPIAudiences are the audiences the API server commonly accepts tokens for, which providers may never
+	// request tokens for besides the audiences configured with --api-audiences
+	defaultAPIAudiences = []string{
+		"https://kubernetes.default.svc",
+		"https://kubernetes.default.svc.cluster.local",
+		"kubernetes.default.svc",
+	}
+)
+
+// tokenExchangeProvider exchanges projected service account tokens for registry tokens following RFC 8693
+type tokenExchangeProvider struct {
+	Tokens corev1client.ServiceAccountsGetter
+	Spec   *cheironv1alpha1.TokenExchangeProvider
+	// ServiceAccountNamespace is the namespace of the service account, defaulted to the namespace of the manager
+	ServiceAccountNamespace string
+}
+
+// newTokenExchangeProvider returns the provider of a spec, namespace is the namespace of the manager
+func newTokenExchangeProvider(deps providerDeps, spec *cheironv1alpha1.TokenExchangeProvider, namespace string) (*tokenExchangeProvider, error) {
+	if deps.Tokens == nil {
+		return nil, fmt.Errorf("token exchange is not available without TokenRequest client")
+	}
+	if err := checkTokenAudience(spec.Audience, deps.APIAudiences); err != nil {
+		return nil, err
+	}
+	if err := checkTokenEndpoint(spec.Endpoint, deps.NamespacedTokenEndpoints, namespace); err != nil {
+		return nil, err
+	}
+	saNamespace, err := serviceAccountNamespace(spec.ServiceAccountNamespace, spec.ServiceAccountName, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenExchangeProvider{Tokens: deps.Tokens, Spec: spec, ServiceAccountNamespace: saNamespace}, nil
+}
+
+// checkTokenAudience rejects audiences of service account tokens that would be valid against the API server, i.e.
+// no audience at all, the default audiences of the API server and the configured apiAudiences
+func checkTokenAudience(audience string, apiAudiences []string) error {
+	if audience == "" {
+		return fmt.Errorf("an audience is required, tokens without audience are valid against the API server")
+	}
+	if containsString(defaultAPIAudiences, audience) || containsString(apiAudiences, audience) {
+		return fmt.Errorf("audience %s is an audience of the API server", audience)
+	}
+	return nil
+}
+
+// checkTokenEndpoint restricts the endpoints namespaced managers may send service account tokens to to the endpoints
+// allowlisted by the operator, namespace is the namespace of the manager
+func checkTokenEndpoint(endpoint string, allowed []string, namespace string) error {
+	if namespace == "" {
+		return nil
+	}
+	for _, a := range allowed {
+		if strings.TrimSuffix(a, "/") == strings.TrimSuffix(endpoint, "/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("endpoint %s is not allowed for namespaced managers, see --namespaced-token-endpoints", endpoint)
+}
+
+// serviceAccountNamespace returns the namespace of a service account whose tokens a provider requests, namespace is
+// the namespace of the manager. Namespaced managers are restricted to service accounts of their own namespace, as the
+// tokens leave the cluster.
+func serviceAccountNamespace(saNamespace, saName, namespace string) (string, error) {
+	switch {
+	case saNamespace == "" && namespace == "":
+		return "", fmt.Errorf("serviceAccountNamespace is required for cluster managers")
+	case saNamespace == "":
+		return namespace, nil
+	case namespace != "" && saNamespace != namespace:
+		return "", fmt.Errorf("service account %s/%s is not in the namespace of the manager", saNamespace, saName)
+	}
+	return saNamespace, nil
+}
+
+// requestServiceAccountToken requests a projected token of a service account for an audience. The service account has
+// to list the audience in its token audiences annotation.
+func requestServiceAccountToken(ctx context.Context, tokens corev1client.ServiceAccountsGetter, namespace, name, audience string, expirationSeconds *int64) (*authenticationv1.TokenRequest, error) {
+	sa, err := tokens.ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch service account %s/%s: %w", namespace, name, err)
+	}
+	if !containsString(splitSecretNames(sa.Annotations[tokenAudiencesAnnotation]), audience) {
+		return nil, fmt.Errorf("service account %s/%s does not allow tokens for audience %s in its %s annotation", namespace, name, audience, tokenAudiencesAnnotation)
+	}
+
+	seconds := defaultTokenExpirationSeconds
+	if expirationSeconds != nil {
+		seconds = *expirationSeconds
+	}
+	request := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			ExpirationSeconds: &seconds,
+			Audiences:         []string{audience},
+		},
+	}
+	token, err := tokens.ServiceAccounts(namespace).CreateToken(ctx, name, request, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token of service account %s/%s: %w", namespace, name, err)
+	}
+	return token, nil
+}
+
+// issue exchanges a fresh projected token for a registry token. The registry token expires with the lifetime given
+// by the security token service, its exp claim or the projected token, whichever is known first.
+func (p *tokenExchangeProvider) issue(ctx context.Context) (providedCredential, error) {
+	issuedAt := time.Now()
+	subject, err := requestServiceAccountToken(ctx, p.Tokens, p.ServiceAccountNamespace, p.Spec.ServiceAccountName, p.Spec.Audience, p.Spec.ExpirationSeconds)
+	if err != nil {
+		return providedCredential{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	form.Set("subject_token", subject.Status.Token)
+	form.Set("subject_token_type", "urn:ietf:params:oauth:token-type:jwt")
+	if p.Spec.Scope != "" {
+		form.Set("scope", p.Spec.Scope)
+	}
+	if p.Spec.Resource != "" {
+		form.Set("resource", p.Spec.Resource)
+	}
+	token, err := requestToken(ctx, p.Spec.Endpoint, form)
+	if err != nil {
+		return providedCredential{}, err
+	}
+	if token.AccessToken == "" {
+		return providedCredential{}, fmt.Errorf("token exchange at %s returned no access token", p.Spec.Endpoint)
+	}
+
+	expiresAt := issuedAt.Add(token.ExpiresIn)
+	if token.ExpiresIn <= 0 {
+		if expiresAt, err = jwtExpiry(token.AccessToken); err != nil {
+			expiresAt = subject.Status.ExpirationTimestamp.Time
+		}
+	}
+	username := p.Spec.Username
+	if username == "" {
+		username = defaultTokenExchangeUsername
+	}
+	return providedCredential{
+		Username:  username,
+		Password:  token.AccessToken,
+		IssuedAt:  issuedAt,
+		ExpiresAt: expiresAt,
+	}, nil
+}
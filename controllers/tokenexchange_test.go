@@ -0,0 +1,246 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+// tokenClientset returns a clientset serving the given service accounts, which issues the token "sa-token" expiring at
+// expiresAt for the service accounts of the namespace shop
+func tokenClientset(expiresAt time.Time, serviceAccounts ...runtime.Object) *kubefake.Clientset {
+	clientset := kubefake.NewSimpleClientset(serviceAccounts...)
+	clientset.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" || action.GetNamespace() != "shop" {
+			return false, nil, nil
+		}
+		request := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenRequest)
+		return true, &authenticationv1.TokenRequest{
+			Spec: request.Spec,
+			Status: authenticationv1.TokenRequestStatus{
+				Token:               "sa-token/" + request.Spec.Audiences[0],
+				ExpirationTimestamp: metav1.NewTime(expiresAt),
+			},
+		}, nil
+	})
+	return clientset
+}
+
+// tokenServiceAccount returns a service account of the namespace shop allowing tokens for the given audiences
+func tokenServiceAccount(name, audiences string) *corev1.ServiceAccount {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop"}}
+	if audiences != "" {
+		sa.Annotations = map[string]string{tokenAudiencesAnnotation: audiences}
+	}
+	return sa
+}
+
+func TestServiceAccountNamespace(t *testing.T) {
+	tests := []struct {
+		name        string
+		saNamespace string
+		namespace   string
+		want        string
+		err         bool
+	}{
+		{name: "namespaced manager defaults to its namespace", namespace: "shop", want: "shop"},
+		{name: "namespaced manager in own namespace", saNamespace: "shop", namespace: "shop", want: "shop"},
+		{name: "namespaced manager in other namespace", saNamespace: "kube-system", namespace: "shop", err: true},
+		{name: "cluster manager", saNamespace: "kube-system", want: "kube-system"},
+		{name: "cluster manager without namespace", err: true},
+	}
+	for _, tt := range tests {
+		got, err := serviceAccountNamespace(tt.saNamespace, "puller", tt.namespace)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%s: serviceAccountNamespace() = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestCheckTokenAudience(t *testing.T) {
+	tests := map[string]bool{
+		"sts.example.com":                true,
+		"":                               false,
+		"https://kubernetes.default.svc": false,
+		"https://kubernetes.default.svc.cluster.local": false,
+		"https://oidc.example.com/cluster":             false,
+	}
+	for audience, allowed := range tests {
+		err := checkTokenAudience(audience, []string{"https://oidc.example.com/cluster"})
+		if (err == nil) != allowed {
+			t.Errorf("checkTokenAudience(%q) error = %v, want allowed %v", audience, err, allowed)
+		}
+	}
+}
+
+func TestCheckTokenEndpoint(t *testing.T) {
+	allowed := []string{"https://sts.example.com/oauth2/token/"}
+	tests := []struct {
+		endpoint  string
+		namespace string
+		allowed   bool
+	}{
+		{endpoint: "https://sts.example.com/oauth2/token", namespace: "shop", allowed: true},
+		{endpoint: "https://attacker.example.com/token", namespace: "shop"},
+		{endpoint: "https://sts.example.com/oauth2/token/other", namespace: "shop"},
+		{endpoint: "https://attacker.example.com/token", allowed: true},
+	}
+	for _, tt := range tests {
+		err := checkTokenEndpoint(tt.endpoint, allowed, tt.namespace)
+		if (err == nil) != tt.allowed {
+			t.Errorf("checkTokenEndpoint(%s, %q) error = %v, want allowed %v", tt.endpoint, tt.namespace, err, tt.allowed)
+		}
+	}
+}
+
+func TestNewTokenExchangeProvider(t *testing.T) {
+	deps := providerDeps{Tokens: tokenClientset(time.Now()).CoreV1(), NamespacedTokenEndpoints: []string{"https://sts.example.com/token"}}
+	spec := func(audience, endpoint string) *cheironv1alpha1.TokenExchangeProvider {
+		return &cheironv1alpha1.TokenExchangeProvider{ServiceAccountName: "puller", Audience: audience, Endpoint: endpoint}
+	}
+
+	tests := []struct {
+		name      string
+		deps      providerDeps
+		spec      *cheironv1alpha1.TokenExchangeProvider
+		namespace string
+		allowed   bool
+	}{
+		{name: "allowed endpoint", deps: deps, spec: spec("sts.example.com", "https://sts.example.com/token"), namespace: "shop", allowed: true},
+		{name: "endpoint not allowed", deps: deps, spec: spec("sts.example.com", "https://other.example.com/token"), namespace: "shop"},
+		{name: "no audience", deps: deps, spec: spec("", "https://sts.example.com/token"), namespace: "shop"},
+		{name: "API server audience", deps: deps, spec: spec("https://kubernetes.default.svc", "https://sts.example.com/token"), namespace: "shop"},
+		{name: "no TokenRequest client", spec: spec("sts.example.com", "https://sts.example.com/token"), namespace: "shop"},
+	}
+	for _, tt := range tests {
+		_, err := newTokenExchangeProvider(tt.deps, tt.spec, tt.namespace)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s: newTokenExchangeProvider() error = %v, want allowed %v", tt.name, err, tt.allowed)
+		}
+	}
+}
+
+func TestRequestServiceAccountToken(t *testing.T) {
+	clientset := tokenClientset(time.Now(),
+		tokenServiceAccount("puller", "vault, sts.example.com"),
+		tokenServiceAccount("builder", ""),
+	)
+	tests := []struct {
+		sa       string
+		audience string
+		allowed  bool
+	}{
+		{sa: "puller", audience: "sts.example.com", allowed: true},
+		{sa: "puller", audience: "vault", allowed: true},
+		{sa: "puller", audience: "other.example.com"},
+		{sa: "builder", audience: "sts.example.com"},
+		{sa: "missing", audience: "sts.example.com"},
+	}
+	for _, tt := range tests {
+		token, err := requestServiceAccountToken(context.Background(), clientset.CoreV1(), "shop", tt.sa, tt.audience, nil)
+		if (err == nil) != tt.allowed {
+			t.Errorf("token of %s for %s: error = %v, want allowed %v", tt.sa, tt.audience, err, tt.allowed)
+			continue
+		}
+		if tt.allowed && (token.Status.Token != "sa-token/"+tt.audience || *token.Spec.ExpirationSeconds != defaultTokenExpirationSeconds) {
+			t.Errorf("token of %s for %s = %+v", tt.sa, tt.audience, token)
+		}
+	}
+}
+
+func TestTokenExchangeProvider(t *testing.T) {
+	subjectExpiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	accessExpiresAt := time.Now().Add(30 * time.Minute).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:token-exchange" ||
+			r.Form.Get("subject_token") != "sa-token/sts.example.com" || r.Form.Get("scope") != "repository:*:pull" {
+			http.Error(w, "invalid exchange", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/expires-in":
+			writeJSON(w, map[string]interface{}{"access_token": "registry-token", "expires_in": 600})
+		case "/jwt":
+			writeJSON(w, map[string]interface{}{"access_token": unsignedJWT(accessExpiresAt)})
+		case "/opaque":
+			writeJSON(w, map[string]interface{}{"access_token": "registry-token"})
+		default:
+			writeJSON(w, map[string]interface{}{})
+		}
+	}))
+	defer server.Close()
+
+	clientset := tokenClientset(subjectExpiresAt, tokenServiceAccount("puller", "sts.example.com"))
+	tests := []struct {
+		path     string
+		username string
+		lifetime func(cred providedCredential) bool
+		fails    bool
+	}{
+		{path: "/expires-in", username: "robot", lifetime: func(cred providedCredential) bool {
+			return cred.ExpiresAt.Sub(cred.IssuedAt) == 10*time.Minute
+		}},
+		{path: "/jwt", lifetime: func(cred providedCredential) bool { return cred.ExpiresAt.Equal(accessExpiresAt) }},
+		{path: "/opaque", lifetime: func(cred providedCredential) bool { return cred.ExpiresAt.Equal(subjectExpiresAt) }},
+		{path: "/empty", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			deps := providerDeps{Tokens: clientset.CoreV1(), NamespacedTokenEndpoints: []string{server.URL + tt.path}}
+			p, err := newTokenExchangeProvider(deps, &cheironv1alpha1.TokenExchangeProvider{
+				ServiceAccountName: "puller",
+				Audience:           "sts.example.com",
+				Endpoint:           server.URL + tt.path,
+				Scope:              "repository:*:pull",
+				Username:           tt.username,
+			}, "shop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cred, err := p.issue(context.Background())
+			if tt.fails {
+				if err == nil {
+					t.Errorf("issue() = %+v, want error", cred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			username := tt.username
+			if username == "" {
+				username = defaultTokenExchangeUsername
+			}
+			if cred.Username != username || cred.Password == "" || !tt.lifetime(cred) {
+				t.Errorf("issue() = %+v", cred)
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+var (
+	// usedByPodsAnnotation records the number of pods referencing a managed secret
+	usedByPodsAnnotation = "cheiron.anny.co/used-by-pods"
+	// usedByServiceAccountsAnnotation records the number of service accounts referencing a managed secret
+	usedByServiceAccountsAnnotation = "cheiron.anny.co/used-by-service-accounts"
+	// lastUsedAnnotation records the creation time of the latest pod referencing a managed secret
+	lastUsedAnnotation = "cheiron.anny.co/last-used"
+)
+
+// UsageTracker periodically counts the pods and service accounts referencing the secrets of all managers, reports
+// the usage on the secrets and in the status of the managers, and removes secrets unused for longer than the cleanup
+// policy of their manager allows
+type UsageTracker struct {
+	client.Client
+	Interval time.Duration
+}
+
+// usageKey identifies the secrets written for a single ImagePullSecretSpec of a manager in a namespace. Versions and
+// pool members of the spec share a key.
+type usageKey struct {
+	Manager   string
+	Secret    string
+	Namespace string
+}
+
+// namespaceUsage is the usage of the secrets of a usageKey
+type namespaceUsage struct {
+	Secrets         []corev1.Secret
+	Pods            int32
+	ServiceAccounts int32
+	LastUsed        *metav1.Time
+	// CreatedAt is the creation time of the newest secret, which is the baseline of the cleanup policy if no pod
+	// used the secrets yet
+	CreatedAt metav1.Time
+}
+
+// usedSince returns the time the secrets were last used or created
+func (u *namespaceUsage) usedSince() time.Time {
+	if u.LastUsed != nil && u.LastUsed.After(u.CreatedAt.Time) {
+		return u.LastUsed.Time
+	}
+	return u.CreatedAt.Time
+}
+
+// managerKey returns the key of a manager controlling a secret in a namespace, or "" if the secret is not managed
+func managerKey(secret *corev1.Secret) string {
+	ref := metav1.GetControllerOf(secret)
+	if ref == nil {
+		return ""
+	}
+	switch ref.Kind {
+	case "ClusterImagePullSecretManager":
+		return managerRef{Cluster: true, Name: ref.Name}.String()
+	case "ImagePullSecretManager":
+		return managerRef{Name: ref.Name, Namespace: secret.Namespace}.String()
+	}
+	return ""
+}
+
+// specSecretName returns the name of the ImagePullSecretSpec a managed secret was written for, including the
+// members of pools assigned per service account
+func specSecretName(secret *corev1.Secret) string {
+	if name, ok := secret.Labels[poolLabel]; ok {
+		return name
+	}
+	return logicalSecretName(secret)
+}
+
+// isExpired reports whether a secret was removed from a namespace by the cleanup policy
+func isExpired(expired []cheironv1alpha1.ExpiredSecret, name, namespace string) bool {
+	for _, e := range expired {
+		if e.Name == name && e.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// trackAll updates the usage of all managed secrets and applies the cleanup policies of their managers
+func (t *UsageTracker) trackAll(ctx context.Context) {
+	log := ctrl.Log.WithName("usage")
+
+	var namespaces corev1.NamespaceList
+	if err := t.List(ctx, &namespaces); err != nil {
+		log.Error(err, "Failed to list Namespaces")
+		return
+	}
+	usage := map[usageKey]*namespaceUsage{}
+	// pods are kept per namespace to bring back expired secrets for pods created after their expiry
+	pods := map[string][]corev1.Pod{}
+	for _, ns := range namespaces.Items {
+		podList, err := t.trackNamespace(ctx, ns.Name, usage)
+		if err != nil {
+			log.Error(err, "Failed to track usage of secrets", "namespace", ns.Name)
+			continue
+		}
+		pods[ns.Name] = podList
+	}
+
+	catalog, err := loadRegistryCatalog(ctx, t.Client)
+	if err != nil {
+		log.Error(err, "Failed to list Registries")
+		return
+	}
+
+	var managers cheironv1alpha1.ImagePullSecretManagerList
+	if err := t.List(ctx, &managers); err != nil {
+		log.Error(err, "Failed to list ImagePullSecretManagers")
+		return
+	}
+	catalog.expandManagers(managers.Items, nil)
+	for i := range managers.Items {
+		m := &managers.Items[i]
+		status := m.Status.DeepCopy()
+		var unused []corev1.Secret
+		status.Usage, status.Expired, unused = aggregateUsage(refForManager(m), m.Spec.Secrets, m.Spec.Cleanup, m.Status.Expired, usage, pods, catalog)
+		if !equality.Semantic.DeepEqual(status, &m.Status) {
+			m.Status = *status
+			if err := t.Status().Update(ctx, m); err != nil {
+				log.Error(err, "Failed to update usage", "manager", m.Name, "namespace", m.Namespace)
+				continue
+			}
+		}
+		t.expire(ctx, unused)
+	}
+
+	var clusterManagers cheironv1alpha1.ClusterImagePullSecretManagerList
+	if err := t.List(ctx, &clusterManagers); err != nil {
+		log.Error(err, "Failed to list ClusterImagePullSecretManagers")
+		return
+	}
+	catalog.expandManagers(nil, clusterManagers.Items)
+	for i := range clusterManagers.Items {
+		m := &clusterManagers.Items[i]
+		status := m.Status.DeepCopy()
+		var unused []corev1.Secret
+		status.Usage, status.Expired, unused = aggregateUsage(refForClusterManager(m), m.Spec.Secrets, m.Spec.Cleanup, m.Status.Expired, usage, pods, catalog)
+		if !equality.Semantic.DeepEqual(status, &m.Status) {
+			m.Status = *status
+			if err := t.Status().Update(ctx, m); err != nil {
+				log.Error(err, "Failed to update usage", "manager", m.Name)
+				continue
+			}
+		}
+		t.expire(ctx, unused)
+	}
+}
+
+// trackNamespace counts the pods and service accounts referencing each managed secret of a namespace, records the
+// counts on the secrets and adds them to usage. The pods of the namespace are returned.
+func (t *UsageTracker) trackNamespace(ctx context.Context, namespace string, usage map[usageKey]*namespaceUsage) ([]corev1.Pod, error) {
+	var secrets corev1.SecretList
+	if err := t.List(ctx, &secrets, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var pods corev1.PodList
+	if err := t.List(ctx, &pods, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var serviceAccounts corev1.ServiceAccountList
+	if err := t.List(ctx, &serviceAccounts, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	podCount := map[string]int32{}
+	lastUsed := map[string]metav1.Time{}
+	for _, pod := range pods.Items {
+		for _, ref := range pod.Spec.ImagePullSecrets {
+			podCount[ref.Name]++
+			if last, ok := lastUsed[ref.Name]; !ok || pod.CreationTimestamp.After(last.Time) {
+				lastUsed[ref.Name] = pod.CreationTimestamp
+			}
+		}
+	}
+	serviceAccountCount := map[string]int32{}
+	for _, sa := range serviceAccounts.Items {
+		for _, ref := range sa.ImagePullSecrets {
+			serviceAccountCount[ref.Name]++
+		}
+	}
+
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		manager := managerKey(secret)
+		if manager == "" {
+			continue
+		}
+
+		// the last use survives the deletion of the pods that used the secret
+		var used *metav1.Time
+		if value, ok := secret.Annotations[lastUsedAnnotation]; ok {
+			if at, err := time.Parse(time.RFC3339, value); err == nil {
+				used = &metav1.Time{Time: at}
+			}
+		}
+		if last, ok := lastUsed[secret.Name]; ok && (used == nil || last.After(used.Time)) {
+			used = &metav1.Time{Time: last.Time}
+		}
+		if err := t.annotateUsage(ctx, secret, podCount[secret.Name], serviceAccountCount[secret.Name], used); err != nil {
+			return nil, err
+		}
+
+		key := usageKey{Manager: manager, Secret: specSecretName(secret), Namespace: namespace}
+		u, ok := usage[key]
+		if !ok {
+			u = &namespaceUsage{}
+			usage[key] = u
+		}
+		u.Secrets = append(u.Secrets, *secret)
+		u.Pods += podCount[secret.Name]
+		u.ServiceAccounts += serviceAccountCount[secret.Name]
+		if used != nil && (u.LastUsed == nil || used.After(u.LastUsed.Time)) {
+			u.LastUsed = used
+		}
+		if secret.CreationTimestamp.After(u.CreatedAt.Time) {
+			u.CreatedAt = secret.CreationTimestamp
+		}
+	}
+	return pods.Items, nil
+}
+
+// annotateUsage records the usage on a secret, unless it is recorded already
+func (t *UsageTracker) annotateUsage(ctx context.Context, secret *corev1.Secret, pods, serviceAccounts int32, used *metav1.Time) error {
+	annotations := map[string]string{
+		usedByPodsAnnotation:            strconv.Itoa(int(pods)),
+		usedByServiceAccountsAnnotation: strconv.Itoa(int(serviceAccounts)),
+	}
+	if used != nil {
+		annotations[lastUsedAnnotation] = used.UTC().Format(time.RFC3339)
+	}
+	changed := false
+	for k, v := range annotations {
+		if secret.Annotations[k] != v {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	patch := client.MergeFrom(secret.DeepCopy())
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		secret.Annotations[k] = v
+	}
+	return client.IgnoreNotFound(t.Patch(ctx, secret, patch))
+}
+
+// aggregateUsage aggregates the usage of the secrets of a manager over all namespaces and applies its cleanup policy.
+// Secrets unused for longer than the policy allows are recorded as expired, s.t. they are no longer attached to the
+// namespace, and returned for deletion. Expired secrets are brought back once a pod pulling images of their registry
+// is created in the namespace, or if the manager has no cleanup policy anymore.
+func aggregateUsage(m managerRef, secrets []cheironv1alpha1.ImagePullSecretSpec, cleanup *cheironv1alpha1.CleanupPolicy, expired []cheironv1alpha1.ExpiredSecret, usage map[usageKey]*namespaceUsage, pods map[string][]corev1.Pod, catalog registryCatalog) ([]cheironv1alpha1.SecretUsage, []cheironv1alpha1.ExpiredSecret, []corev1.Secret) {
+	log := ctrl.Log.WithName("usage")
+	now := time.Now()
+
+	specs := map[string]*cheironv1alpha1.ImagePullSecretSpec{}
+	for i := range secrets {
+		specs[secrets[i].Name] = &secrets[i]
+	}
+	keep := []cheironv1alpha1.ExpiredSecret{}
+	if cleanup != nil {
+		for _, e := range expired {
+			spec, ok := specs[e.Name]
+			if !ok {
+				continue
+			}
+			if _, ok := pods[e.Namespace]; !ok {
+				// the namespace is gone
+				continue
+			}
+			if requestedSince(pods[e.Namespace], e.ExpiredAt.Time, normalizeRegistry(spec.Registry), catalog) {
+				log.Info("Bringing back expired secret", "manager", m.String(), "secret", e.Name, "namespace", e.Namespace)
+				continue
+			}
+			keep = append(keep, e)
+		}
+	}
+
+	result := []cheironv1alpha1.SecretUsage{}
+	unused := []corev1.Secret{}
+	for _, spec := range secrets {
+		if spec.ExistingSecretRef.Name != "" {
+			continue
+		}
+		total := cheironv1alpha1.SecretUsage{Name: spec.Name}
+		for key, u := range usage {
+			if key.Manager != m.String() || key.Secret != spec.Name {
+				continue
+			}
+			if cleanup != nil && u.Pods == 0 && now.Sub(u.usedSince()) > cleanup.UnusedFor.Duration {
+				unused = append(unused, u.Secrets...)
+				if !isExpired(keep, spec.Name, key.Namespace) {
+					keep = append(keep, cheironv1alpha1.ExpiredSecret{Name: spec.Name, Namespace: key.Namespace, ExpiredAt: metav1.NewTime(now)})
+				}
+				continue
+			}
+			total.Namespaces++
+			total.Pods += u.Pods
+			total.ServiceAccounts += u.ServiceAccounts
+			if u.LastUsed != nil && (total.LastUsed == nil || u.LastUsed.After(total.LastUsed.Time)) {
+				total.LastUsed = u.LastUsed
+			}
+		}
+		result = append(result, total)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	sort.Slice(keep, func(i, j int) bool {
+		if keep[i].Namespace != keep[j].Namespace {
+			return keep[i].Namespace < keep[j].Namespace
+		}
+		return keep[i].Name < keep[j].Name
+	})
+	if len(result) == 0 {
+		result = nil
+	}
+	if len(keep) == 0 {
+		keep = nil
+	}
+	return result, keep, unused
+}
+
+// expire deletes unused secrets. They are deleted only after their expiry is recorded in the status of the manager,
+// otherwise the manager would write them again right away.
+func (t *UsageTracker) expire(ctx context.Context, secrets []corev1.Secret) {
+	log := ctrl.Log.WithName("usage")
+	for i := range secrets {
+		if err := t.Delete(ctx, &secrets[i]); client.IgnoreNotFound(err) != nil {
+			log.Error(err, "Failed to delete unused secret", "secret", secrets[i].Name, "namespace", secrets[i].Namespace)
+			continue
+		}
+		log.Info("Deleted unused secret", "secret", secrets[i].Name, "namespace", secrets[i].Namespace)
+	}
+}
+
+// requestedSince reports whether a pod created after the given time pulls an image of the registry
+func requestedSince(pods []corev1.Pod, since time.Time, registry string, catalog registryCatalog) bool {
+	for _, pod := range pods {
+		if !pod.CreationTimestamp.After(since) {
+			continue
+		}
+		containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			if catalog.canonical(imageRegistry(container.Image)) == registry {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Start tracks the usage of all secrets every interval until the context is done
+func (t *UsageTracker) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, t.trackAll, t.Interval)
+	return nil
+}
+
+// NeedLeaderElection makes only the leader track usage, s.t. replicas don't expire secrets concurrently
+func (t *UsageTracker) NeedLeaderElection() bool {
+	return true
+}
+
+// SetupWithManager adds the tracker to the Manager. A non-positive interval disables tracking and cleanup.
+func (t *UsageTracker) SetupWithManager(mgr ctrl.Manager) error {
+	if t.Interval <= 0 {
+		return nil
+	}
+	return mgr.Add(t)
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+func TestAggregateUsage(t *testing.T) {
+	m := managerRef{Cluster: true, Name: "platform"}
+	secrets := []cheironv1alpha1.ImagePullSecretSpec{
+		basicSecret("quay", "quay.io"),
+		basicSecret("hub", "docker.io"),
+		{Name: "legacy", ExistingSecretRef: corev1.LocalObjectReference{Name: "legacy"}},
+	}
+	now := time.Now()
+	ago := func(d time.Duration) metav1.Time { return metav1.NewTime(now.Add(-d)) }
+	lastUsed := ago(time.Hour)
+	secretIn := func(namespace string) corev1.Secret {
+		return corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "quay", Namespace: namespace}}
+	}
+	usage := func() map[usageKey]*namespaceUsage {
+		return map[usageKey]*namespaceUsage{
+			{Manager: m.String(), Secret: "quay", Namespace: "shop"}:                            {Secrets: []corev1.Secret{secretIn("shop")}, Pods: 3, ServiceAccounts: 1, LastUsed: &lastUsed, CreatedAt: ago(72 * time.Hour)},
+			{Manager: m.String(), Secret: "quay", Namespace: "billing"}:                         {Secrets: []corev1.Secret{secretIn("billing")}, CreatedAt: ago(72 * time.Hour)},
+			{Manager: m.String(), Secret: "hub", Namespace: "shop"}:                             {ServiceAccounts: 2, CreatedAt: ago(time.Hour)},
+			{Manager: "ClusterImagePullSecretManager/other", Secret: "quay", Namespace: "shop"}: {Pods: 5},
+		}
+	}
+	pods := map[string][]corev1.Pod{
+		"shop":    {{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: ago(time.Hour)}, Spec: corev1.PodSpec{Containers: []corev1.Container{{Image: "quay.io/app"}}}}},
+		"billing": {},
+		"search":  {{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: ago(time.Minute)}, Spec: corev1.PodSpec{Containers: []corev1.Container{{Image: "nginx"}}}}},
+	}
+	cleanup := &cheironv1alpha1.CleanupPolicy{UnusedFor: metav1.Duration{Duration: 24 * time.Hour}}
+
+	tests := []struct {
+		name    string
+		cleanup *cheironv1alpha1.CleanupPolicy
+		expired []cheironv1alpha1.ExpiredSecret
+		usage   []cheironv1alpha1.SecretUsage
+		keep    []string
+		unused  []string
+	}{
+		{
+			name: "usage is summed over namespaces without cleanup policy",
+			expired: []cheironv1alpha1.ExpiredSecret{
+				{Name: "quay", Namespace: "search", ExpiredAt: ago(time.Hour)},
+			},
+			usage: []cheironv1alpha1.SecretUsage{
+				{Name: "hub", Namespaces: 1, ServiceAccounts: 2},
+				{Name: "quay", Namespaces: 2, Pods: 3, ServiceAccounts: 1, LastUsed: &lastUsed},
+			},
+		},
+		{
+			name:    "secrets unused for longer than the cleanup policy allows expire",
+			cleanup: cleanup,
+			usage: []cheironv1alpha1.SecretUsage{
+				{Name: "hub", Namespaces: 1, ServiceAccounts: 2},
+				{Name: "quay", Namespaces: 1, Pods: 3, ServiceAccounts: 1, LastUsed: &lastUsed},
+			},
+			keep:   []string{"billing/quay"},
+			unused: []string{"billing/quay"},
+		},
+		{
+			name:    "expired secrets come back for pods of their registry and are dropped with their namespace",
+			cleanup: cleanup,
+			expired: []cheironv1alpha1.ExpiredSecret{
+				{Name: "quay", Namespace: "shop", ExpiredAt: ago(2 * time.Hour)},
+				{Name: "quay", Namespace: "search", ExpiredAt: ago(time.Hour)},
+				{Name: "hub", Namespace: "search", ExpiredAt: ago(time.Hour)},
+				{Name: "quay", Namespace: "deleted", ExpiredAt: ago(time.Hour)},
+				{Name: "removed", Namespace: "search", ExpiredAt: ago(time.Hour)},
+			},
+			usage: []cheironv1alpha1.SecretUsage{
+				{Name: "hub", Namespaces: 1, ServiceAccounts: 2},
+				{Name: "quay", Namespaces: 1, Pods: 3, ServiceAccounts: 1, LastUsed: &lastUsed},
+			},
+			keep:   []string{"billing/quay", "search/quay"},
+			unused: []string{"billing/quay"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, keep, unused := aggregateUsage(m, secrets, tt.cleanup, tt.expired, usage(), pods, registryCatalog{})
+			if !reflect.DeepEqual(result, tt.usage) {
+				t.Errorf("usage = %+v, want %+v", result, tt.usage)
+			}
+			kept := []string{}
+			for _, e := range keep {
+				kept = append(kept, e.Namespace+"/"+e.Name)
+			}
+			if tt.keep == nil {
+				tt.keep = []string{}
+			}
+			if !reflect.DeepEqual(kept, tt.keep) {
+				t.Errorf("expired = %v, want %v", kept, tt.keep)
+			}
+			deleted := []string{}
+			for _, s := range unused {
+				deleted = append(deleted, s.Namespace+"/"+s.Name)
+			}
+			if tt.unused == nil {
+				tt.unused = []string{}
+			}
+			if !reflect.DeepEqual(deleted, tt.unused) {
+				t.Errorf("unused = %v, want %v", deleted, tt.unused)
+			}
+		})
+	}
+}
+
+func TestManagerKey(t *testing.T) {
+	controlled := func(kind string) *corev1.Secret {
+		secret := newDockerSecretObj("quay", "shop")
+		secret.OwnerReferences = []metav1.OwnerReference{controllerRef(kind, "team", "team-uid")}
+		return secret
+	}
+	tests := []struct {
+		secret *corev1.Secret
+		want   string
+	}{
+		{secret: controlled("ImagePullSecretManager"), want: "ImagePullSecretManager/shop/team"},
+		{secret: controlled("ClusterImagePullSecretManager"), want: "ClusterImagePullSecretManager/team"},
+		{secret: controlled("ReplicaSet")},
+		{secret: newDockerSecretObj("quay", "shop")},
+	}
+	for _, tt := range tests {
+		if got := managerKey(tt.secret); got != tt.want {
+			t.Errorf("managerKey() of secret owned by %v = %q, want %q", tt.secret.OwnerReferences, got, tt.want)
+		}
+	}
+}
+
+func TestSpecSecretName(t *testing.T) {
+	member := newDockerSecretObj("quay-1", "shop")
+	member.Labels = map[string]string{poolLabel: "quay"}
+	version := newDockerSecretObj("hub-3f2a9c41d0", "shop")
+	version.Labels = map[string]string{versionLabel: "hub"}
+	for secret, want := range map[*corev1.Secret]string{member: "quay", version: "hub", newDockerSecretObj("ghcr", "shop"): "ghcr"} {
+		if got := specSecretName(secret); got != want {
+			t.Errorf("specSecretName() of %s = %s, want %s", secret.Name, got, want)
+		}
+	}
+}
+
+func TestRequestedSince(t *testing.T) {
+	since := time.Now().Add(-time.Hour)
+	pod := func(created time.Duration, image string) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(since.Add(created))},
+			Spec:       corev1.PodSpec{InitContainers: []corev1.Container{{Image: "busybox"}}, Containers: []corev1.Container{{Image: image}}},
+		}
+	}
+	catalog := registryCatalog{registries: map[string]cheironv1alpha1.RegistrySpec{
+		"harbor": {Host: "harbor.example.com", Aliases: []string{"harbor.internal"}},
+	}}
+	tests := []struct {
+		name     string
+		pods     []corev1.Pod
+		registry string
+		want     bool
+	}{
+		{name: "new pod of registry", pods: []corev1.Pod{pod(time.Minute, "quay.io/app")}, registry: "quay.io", want: true},
+		{name: "new pod with init container of registry", pods: []corev1.Pod{pod(time.Minute, "quay.io/app")}, registry: "docker.io", want: true},
+		{name: "new pod of alias", pods: []corev1.Pod{pod(time.Minute, "harbor.internal/app")}, registry: "harbor.example.com", want: true},
+		{name: "old pod of registry", pods: []corev1.Pod{pod(-time.Minute, "quay.io/app")}, registry: "quay.io"},
+		{name: "new pod of other registry", pods: []corev1.Pod{pod(time.Minute, "ghcr.io/app")}, registry: "quay.io"},
+	}
+	for _, tt := range tests {
+		if got := requestedSince(tt.pods, since, tt.registry, catalog); got != tt.want {
+			t.Errorf("requestedSince() of %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAnnotateUsage(t *testing.T) {
+	used := metav1.NewTime(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+	secret := newDockerSecretObj("quay", "shop")
+	secret.Annotations = map[string]string{"keep": "true"}
+	c := fakeClient(secret)
+	tracker := &UsageTracker{Client: c}
+
+	current := &corev1.Secret{}
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(secret), current); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.annotateUsage(context.Background(), current, 3, 1, &used); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(secret), current); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"keep": "true", usedByPodsAnnotation: "3", usedByServiceAccountsAnnotation: "1", lastUsedAnnotation: "2021-06-01T12:00:00Z"}
+	if !reflect.DeepEqual(current.Annotations, want) {
+		t.Errorf("annotations = %v, want %v", current.Annotations, want)
+	}
+
+	// unchanged usage is not written again
+	version := current.ResourceVersion
+	if err := tracker.annotateUsage(context.Background(), current, 3, 1, &used); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(secret), current); err != nil {
+		t.Fatal(err)
+	}
+	if current.ResourceVersion != version {
+		t.Errorf("unchanged usage was written again")
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+const (
+	// defaultVaultRefreshInterval is the time after which secrets are read again if the provider does not specify it
+	defaultVaultRefreshInterval = 5 * time.Minute
+	// serviceAccountTokenFile is the token of cheiron's own service account
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// vaultProvider reads credentials from a KV v2 secret of Vault
+type vaultProvider struct {
+	Tokens corev1client.ServiceAccountsGetter
+	Spec   *cheironv1alpha1.VaultProvider
+	// ServiceAccountNamespace is the namespace of the service account logging in, if one is specified
+	ServiceAccountNamespace string
+}
+
+// newVaultProvider returns the provider of a spec, namespace is the namespace of the manager. Only cluster managers may
+// log in with the token of cheiron's own service account, as it is sent to the address of the spec. Namespaced managers
+// may only send tokens to the addresses allowed by the operator.
+func newVaultProvider(deps providerDeps, spec *cheironv1alpha1.VaultProvider, namespace string) (*vaultProvider, error) {
+	p := &vaultProvider{Tokens: deps.Tokens, Spec: spec}
+	if spec.ServiceAccountName == "" && namespace != "" {
+		return nil, fmt.Errorf("vault login requires serviceAccountName for namespaced managers")
+	}
+	if spec.ServiceAccountName == "" {
+		return p, nil
+	}
+	if deps.Tokens == nil {
+		return nil, fmt.Errorf("vault login with serviceAccountName is not available without TokenRequest client")
+	}
+	if err := checkTokenAudience(spec.Audience, deps.APIAudiences); err != nil {
+		return nil, err
+	}
+	if err := checkTokenEndpoint(spec.Address, deps.NamespacedTokenEndpoints, namespace); err != nil {
+		return nil, err
+	}
+	saNamespace, err := serviceAccountNamespace(spec.ServiceAccountNamespace, spec.ServiceAccountName, namespace)
+	if err != nil {
+		return nil, err
+	}
+	p.ServiceAccountNamespace = saNamespace
+	return p, nil
+}
+
+// do sends a request to the Vault API and decodes the response into out
+func (p *vaultProvider) do(ctx context.Context, method, path, token string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(p.Spec.Address, "/")+"/v1/"+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if p.Spec.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Spec.Namespace)
+	}
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Vault request %s %s failed with status %s: %s", method, path, resp.Status, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// login authenticates with the Kubernetes auth method and returns the Vault token
+func (p *vaultProvider) login(ctx context.Context) (string, error) {
+	var jwt string
+	if p.Spec.ServiceAccountName != "" {
+		token, err := requestServiceAccountToken(ctx, p.Tokens, p.ServiceAccountNamespace, p.Spec.ServiceAccountName, p.Spec.Audience, nil)
+		if err != nil {
+			return "", err
+		}
+		jwt = token.Status.Token
+	} else {
+		token, err := ioutil.ReadFile(serviceAccountTokenFile)
+		if err != nil {
+			return "", err
+		}
+		jwt = strings.TrimSpace(string(token))
+	}
+
+	authMount := p.Spec.AuthMount
+	if authMount == "" {
+		authMount = "kubernetes"
+	}
+	var out struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := p.do(ctx, http.MethodPost, "auth/"+strings.Trim(authMount, "/")+"/login", "", map[string]string{"role": p.Spec.Role, "jwt": jwt}, &out); err != nil {
+		return "", err
+	}
+	if out.Auth.ClientToken == "" {
+		return "", fmt.Errorf("Vault login with role %s returned no token", p.Spec.Role)
+	}
+	return out.Auth.ClientToken, nil
+}
+
+// issue reads the secret from Vault. Secrets without lease, like those of KV v2, are read again after the refresh
+// interval, leased secrets after half of their lease if that is shorter.
+func (p *vaultProvider) issue(ctx context.Context) (providedCredential, error) {
+	issuedAt := time.Now()
+	token, err := p.login(ctx)
+	if err != nil {
+		return providedCredential{}, err
+	}
+	// the token is only needed for this read
+	defer func() {
+		_ = p.do(context.Background(), http.MethodPost, "auth/token/revoke-self", token, nil, nil)
+	}()
+
+	mount := p.Spec.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	var out struct {
+		LeaseDuration int64 `json:"lease_duration"`
+		Data          struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	path := strings.Trim(mount, "/") + "/data/" + strings.Trim(p.Spec.Path, "/")
+	if err := p.do(ctx, http.MethodGet, path, token, nil, &out); err != nil {
+		return providedCredential{}, err
+	}
+
+	usernameKey, passwordKey := p.Spec.UsernameKey, p.Spec.PasswordKey
+	if usernameKey == "" {
+		usernameKey = "username"
+	}
+	if passwordKey == "" {
+		passwordKey = "password"
+	}
+	username, _ := out.Data.Data[usernameKey].(string)
+	password, _ := out.Data.Data[passwordKey].(string)
+	if username == "" || password == "" {
+		return providedCredential{}, fmt.Errorf("Vault secret %s lacks %s or %s", path, usernameKey, passwordKey)
+	}
+	email := ""
+	if p.Spec.EmailKey != "" {
+		email, _ = out.Data.Data[p.Spec.EmailKey].(string)
+	}
+
+	interval := defaultVaultRefreshInterval
+	if p.Spec.RefreshInterval != nil && p.Spec.RefreshInterval.Duration > 0 {
+		interval = p.Spec.RefreshInterval.Duration
+	}
+	// credentials are refreshed after half of their lifetime, see refreshAt()
+	expiresAt := issuedAt.Add(2 * interval)
+	if lease := time.Duration(out.LeaseDuration) * time.Second; lease > 0 && lease < 2*interval {
+		expiresAt = issuedAt.Add(lease)
+	}
+	return providedCredential{
+		Username:  username,
+		Password:  password,
+		Email:     email,
+		IssuedAt:  issuedAt,
+		ExpiresAt: expiresAt,
+	}, nil
+}
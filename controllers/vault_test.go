@@ -0,0 +1,148 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
+)
+
+func TestNewVaultProvider(t *testing.T) {
+	deps := providerDeps{
+		Tokens:                   tokenClientset(time.Now()).CoreV1(),
+		NamespacedTokenEndpoints: []string{"https://vault.example.com:8200/"},
+		APIAudiences:             []string{"https://api.example.com"},
+	}
+	tests := []struct {
+		name      string
+		spec      cheironv1alpha1.VaultProvider
+		namespace string
+		deps      *providerDeps
+		allowed   bool
+	}{
+		{name: "cheiron's own service account", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.other.com"}, allowed: true},
+		{name: "cheiron's own service account for namespaced manager", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.example.com:8200"}, namespace: "shop"},
+		{name: "service account", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.other.com", ServiceAccountName: "vault", ServiceAccountNamespace: "shop", Audience: "vault"}, allowed: true},
+		{name: "service account without TokenRequest client", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.other.com", ServiceAccountName: "vault", ServiceAccountNamespace: "shop", Audience: "vault"}, deps: &providerDeps{}},
+		{name: "service account without audience", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.other.com", ServiceAccountName: "vault", ServiceAccountNamespace: "shop"}},
+		{name: "service account with default API audience", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.other.com", ServiceAccountName: "vault", ServiceAccountNamespace: "shop", Audience: "https://kubernetes.default.svc"}},
+		{name: "service account with configured API audience", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.other.com", ServiceAccountName: "vault", ServiceAccountNamespace: "shop", Audience: "https://api.example.com"}},
+		{name: "service account without namespace", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.other.com", ServiceAccountName: "vault", Audience: "vault"}},
+		{name: "namespaced manager at allowed address", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.example.com:8200", ServiceAccountName: "vault", Audience: "vault"}, namespace: "shop", allowed: true},
+		{name: "namespaced manager at other address", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.other.com", ServiceAccountName: "vault", Audience: "vault"}, namespace: "shop"},
+		{name: "namespaced manager with service account of other namespace", spec: cheironv1alpha1.VaultProvider{Address: "https://vault.example.com:8200", ServiceAccountName: "vault", ServiceAccountNamespace: "kube-system", Audience: "vault"}, namespace: "shop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := deps
+			if tt.deps != nil {
+				d = *tt.deps
+			}
+			_, err := newVaultProvider(d, &tt.spec, tt.namespace)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("newVaultProvider() error = %v, allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestVaultProvider(t *testing.T) {
+	revoked := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Namespace") != "team" {
+			http.Error(w, "unknown namespace", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/auth/k8s/login":
+			var body map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["role"] != "cheiron" || body["jwt"] != "sa-token/vault" {
+				http.Error(w, "permission denied", http.StatusForbidden)
+				return
+			}
+			writeJSON(w, map[string]interface{}{"auth": map[string]string{"client_token": "vault-token"}})
+		case "/v1/kv/data/registries/quay":
+			if r.Header.Get("X-Vault-Token") != "vault-token" {
+				http.Error(w, "permission denied", http.StatusForbidden)
+				return
+			}
+			writeJSON(w, map[string]interface{}{"lease_duration": 60, "data": map[string]interface{}{"data": map[string]string{
+				"user": "robot", "password": "vault-password", "email": "robot@example.com",
+			}}})
+		case "/v1/auth/token/revoke-self":
+			revoked = r.Header.Get("X-Vault-Token") == "vault-token"
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	clientset := tokenClientset(time.Now().Add(time.Hour), tokenServiceAccount("vault", "vault"), tokenServiceAccount("builder", "sts.example.com"))
+	deps := providerDeps{Tokens: clientset.CoreV1(), NamespacedTokenEndpoints: []string{server.URL}}
+	tests := []struct {
+		name           string
+		serviceAccount string
+		fails          bool
+	}{
+		{name: "opted in service account", serviceAccount: "vault"},
+		{name: "service account opted in for other audience", serviceAccount: "builder", fails: true},
+		{name: "service account without opt in", serviceAccount: "default", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked = false
+			p, err := newVaultProvider(deps, &cheironv1alpha1.VaultProvider{
+				Address:            server.URL,
+				Namespace:          "team",
+				Mount:              "kv",
+				Path:               "registries/quay",
+				UsernameKey:        "user",
+				EmailKey:           "email",
+				Role:               "cheiron",
+				AuthMount:          "k8s",
+				ServiceAccountName: tt.serviceAccount,
+				Audience:           "vault",
+			}, "shop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cred, err := p.issue(context.Background())
+			if tt.fails {
+				if err == nil {
+					t.Errorf("issue() = %+v, want error", cred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cred.Username != "robot" || cred.Password != "vault-password" || cred.Email != "robot@example.com" ||
+				cred.ExpiresAt.Sub(cred.IssuedAt) != time.Minute {
+				t.Errorf("issue() = %+v", cred)
+			}
+			if !revoked {
+				t.Errorf("issue() did not revoke the Vault token")
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets;replicasets,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups=batch,resources=jobs;cronjobs,verbs=get;list;watch;patch
+
+var rolloutAnnotation = "cheiron.anny.co/rollout"
+var attachedAnnotation = "cheiron.anny.co/attached"
+var templateHashAnnotation = "cheiron.anny.co/template-hash"
+
+// rolloutDeferred is the value of the rollout annotation that defers attaching changed secrets to existing workloads
+// until their pod template changes for another reason, s.t. cheiron never triggers a rollout on its own
+const rolloutDeferred = "Deferred"
+
+// workloadKind describes a kind whose pod template receives imagePullSecrets in Workload mode
+type workloadKind struct {
+	schema.GroupVersionKind
+	// PullSecrets locates the imagePullSecrets lists of the pod templates
+	PullSecrets []pullSecretsList
+}
+
+// workloadKinds are the built-in workload kinds reconciled in Workload mode
+var workloadKinds = []workloadKind{
+	{GroupVersionKind: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, PullSecrets: []pullSecretsList{templatePullSecrets}},
+	{GroupVersionKind: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}, PullSecrets: []pullSecretsList{templatePullSecrets}},
+	{GroupVersionKind: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"}, PullSecrets: []pullSecretsList{templatePullSecrets}},
+	{GroupVersionKind: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"}, PullSecrets: []pullSecretsList{templatePullSecrets}},
+	{GroupVersionKind: schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, PullSecrets: []pullSecretsList{templatePullSecrets}},
+	{GroupVersionKind: schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"}, PullSecrets: []pullSecretsList{{
+		Path: []string{"spec", "jobTemplate", "spec", "template", "spec", "imagePullSecrets"},
+	}}},
+}
+
+// templatePullSecrets is the location of imagePullSecrets in the pod template of most workloads
+var templatePullSecrets = pullSecretsList{Path: []string{"spec", "template", "spec", "imagePullSecrets"}}
+
+// isControlledByWorkload reports whether an object is controlled by one of the given workload kinds, e.g. a
+// ReplicaSet of a Deployment. Such objects receive their secrets through the pod template of their controller.
+func isControlledByWorkload(obj client.Object, kinds []workloadKind) bool {
+	owner := metav1.GetControllerOf(obj)
+	if owner == nil {
+		return false
+	}
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return false
+	}
+	for _, kind := range kinds {
+		if kind.Group == gv.Group && kind.Kind == owner.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// podTemplateHash hashes the pod templates containing the imagePullSecrets lists of a workload without the given
+// cheiron entries, s.t. the hash only changes on changes to the pod templates made by others than cheiron. Pod specs
+// embedded as spec of a template are hashed together with the metadata of the template, as e.g. kubectl rollout
+// restart only annotates the template.
+func podTemplateHash(obj *unstructured.Unstructured, lists []pullSecretsList, cheironEntries []string) string {
+	own := map[string]bool{}
+	for _, name := range cheironEntries {
+		own[name] = true
+	}
+
+	templates := []interface{}{}
+	for _, list := range lists {
+		podSpecPath := list.Path[:len(list.Path)-1]
+		templatePath := podSpecPath
+		if len(podSpecPath) > 1 && podSpecPath[len(podSpecPath)-1] == "spec" {
+			templatePath = podSpecPath[:len(podSpecPath)-1]
+		}
+		template, _, err := unstructured.NestedMap(obj.Object, templatePath...)
+		if err != nil || template == nil {
+			templates = append(templates, nil)
+			continue
+		}
+		podSpec := template
+		if len(templatePath) < len(podSpecPath) {
+			podSpec, _, _ = unstructured.NestedMap(template, "spec")
+		}
+		field := list.Path[len(list.Path)-1]
+		if refs, ok := podSpec[field].([]interface{}); ok {
+			foreign := []interface{}{}
+			for _, item := range refs {
+				if ref, ok := item.(map[string]interface{}); ok {
+					if name, _ := ref["name"].(string); own[name] {
+						continue
+					}
+				}
+				foreign = append(foreign, item)
+			}
+			podSpec[field] = foreign
+			if len(templatePath) < len(podSpecPath) {
+				template["spec"] = podSpec
+			}
+		}
+		templates = append(templates, template)
+	}
+
+	content, err := json.Marshal(templates)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// workloadNeedsUpdate reports whether a workload has to be (re-)applied with the given secrets
+func workloadNeedsUpdate(obj *unstructured.Unstructured, lists []pullSecretsList, secrets string) bool {
+	if targetNeedsUpdate(obj, lists, secrets) {
+		return true
+	}
+	annotations := obj.GetAnnotations()
+	if annotations[reconcilableAnnotation] != "true" || annotations[ignoreAnnotation] == "true" {
+		return false
+	}
+	attached := annotations[attachedAnnotation]
+	hash := podTemplateHash(obj, lists, splitSecretNames(attached))
+	// the pod template changed, deferred secrets are attached now
+	return annotations[templateHashAnnotation] != hash || (attached != secrets && annotations[rolloutAnnotation] != rolloutDeferred)
+}
+
+// applyWorkload server-side applies the given secrets to the pod template of a workload. Workloads that defer their
+// rollout keep the currently attached secrets until their pod template was changed by someone else.
+func applyWorkload(ctx context.Context, c client.Client, obj *unstructured.Unstructured, lists []pullSecretsList, secrets []string) error {
+	annotations := obj.GetAnnotations()
+	attached, previouslyAttached := annotations[attachedAnnotation]
+	hash := podTemplateHash(obj, lists, splitSecretNames(attached))
+
+	attach := secrets
+	if annotations[rolloutAnnotation] == rolloutDeferred && previouslyAttached && annotations[templateHashAnnotation] == hash {
+		// the pod template did not change since cheiron attached secrets the last time, changing the entries now would
+		// trigger a rollout
+		attach = splitSecretNames(attached)
+	}
+
+	return applyTarget(ctx, c, obj, lists, secrets, attach, map[string]string{
+		attachedAnnotation:     strings.Join(attach, ","),
+		templateHashAnnotation: hash,
+	})
+}
+
+// getAndUpdateWorkloads reconciles all workloads of the given kinds in the namespace s.t. their pod templates have the
+// annotations and imagePullSecrets of Cheiron applied
+func getAndUpdateWorkloads(ctx context.Context, c client.Client, namespace string, kinds []workloadKind, secrets string) error {
+	log := log.FromContext(ctx)
+	for _, kind := range kinds {
+		workloads := &unstructured.UnstructuredList{}
+		workloads.SetGroupVersionKind(kind.GroupVersion().WithKind(kind.Kind + "List"))
+		if err := c.List(ctx, workloads, client.InNamespace(namespace)); err != nil {
+			if meta.IsNoMatchError(err) {
+				// kind registered by a PodTemplateTarget is not served (yet)
+				continue
+			}
+			if errors.IsForbidden(err) {
+				// the ClusterRole of a kind registered by a PodTemplateTarget lacks its rules (yet), which is
+				// reported on the PodTemplateTarget
+				log.Info("Not permitted to list workloads", "kind", kind.Kind)
+				continue
+			}
+			log.Error(err, "Failed to fetch all workloads in namespace", "kind", kind.Kind)
+			return err
+		}
+
+		for i := range workloads.Items {
+			workload := &workloads.Items[i]
+			if isControlledByWorkload(workload, kinds) || !workloadNeedsUpdate(workload, kind.PullSecrets, secrets) {
+				continue
+			}
+			if err := applyWorkload(ctx, c, workload, kind.PullSecrets, splitSecretNames(secrets)); err != nil {
+				if errors.IsInvalid(err) {
+					// the pod template of some workloads, e.g. Jobs, is immutable
+					log.Info("Cannot attach imagePullSecrets to existing workload", "kind", kind.Kind, "workload", workload.GetName())
+					continue
+				}
+				if errors.IsForbidden(err) {
+					log.Info("Not permitted to patch workloads", "kind", kind.Kind)
+					break
+				}
+				return client.IgnoreNotFound(err)
+			}
+		}
+	}
+	return nil
+}
+
+// ImagePullSecretManagerWorkloadReconciler reconciles the pod templates of workloads marked as reconcilable
+type ImagePullSecretManagerWorkloadReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// workloadReconciler reconciles a single workload kind, either built-in or registered through a PodTemplateTarget
+type workloadReconciler struct {
+	client.Client
+	GroupVersionKind schema.GroupVersionKind
+}
+
+// Reconcile attaches the secrets of the reconcile-with annotation to the pod template of a workload, just like the pod
+// and service account controllers do for their ressources.
+func (r *workloadReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	// look up the kind on every reconcile, as PodTemplateTargets may change the paths or stop targeting the kind
+	kinds, err := allWorkloadKinds(ctx, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	kind, ok := findWorkloadKind(kinds, r.GroupVersionKind)
+	if !ok {
+		return ctrl.Result{}, nil
+	}
+
+	workload := &unstructured.Unstructured{}
+	workload.SetGroupVersionKind(kind.GroupVersionKind)
+	if err := r.Get(ctx, req.NamespacedName, workload); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	annotations := workload.GetAnnotations()
+	reconcileWith := annotations[reconcileWithAnnotation]
+	if annotations[reconcilableAnnotation] != "true" || annotations[ignoreAnnotation] == "true" {
+		log.Info("Resource is marked as non-reconcilable", "kind", kind.Kind, "workload", workload.GetName())
+		return ctrl.Result{}, nil
+	}
+	if isControlledByWorkload(workload, kinds) || !workloadNeedsUpdate(workload, kind.PullSecrets, reconcileWith) {
+		return ctrl.Result{}, nil
+	}
+
+	if err := applyWorkload(ctx, r.Client, workload, kind.PullSecrets, splitSecretNames(reconcileWith)); err != nil {
+		if errors.IsInvalid(err) {
+			log.Info("Cannot attach imagePullSecrets to existing workload", "kind", kind.Kind, "workload", workload.GetName())
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	log.Info("Updated workload with imagePullSecrets", "kind", kind.Kind, "workload", workload.GetName())
+	return ctrl.Result{}, nil
+}
+
+// findWorkloadKind returns the workload kind with the given GroupVersionKind
+func findWorkloadKind(kinds []workloadKind, gvk schema.GroupVersionKind) (workloadKind, bool) {
+	for _, kind := range kinds {
+		if kind.GroupVersionKind == gvk {
+			return kind, true
+		}
+	}
+	return workloadKind{}, false
+}
+
+// workloadFilters reconciles fresh workloads and workloads whose spec or annotations changed, as a changed pod
+// template may release secrets deferred to the next rollout
+func workloadFilters() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return true
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return e.ObjectOld.GetGeneration() != e.ObjectNew.GetGeneration() ||
+				!equalAnnotations(e.ObjectOld.GetAnnotations(), e.ObjectNew.GetAnnotations())
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return false
+		},
+	}
+}
+
+// equalAnnotations compares two sets of annotations
+func equalAnnotations(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// SetupWithManager sets up one controller per built-in workload kind with the Manager.
+func (r *ImagePullSecretManagerWorkloadReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	for _, kind := range workloadKinds {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(kind.GroupVersionKind)
+		err := ctrl.NewControllerManagedBy(mgr).
+			Named("workload-" + strings.ToLower(kind.Kind)).
+			For(obj).
+			WithEventFilter(workloadFilters()).
+			Complete(&workloadReconciler{Client: r.Client, GroupVersionKind: kind.GroupVersionKind})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// deployment returns a Deployment as unstructured object with the given annotations and template imagePullSecrets
+func deployment(t *testing.T, annotations map[string]string, secrets ...string) *unstructured.Unstructured {
+	d := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "shop", Annotations: annotations},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "shop"}},
+			Spec: corev1.PodSpec{
+				Containers:       []corev1.Container{{Name: "shop", Image: "quay.io/anny-co/shop:1.0"}},
+				ImagePullSecrets: pullSecretRefs(secrets...),
+			},
+		}},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &unstructured.Unstructured{Object: content}
+}
+
+func TestPodTemplateHash(t *testing.T) {
+	lists := []pullSecretsList{templatePullSecrets}
+	base := podTemplateHash(deployment(t, nil, "foreign", "quay"), lists, []string{"quay"})
+
+	tests := []struct {
+		name    string
+		mutate  func(*unstructured.Unstructured)
+		entries []string
+		changed bool
+	}{
+		{name: "cheiron's entries are ignored", mutate: func(u *unstructured.Unstructured) {
+			_ = unstructured.SetNestedSlice(u.Object, []interface{}{map[string]interface{}{"name": "foreign"}, map[string]interface{}{"name": "hub"}}, templatePullSecrets.Path...)
+		}, entries: []string{"hub"}},
+		{name: "workload metadata is ignored", mutate: func(u *unstructured.Unstructured) {
+			u.SetAnnotations(map[string]string{reconcileWithAnnotation: "hub"})
+		}, entries: []string{"quay"}},
+		{name: "foreign entries count", mutate: func(u *unstructured.Unstructured) {
+			_ = unstructured.SetNestedSlice(u.Object, []interface{}{map[string]interface{}{"name": "quay"}}, templatePullSecrets.Path...)
+		}, entries: []string{"quay"}, changed: true},
+		{name: "the pod spec counts", mutate: func(u *unstructured.Unstructured) {
+			_ = unstructured.SetNestedField(u.Object, int64(30), "spec", "template", "spec", "terminationGracePeriodSeconds")
+		}, entries: []string{"quay"}, changed: true},
+		{name: "the template metadata counts", mutate: func(u *unstructured.Unstructured) {
+			_ = unstructured.SetNestedField(u.Object, "2021-09-01T00:00:00Z", "spec", "template", "metadata", "annotations", "kubectl.kubernetes.io/restartedAt")
+		}, entries: []string{"quay"}, changed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := deployment(t, nil, "foreign", "quay")
+			tt.mutate(obj)
+			if changed := podTemplateHash(obj, lists, tt.entries) != base; changed != tt.changed {
+				t.Errorf("hash changed = %v, want %v", changed, tt.changed)
+			}
+		})
+	}
+}
+
+func TestWorkloadNeedsUpdate(t *testing.T) {
+	lists := []pullSecretsList{templatePullSecrets}
+	applied := func(rollout, attached, reconcileWith string, secrets ...string) *unstructured.Unstructured {
+		obj := deployment(t, nil, secrets...)
+		annotations := map[string]string{
+			reconcilableAnnotation:  "true",
+			reconciledAnnotation:    "true",
+			reconcileWithAnnotation: reconcileWith,
+			attachedAnnotation:      attached,
+			templateHashAnnotation:  podTemplateHash(obj, lists, splitSecretNames(attached)),
+		}
+		if rollout != "" {
+			annotations[rolloutAnnotation] = rollout
+		}
+		obj.SetAnnotations(annotations)
+		return obj
+	}
+	restarted := applied(rolloutDeferred, "quay", "quay,hub", "quay")
+	_ = unstructured.SetNestedField(restarted.Object, "now", "spec", "template", "metadata", "annotations", "kubectl.kubernetes.io/restartedAt")
+
+	tests := []struct {
+		name    string
+		obj     *unstructured.Unstructured
+		secrets string
+		want    bool
+	}{
+		{name: "fresh workloads are applied", obj: deployment(t, nil), secrets: "quay", want: true},
+		{name: "applied workloads are up to date", obj: applied("", "quay", "quay", "quay"), secrets: "quay"},
+		{name: "changed secrets are applied right away", obj: applied("", "quay", "quay", "quay"), secrets: "quay,hub", want: true},
+		{name: "deferred workloads wait for a template change", obj: applied(rolloutDeferred, "quay", "quay,hub", "quay"), secrets: "quay,hub"},
+		{name: "deferred workloads are applied after a restart", obj: restarted, secrets: "quay,hub", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := workloadNeedsUpdate(tt.obj, lists, tt.secrets); got != tt.want {
+				t.Errorf("workloadNeedsUpdate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyWorkload(t *testing.T) {
+	lists := []pullSecretsList{templatePullSecrets}
+	tests := []struct {
+		name     string
+		rollout  string
+		restart  bool
+		attached string
+	}{
+		{name: "new secrets are attached right away", attached: "quay,hub"},
+		{name: "deferred workloads keep the attached secrets", rollout: rolloutDeferred, attached: "quay"},
+		{name: "deferred workloads receive new secrets with a template change", rollout: rolloutDeferred, restart: true, attached: "quay,hub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := deployment(t, nil, "quay")
+			annotations := map[string]string{
+				reconcilableAnnotation:  "true",
+				reconcileWithAnnotation: "quay",
+				attachedAnnotation:      "quay",
+				templateHashAnnotation:  podTemplateHash(obj, lists, []string{"quay"}),
+			}
+			if tt.rollout != "" {
+				annotations[rolloutAnnotation] = tt.rollout
+			}
+			obj.SetAnnotations(annotations)
+			if tt.restart {
+				_ = unstructured.SetNestedField(obj.Object, "now", "spec", "template", "metadata", "annotations", "kubectl.kubernetes.io/restartedAt")
+			}
+
+			recorder := &applyRecorder{Client: fakeClient()}
+			if err := applyWorkload(context.Background(), recorder, obj, lists, []string{"quay", "hub"}); err != nil {
+				t.Fatal(err)
+			}
+			apply := recorder.patches[0]
+			if got := apply.GetAnnotations()[attachedAnnotation]; got != tt.attached {
+				t.Errorf("attached = %q, want %q", got, tt.attached)
+			}
+			refs, _, _ := unstructured.NestedSlice(apply.Object, templatePullSecrets.Path...)
+			if len(refs) != len(strings.Split(tt.attached, ",")) {
+				t.Errorf("imagePullSecrets = %v, want %s", refs, tt.attached)
+			}
+			if got := apply.GetAnnotations()[templateHashAnnotation]; got != podTemplateHash(obj, lists, []string{"quay"}) {
+				t.Errorf("template hash = %q, want the hash of the current template", got)
+			}
+		})
+	}
+}
+
+func TestIsControlledByWorkload(t *testing.T) {
+	controller := true
+	owned := func(apiVersion, kind string) *appsv1.ReplicaSet {
+		return &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{APIVersion: apiVersion, Kind: kind, Name: "shop", Controller: &controller}}}}
+	}
+	if !isControlledByWorkload(owned("apps/v1", "Deployment"), workloadKinds) {
+		t.Errorf("ReplicaSet of a Deployment is not controlled by a workload")
+	}
+	if isControlledByWorkload(owned("argoproj.io/v1alpha1", "Rollout"), workloadKinds) {
+		t.Errorf("ReplicaSet of an unknown kind is controlled by a workload")
+	}
+	if isControlledByWorkload(&appsv1.ReplicaSet{}, workloadKinds) {
+		t.Errorf("ReplicaSet without owner is controlled by a workload")
+	}
+}
@@ -19,6 +19,8 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -26,10 +28,12 @@ import (
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	cheironv1alpha1 "github.com/anny-co/cheiron/api/v1alpha1"
 	"github.com/anny-co/cheiron/controllers"
@@ -52,11 +56,48 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var dockerHubAuthURL string
+	var dockerHubRegistryURL string
+	var rateLimitInterval time.Duration
+	var credentialPluginDir string
+	var credentialPluginEnv string
+	var namespacedCredentialPlugins string
+	var namespacedCredentialPluginEnv string
+	var namespacedTokenEndpoints string
+	var apiAudiences string
+	var reportInterval time.Duration
+	var usageInterval time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&dockerHubAuthURL, "dockerhub-auth-url", controllers.DefaultDockerHubAuthURL,
+		"The Docker Hub token endpoint used to probe rate limits.")
+	flag.StringVar(&dockerHubRegistryURL, "dockerhub-registry-url", controllers.DefaultDockerHubRegistryURL,
+		"The Docker Hub registry endpoint used to probe rate limits.")
+	flag.DurationVar(&rateLimitInterval, "ratelimit-probe-interval", 15*time.Minute,
+		"The interval the Docker Hub rate limit of each credential is probed in. Set to 0 to disable probing.")
+	flag.StringVar(&credentialPluginDir, "credential-plugin-dir", "",
+		"The directory of the binaries exec providers may run. Exec providers are disabled if empty.")
+	flag.StringVar(&credentialPluginEnv, "credential-plugin-env", "PATH,HOME",
+		"Comma-separated names of the environment variables passed to exec plugins.")
+	flag.StringVar(&namespacedCredentialPlugins, "namespaced-credential-plugins", "",
+		"Comma-separated names of the exec plugins ImagePullSecretManagers may run. "+
+			"ClusterImagePullSecretManagers may run all plugins.")
+	flag.StringVar(&namespacedCredentialPluginEnv, "namespaced-credential-plugin-env", "",
+		"Comma-separated names of the environment variables ImagePullSecretManagers may pass to exec plugins. "+
+			"ClusterImagePullSecretManagers may pass all variables.")
+	flag.StringVar(&namespacedTokenEndpoints, "namespaced-token-endpoints", "",
+		"Comma-separated token exchange endpoints and Vault addresses ImagePullSecretManagers may send service "+
+			"account tokens to. ClusterImagePullSecretManagers may use all endpoints.")
+	flag.StringVar(&apiAudiences, "api-audiences", "",
+		"Comma-separated audiences of the API server besides the Kubernetes defaults, which credential providers "+
+			"never request service account tokens for.")
+	flag.DurationVar(&reportInterval, "report-interval", 10*time.Minute,
+		"The interval PullSecretReports are refreshed in besides on changes. Set to 0 to only refresh on changes.")
+	flag.DurationVar(&usageInterval, "usage-interval", 5*time.Minute,
+		"The interval the usage of managed secrets is tracked and cleanup policies are applied in. Set to 0 to disable.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -79,16 +120,36 @@ func main() {
 		os.Exit(1)
 	}
 
+	// the controller-runtime client does not support the token subresource of service accounts
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create clientset")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.ImagePullSecretManagerReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                        mgr.GetClient(),
+		Scheme:                        mgr.GetScheme(),
+		Recorder:                      mgr.GetEventRecorderFor("cheiron"),
+		ServiceAccounts:               clientset.CoreV1(),
+		CredentialPluginDir:           credentialPluginDir,
+		CredentialPluginEnv:           splitList(credentialPluginEnv),
+		NamespacedCredentialPlugins:   splitList(namespacedCredentialPlugins),
+		NamespacedCredentialPluginEnv: splitList(namespacedCredentialPluginEnv),
+		NamespacedTokenEndpoints:      splitList(namespacedTokenEndpoints),
+		APIAudiences:                  splitList(apiAudiences),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ImagePullSecretManager")
 		os.Exit(1)
 	}
 	if err = (&controllers.ClusterImagePullSecretManagerReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:              mgr.GetClient(),
+		Scheme:              mgr.GetScheme(),
+		Recorder:            mgr.GetEventRecorderFor("cheiron"),
+		ServiceAccounts:     clientset.CoreV1(),
+		CredentialPluginDir: credentialPluginDir,
+		CredentialPluginEnv: splitList(credentialPluginEnv),
+		APIAudiences:        splitList(apiAudiences),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ClusterImagePullSecretManager")
 		os.Exit(1)
@@ -107,6 +168,63 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "ImagePullSecretManagerServiceAccountReconciler")
 		os.Exit(1)
 	}
+	if err = (&controllers.ImagePullSecretManagerWorkloadReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ImagePullSecretManagerWorkloadReconciler")
+		os.Exit(1)
+	}
+	if err = (&controllers.PodTemplateTargetReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PodTemplateTarget")
+		os.Exit(1)
+	}
+	if err = (&controllers.AuthFileReconciler{
+		Client: mgr.GetClient(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "AuthFile")
+		os.Exit(1)
+	}
+	if err = (&controllers.PullFailureReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("cheiron"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PullFailure")
+		os.Exit(1)
+	}
+	if err = (&controllers.PullSecretReportReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Interval: reportInterval,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PullSecretReport")
+		os.Exit(1)
+	}
+	if err = (&controllers.RateLimitProber{
+		Client:      mgr.GetClient(),
+		AuthURL:     dockerHubAuthURL,
+		RegistryURL: dockerHubRegistryURL,
+		Interval:    rateLimitInterval,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to set up rate limit prober")
+		os.Exit(1)
+	}
+	if err = (&controllers.UsageTracker{
+		Client:   mgr.GetClient(),
+		Interval: usageInterval,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to set up usage tracker")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		mgr.GetWebhookServer().Register("/mutate-v1-pod-auth-file", &webhook.Admission{Handler: &controllers.AuthFileInjector{}})
+		mgr.GetWebhookServer().Register("/mutate-v1-pod-mirror", &webhook.Admission{Handler: &controllers.RegistryMirrorInjector{Client: mgr.GetClient()}})
+		mgr.GetWebhookServer().Register("/validate-v1-pod-policy", &webhook.Admission{Handler: &controllers.ImagePullSecretPolicyValidator{Client: mgr.GetClient()}})
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -124,3 +242,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma-separated flag value, ignoring empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}